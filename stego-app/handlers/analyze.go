@@ -0,0 +1,104 @@
+package handlers
+
+import (
+	"encoding/base64"
+	"errors"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"path/filepath"
+	"strings"
+
+	"stego-app/utils"
+
+	"github.com/gin-gonic/gin"
+)
+
+// AnalyzeAudioResponse reports how much an embed changed an audio file
+type AnalyzeAudioResponse struct {
+	Success          bool     `json:"success"`
+	Message          string   `json:"message,omitempty"`
+	SampleRate       float64  `json:"sample_rate,omitempty"`
+	Channels         int      `json:"channels,omitempty"`
+	Samples          int      `json:"samples,omitempty"`
+	ChangedSamples   int      `json:"changed_samples"`
+	SNR              *float64 `json:"snr_db"`
+	SegmentalSNR     float64  `json:"segmental_snr_db"`
+	PeakSampleChange int      `json:"peak_sample_change"`
+	Spectrogram      string   `json:"spectrogram,omitempty"` // base64 PNG of the difference signal
+}
+
+// AnalyzeAudioHandler compares a cover and a stego audio file (WAV/AIFF) for QA before release
+func AnalyzeAudioHandler(c *gin.Context) {
+	form, err := c.MultipartForm()
+	if err != nil {
+		respondAnalyzeError(c, http.StatusBadRequest, "failed to parse multipart form")
+		return
+	}
+
+	cover, err := readAnalyzeFile(form, "cover_audio")
+	if err != nil {
+		respondAnalyzeError(c, http.StatusBadRequest, err.Error())
+		return
+	}
+	stego, err := readAnalyzeFile(form, "stego_audio")
+	if err != nil {
+		respondAnalyzeError(c, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	analysis, err := utils.AnalyzeAudioDifference(cover, stego)
+	if err != nil {
+		respondAnalyzeError(c, http.StatusUnprocessableEntity, err.Error())
+		return
+	}
+
+	c.JSON(http.StatusOK, AnalyzeAudioResponse{
+		Success:          true,
+		SampleRate:       analysis.SampleRate,
+		Channels:         analysis.Channels,
+		Samples:          analysis.Samples,
+		ChangedSamples:   analysis.ChangedSamples,
+		SNR:              analysis.SNR,
+		SegmentalSNR:     analysis.SegmentalSNR,
+		PeakSampleChange: analysis.PeakSampleChange,
+		Spectrogram:      base64.StdEncoding.EncodeToString(analysis.Spectrogram),
+	})
+}
+
+// readAnalyzeFile reads one uploaded PCM audio file
+func readAnalyzeFile(form *multipart.Form, fieldName string) ([]byte, error) {
+	files := form.File[fieldName]
+	if len(files) == 0 {
+		return nil, errors.New("no " + fieldName + " file provided")
+	}
+
+	ext := strings.ToLower(filepath.Ext(files[0].Filename))
+	if ext != ".wav" && ext != ".aif" && ext != ".aiff" && ext != ".aifc" {
+		return nil, errors.New("unsupported " + fieldName + " format. Must be: wav or aiff")
+	}
+
+	src, err := files[0].Open()
+	if err != nil {
+		return nil, errors.New("failed to open " + fieldName + " file")
+	}
+	defer src.Close()
+
+	// Same bound as the carriers that are processed in memory
+	data, err := io.ReadAll(io.LimitReader(src, utils.MaxInMemoryCarrier+1))
+	if err != nil {
+		return nil, errors.New("failed to read " + fieldName + " file")
+	}
+	if len(data) > utils.MaxInMemoryCarrier {
+		return nil, errors.New(fieldName + " file too large, at most 512MB can be analyzed")
+	}
+	return data, nil
+}
+
+// respondAnalyzeError helper function for analysis error responses
+func respondAnalyzeError(c *gin.Context, statusCode int, message string) {
+	c.JSON(statusCode, AnalyzeAudioResponse{
+		Success: false,
+		Message: message,
+	})
+}
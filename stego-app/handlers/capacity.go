@@ -0,0 +1,120 @@
+package handlers
+
+import (
+	"errors"
+	"net/http"
+
+	"stego-app/utils"
+
+	"github.com/gin-gonic/gin"
+)
+
+// CapacityResponse reports how much data a carrier can hold with the chosen strategy
+type CapacityResponse struct {
+	Success   bool   `json:"success"`
+	Message   string `json:"message,omitempty"`
+	MediaType string `json:"media_type,omitempty"`
+	Format    string `json:"format,omitempty"`
+	Mode      string `json:"mode,omitempty"`
+	Capacity  int    `json:"capacity"` // bytes available for the encrypted payload
+	Reasoning string `json:"reasoning,omitempty"`
+	PageBits  []int  `json:"page_bits,omitempty"` // bits per page for the PDF kerning mode
+	Warning   string `json:"warning,omitempty"`   // e.g. data found after the end of a file carrier
+}
+
+// CapacityHandler estimates the capacity of a carrier file for the same form fields as embed
+func CapacityHandler(c *gin.Context) {
+	form, err := c.MultipartForm()
+	if err != nil {
+		respondCapacityError(c, http.StatusBadRequest, "failed to parse multipart form")
+		return
+	}
+
+	req := &EmbedRequest{
+		MediaType: c.PostForm("media_type"),
+		Mode:      c.PostForm("mode"),
+	}
+	if req.MediaType == "" {
+		respondCapacityError(c, http.StatusBadRequest, "media_type is required (image/video/audio/pdf/office/archive/text/file/qr/dicom/subtitle)")
+		return
+	}
+	if req.Channels, err = parseChannels(c.PostForm("channels")); err != nil {
+		respondCapacityError(c, http.StatusBadRequest, err.Error())
+		return
+	}
+	req.Spread = c.PostForm("spread") == "true"
+	if req.Frames, err = parseFrames(c.PostForm("frames")); err != nil {
+		respondCapacityError(c, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	if err := parseCarrierMedia(form, req); err != nil {
+		respondCapacityError(c, http.StatusBadRequest, err.Error())
+		return
+	}
+	if req.Carrier != nil {
+		defer req.Carrier.Close()
+	}
+
+	estimate, err := estimateCapacity(req)
+	if err != nil {
+		respondCapacityError(c, http.StatusUnprocessableEntity, err.Error())
+		return
+	}
+
+	c.JSON(http.StatusOK, CapacityResponse{
+		Success:   true,
+		MediaType: req.MediaType,
+		Format:    estimate.Format,
+		Mode:      estimate.Mode,
+		Capacity:  estimate.Capacity,
+		Reasoning: estimate.Reasoning,
+		PageBits:  estimate.PageBits,
+		Warning:   estimate.Warning,
+	})
+}
+
+// estimateCapacity runs the estimate matching the carrier media type
+func estimateCapacity(req *EmbedRequest) (utils.CapacityEstimate, error) {
+	switch req.MediaType {
+	case "image":
+		bounds := req.Image.Bounds()
+		return utils.EstimateImageCapacity(bounds.Dx(), bounds.Dy()), nil
+	case "video":
+		return utils.EstimateVideoCapacityStream(req.Carrier, req.CarrierSize, utils.VideoOptions{
+			Mode:   req.Mode,
+			Frames: req.Frames,
+		})
+	case "audio":
+		return utils.EstimateAudioCapacityStream(req.Carrier, req.CarrierSize, utils.AudioOptions{
+			Mode:     req.Mode,
+			Channels: req.Channels,
+			Spread:   req.Spread,
+		})
+	case "pdf":
+		return utils.EstimatePDFCapacityStream(req.Carrier, req.CarrierSize, req.Mode)
+	case "office":
+		return utils.EstimateOOXMLCapacityStream(req.Carrier, req.CarrierSize, req.Mode)
+	case "archive":
+		return utils.EstimateZIPCapacityStream(req.Carrier, req.CarrierSize, req.Mode)
+	case "text":
+		return utils.EstimateTextCapacity(req.CoverText, req.Mode)
+	case "file":
+		return utils.EstimateFileCapacityStream(req.Carrier, req.CarrierSize)
+	case "qr":
+		return utils.EstimateQRCapacity(req.CoverText, req.Mode)
+	case "dicom":
+		return utils.EstimateDICOMCapacityStream(req.Carrier, req.CarrierSize, req.Mode)
+	case "subtitle":
+		return utils.EstimateSubtitleCapacityStream(req.Carrier, req.CarrierSize, req.Mode)
+	}
+	return utils.CapacityEstimate{}, errors.New("invalid media type")
+}
+
+// respondCapacityError helper function for capacity error responses
+func respondCapacityError(c *gin.Context, statusCode int, message string) {
+	c.JSON(statusCode, CapacityResponse{
+		Success: false,
+		Message: message,
+	})
+}
@@ -8,28 +8,40 @@ import (
 	"image"
 	_ "image/jpeg" // Nhận jpeg
 	"io"
+	"mime"
 	"mime/multipart"
 	"net/http"
+	"os"
 	"path/filepath"
+	"strconv"
 	"strings"
+	"unicode/utf8"
 
 	"stego-app/utils"
 
 	"github.com/gin-gonic/gin"
 )
 
+// maxTextCarrier is the largest text or source file accepted as a text carrier
+const maxTextCarrier = 16 * 1024 * 1024
+
 // EmbedRequest represents the request for embedding secret message into media
 type EmbedRequest struct {
 	// Carrier media files (where to embed into)
-	Image     image.Image
-	VideoData []byte
-	AudioData []byte
-	PDFData   []byte
+	Image       image.Image
+	Carrier     multipart.File // video/audio/pdf/office/archive/file carrier, read through io.ReaderAt
+	CarrierSize int64
+	CoverText   string // cover text carrier, or the visible content of a generated qr code
 
 	// Metadata
 	Passphrase  string
-	MediaType   string // "image", "video", "audio", "pdf" - carrier media type
+	MediaType   string // "image", "video", "audio", "pdf", "office", "archive", "text", "file", "qr", "dicom", "subtitle" - carrier media type
 	MessageType string // "text", "audio", "image", "video", "pdf" - secret message type
+	Mode        string // optional carrier specific strategy, e.g. "id3"/"ancillary" for mp3, "uuid"/"free" for mp4
+	Channels    []int  // optional audio channels carrying data (wav/aiff), empty means all
+	Spread      bool   // interleave bits across audio channels
+	Frames      []int  // optional video frames carrying data (y4m), empty means all
+	Compress    bool   // gzip the message before encryption
 
 	// Secret message content
 	Text         string
@@ -56,18 +68,43 @@ func EmbedHandler(c *gin.Context) {
 		respondError(c, http.StatusBadRequest, err.Error())
 		return
 	}
+	if req.Carrier != nil {
+		defer req.Carrier.Close()
+	}
+
+	// The result is spooled to a temp file so large carriers are never held in memory
+	out, err := os.CreateTemp("", "stego-embed-*")
+	if err != nil {
+		respondError(c, http.StatusInternalServerError, "failed to create temporary file")
+		return
+	}
+	defer os.Remove(out.Name())
+	defer out.Close()
 
 	// Process embedding
-	result, contentType, filename, err := processEmbed(req)
+	contentType, filename, warning, err := processEmbed(req, out)
 	if err != nil {
 		respondError(c, http.StatusInternalServerError, err.Error())
 		return
 	}
 
-	// Return result with proper headers
-	c.Header("Content-Type", contentType)
-	c.Header("Content-Disposition", "attachment; filename=\""+filename+"\"")
-	c.Data(http.StatusOK, contentType, result)
+	size, err := out.Seek(0, io.SeekCurrent)
+	if err == nil {
+		_, err = out.Seek(0, io.SeekStart)
+	}
+	if err != nil {
+		respondError(c, http.StatusInternalServerError, "failed to read embedded result")
+		return
+	}
+
+	// Stream result back with proper headers
+	headers := map[string]string{
+		"Content-Disposition": "attachment; filename=\"" + filename + "\"",
+	}
+	if warning != "" {
+		headers["X-Stego-Warning"] = warning
+	}
+	c.DataFromReader(http.StatusOK, size, contentType, out, headers)
 }
 
 // parseEmbedRequest parses all request data
@@ -82,6 +119,7 @@ func parseEmbedRequest(c *gin.Context) (*EmbedRequest, error) {
 		MediaType:   c.PostForm("media_type"),   // "image", "video", "audio" - carrier
 		MessageType: c.PostForm("message_type"), // "text", "audio", "image", "video" - secret
 		Text:        c.PostForm("text"),
+		Mode:        c.PostForm("mode"),
 	}
 
 	// Validate required fields
@@ -89,12 +127,24 @@ func parseEmbedRequest(c *gin.Context) (*EmbedRequest, error) {
 		return nil, errors.New("passphrase is required")
 	}
 	if req.MediaType == "" {
-		return nil, errors.New("media_type is required (image/video/audio/pdf)")
+		return nil, errors.New("media_type is required (image/video/audio/pdf/office/archive/text/file/qr/dicom/subtitle)")
 	}
 	if req.MessageType == "" {
 		return nil, errors.New("message_type is required (text/audio/image/video/pdf)")
 	}
 
+	// Parse optional audio sample layout
+	if req.Channels, err = parseChannels(c.PostForm("channels")); err != nil {
+		return nil, err
+	}
+	req.Spread = c.PostForm("spread") == "true"
+	req.Compress = c.PostForm("compress") == "true"
+
+	// Parse optional video frame selection
+	if req.Frames, err = parseFrames(c.PostForm("frames")); err != nil {
+		return nil, err
+	}
+
 	// Parse carrier media file (where to embed into)
 	if err := parseCarrierMedia(form, req); err != nil {
 		return nil, err
@@ -102,6 +152,9 @@ func parseEmbedRequest(c *gin.Context) (*EmbedRequest, error) {
 
 	// Parse secret message content
 	if err := parseMessageContent(form, req); err != nil {
+		if req.Carrier != nil {
+			req.Carrier.Close()
+		}
 		return nil, err
 	}
 
@@ -126,8 +179,41 @@ func parseCarrierMedia(form *multipart.Form, req *EmbedRequest) error {
 	case "pdf":
 		files = form.File["carrier_pdf"]
 		fieldName = "carrier_pdf"
+	case "office":
+		files = form.File["carrier_office"]
+		fieldName = "carrier_office"
+	case "archive":
+		files = form.File["carrier_archive"]
+		fieldName = "carrier_archive"
+	case "text":
+		// The cover text is either pasted from a chat or email or uploaded as a text or source file
+		if values := form.Value["cover_text"]; len(values) > 0 && values[0] != "" {
+			req.CoverText = values[0]
+			return nil
+		}
+		files = form.File["carrier_text"]
+		fieldName = "carrier_text"
+		if len(files) == 0 {
+			return errors.New("cover_text or carrier_text file is required for text media type")
+		}
+	case "file":
+		files = form.File["carrier_file"]
+		fieldName = "carrier_file"
+	case "qr":
+		// No carrier file, the qr code is generated with cover_text as its visible content
+		if values := form.Value["cover_text"]; len(values) > 0 && values[0] != "" {
+			req.CoverText = values[0]
+			return nil
+		}
+		return errors.New("cover_text is required for qr media type (the visible content of the code)")
+	case "dicom":
+		files = form.File["carrier_dicom"]
+		fieldName = "carrier_dicom"
+	case "subtitle":
+		files = form.File["carrier_subtitle"]
+		fieldName = "carrier_subtitle"
 	default:
-		return errors.New("invalid media_type. Must be: image, video, audio, or pdf")
+		return errors.New("invalid media_type. Must be: image, video, audio, pdf, office, archive, text, file, qr, dicom, or subtitle")
 	}
 
 	if len(files) == 0 {
@@ -146,39 +232,35 @@ func parseCarrierMedia(form *multipart.Form, req *EmbedRequest) error {
 	if err != nil {
 		return errors.New("failed to open " + fieldName + " file")
 	}
-	defer src.Close()
 
-	switch req.MediaType {
-	case "image":
+	if req.MediaType == "image" {
 		// For images, decode to image.Image
+		defer src.Close()
 		img, _, err := image.Decode(src)
 		if err != nil {
 			return errors.New("invalid image format or corrupted file")
 		}
 		req.Image = img
-	case "video":
-		// For video, read as bytes
-		data, err := io.ReadAll(src)
-		if err != nil {
-			return errors.New("failed to read video file")
-		}
-		req.VideoData = data
-	case "audio":
-		// For audio, read as bytes
-		data, err := io.ReadAll(src)
+		return nil
+	}
+
+	if req.MediaType == "text" {
+		defer src.Close()
+		content, err := io.ReadAll(io.LimitReader(src, maxTextCarrier+1))
 		if err != nil {
-			return errors.New("failed to read audio file")
+			return errors.New("failed to read " + fieldName + " file")
 		}
-		req.AudioData = data
-	case "pdf":
-		// For PDF, read as bytes
-		data, err := io.ReadAll(src)
-		if err != nil {
-			return errors.New("failed to read pdf file")
+		if len(content) > maxTextCarrier || !utf8.Valid(content) {
+			return errors.New("carrier text must be UTF-8 and at most 16MB")
 		}
-		req.PDFData = data
+		req.CoverText = string(content)
+		return nil
 	}
 
+	// Other carriers stay where multipart put them (large uploads are spooled to
+	// temp files) and are read through io.ReaderAt; the caller closes them
+	req.Carrier = src
+	req.CarrierSize = file.Size
 	return nil
 }
 
@@ -292,11 +374,25 @@ func isValidCarrierFormat(filename, mediaType string) bool {
 	case "image":
 		return ext == ".png" || ext == ".jpg" || ext == ".jpeg" || ext == ".bmp" || ext == ".tiff"
 	case "video":
-		return ext == ".mp4" || ext == ".avi" || ext == ".mkv" || ext == ".mov" || ext == ".wmv" || ext == ".flv"
+		return ext == ".mp4" || ext == ".avi" || ext == ".mkv" || ext == ".webm" || ext == ".mov" || ext == ".wmv" || ext == ".flv" || ext == ".y4m" ||
+			ext == ".ts" || ext == ".m2ts" || ext == ".mts"
 	case "audio":
-		return ext == ".wav" || ext == ".mp3" || ext == ".flac" || ext == ".aac" || ext == ".ogg"
+		return ext == ".wav" || ext == ".mp3" || ext == ".flac" || ext == ".aac" || ext == ".ogg" ||
+			ext == ".aif" || ext == ".aiff" || ext == ".aifc"
 	case "pdf":
 		return ext == ".pdf"
+	case "office":
+		return isOfficeExt(ext)
+	case "archive":
+		return isArchiveExt(ext)
+	case "text":
+		return isTextExt(ext)
+	case "file":
+		return true // any file can get the payload appended
+	case "dicom":
+		return isDICOMExt(ext)
+	case "subtitle":
+		return ext == ".srt" || ext == ".vtt"
 	}
 
 	return false
@@ -320,21 +416,29 @@ func isValidMessageFormat(filename, messageType string) bool {
 	return false
 }
 
-// processEmbed handles the complete embedding process
-func processEmbed(req *EmbedRequest) ([]byte, string, string, error) {
+// processEmbed handles the complete embedding process and writes the result to dst.
+// It returns the content type and file name of the result and a warning about the carrier, if any.
+func processEmbed(req *EmbedRequest, dst io.Writer) (string, string, string, error) {
 	// Create message data structure
 	messageData := createMessageData(req)
 
 	// Serialize to JSON
 	jsonData, err := json.Marshal(messageData)
 	if err != nil {
-		return nil, "", "", errors.New("failed to serialize message data")
+		return "", "", "", errors.New("failed to serialize message data")
+	}
+
+	// Optionally compress the message, it cannot shrink once encrypted
+	if req.Compress {
+		if jsonData, err = utils.CompressData(jsonData); err != nil {
+			return "", "", "", errors.New("failed to compress message data")
+		}
 	}
 
 	// Generate random salt for encryption
 	salt := make([]byte, 16)
 	if _, err := rand.Read(salt); err != nil {
-		return nil, "", "", errors.New("failed to generate encryption salt")
+		return "", "", "", errors.New("failed to generate encryption salt")
 	}
 
 	// Generate encryption key from passphrase and salt
@@ -343,51 +447,129 @@ func processEmbed(req *EmbedRequest) ([]byte, string, string, error) {
 	// Encrypt the message data
 	encrypted, err := utils.EncryptData(jsonData, key)
 	if err != nil {
-		return nil, "", "", errors.New("failed to encrypt message data")
+		return "", "", "", errors.New("failed to encrypt message data")
 	}
 
 	// Combine salt + encrypted data (salt is needed for decryption)
 	fullData := append(salt, encrypted...)
 
 	// Embed into carrier media based on type
-	var result []byte
-	var contentType, filename string
+	var contentType, filename, warning string
 
 	switch req.MediaType {
 	case "image":
-		result, err = utils.EmbedDataInImage(req.Image, fullData)
+		result, err := utils.EmbedDataInImage(req.Image, fullData)
 		if err != nil {
-			return nil, "", "", errors.New("failed to embed data in image: " + err.Error())
+			return "", "", "", errors.New("failed to embed data in image: " + err.Error())
+		}
+		if _, err := dst.Write(result); err != nil {
+			return "", "", "", errors.New("failed to write embedded image")
 		}
 		contentType = "image/png"
 		filename = generateFilename(req.OriginalFilename, "embedded", ".png")
 
 	case "video":
-		result, err = utils.EmbedDataInVideo(req.VideoData, fullData)
+		err = utils.EmbedDataInVideoStream(req.Carrier, req.CarrierSize, fullData, utils.VideoOptions{
+			Mode:       req.Mode,
+			Frames:     req.Frames,
+			Passphrase: req.Passphrase,
+		}, dst)
 		if err != nil {
-			return nil, "", "", errors.New("failed to embed data in video: " + err.Error())
+			return "", "", "", errors.New("failed to embed data in video: " + err.Error())
 		}
 		contentType = getVideoContentType(req.OriginalFilename)
 		filename = generateFilename(req.OriginalFilename, "embedded", "")
 
 	case "audio":
-		result, err = utils.EmbedDataInAudio(req.AudioData, fullData)
+		err = utils.EmbedDataInAudioStream(req.Carrier, req.CarrierSize, fullData, utils.AudioOptions{
+			Mode:     req.Mode,
+			Channels: req.Channels,
+			Spread:   req.Spread,
+		}, dst)
 		if err != nil {
-			return nil, "", "", errors.New("failed to embed data in audio: " + err.Error())
+			return "", "", "", errors.New("failed to embed data in audio: " + err.Error())
 		}
 		contentType = getAudioContentType(req.OriginalFilename)
 		filename = generateFilename(req.OriginalFilename, "embedded", "")
 
 	case "pdf":
-		result, err = utils.EmbedDataInPDF(req.PDFData, fullData)
+		err = utils.EmbedDataInPDFStream(req.Carrier, req.CarrierSize, fullData, req.Mode, dst)
 		if err != nil {
-			return nil, "", "", errors.New("failed to embed data in pdf: " + err.Error())
+			return "", "", "", errors.New("failed to embed data in pdf: " + err.Error())
 		}
 		contentType = "application/pdf"
 		filename = generateFilename(req.OriginalFilename, "embedded", "")
+
+	case "office":
+		err = utils.EmbedDataInOOXMLStream(req.Carrier, req.CarrierSize, fullData, req.Mode, dst)
+		if err != nil {
+			return "", "", "", errors.New("failed to embed data in office document: " + err.Error())
+		}
+		contentType = getOfficeContentType(req.OriginalFilename)
+		filename = generateFilename(req.OriginalFilename, "embedded", "")
+
+	case "archive":
+		err = utils.EmbedDataInZIPStream(req.Carrier, req.CarrierSize, fullData, req.Mode, dst)
+		if err != nil {
+			return "", "", "", errors.New("failed to embed data in archive: " + err.Error())
+		}
+		contentType = getArchiveContentType(req.OriginalFilename)
+		filename = generateFilename(req.OriginalFilename, "embedded", "")
+
+	case "text":
+		result, err := utils.EmbedDataInText(req.CoverText, fullData, req.Mode, req.Passphrase)
+		if err != nil {
+			return "", "", "", errors.New("failed to embed data in text: " + err.Error())
+		}
+		if _, err := io.WriteString(dst, result); err != nil {
+			return "", "", "", errors.New("failed to write embedded text")
+		}
+		contentType = "text/plain; charset=utf-8"
+		// Uploaded source files keep their extension, pasted text becomes a .txt file
+		if req.OriginalFilename == "" {
+			filename = generateFilename("", "embedded", ".txt")
+		} else {
+			filename = generateFilename(req.OriginalFilename, "embedded", "")
+		}
+
+	case "file":
+		info, err := utils.EmbedDataInFileStream(req.Carrier, req.CarrierSize, fullData, dst)
+		if err != nil {
+			return "", "", "", errors.New("failed to embed data in file: " + err.Error())
+		}
+		warning = info.Warning
+		contentType = getFileContentType(req.OriginalFilename)
+		filename = generateFilename(req.OriginalFilename, "embedded", "")
+
+	case "qr":
+		result, err := utils.GenerateQRCode(req.CoverText, fullData, req.Mode, req.Passphrase)
+		if err != nil {
+			return "", "", "", errors.New("failed to generate qr code: " + err.Error())
+		}
+		if _, err := dst.Write(result); err != nil {
+			return "", "", "", errors.New("failed to write qr code")
+		}
+		contentType = "image/png"
+		filename = "qr_code.png"
+
+	case "dicom":
+		err = utils.EmbedDataInDICOMStream(req.Carrier, req.CarrierSize, fullData, req.Mode, dst)
+		if err != nil {
+			return "", "", "", errors.New("failed to embed data in dicom: " + err.Error())
+		}
+		contentType = "application/dicom"
+		filename = generateFilename(req.OriginalFilename, "embedded", "")
+
+	case "subtitle":
+		err = utils.EmbedDataInSubtitleStream(req.Carrier, req.CarrierSize, fullData, req.Mode, dst)
+		if err != nil {
+			return "", "", "", errors.New("failed to embed data in subtitle: " + err.Error())
+		}
+		contentType = getSubtitleContentType(req.OriginalFilename)
+		filename = generateFilename(req.OriginalFilename, "embedded", "")
 	}
 
-	return result, contentType, filename, nil
+	return contentType, filename, warning, nil
 }
 
 // createMessageData creates the message data structure
@@ -417,6 +599,41 @@ func createMessageData(req *EmbedRequest) map[string]interface{} {
 	return messageData
 }
 
+// parseChannels parses a comma separated list of channel indices such as "0,1"
+func parseChannels(value string) ([]int, error) {
+	channels, ok := parseIndexList(value)
+	if !ok {
+		return nil, errors.New("invalid channels. Must be a comma separated list of channel indices, e.g. 0,1")
+	}
+	return channels, nil
+}
+
+// parseFrames parses a comma separated list of frame indices such as "0,5,10"
+func parseFrames(value string) ([]int, error) {
+	frames, ok := parseIndexList(value)
+	if !ok {
+		return nil, errors.New("invalid frames. Must be a comma separated list of frame indices, e.g. 0,5,10")
+	}
+	return frames, nil
+}
+
+// parseIndexList parses a comma separated list of non-negative integers; empty means none
+func parseIndexList(value string) ([]int, bool) {
+	if strings.TrimSpace(value) == "" {
+		return nil, true
+	}
+
+	var indices []int
+	for _, part := range strings.Split(value, ",") {
+		i, err := strconv.Atoi(strings.TrimSpace(part))
+		if err != nil || i < 0 {
+			return nil, false
+		}
+		indices = append(indices, i)
+	}
+	return indices, true
+}
+
 // generateFilename generates output filename
 func generateFilename(original, prefix, newExt string) string {
 	if original == "" {
@@ -443,12 +660,18 @@ func getVideoContentType(filename string) string {
 		return "video/x-msvideo"
 	case ".mkv":
 		return "video/x-matroska"
+	case ".webm":
+		return "video/webm"
 	case ".mov":
 		return "video/quicktime"
 	case ".wmv":
 		return "video/x-ms-wmv"
 	case ".flv":
 		return "video/x-flv"
+	case ".y4m":
+		return "video/x-yuv4mpeg"
+	case ".ts", ".m2ts", ".mts":
+		return "video/mp2t"
 	default:
 		return "video/mp4"
 	}
@@ -470,6 +693,8 @@ func getAudioContentType(filename string) string {
 		return "audio/ogg"
 	case ".m4a":
 		return "audio/mp4"
+	case ".aif", ".aiff", ".aifc":
+		return "audio/aiff"
 	default:
 		return "audio/wav"
 	}
@@ -489,3 +714,87 @@ func respondError(c *gin.Context, statusCode int, message string) {
 		Message: message,
 	})
 }
+
+// isOfficeExt reports whether ext is an OOXML document extension
+func isOfficeExt(ext string) bool {
+	switch ext {
+	case ".docx", ".docm", ".xlsx", ".xlsm", ".pptx", ".pptm":
+		return true
+	}
+	return false
+}
+
+// getOfficeContentType returns the content type of an OOXML document
+func getOfficeContentType(filename string) string {
+	ext := strings.ToLower(filepath.Ext(filename))
+	switch ext {
+	case ".docx":
+		return "application/vnd.openxmlformats-officedocument.wordprocessingml.document"
+	case ".docm":
+		return "application/vnd.ms-word.document.macroEnabled.12"
+	case ".xlsx":
+		return "application/vnd.openxmlformats-officedocument.spreadsheetml.sheet"
+	case ".xlsm":
+		return "application/vnd.ms-excel.sheet.macroEnabled.12"
+	case ".pptx":
+		return "application/vnd.openxmlformats-officedocument.presentationml.presentation"
+	case ".pptm":
+		return "application/vnd.ms-powerpoint.presentation.macroEnabled.12"
+	default:
+		return "application/octet-stream"
+	}
+}
+
+// isArchiveExt reports whether ext is a ZIP-based archive extension. APKs are listed so the
+// archive carrier can refuse them with a clear error
+func isArchiveExt(ext string) bool {
+	switch ext {
+	case ".zip", ".jar", ".war", ".epub", ".apk":
+		return true
+	}
+	return false
+}
+
+// getArchiveContentType returns the content type of a ZIP-based archive
+func getArchiveContentType(filename string) string {
+	ext := strings.ToLower(filepath.Ext(filename))
+	switch ext {
+	case ".jar", ".war":
+		return "application/java-archive"
+	case ".epub":
+		return "application/epub+zip"
+	default:
+		return "application/zip"
+	}
+}
+
+// isTextExt reports whether ext is a plain text or source file extension
+func isTextExt(ext string) bool {
+	switch ext {
+	case ".txt", ".md", ".csv", ".log", ".ini", ".cfg", ".conf", ".json", ".xml", ".yaml", ".yml", ".html", ".css",
+		".go", ".py", ".js", ".java", ".c", ".h", ".cpp", ".hpp", ".cs", ".rb", ".rs", ".php", ".sh", ".sql":
+		return true
+	}
+	return false
+}
+
+// getFileContentType returns the content type registered for the file extension
+func getFileContentType(filename string) string {
+	if contentType := mime.TypeByExtension(filepath.Ext(filename)); contentType != "" {
+		return contentType
+	}
+	return "application/octet-stream"
+}
+
+// isDICOMExt reports whether ext is a DICOM file extension; files from PACS exports often have none
+func isDICOMExt(ext string) bool {
+	return ext == ".dcm" || ext == ".dicom" || ext == ""
+}
+
+// getSubtitleContentType returns the content type of an SRT or WebVTT file
+func getSubtitleContentType(filename string) string {
+	if strings.ToLower(filepath.Ext(filename)) == ".vtt" {
+		return "text/vtt"
+	}
+	return "application/x-subrip"
+}
@@ -18,20 +18,24 @@ import (
 
 type ExtractRequest struct {
 	Image      image.Image
-	VideoData  []byte
-	AudioData  []byte
-	PDFData    []byte
+	Media      multipart.File // video/audio/pdf/office/archive/file media, read through io.ReaderAt
+	MediaSize  int64
+	Text       string // stego text, for the text media type
 	Passphrase string
-	MediaType  string // "image", "video", "audio", "pdf"
+	MediaType  string // "image", "video", "audio", "pdf", "office", "archive", "text", "file", "qr", "dicom", "subtitle"
+	Channels   []int  // optional audio channels used when embedding, empty means search
+	Spread     bool
+	Frames     []int // optional video frames used when embedding (y4m), empty means all
 }
 
 type ExtractResponse struct {
-	Success     bool        `json:"success"`
-	Message     string      `json:"message,omitempty"`
-	MessageType string      `json:"message_type,omitempty"`
-	Content     interface{} `json:"content,omitempty"`
-	Timestamp   int64       `json:"timestamp,omitempty"`
-	Size        int         `json:"size,omitempty"`
+	Success        bool        `json:"success"`
+	Message        string      `json:"message,omitempty"`
+	MessageType    string      `json:"message_type,omitempty"`
+	Content        interface{} `json:"content,omitempty"`
+	Timestamp      int64       `json:"timestamp,omitempty"`
+	Size           int         `json:"size,omitempty"`
+	VisibleContent string      `json:"visible_content,omitempty"` // what scanners show, for the qr media type
 }
 
 // ExtractHandler main API handler for extracting hidden messages
@@ -41,6 +45,9 @@ func ExtractHandler(c *gin.Context) {
 		respondExtractError(c, http.StatusBadRequest, err.Error())
 		return
 	}
+	if req.Media != nil {
+		defer req.Media.Close()
+	}
 
 	result, err := processExtract(req)
 	if err != nil {
@@ -68,7 +75,15 @@ func parseExtractRequest(c *gin.Context) (*ExtractRequest, error) {
 		return nil, errors.New("passphrase is required")
 	}
 	if req.MediaType == "" {
-		return nil, errors.New("media_type is required (image/video/audio/pdf)")
+		return nil, errors.New("media_type is required (image/video/audio/pdf/office/archive/text/file/qr/dicom/subtitle)")
+	}
+
+	if req.Channels, err = parseChannels(c.PostForm("channels")); err != nil {
+		return nil, err
+	}
+	req.Spread = c.PostForm("spread") == "true"
+	if req.Frames, err = parseFrames(c.PostForm("frames")); err != nil {
+		return nil, err
 	}
 
 	// Parse media file containing hidden data
@@ -96,8 +111,34 @@ func parseExtractMedia(form *multipart.Form, req *ExtractRequest) error {
 	case "pdf":
 		files = form.File["pdf"]
 		fieldName = "pdf"
+	case "office":
+		files = form.File["office"]
+		fieldName = "office"
+	case "archive":
+		files = form.File["archive"]
+		fieldName = "archive"
+	case "text":
+		// Pasted text, or a text or source file uploaded under the same field
+		if values := form.Value["text"]; len(values) > 0 && values[0] != "" {
+			req.Text = values[0]
+			return nil
+		}
+		files = form.File["text"]
+		fieldName = "text"
+	case "file":
+		files = form.File["file"]
+		fieldName = "file"
+	case "qr":
+		files = form.File["qr"]
+		fieldName = "qr"
+	case "dicom":
+		files = form.File["dicom"]
+		fieldName = "dicom"
+	case "subtitle":
+		files = form.File["subtitle"]
+		fieldName = "subtitle"
 	default:
-		return errors.New("invalid media_type. Must be: image, video, audio, or pdf")
+		return errors.New("invalid media_type. Must be: image, video, audio, pdf, office, archive, text, file, qr, dicom, or subtitle")
 	}
 
 	if len(files) == 0 {
@@ -115,35 +156,30 @@ func parseExtractMedia(form *multipart.Form, req *ExtractRequest) error {
 	if err != nil {
 		return errors.New("failed to open " + fieldName + " file")
 	}
-	defer src.Close()
 
-	switch req.MediaType {
-	case "image":
+	if req.MediaType == "image" || req.MediaType == "qr" {
+		defer src.Close()
 		img, _, err := image.Decode(src)
 		if err != nil {
 			return errors.New("invalid image format or corrupted file")
 		}
 		req.Image = img
-	case "video":
-		data, err := io.ReadAll(src)
-		if err != nil {
-			return errors.New("failed to read video file")
-		}
-		req.VideoData = data
-	case "audio":
-		data, err := io.ReadAll(src)
-		if err != nil {
-			return errors.New("failed to read audio file")
-		}
-		req.AudioData = data
-	case "pdf":
-		data, err := io.ReadAll(src)
-		if err != nil {
-			return errors.New("failed to read pdf file")
+		return nil
+	}
+
+	if req.MediaType == "text" {
+		defer src.Close()
+		content, err := io.ReadAll(io.LimitReader(src, maxTextCarrier+1))
+		if err != nil || len(content) > maxTextCarrier {
+			return errors.New("failed to read " + fieldName + " file")
 		}
-		req.PDFData = data
+		req.Text = string(content)
+		return nil
 	}
 
+	// Other media is read in place through io.ReaderAt; the caller closes it
+	req.Media = src
+	req.MediaSize = file.Size
 	return nil
 }
 
@@ -151,17 +187,38 @@ func parseExtractMedia(form *multipart.Form, req *ExtractRequest) error {
 func processExtract(req *ExtractRequest) (*ExtractResponse, error) {
 	// Extract raw data from media
 	var rawData []byte
+	var visible string
 	var err error
 
 	switch req.MediaType {
 	case "image":
 		rawData, err = utils.ExtractDataFromImage(req.Image)
 	case "video":
-		rawData, err = utils.ExtractDataFromVideo(req.VideoData)
+		rawData, err = utils.ExtractDataFromVideoStream(req.Media, req.MediaSize, utils.VideoOptions{
+			Frames:     req.Frames,
+			Passphrase: req.Passphrase,
+		})
 	case "audio":
-		rawData, err = utils.ExtractDataFromAudio(req.AudioData)
+		rawData, err = utils.ExtractDataFromAudioStream(req.Media, req.MediaSize, utils.AudioOptions{
+			Channels: req.Channels,
+			Spread:   req.Spread,
+		})
 	case "pdf":
-		rawData, err = utils.ExtractDataFromPDF(req.PDFData)
+		rawData, err = utils.ExtractDataFromPDFStream(req.Media, req.MediaSize)
+	case "office":
+		rawData, err = utils.ExtractDataFromOOXMLStream(req.Media, req.MediaSize)
+	case "archive":
+		rawData, err = utils.ExtractDataFromZIPStream(req.Media, req.MediaSize)
+	case "text":
+		rawData, err = utils.ExtractDataFromText(req.Text)
+	case "file":
+		rawData, err = utils.ExtractDataFromFileStream(req.Media, req.MediaSize)
+	case "qr":
+		visible, rawData, err = utils.ExtractDataFromQRCode(req.Image, req.Passphrase)
+	case "dicom":
+		rawData, err = utils.ExtractDataFromDICOMStream(req.Media, req.MediaSize)
+	case "subtitle":
+		rawData, err = utils.ExtractDataFromSubtitleStream(req.Media, req.MediaSize)
 	default:
 		return nil, errors.New("invalid media type")
 	}
@@ -187,6 +244,11 @@ func processExtract(req *ExtractRequest) (*ExtractResponse, error) {
 	if err != nil {
 		return nil, errors.New("invalid passphrase or corrupted encrypted data")
 	}
+	if utils.IsCompressed(decrypted) {
+		if decrypted, err = utils.DecompressData(decrypted); err != nil {
+			return nil, errors.New("corrupted compressed message data")
+		}
+	}
 
 	// Parse JSON message data
 	var messageData map[string]interface{}
@@ -208,8 +270,9 @@ func processExtract(req *ExtractRequest) (*ExtractResponse, error) {
 
 	// Create response
 	response := &ExtractResponse{
-		Success:     true,
-		MessageType: messageType,
+		Success:        true,
+		MessageType:    messageType,
+		VisibleContent: visible,
 	}
 
 	// Extract optional fields
@@ -280,14 +343,28 @@ func isValidExtractFormat(filename, mediaType string) bool {
 	ext := strings.ToLower(filepath.Ext(filename))
 
 	switch mediaType {
-	case "image":
+	case "image", "qr":
 		return ext == ".png" || ext == ".jpg" || ext == ".jpeg" || ext == ".bmp" || ext == ".tiff"
 	case "video":
-		return ext == ".mp4" || ext == ".avi" || ext == ".mkv" || ext == ".mov" || ext == ".wmv" || ext == ".flv"
+		return ext == ".mp4" || ext == ".avi" || ext == ".mkv" || ext == ".webm" || ext == ".mov" || ext == ".wmv" || ext == ".flv" || ext == ".y4m" ||
+			ext == ".ts" || ext == ".m2ts" || ext == ".mts"
 	case "audio":
-		return ext == ".wav" || ext == ".mp3" || ext == ".flac" || ext == ".aac" || ext == ".ogg"
+		return ext == ".wav" || ext == ".mp3" || ext == ".flac" || ext == ".aac" || ext == ".ogg" ||
+			ext == ".aif" || ext == ".aiff" || ext == ".aifc"
 	case "pdf":
 		return ext == ".pdf"
+	case "office":
+		return isOfficeExt(ext)
+	case "archive":
+		return isArchiveExt(ext)
+	case "text":
+		return isTextExt(ext)
+	case "file":
+		return true
+	case "dicom":
+		return isDICOMExt(ext)
+	case "subtitle":
+		return ext == ".srt" || ext == ".vtt"
 	}
 
 	return false
@@ -16,6 +16,8 @@ func main() {
 	// API routes
 	r.POST("/api/embed", handlers.EmbedHandler)
 	r.POST("/api/extract", handlers.ExtractHandler)
+	r.POST("/api/analyze/audio", handlers.AnalyzeAudioHandler)
+	r.POST("/api/capacity", handlers.CapacityHandler)
 	r.GET("/api/health", func(c *gin.Context) {
 		c.JSON(http.StatusOK, gin.H{"status": "ok"})
 	})
@@ -0,0 +1,164 @@
+package utils
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+)
+
+// aiffInfo holds the parts of an AIFF/AIFC file needed for sample embedding
+type aiffInfo struct {
+	Channels      int
+	SampleFrames  int
+	BitsPerSample int
+	SampleRate    float64
+	LittleEndian  bool // AIFC "sowt" compression
+	SoundStart    int  // offset of the first sample byte
+	SoundEnd      int
+}
+
+// IsAIFF reports whether data is an AIFF or AIFC file
+func IsAIFF(data []byte) bool {
+	return len(data) >= 12 && string(data[:4]) == "FORM" &&
+		(string(data[8:12]) == "AIFF" || string(data[8:12]) == "AIFC")
+}
+
+// EmbedDataInAIFF embeds data into the sample LSBs of an AIFF/AIFC file
+func EmbedDataInAIFF(aiffData []byte, data []byte, opts AudioOptions) ([]byte, error) {
+	if len(data) == 0 {
+		return nil, errors.New("data to embed cannot be empty")
+	}
+
+	if len(data) > MaxDataSize {
+		return nil, fmt.Errorf("data too large: %d bytes, max allowed: %d bytes", len(data), MaxDataSize)
+	}
+
+	info, err := parseAIFF(aiffData)
+	if err != nil {
+		return nil, err
+	}
+
+	result := make([]byte, len(aiffData))
+	copy(result, aiffData)
+
+	pcm, err := newPCMAudio(result[info.SoundStart:info.SoundEnd], info.Channels, info.BitsPerSample, !info.LittleEndian)
+	if err != nil {
+		return nil, err
+	}
+	if err := pcm.embed(data, opts); err != nil {
+		return nil, err
+	}
+
+	return result, nil
+}
+
+// ExtractDataFromAIFF extracts data from the sample LSBs of an AIFF/AIFC file
+func ExtractDataFromAIFF(aiffData []byte, opts AudioOptions) ([]byte, error) {
+	info, err := parseAIFF(aiffData)
+	if err != nil {
+		return nil, err
+	}
+
+	pcm, err := newPCMAudio(aiffData[info.SoundStart:info.SoundEnd], info.Channels, info.BitsPerSample, !info.LittleEndian)
+	if err != nil {
+		return nil, err
+	}
+	return pcm.extract(opts)
+}
+
+// parseAIFF walks the chunks of an AIFF/AIFC file and locates COMM and SSND
+func parseAIFF(data []byte) (*aiffInfo, error) {
+	if !IsAIFF(data) {
+		return nil, errors.New("not an aiff file")
+	}
+	isAIFC := string(data[8:12]) == "AIFC"
+
+	end := 8 + int(binary.BigEndian.Uint32(data[4:8]))
+	if end > len(data) {
+		end = len(data)
+	}
+
+	info := &aiffInfo{}
+	var haveCOMM, haveSSND bool
+
+	pos := 12
+	for pos+8 <= end {
+		id := string(data[pos : pos+4])
+		size := int(binary.BigEndian.Uint32(data[pos+4 : pos+8]))
+		body := pos + 8
+		if body+size > end {
+			return nil, fmt.Errorf("truncated aiff chunk %q", id)
+		}
+
+		switch id {
+		case "COMM":
+			if size < 18 {
+				return nil, errors.New("invalid aiff COMM chunk")
+			}
+			c := data[body : body+size]
+			info.Channels = int(binary.BigEndian.Uint16(c[0:2]))
+			info.SampleFrames = int(binary.BigEndian.Uint32(c[2:6]))
+			info.BitsPerSample = int(binary.BigEndian.Uint16(c[6:8]))
+			info.SampleRate = parseExtended80(c[8:18])
+			if isAIFC {
+				if size < 22 {
+					return nil, errors.New("invalid aifc COMM chunk")
+				}
+				switch string(c[18:22]) {
+				case "NONE", "twos":
+				case "sowt":
+					info.LittleEndian = true
+				default:
+					return nil, fmt.Errorf("unsupported aifc compression %q", string(c[18:22]))
+				}
+			}
+			haveCOMM = true
+		case "SSND":
+			if size < 8 {
+				return nil, errors.New("invalid aiff SSND chunk")
+			}
+			offset := int(binary.BigEndian.Uint32(data[body : body+4]))
+			info.SoundStart = body + 8 + offset
+			info.SoundEnd = body + size
+			if info.SoundStart > info.SoundEnd {
+				return nil, errors.New("invalid aiff SSND offset")
+			}
+			haveSSND = true
+		}
+
+		pos = body + size + size%2 // chunks are padded to an even length
+	}
+
+	if !haveCOMM || !haveSSND {
+		return nil, errors.New("aiff file is missing COMM or SSND chunk")
+	}
+
+	// Only the frames declared in COMM are sound data
+	frameSize := (info.BitsPerSample + 7) / 8 * info.Channels
+	if declared := info.SoundStart + info.SampleFrames*frameSize; declared < info.SoundEnd {
+		info.SoundEnd = declared
+	}
+
+	return info, nil
+}
+
+// parseExtended80 decodes an IEEE 754 80-bit extended precision number (big-endian)
+func parseExtended80(b []byte) float64 {
+	exponent := int(binary.BigEndian.Uint16(b[0:2]))
+	mantissa := binary.BigEndian.Uint64(b[2:10])
+
+	sign := 1.0
+	if exponent&0x8000 != 0 {
+		sign = -1
+		exponent &= 0x7FFF
+	}
+	if exponent == 0 && mantissa == 0 {
+		return 0
+	}
+	if exponent == 0x7FFF {
+		return sign * math.Inf(1)
+	}
+
+	return sign * math.Ldexp(float64(mantissa), exponent-16383-63)
+}
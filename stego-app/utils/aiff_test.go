@@ -0,0 +1,141 @@
+package utils
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math"
+	"testing"
+)
+
+// testAIFF builds a 16-bit AIFF file, or an AIFC file with the given compression type.
+// padding extra bytes follow the declared frames inside SSND.
+func testAIFF(compression string, channels, frames, padding int) []byte {
+	comm := binary.BigEndian.AppendUint16(nil, uint16(channels))
+	comm = binary.BigEndian.AppendUint32(comm, uint32(frames))
+	comm = binary.BigEndian.AppendUint16(comm, 16)
+	comm = append(comm, 0x40, 0x0E, 0xAC, 0x44, 0, 0, 0, 0, 0, 0) // 44100
+	form := "AIFF"
+	if compression != "" {
+		form = "AIFC"
+		comm = append(comm, compression+"\x00\x00"...)
+	}
+
+	ssnd := make([]byte, 8, 8+frames*channels*2+padding)
+	for f := 0; f < frames; f++ {
+		for ch := 0; ch < channels; ch++ {
+			v := uint16(int16(math.Sin(float64(f*(ch+1))/10) * 8000))
+			if compression == "sowt" {
+				ssnd = binary.LittleEndian.AppendUint16(ssnd, v)
+			} else {
+				ssnd = binary.BigEndian.AppendUint16(ssnd, v)
+			}
+		}
+	}
+	ssnd = append(ssnd, bytes.Repeat([]byte{0xEE}, padding)...)
+
+	body := append([]byte(form), aiffTestChunk("COMM", comm)...)
+	body = append(body, aiffTestChunk("NAME", []byte("odd"))...) // padded to an even length
+	body = append(body, aiffTestChunk("SSND", ssnd)...)
+	return aiffTestChunk("FORM", body)
+}
+
+// aiffTestChunk encodes a big-endian IFF chunk with its pad byte
+func aiffTestChunk(id string, body []byte) []byte {
+	chunk := binary.BigEndian.AppendUint32([]byte(id), uint32(len(body)))
+	chunk = append(chunk, body...)
+	if len(body)%2 == 1 {
+		chunk = append(chunk, 0)
+	}
+	return chunk
+}
+
+func TestAIFFRoundTrip(t *testing.T) {
+	data := bytes.Repeat([]byte("aiff"), 50)
+	for _, compression := range []string{"", "NONE", "twos", "sowt"} {
+		carrier := testAIFF(compression, 2, 3000, 0)
+		out, err := EmbedDataInAIFF(carrier, data, AudioOptions{})
+		if err != nil {
+			t.Fatalf("%q: %v", compression, err)
+		}
+		got, err := ExtractDataFromAIFF(out, AudioOptions{})
+		if err != nil || !bytes.Equal(got, data) {
+			t.Fatalf("%q: got %d bytes, %v", compression, len(got), err)
+		}
+
+		// Only the low bit of each sample changes, in the byte order of the file
+		info, _ := parseAIFF(out)
+		lsb := 1
+		if compression == "sowt" {
+			lsb = 0
+		}
+		for i := info.SoundStart; i < info.SoundEnd; i++ {
+			if d := carrier[i] ^ out[i]; d != 0 && ((i-info.SoundStart)%2 != lsb || d != 1) {
+				t.Fatalf("%q: byte %d changed by %x", compression, i, d)
+			}
+		}
+		if info.SampleRate != 44100 {
+			t.Fatalf("%q: sample rate %v", compression, info.SampleRate)
+		}
+	}
+}
+
+func TestAIFFOnlyDeclaredFrames(t *testing.T) {
+	carrier := testAIFF("", 1, 2000, 100)
+	out, err := EmbedDataInAIFF(carrier, bytes.Repeat([]byte("x"), 200), AudioOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(out[len(out)-100:], carrier[len(carrier)-100:]) {
+		t.Fatal("bytes after the declared frames changed")
+	}
+}
+
+func TestAIFFReembed(t *testing.T) {
+	carrier := testAIFF("", 2, 3000, 0)
+	first, err := EmbedDataInAIFF(carrier, bytes.Repeat([]byte("first"), 50), AudioOptions{Spread: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := EmbedDataInAIFF(first, []byte("second"), AudioOptions{Channels: []int{0}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, err := ExtractDataFromAIFF(second, AudioOptions{Channels: []int{0}}); err != nil || string(got) != "second" {
+		t.Fatalf("got %q, %v", got, err)
+	}
+}
+
+func TestAIFFMalformed(t *testing.T) {
+	carrier := testAIFF("", 1, 1000, 0)
+	compressed := testAIFF("ima4", 1, 1000, 0)
+	noSSND := bytes.Replace(carrier, []byte("SSND"), []byte("XSND"), 1)
+	badOffset := bytes.Clone(carrier)
+	ssnd := bytes.Index(badOffset, []byte("SSND"))
+	binary.BigEndian.PutUint32(badOffset[ssnd+8:], 0xFFFFFF)
+	shortCOMM := bytes.Clone(carrier)
+	binary.BigEndian.PutUint32(shortCOMM[16:], 10)
+	truncated := bytes.Clone(carrier)
+	binary.BigEndian.PutUint32(truncated[ssnd+4:], uint32(len(carrier)))
+
+	for name, bad := range map[string][]byte{
+		"compressed":     compressed,
+		"no SSND":        noSSND,
+		"bad offset":     badOffset,
+		"short COMM":     shortCOMM,
+		"truncated SSND": truncated,
+		"not aiff":       []byte("FORM\x00\x00\x00\x04WAVE"),
+	} {
+		if _, err := EmbedDataInAIFF(bad, []byte("x"), AudioOptions{}); err == nil {
+			t.Errorf("%s accepted", name)
+		}
+		if _, err := ExtractDataFromAIFF(bad, AudioOptions{}); err == nil {
+			t.Errorf("%s extracted", name)
+		}
+	}
+	if _, err := EmbedDataInAIFF(carrier, nil, AudioOptions{}); err == nil {
+		t.Error("empty data accepted")
+	}
+	if _, err := ExtractDataFromAIFF(carrier, AudioOptions{}); err == nil {
+		t.Error("clean file extracted")
+	}
+}
@@ -0,0 +1,222 @@
+package utils
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"math"
+	"math/cmplx"
+)
+
+// Spectrogram and segmental SNR parameters
+const (
+	spectrogramWindow     = 512  // FFT size in samples
+	spectrogramMaxColumns = 1024 // longer signals use a larger hop
+	spectrogramRangeDB    = 90.0 // dynamic range mapped onto the color scale
+
+	segmentDuration = 0.02 // 20 ms segments for segmental SNR
+	segmentMinSNR   = -10.0
+	segmentMaxSNR   = 35.0
+)
+
+// AudioAnalysis compares a cover audio file with its stego version
+type AudioAnalysis struct {
+	SampleRate       float64
+	Channels         int
+	Samples          int      // samples compared (frames * channels)
+	ChangedSamples   int      // samples that differ between cover and stego
+	SNR              *float64 // dB, nil when the files are identical or the cover is silent
+	SegmentalSNR     float64  // dB, mean of per-segment SNR clamped to [-10, 35]
+	PeakSampleChange int      // largest absolute sample difference
+	Spectrogram      []byte   // PNG rendering of the difference signal
+}
+
+// AnalyzeAudioDifference computes SNR, segmental SNR, the peak sample change and
+// a spectrogram of the difference between two PCM files (WAV or AIFF) of the same layout
+func AnalyzeAudioDifference(coverData, stegoData []byte) (*AudioAnalysis, error) {
+	cover, sampleRate, err := loadPCM(coverData)
+	if err != nil {
+		return nil, fmt.Errorf("invalid cover audio: %w", err)
+	}
+	stego, _, err := loadPCM(stegoData)
+	if err != nil {
+		return nil, fmt.Errorf("invalid stego audio: %w", err)
+	}
+
+	if cover.Channels != stego.Channels || cover.BytesPerSample != stego.BytesPerSample {
+		return nil, errors.New("cover and stego audio have a different sample layout")
+	}
+	if cover.sampleCount() != stego.sampleCount() {
+		return nil, errors.New("cover and stego audio have a different length")
+	}
+	if cover.sampleCount() == 0 {
+		return nil, errors.New("audio contains no samples")
+	}
+
+	result := &AudioAnalysis{
+		SampleRate: sampleRate,
+		Channels:   cover.Channels,
+		Samples:    cover.sampleCount(),
+	}
+
+	frames := cover.frameCount()
+	segmentFrames := max(1, int(sampleRate*segmentDuration))
+	var signalPower, noisePower float64
+	var segSignal, segNoise, segSum float64
+	segments := 0
+
+	for f := 0; f < frames; f++ {
+		for ch := 0; ch < cover.Channels; ch++ {
+			i := f*cover.Channels + ch
+			s := float64(cover.sample(i))
+			d := float64(stego.sample(i)) - s
+			if d != 0 {
+				result.ChangedSamples++
+				result.PeakSampleChange = max(result.PeakSampleChange, int(math.Abs(d)))
+			}
+			signalPower += s * s
+			noisePower += d * d
+			segSignal += s * s
+			segNoise += d * d
+		}
+
+		if (f+1)%segmentFrames == 0 || f == frames-1 {
+			// Segments without signal say nothing about audibility and are skipped
+			if segSignal > 0 {
+				snr := segmentMaxSNR
+				if segNoise > 0 {
+					snr = math.Max(segmentMinSNR, math.Min(segmentMaxSNR, 10*math.Log10(segSignal/segNoise)))
+				}
+				segSum += snr
+				segments++
+			}
+			segSignal, segNoise = 0, 0
+		}
+	}
+
+	if noisePower > 0 && signalPower > 0 {
+		snr := 10 * math.Log10(signalPower/noisePower)
+		result.SNR = &snr
+	}
+	if segments > 0 {
+		result.SegmentalSNR = segSum / float64(segments)
+	}
+
+	// Each channel's difference gets its own transform and the powers are summed, so opposite
+	// changes in two channels do not cancel out
+	result.Spectrogram, err = renderSpectrogram(frames, cover.Channels, func(f, ch int) float64 {
+		i := f*cover.Channels + ch
+		return float64(stego.sample(i)) - float64(cover.sample(i))
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return result, nil
+}
+
+// renderSpectrogram renders the STFT power of a multichannel signal of frames samples per
+// channel, summed over the channels, as a PNG with time on the x axis and frequency (low at
+// the bottom) on the y axis
+func renderSpectrogram(frames, channels int, signal func(frame, channel int) float64) ([]byte, error) {
+	bins := spectrogramWindow / 2
+	hop := spectrogramWindow / 2
+	if columns := (frames + hop - 1) / hop; columns > spectrogramMaxColumns {
+		hop = (frames + spectrogramMaxColumns - 1) / spectrogramMaxColumns
+	}
+	columns := max(1, (frames+hop-1)/hop)
+
+	window := make([]float64, spectrogramWindow)
+	for i := range window {
+		window[i] = 0.5 - 0.5*math.Cos(2*math.Pi*float64(i)/float64(spectrogramWindow-1))
+	}
+
+	magnitudes := make([][]float64, columns)
+	peak := math.Inf(-1)
+	buf := make([]complex128, spectrogramWindow)
+	power := make([]float64, bins)
+	for c := 0; c < columns; c++ {
+		start := c * hop
+		clear(power)
+		for ch := 0; ch < channels; ch++ {
+			for i := range buf {
+				v := 0.0
+				if start+i < frames {
+					v = signal(start+i, ch) * window[i]
+				}
+				buf[i] = complex(v, 0)
+			}
+			fft(buf)
+			for b := 0; b < bins; b++ {
+				m := cmplx.Abs(buf[b])
+				power[b] += m * m
+			}
+		}
+
+		magnitudes[c] = make([]float64, bins)
+		for b := 0; b < bins; b++ {
+			db := 10 * math.Log10(power[b]+1e-24)
+			magnitudes[c][b] = db
+			peak = math.Max(peak, db)
+		}
+	}
+
+	img := image.NewNRGBA(image.Rect(0, 0, columns, bins))
+	floor := peak - spectrogramRangeDB
+	for c := 0; c < columns; c++ {
+		for b := 0; b < bins; b++ {
+			level := 0.0
+			if peak > -200 { // an all-zero difference stays black
+				level = math.Max(0, math.Min(1, (magnitudes[c][b]-floor)/spectrogramRangeDB))
+			}
+			img.SetNRGBA(c, bins-1-b, heatColor(level))
+		}
+	}
+
+	var out bytes.Buffer
+	if err := png.Encode(&out, img); err != nil {
+		return nil, fmt.Errorf("failed to encode spectrogram: %w", err)
+	}
+	return out.Bytes(), nil
+}
+
+// heatColor maps a level in [0, 1] onto a black-red-yellow-white scale
+func heatColor(level float64) color.NRGBA {
+	v := level * 3
+	r := math.Min(1, v)
+	g := math.Max(0, math.Min(1, v-1))
+	b := math.Max(0, math.Min(1, v-2))
+	return color.NRGBA{R: uint8(r * 255), G: uint8(g * 255), B: uint8(b * 255), A: 255}
+}
+
+// fft computes an in-place radix-2 FFT; len(a) must be a power of two
+func fft(a []complex128) {
+	n := len(a)
+	for i, j := 1, 0; i < n; i++ {
+		bit := n >> 1
+		for ; j&bit != 0; bit >>= 1 {
+			j ^= bit
+		}
+		j ^= bit
+		if i < j {
+			a[i], a[j] = a[j], a[i]
+		}
+	}
+
+	for length := 2; length <= n; length <<= 1 {
+		w := cmplx.Exp(complex(0, -2*math.Pi/float64(length)))
+		for i := 0; i < n; i += length {
+			wn := complex(1, 0)
+			for k := 0; k < length/2; k++ {
+				u := a[i+k]
+				v := a[i+k+length/2] * wn
+				a[i+k] = u + v
+				a[i+k+length/2] = u - v
+				wn *= w
+			}
+		}
+	}
+}
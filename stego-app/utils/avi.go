@@ -0,0 +1,230 @@
+package utils
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"slices"
+)
+
+// riffChunk is a chunk located inside a RIFF file
+type riffChunk struct {
+	ID     string
+	Form   string // list type for RIFF and LIST chunks
+	Offset int    // offset of the chunk header
+	Size   int    // data size, without the header and pad byte
+}
+
+// dataOffset returns the offset of the chunk data (after the list type for RIFF/LIST)
+func (c riffChunk) dataOffset() int {
+	if c.Form != "" {
+		return c.Offset + 12
+	}
+	return c.Offset + 8
+}
+
+// end returns the offset just past the chunk, including the pad byte
+func (c riffChunk) end() int {
+	return c.Offset + 8 + c.Size + c.Size%2
+}
+
+// IsAVI reports whether data is a RIFF AVI file
+func IsAVI(data []byte) bool {
+	return len(data) >= 12 && string(data[:4]) == "RIFF" && string(data[8:12]) == "AVI "
+}
+
+// EmbedDataInAVI stores data in a JUNK chunk of an AVI file.
+// A JUNK chunk that is already large enough (e.g. the alignment padding after hdrl)
+// is filled in place, otherwise a new one is added at the end of the last RIFF
+// (AVI or OpenDML AVIX) chunk. Nothing before it moves, so idx1 entries and the
+// absolute OpenDML index offsets stay valid; only that RIFF size is updated.
+func EmbedDataInAVI(aviData []byte, data []byte) ([]byte, error) {
+	var out bytes.Buffer
+	if err := EmbedDataInAVIStream(bytes.NewReader(aviData), int64(len(aviData)), data, &out); err != nil {
+		return nil, err
+	}
+	return out.Bytes(), nil
+}
+
+// EmbedDataInAVIStream is EmbedDataInAVI reading the size byte file from src and writing to dst.
+// Only chunk headers are held in memory, so OpenDML files of several GB are fine.
+func EmbedDataInAVIStream(src io.ReaderAt, size int64, data []byte, dst io.Writer) error {
+	if len(data) == 0 {
+		return errors.New("data to embed cannot be empty")
+	}
+
+	if len(data) > MaxDataSize {
+		return fmt.Errorf("data too large: %d bytes, max allowed: %d bytes", len(data), MaxDataSize)
+	}
+
+	riffs, end := parseRIFFChunksAt(src, 0, int(size))
+	if len(riffs) == 0 || riffs[0].ID != "RIFF" || riffs[0].Form != "AVI " {
+		return errors.New("not an avi file")
+	}
+
+	payload := prepareDataWithHeader(data)
+
+	// Wipe payloads from previous embeds and fill the first JUNK chunk with room.
+	// Anything after the last RIFF chunk (e.g. a legacy appended payload) is dropped.
+	var edits []aviEdit
+	placed := false
+	for _, j := range aviJunkChunks(src, int(size), riffs) {
+		start, stop := j.dataOffset(), j.dataOffset()+j.Size
+		wiped := hasHeaderedDataAt(src, start, stop)
+		switch {
+		case !placed && j.Size >= len(payload):
+			var rest io.Reader = io.NewSectionReader(src, int64(start+len(payload)), int64(j.Size-len(payload)))
+			if wiped {
+				rest = zeroReader{}
+			}
+			edits = append(edits, aviEdit{start, stop, io.MultiReader(bytes.NewReader(payload), rest)})
+			placed = true
+		case wiped:
+			edits = append(edits, aviEdit{start, stop, zeroReader{}})
+		}
+	}
+
+	var junk []byte
+	if !placed {
+		last := riffs[len(riffs)-1]
+		if last.end() != end {
+			return errors.New("avi file does not end with a complete RIFF chunk")
+		}
+
+		junk = make([]byte, 8, 8+len(payload)+1)
+		copy(junk, "JUNK")
+		binary.LittleEndian.PutUint32(junk[4:8], uint32(len(payload)))
+		junk = append(junk, payload...)
+		if len(payload)%2 != 0 {
+			junk = append(junk, 0)
+		}
+
+		newSize := uint64(end - last.Offset - 8 + len(junk))
+		if newSize > math.MaxUint32 {
+			return errors.New("avi RIFF chunk would exceed 4GB")
+		}
+		header := binary.LittleEndian.AppendUint32(nil, uint32(newSize))
+		edits = append(edits, aviEdit{last.Offset + 4, last.Offset + 8, bytes.NewReader(header)})
+		slices.SortFunc(edits, func(a, b aviEdit) int { return a.start - b.start })
+	}
+
+	pos := 0
+	for _, e := range edits {
+		if err := copyRange(dst, src, pos, e.start); err != nil {
+			return err
+		}
+		if _, err := io.CopyN(dst, e.content, int64(e.end-e.start)); err != nil {
+			return fmt.Errorf("failed to copy carrier: %w", err)
+		}
+		pos = e.end
+	}
+	if err := copyRange(dst, src, pos, end); err != nil {
+		return err
+	}
+	_, err := dst.Write(junk)
+	return err
+}
+
+// aviEdit replaces the bytes [start, end) of the file with content
+type aviEdit struct {
+	start, end int
+	content    io.Reader
+}
+
+// ExtractDataFromAVI walks the RIFF chunks and returns the payload stored by EmbedDataInAVI
+func ExtractDataFromAVI(aviData []byte) ([]byte, error) {
+	return ExtractDataFromAVIStream(bytes.NewReader(aviData), int64(len(aviData)))
+}
+
+// ExtractDataFromAVIStream is ExtractDataFromAVI reading the size byte file from src
+func ExtractDataFromAVIStream(src io.ReaderAt, size int64) ([]byte, error) {
+	riffs, end := parseRIFFChunksAt(src, 0, int(size))
+	if len(riffs) == 0 || riffs[0].ID != "RIFF" || riffs[0].Form != "AVI " {
+		return nil, errors.New("not an avi file")
+	}
+
+	for _, j := range aviJunkChunks(src, int(size), riffs) {
+		if data, err := readHeaderedDataAt(src, j.dataOffset(), j.dataOffset()+j.Size); err == nil {
+			return data, nil
+		}
+	}
+
+	// Files embedded before the RIFF-aware carrier have the payload appended after the last chunk
+	if data, err := readHeaderedDataAt(src, end, int(size)); err == nil {
+		return data, nil
+	}
+
+	return nil, errors.New("no embedded data found in avi")
+}
+
+// aviJunkChunks returns the JUNK chunks directly inside the RIFF chunks and inside hdrl
+func aviJunkChunks(src io.ReaderAt, size int, riffs []riffChunk) []riffChunk {
+	var junks []riffChunk
+	for _, r := range riffs {
+		if r.ID != "RIFF" {
+			continue
+		}
+		children, _ := parseRIFFChunksAt(src, r.dataOffset(), min(r.end(), size))
+		for _, c := range children {
+			switch {
+			case c.ID == "JUNK":
+				junks = append(junks, c)
+			case c.ID == "LIST" && c.Form == "hdrl":
+				header, _ := parseRIFFChunksAt(src, c.dataOffset(), c.end())
+				for _, h := range header {
+					if h.ID == "JUNK" {
+						junks = append(junks, h)
+					}
+				}
+			}
+		}
+	}
+	return junks
+}
+
+// parseRIFFChunksAt parses the chunks between start and end reading only the chunk
+// headers from r, stopping at the first one that does not fit; it returns the offset
+// where parsing ended
+func parseRIFFChunksAt(r io.ReaderAt, start, end int) ([]riffChunk, int) {
+	var chunks []riffChunk
+	var header [12]byte
+	pos := start
+	for pos+8 <= end {
+		if _, err := r.ReadAt(header[:8], int64(pos)); err != nil {
+			return chunks, pos
+		}
+		id := string(header[0:4])
+		size := int(binary.LittleEndian.Uint32(header[4:8]))
+		if !isFourCC(id) || pos+8+size > end {
+			return chunks, pos
+		}
+
+		c := riffChunk{ID: id, Offset: pos, Size: size}
+		if id == "RIFF" || id == "LIST" {
+			if size < 4 {
+				return chunks, pos
+			}
+			if _, err := r.ReadAt(header[8:12], int64(pos+8)); err != nil {
+				return chunks, pos
+			}
+			c.Form = string(header[8:12])
+		}
+
+		chunks = append(chunks, c)
+		pos = min(c.end(), end)
+	}
+	return chunks, pos
+}
+
+// isFourCC reports whether id consists of printable ASCII characters
+func isFourCC(id string) bool {
+	for i := 0; i < len(id); i++ {
+		if id[i] < 0x20 || id[i] > 0x7E {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,179 @@
+package utils
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+)
+
+// riffTestChunk serializes a chunk with its pad byte; a list type starts list bodies
+func riffTestChunk(id string, body []byte) []byte {
+	out := binary.LittleEndian.AppendUint32([]byte(id), uint32(len(body)))
+	out = append(out, body...)
+	if len(body)%2 != 0 {
+		out = append(out, 0)
+	}
+	return out
+}
+
+// testAVI builds an AVI file with hdrl, a movi list of frames and idx1; hdrlJunk adds
+// a JUNK chunk of that size to hdrl, and avix adds an OpenDML AVIX RIFF chunk
+func testAVI(hdrlJunk int, avix bool) []byte {
+	hdrl := append([]byte("hdrl"), riffTestChunk("avih", make([]byte, 56))...)
+	if hdrlJunk > 0 {
+		hdrl = append(hdrl, riffTestChunk("JUNK", make([]byte, hdrlJunk))...)
+	}
+	movi := []byte("movi")
+	var idx1 []byte
+	for i := 0; i < 5; i++ {
+		frame := bytes.Repeat([]byte{byte('A' + i)}, 33)
+		idx1 = append(idx1, "00dc"...)
+		idx1 = binary.LittleEndian.AppendUint32(idx1, 0x10)
+		idx1 = binary.LittleEndian.AppendUint32(idx1, uint32(len(movi)))
+		idx1 = binary.LittleEndian.AppendUint32(idx1, uint32(len(frame)))
+		movi = append(movi, riffTestChunk("00dc", frame)...)
+	}
+	body := append([]byte("AVI "), riffTestChunk("LIST", hdrl)...)
+	body = append(body, riffTestChunk("LIST", movi)...)
+	body = append(body, riffTestChunk("idx1", idx1)...)
+	out := riffTestChunk("RIFF", body)
+	if avix {
+		extra := append([]byte("AVIX"), riffTestChunk("LIST", append([]byte("movi"), riffTestChunk("00dc", []byte("MORE"))...))...)
+		out = append(out, riffTestChunk("RIFF", extra)...)
+	}
+	return out
+}
+
+// checkAVIFrames checks that the RIFF chunks span the file and the idx1 entries still
+// point at their frames
+func checkAVIFrames(t *testing.T, name string, data []byte) {
+	t.Helper()
+	riffs, end := parseRIFFChunksAt(bytes.NewReader(data), 0, len(data))
+	if end != len(data) {
+		t.Fatalf("%s: RIFF chunks end at %d of %d", name, end, len(data))
+	}
+	children, _ := parseRIFFChunksAt(bytes.NewReader(data), riffs[0].dataOffset(), riffs[0].end())
+	var movi, idx1 riffChunk
+	for _, c := range children {
+		switch {
+		case c.ID == "LIST" && c.Form == "movi":
+			movi = c
+		case c.ID == "idx1":
+			idx1 = c
+		}
+	}
+	entries := data[idx1.Offset+8 : idx1.Offset+8+idx1.Size]
+	for i := 0; i+16 <= len(entries); i += 16 {
+		offset := movi.Offset + 8 + int(binary.LittleEndian.Uint32(entries[i+8:]))
+		if string(data[offset:offset+4]) != "00dc" || data[offset+8] != byte('A'+i/16) {
+			t.Fatalf("%s: idx1 entry %d no longer points at its frame", name, i/16)
+		}
+	}
+}
+
+func TestAVIRoundTrip(t *testing.T) {
+	carriers := map[string][]byte{
+		"plain":     testAVI(0, false),
+		"hdrl junk": testAVI(2000, false),
+		"odd junk":  testAVI(9, false),
+		"avix":      testAVI(0, true),
+	}
+	for _, size := range []int{1, 100, 5000} {
+		data := bytes.Repeat([]byte{0x7E, 0x01, 0x80}, size)[:size]
+		for name, carrier := range carriers {
+			out, err := EmbedDataInAVI(carrier, data)
+			if err != nil {
+				t.Fatalf("%s, %d bytes: %v", name, size, err)
+			}
+			got, err := ExtractDataFromAVI(out)
+			if err != nil || !bytes.Equal(got, data) {
+				t.Fatalf("%s, %d bytes: got %d bytes, %v", name, size, len(got), err)
+			}
+			checkAVIFrames(t, name, out)
+			if name == "hdrl junk" && size < 2000 && len(out) != len(carrier) {
+				t.Fatalf("%s, %d bytes: JUNK chunk not filled in place", name, size)
+			}
+		}
+	}
+}
+
+func TestAVIReembed(t *testing.T) {
+	for name, carrier := range map[string][]byte{
+		"plain":     testAVI(0, false),
+		"hdrl junk": testAVI(300, false),
+		"avix":      testAVI(0, true),
+	} {
+		out := carrier
+		for i, size := range []int{200, 50, 1000, 20, 400} {
+			data := bytes.Repeat([]byte{byte('a' + i)}, size)
+			var err error
+			out, err = EmbedDataInAVI(out, data)
+			if err != nil {
+				t.Fatalf("%s, step %d: %v", name, i, err)
+			}
+			got, err := ExtractDataFromAVI(out)
+			if err != nil || !bytes.Equal(got, data) {
+				t.Fatalf("%s, step %d: got %d bytes, %v", name, i, len(got), err)
+			}
+			checkAVIFrames(t, name, out)
+			if i > 0 && bytes.Contains(out, bytes.Repeat([]byte{byte('a' + i - 1)}, 20)) {
+				t.Fatalf("%s, step %d: previous payload left in the file", name, i)
+			}
+		}
+	}
+}
+
+func TestAVILegacyAppendedPayload(t *testing.T) {
+	out := append(testAVI(0, false), prepareDataWithHeader([]byte("appended"))...)
+	got, err := ExtractDataFromAVI(out)
+	if err != nil || string(got) != "appended" {
+		t.Fatalf("got %q, %v", got, err)
+	}
+
+	// Embedding again drops the appended payload
+	out, err = EmbedDataInAVI(out, []byte("chunked"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(out, []byte("appended")) {
+		t.Fatal("appended payload left in the file")
+	}
+	checkAVIFrames(t, "legacy", out)
+}
+
+func TestAVIMalformed(t *testing.T) {
+	carrier := testAVI(0, false)
+	if _, err := EmbedDataInAVI([]byte("RIFF\x04\x00\x00\x00WAVE"), []byte("x")); err == nil {
+		t.Error("non-avi RIFF accepted")
+	}
+	if _, err := EmbedDataInAVI(carrier, nil); err == nil {
+		t.Error("empty data accepted")
+	}
+
+	// A RIFF size past the end of the file (a truncated download) cannot be appended to
+	truncated := carrier[:len(carrier)-10]
+	if _, err := EmbedDataInAVI(truncated, []byte("x")); err == nil {
+		t.Error("truncated file accepted")
+	}
+	if _, err := ExtractDataFromAVI(truncated); err == nil {
+		t.Error("truncated clean file extracted")
+	}
+
+	// A chunk size pointing past its RIFF chunk stops the walk instead of reading past it
+	bad := bytes.Clone(carrier)
+	binary.LittleEndian.PutUint32(bad[16:], 1<<30)
+	if _, err := ExtractDataFromAVI(bad); err == nil {
+		t.Error("corrupt file extracted")
+	}
+
+	if _, err := ExtractDataFromAVI(carrier); err == nil {
+		t.Error("clean file extracted")
+	}
+	estimate, err := estimateAVICapacity(bytes.NewReader(carrier), int64(len(carrier)))
+	if err != nil || estimate.Capacity <= 0 {
+		t.Fatalf("estimate %+v, %v", estimate, err)
+	}
+	if _, err := estimateAVICapacity(bytes.NewReader([]byte("RIFF")), 4); err == nil {
+		t.Error("estimate of a non-avi file")
+	}
+}
@@ -0,0 +1,281 @@
+package utils
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+)
+
+// CapacityEstimate reports how many bytes a carrier can hold with a given strategy
+type CapacityEstimate struct {
+	Format    string // detected carrier format, e.g. "mp4"
+	Mode      string // embedding strategy the estimate applies to
+	Capacity  int    // payload bytes, the 8 byte header already reserved
+	Reasoning string // how the capacity was derived
+	PageBits  []int  // bits each page can carry, for PDF kerning mode
+	Warning   string // problem found in the carrier, e.g. data after the end of a file carrier
+}
+
+// newEstimate builds an estimate from the raw number of bytes the carrier structure can take,
+// reserving the header and applying MaxDataSize
+func newEstimate(format, mode string, room int, reasoning string) CapacityEstimate {
+	capacity := max(0, room-8) // Reserve 8 bytes for header
+	if capacity > MaxDataSize {
+		capacity = MaxDataSize
+		reasoning += fmt.Sprintf("; capped at the %d byte payload limit", MaxDataSize)
+	}
+	return CapacityEstimate{Format: format, Mode: mode, Capacity: capacity, Reasoning: reasoning}
+}
+
+// checkCapacity returns an error when data does not fit the estimate
+func (e CapacityEstimate) checkCapacity(dataSize int) error {
+	if dataSize > e.Capacity {
+		return fmt.Errorf("data too large for %s carrier in %s mode: %d bytes, capacity %d bytes (%s)",
+			e.Format, e.Mode, dataSize, e.Capacity, e.Reasoning)
+	}
+	return nil
+}
+
+// appendEstimate covers carriers that get the payload appended after their last byte
+func appendEstimate(format string) CapacityEstimate {
+	return newEstimate(format, "append", math.MaxInt32,
+		"payload is appended after the end of the file, so only the payload size limit applies")
+}
+
+// EstimateImageCapacity estimates the LSB capacity of a width x height image
+func EstimateImageCapacity(width, height int) CapacityEstimate {
+	return CapacityEstimate{
+		Format:   "image",
+		Mode:     "lsb",
+		Capacity: CalculateImageCapacity(width, height),
+		Reasoning: fmt.Sprintf("1 bit in each of the R, G and B channels of %dx%d pixels, output as PNG",
+			width, height),
+	}
+}
+
+// EstimateAudioCapacity estimates the capacity of an audio carrier for the chosen options
+func EstimateAudioCapacity(audioData []byte, opts AudioOptions) (CapacityEstimate, error) {
+	if len(audioData) == 0 {
+		return CapacityEstimate{}, errors.New("audio data cannot be empty")
+	}
+
+	switch {
+	case IsFLAC(audioData):
+		return newEstimate("flac", "application", flacMaxBlockLength-4,
+			"payload is stored in an APPLICATION metadata block, whose 24-bit length field allows 16MB"), nil
+
+	case IsWAV(audioData) || IsAIFF(audioData):
+		pcm, _, err := loadPCM(audioData)
+		if err != nil {
+			break // not PCM, the payload gets appended
+		}
+		layout, err := pcm.layout(opts)
+		if err != nil {
+			return CapacityEstimate{}, err
+		}
+		format := "wav"
+		if IsAIFF(audioData) {
+			format = "aiff"
+		}
+		usable := pcm.usable(layout)
+		return newEstimate(format, "lsb", usable/8, fmt.Sprintf(
+			"1 bit per sample over %d of %d samples in channels %v; runs of %d or more digitally silent samples are skipped",
+			usable, pcm.sampleCount(), layout.Channels, minSilentRun)), nil
+
+	case IsOgg(audioData):
+		return newEstimate("ogg", "comment", math.MaxInt32,
+			"payload is stored base64 encoded in the Vorbis/Opus comment header, which grows by about 4/3 of the payload"), nil
+
+	case IsMP3(audioData):
+		switch opts.Mode {
+		case "", MP3ModeID3:
+			return newEstimate("mp3", MP3ModeID3, 1<<28-10-10-len(mp3PrivOwner)-1,
+				"payload is stored in an ID3v2 PRIV frame, the tag size is a 28-bit syncsafe integer"), nil
+		case MP3ModeAncillary:
+			return CapacityEstimate{
+				Format:    "mp3",
+				Mode:      MP3ModeAncillary,
+				Capacity:  CalculateMP3AncillaryCapacity(audioData),
+				Reasoning: "sum of the unused main data bytes (ancillary data and padding) between the Layer III frames",
+			}, nil
+		default:
+			return CapacityEstimate{}, fmt.Errorf("invalid mp3 mode %q. Must be: %s or %s", opts.Mode, MP3ModeID3, MP3ModeAncillary)
+		}
+	}
+
+	return appendEstimate("audio"), nil
+}
+
+// EstimateVideoCapacity estimates the capacity of a video carrier for the chosen options
+func EstimateVideoCapacity(videoData []byte, opts VideoOptions) (CapacityEstimate, error) {
+	if len(videoData) == 0 {
+		return CapacityEstimate{}, errors.New("video data cannot be empty")
+	}
+
+	switch {
+	case IsY4M(videoData):
+		video, err := parseY4M(videoData)
+		if err != nil {
+			return CapacityEstimate{}, err
+		}
+		frames, err := video.selectFrames(opts.Frames)
+		if err != nil {
+			return CapacityEstimate{}, err
+		}
+		return newEstimate("y4m", Y4MModeLSB, len(frames)*video.PlaneSamples/8, fmt.Sprintf(
+			"1 bit per luma/chroma sample: %d frame(s) x %d samples of %dx%d video",
+			len(frames), video.PlaneSamples, video.Width, video.Height)), nil
+
+	case IsMP4(videoData):
+		return estimateMP4Capacity(bytes.NewReader(videoData), int64(len(videoData)), opts.Mode)
+
+	case IsMKV(videoData):
+		switch opts.Mode {
+		case "", MKVModeAttachment:
+			segment, children, err := parseMKVSegment(videoData)
+			if err != nil {
+				return CapacityEstimate{}, err
+			}
+			if err := checkMKVAttachmentsSeek(videoData, segment, children); err != nil {
+				return newEstimate("mkv", MKVModeAttachment, 0,
+					"Attachments has to move to the end of the Segment, but the SeekHead has no Void element after it "+
+						"to grow into for the new entry; void mode has no such limit"), nil
+			}
+			return newEstimate("mkv", MKVModeAttachment, math.MaxInt32,
+				"payload is stored as an attached file; EBML sizes allow it, but when Attachments is not the last "+
+					"element the SeekHead needs a Void element after it to grow into"), nil
+		case MKVModeVoid:
+			return newEstimate("mkv", MKVModeVoid, math.MaxInt32,
+				"payload is stored in a Void element at the end of the Segment, EBML sizes allow it"), nil
+		default:
+			return CapacityEstimate{}, fmt.Errorf("invalid mkv mode %q. Must be: %s or %s", opts.Mode, MKVModeAttachment, MKVModeVoid)
+		}
+
+	case IsAVI(videoData):
+		return estimateAVICapacity(bytes.NewReader(videoData), int64(len(videoData)))
+
+	case IsTS(videoData):
+		return estimateTSCapacity(videoData, opts.Mode)
+	}
+
+	return appendEstimate("video"), nil
+}
+
+// EstimatePDFCapacity estimates the capacity of a PDF carrier for the chosen mode
+func EstimatePDFCapacity(pdfData []byte, mode string) (CapacityEstimate, error) {
+	return EstimatePDFCapacityStream(bytes.NewReader(pdfData), int64(len(pdfData)), mode)
+}
+
+// estimateMP4Capacity covers the uuid and free box strategies
+func estimateMP4Capacity(src io.ReaderAt, size int64, mode string) (CapacityEstimate, error) {
+	boxes, _ := parseMP4BoxesAt(src, 0, int(size))
+	if len(boxes) == 0 {
+		return CapacityEstimate{}, errors.New("not an mp4 file")
+	}
+
+	switch mode {
+	case "", MP4ModeUUID:
+		if last := boxes[len(boxes)-1]; last.ToEnd && last.Size > math.MaxUint32 {
+			return newEstimate("mp4", MP4ModeUUID, 0, fmt.Sprintf(
+				"the last %s box extends to the end of the file and is too large for a 32-bit size, so no box can follow it",
+				last.Type)), nil
+		}
+		return newEstimate("mp4", MP4ModeUUID, math.MaxInt32-8-len(mp4PayloadUUID),
+			"payload is stored in a top-level uuid box after the last box, box sizes go up to 64 bits"), nil
+
+	case MP4ModeFree:
+		largest := 0
+		fragmented := false
+		for _, b := range boxes {
+			switch b.Type {
+			case "free", "skip":
+				largest = max(largest, b.Size-b.HeaderSize)
+			case "moof":
+				fragmented = true
+			}
+		}
+		if fragmented {
+			return newEstimate("mp4", MP4ModeFree, largest,
+				"fragmented mp4: moof offsets are not rewritten, so only an existing free box can be reused"), nil
+		}
+		// Inserting before mdat shifts 32-bit stco offsets, which must stay below 4GB
+		room := math.MaxUint32 - int(size) - 8
+		reasoning := "a new free box is inserted before mdat and the stco/co64 chunk offsets are shifted; 32-bit stco entries must stay below 4GB"
+		if largest > 0 {
+			reasoning += fmt.Sprintf("; up to %d bytes reuse an existing free box without moving mdat", max(0, largest-8))
+		}
+		return newEstimate("mp4", MP4ModeFree, room, reasoning), nil
+
+	default:
+		return CapacityEstimate{}, fmt.Errorf("invalid mp4 mode %q. Must be: %s or %s", mode, MP4ModeUUID, MP4ModeFree)
+	}
+}
+
+// estimateAVICapacity covers JUNK chunk reuse and a new JUNK chunk in the last RIFF chunk
+func estimateAVICapacity(src io.ReaderAt, size int64) (CapacityEstimate, error) {
+	riffs, _ := parseRIFFChunksAt(src, 0, int(size))
+	if len(riffs) == 0 || riffs[0].Form != "AVI " {
+		return CapacityEstimate{}, errors.New("not an avi file")
+	}
+
+	largest := 0
+	for _, j := range aviJunkChunks(src, int(size), riffs) {
+		largest = max(largest, j.Size)
+	}
+
+	last := riffs[len(riffs)-1]
+	room := math.MaxUint32 - (last.Size + last.Size%2) - 8 - 1 // JUNK header and pad byte
+	reasoning := fmt.Sprintf("payload is stored in a JUNK chunk added to the end of the last of %d RIFF chunks, "+
+		"whose 32-bit size must stay below 4GB", len(riffs))
+	if largest > 0 {
+		reasoning += fmt.Sprintf("; up to %d bytes fit into an existing JUNK chunk in place", max(0, largest-8))
+	}
+	return newEstimate("avi", "junk", room, reasoning), nil
+}
+
+// estimateTSCapacity covers the private PID strategies
+func estimateTSCapacity(tsData []byte, mode string) (CapacityEstimate, error) {
+	if mode != "" && mode != TSModePID && mode != TSModePMT {
+		return CapacityEstimate{}, fmt.Errorf("invalid ts mode %q. Must be: %s or %s", mode, TSModePID, TSModePMT)
+	}
+	if mode == "" {
+		mode = TSModePID
+	}
+
+	stream, err := parseTS(tsData)
+	if err != nil {
+		return CapacityEstimate{}, err
+	}
+	nulls := 0
+	for _, p := range stream.Packets {
+		if tsPID(tsData, p) == tsNullPID {
+			nulls++
+		}
+	}
+
+	// Each packet carries 184 bytes, each PES packet of up to 64KB adds a 6 byte header
+	inPlace := max(0, nulls*(tsPacketSize-4)-6-8)
+	reasoning := fmt.Sprintf("payload is stored as private PES packets on an unused PID; %d null packets hold about "+
+		"%d bytes without growing the stream, the rest is appended as new packets", nulls, inPlace)
+	if mode == TSModePMT {
+		reasoning += "; every PMT section needs 5 spare bytes in its packet to advertise the PID"
+	}
+	return newEstimate("ts", mode, math.MaxInt32, reasoning), nil
+}
+
+// EstimateOOXMLCapacity estimates the capacity of an OOXML document carrier for the chosen mode
+func EstimateOOXMLCapacity(docData []byte, mode string) (CapacityEstimate, error) {
+	return EstimateOOXMLCapacityStream(bytes.NewReader(docData), int64(len(docData)), mode)
+}
+
+// EstimateZIPCapacity estimates the capacity of a ZIP archive carrier for the chosen mode
+func EstimateZIPCapacity(zipData []byte, mode string) (CapacityEstimate, error) {
+	return EstimateZIPCapacityStream(bytes.NewReader(zipData), int64(len(zipData)), mode)
+}
+
+// EstimateFileCapacity estimates the capacity of any file used as an append carrier
+func EstimateFileCapacity(fileData []byte) (CapacityEstimate, error) {
+	return EstimateFileCapacityStream(bytes.NewReader(fileData), int64(len(fileData)))
+}
@@ -0,0 +1,50 @@
+package utils
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"io"
+)
+
+// maxDecompressedSize bounds decompressed messages; a 10MB file message is about 14MB of JSON
+const maxDecompressedSize = 4 * MaxDataSize
+
+// CompressData gzips a message before it is encrypted, for carriers with little room
+func CompressData(data []byte) ([]byte, error) {
+	var out bytes.Buffer
+	zw, err := gzip.NewWriterLevel(&out, gzip.BestCompression)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := zw.Write(data); err != nil {
+		return nil, err
+	}
+	if err := zw.Close(); err != nil {
+		return nil, err
+	}
+	return out.Bytes(), nil
+}
+
+// IsCompressed checks for the gzip magic; uncompressed messages are JSON and start with '{'
+func IsCompressed(data []byte) bool {
+	return bytes.HasPrefix(data, []byte{0x1f, 0x8b})
+}
+
+// DecompressData reverses CompressData
+func DecompressData(data []byte) ([]byte, error) {
+	zr, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	defer zr.Close()
+
+	out, err := io.ReadAll(io.LimitReader(zr, maxDecompressedSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(out) > maxDecompressedSize {
+		return nil, errors.New("decompressed message too large")
+	}
+	return out, nil
+}
@@ -0,0 +1,608 @@
+package utils
+
+import (
+	"bytes"
+	"compress/flate"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"strings"
+)
+
+// DICOM Part 10 files are a 128 byte preamble, "DICM", the file meta group in explicit VR
+// little endian and the data set in the transfer syntax the meta group names. The data set
+// is rewritten by splicing: elements other than the pixel data or the private block holding
+// the payload are copied byte for byte, so the transfer syntax and every other data element
+// stay as they were. Deflated data sets are inflated, changed and deflated again.
+
+// DICOM embedding modes
+const (
+	DICOMModeLSB     = "lsb"     // payload in the lowest stored bit of 12 to 16-bit pixel samples (default)
+	DICOMModePrivate = "private" // payload in an OB element of a private block
+)
+
+// The private block holding the payload, identified by its creator
+const (
+	dicomPrivateGroup   = 0x0009
+	dicomPrivateCreator = "STEGO-APP"
+)
+
+// Transfer syntaxes that are not explicit VR little endian; the others, compressed ones
+// included, encode their data set in explicit VR little endian
+const (
+	dicomImplicitLE = "1.2.840.10008.1.2"
+	dicomDeflatedLE = "1.2.840.10008.1.2.1.99"
+	dicomExplicitBE = "1.2.840.10008.1.2.2"
+)
+
+// Tags used by the carrier, group << 16 | element
+const (
+	dicomTransferSyntax  = 0x00020010
+	dicomBitsAllocated   = 0x00280100
+	dicomBitsStored      = 0x00280101
+	dicomHighBit         = 0x00280102
+	dicomPixelSigned     = 0x00280103
+	dicomSmallestPixel   = 0x00280106
+	dicomLargestPixel    = 0x00280107
+	dicomPixelPadding    = 0x00280120
+	dicomPixelData       = 0x7FE00010
+	dicomItem            = 0xFFFEE000
+	dicomItemDelimiter   = 0xFFFEE00D
+	dicomSeqDelimiter    = 0xFFFEE0DD
+	dicomUndefinedLength = 0xFFFFFFFF
+)
+
+// IsDICOM checks for the DICM prefix after the preamble of a DICOM Part 10 file
+func IsDICOM(data []byte) bool {
+	return len(data) >= 132 && string(data[128:132]) == "DICM"
+}
+
+// EmbedDataInDICOM embeds data in a DICOM file using the chosen mode. A payload of an
+// earlier embed in a private block is removed first, in either mode.
+func EmbedDataInDICOM(dcmData []byte, data []byte, mode string) ([]byte, error) {
+	if len(data) == 0 {
+		return nil, errors.New("data to embed cannot be empty")
+	}
+
+	if len(data) > MaxDataSize {
+		return nil, fmt.Errorf("data too large: %d bytes, max allowed: %d bytes", len(data), MaxDataSize)
+	}
+
+	if mode != "" && mode != DICOMModeLSB && mode != DICOMModePrivate {
+		return nil, invalidDICOMMode(mode)
+	}
+
+	d, err := parseDICOM(dcmData)
+	if err != nil {
+		return nil, err
+	}
+
+	payload := prepareDataWithHeader(data)
+	if mode == DICOMModePrivate {
+		if len(payload)%2 == 1 {
+			payload = append(payload, 0) // values have an even length
+		}
+		dataset, err := d.withPrivatePayload(payload)
+		if err != nil {
+			return nil, err
+		}
+		return d.write(dataset)
+	}
+
+	pixels, err := d.pixels()
+	if err != nil {
+		return nil, err
+	}
+	if err := pixels.estimate().checkCapacity(len(data)); err != nil {
+		return nil, err
+	}
+	dataset, err := d.withPrivatePayload(nil)
+	if err != nil {
+		return nil, err
+	}
+	pixels.embed(dataset[pixels.offset(d, dataset):], bytesToBits(payload))
+	return d.write(dataset)
+}
+
+// ExtractDataFromDICOM extracts data hidden in a DICOM file by either mode
+func ExtractDataFromDICOM(dcmData []byte) ([]byte, error) {
+	d, err := parseDICOM(dcmData)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, value, ok := d.privateBlock(); ok {
+		if data, err := parseHeaderedData(value); err == nil {
+			return data, nil
+		}
+	}
+	if pixels, err := d.pixels(); err == nil {
+		if data, err := pixels.extract(); err == nil {
+			return data, nil
+		}
+	}
+	return nil, errors.New("no embedded data found in dicom file")
+}
+
+// EstimateDICOMCapacity estimates the capacity of a DICOM file for the chosen mode
+func EstimateDICOMCapacity(dcmData []byte, mode string) (CapacityEstimate, error) {
+	d, err := parseDICOM(dcmData)
+	if err != nil {
+		return CapacityEstimate{}, err
+	}
+
+	switch mode {
+	case "", DICOMModeLSB:
+		pixels, err := d.pixels()
+		if err != nil {
+			return CapacityEstimate{}, err
+		}
+		return pixels.estimate(), nil
+	case DICOMModePrivate:
+		return newEstimate("dicom", DICOMModePrivate, math.MaxInt32, fmt.Sprintf(
+			"payload is stored in an OB element of the %q private block in group %04X, whose 32-bit length allows 4GB",
+			dicomPrivateCreator, dicomPrivateGroup)), nil
+	}
+	return CapacityEstimate{}, invalidDICOMMode(mode)
+}
+
+// EmbedDataInDICOMStream is EmbedDataInDICOM reading the size byte file from src and writing to dst
+func EmbedDataInDICOMStream(src io.ReaderAt, size int64, data []byte, mode string, dst io.Writer) error {
+	dcmData, err := readCarrier(src, size, "dicom")
+	if err != nil {
+		return err
+	}
+	result, err := EmbedDataInDICOM(dcmData, data, mode)
+	if err != nil {
+		return err
+	}
+	_, err = dst.Write(result)
+	return err
+}
+
+// ExtractDataFromDICOMStream is ExtractDataFromDICOM for the size byte file read from src
+func ExtractDataFromDICOMStream(src io.ReaderAt, size int64) ([]byte, error) {
+	dcmData, err := readCarrier(src, size, "dicom")
+	if err != nil {
+		return nil, err
+	}
+	return ExtractDataFromDICOM(dcmData)
+}
+
+// EstimateDICOMCapacityStream is EstimateDICOMCapacity for the size byte file read from src
+func EstimateDICOMCapacityStream(src io.ReaderAt, size int64, mode string) (CapacityEstimate, error) {
+	dcmData, err := readCarrier(src, size, "dicom")
+	if err != nil {
+		return CapacityEstimate{}, err
+	}
+	return EstimateDICOMCapacity(dcmData, mode)
+}
+
+// invalidDICOMMode reports a mode DICOM files do not support
+func invalidDICOMMode(mode string) error {
+	return fmt.Errorf("invalid dicom mode %q. Must be: %s or %s", mode, DICOMModeLSB, DICOMModePrivate)
+}
+
+// dicomElement is a data element of the top level data set
+type dicomElement struct {
+	tag   uint32
+	start int // offset of the element header
+	value int // offset of the value
+	end   int // offset after the value, or after the sequence delimiter of an undefined length value
+
+	undefined bool // undefined length: a sequence or encapsulated pixel data
+}
+
+// dicomEncoding is how a data set is encoded
+type dicomEncoding struct {
+	explicit bool // explicit VR
+	order    dicomByteOrder
+}
+
+// dicomByteOrder is binary.LittleEndian or binary.BigEndian
+type dicomByteOrder interface {
+	binary.ByteOrder
+	binary.AppendByteOrder
+}
+
+// dicomFile is a parsed DICOM file
+type dicomFile struct {
+	meta     []byte // preamble, prefix and file meta group
+	dataset  []byte // inflated for the deflated transfer syntax
+	syntax   string
+	deflated bool
+	enc      dicomEncoding
+	elements []dicomElement
+}
+
+// parseDICOM reads the file meta group and the top level elements of the data set
+func parseDICOM(data []byte) (*dicomFile, error) {
+	if !IsDICOM(data) {
+		return nil, errors.New("not a dicom file")
+	}
+
+	// The meta group is explicit VR little endian, whatever the transfer syntax
+	metaEnc := dicomEncoding{explicit: true, order: binary.LittleEndian}
+	d := &dicomFile{enc: dicomEncoding{explicit: true, order: binary.LittleEndian}}
+	pos := 132
+	for pos+2 <= len(data) && binary.LittleEndian.Uint16(data[pos:]) == 0x0002 {
+		el, err := metaEnc.readElement(data, pos)
+		if err != nil {
+			return nil, fmt.Errorf("invalid dicom file meta information: %w", err)
+		}
+		if el.tag == dicomTransferSyntax {
+			d.syntax = strings.TrimRight(string(data[el.value:el.end]), "\x00 ")
+		}
+		pos = el.end
+	}
+	if d.syntax == "" {
+		return nil, errors.New("dicom file has no transfer syntax")
+	}
+	d.meta, d.dataset = data[:pos], data[pos:]
+
+	switch d.syntax {
+	case dicomImplicitLE:
+		d.enc.explicit = false
+	case dicomExplicitBE:
+		d.enc.order = binary.BigEndian
+	case dicomDeflatedLE:
+		inflated, err := io.ReadAll(io.LimitReader(flate.NewReader(bytes.NewReader(d.dataset)), MaxInMemoryCarrier+1))
+		if err != nil || len(inflated) > MaxInMemoryCarrier {
+			return nil, errors.New("invalid deflated dicom data set")
+		}
+		d.dataset, d.deflated = inflated, true
+	}
+
+	for pos := 0; pos < len(d.dataset); {
+		el, err := d.enc.readElement(d.dataset, pos)
+		if err != nil {
+			return nil, fmt.Errorf("invalid dicom data set: %w", err)
+		}
+		d.elements = append(d.elements, el)
+		pos = el.end
+	}
+	return d, nil
+}
+
+// write assembles the file around a data set
+func (d *dicomFile) write(dataset []byte) ([]byte, error) {
+	out := bytes.NewBuffer(make([]byte, 0, len(d.meta)+len(dataset)))
+	out.Write(d.meta)
+	if !d.deflated {
+		out.Write(dataset)
+		return out.Bytes(), nil
+	}
+
+	zw, err := flate.NewWriter(out, flate.DefaultCompression)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := zw.Write(dataset); err != nil {
+		return nil, err
+	}
+	if err := zw.Close(); err != nil {
+		return nil, err
+	}
+	if out.Len()%2 == 1 {
+		out.WriteByte(0) // the deflated stream is padded to an even length
+	}
+	return out.Bytes(), nil
+}
+
+// find returns the top level element with a tag
+func (d *dicomFile) find(tag uint32) (dicomElement, bool) {
+	for _, el := range d.elements {
+		if el.tag == tag {
+			return el, true
+		}
+	}
+	return dicomElement{}, false
+}
+
+// uint16Value returns the value of a US or SS element
+func (d *dicomFile) uint16Value(tag uint32) (uint16, bool) {
+	el, ok := d.find(tag)
+	if !ok || el.end-el.value < 2 {
+		return 0, false
+	}
+	return d.enc.order.Uint16(d.dataset[el.value:]), true
+}
+
+// readElement reads the element header at pos and finds the end of its value
+func (enc dicomEncoding) readElement(buf []byte, pos int) (dicomElement, error) {
+	if pos+8 > len(buf) {
+		return dicomElement{}, errors.New("truncated element header")
+	}
+	tag := uint32(enc.order.Uint16(buf[pos:]))<<16 | uint32(enc.order.Uint16(buf[pos+2:]))
+	el := dicomElement{tag: tag, start: pos, value: pos + 8}
+	length := enc.order.Uint32(buf[pos+4:])
+	nested := enc
+
+	if enc.explicit && tag>>16 != 0xFFFE {
+		vr := string(buf[pos+4 : pos+6])
+		switch vr {
+		case "OB", "OD", "OF", "OL", "OV", "OW", "SQ", "SV", "UC", "UN", "UR", "UT", "UV":
+			if pos+12 > len(buf) {
+				return dicomElement{}, errors.New("truncated element header")
+			}
+			length = enc.order.Uint32(buf[pos+8:])
+			el.value = pos + 12
+		default:
+			length = uint32(enc.order.Uint16(buf[pos+6:]))
+		}
+		if vr == "UN" {
+			// An undefined length UN value is a sequence in implicit VR little endian
+			nested = dicomEncoding{order: binary.LittleEndian}
+		}
+	}
+
+	if length == dicomUndefinedLength {
+		end, err := nested.skipSequence(buf, el.value)
+		el.end, el.undefined = end, true
+		return el, err
+	}
+	el.end = el.value + int(length)
+	if el.end > len(buf) {
+		return dicomElement{}, fmt.Errorf("element (%04X,%04X) runs past the end of the file", tag>>16, tag&0xFFFF)
+	}
+	return el, nil
+}
+
+// skipSequence returns the end of an undefined length value: items, or encapsulated pixel
+// data fragments, up to the sequence delimiter
+func (enc dicomEncoding) skipSequence(buf []byte, pos int) (int, error) {
+	for {
+		if pos+8 > len(buf) {
+			return 0, errors.New("sequence without delimiter")
+		}
+		tag := uint32(enc.order.Uint16(buf[pos:]))<<16 | uint32(enc.order.Uint16(buf[pos+2:]))
+		length := enc.order.Uint32(buf[pos+4:])
+		switch {
+		case tag == dicomSeqDelimiter:
+			return pos + 8, nil
+		case tag != dicomItem:
+			return 0, fmt.Errorf("unexpected element (%04X,%04X) in a sequence", tag>>16, tag&0xFFFF)
+		case length != dicomUndefinedLength:
+			pos += 8 + int(length)
+			continue
+		}
+
+		// An undefined length item holds elements up to its delimiter
+		for pos += 8; ; {
+			el, err := enc.readElement(buf, pos)
+			if err != nil {
+				return 0, err
+			}
+			pos = el.end
+			if el.tag == dicomItemDelimiter {
+				break
+			}
+		}
+	}
+}
+
+// privateBlock finds the block reserved by the payload creator and returns its block number
+// and the value of its payload element
+func (d *dicomFile) privateBlock() (uint32, []byte, bool) {
+	var block uint32
+	for _, el := range d.elements {
+		group, element := el.tag>>16, el.tag&0xFFFF
+		switch {
+		case group == dicomPrivateGroup && element >= 0x10 && element <= 0xFF &&
+			strings.TrimRight(string(d.dataset[el.value:el.end]), "\x00 ") == dicomPrivateCreator:
+			block = element
+		case block != 0 && group == dicomPrivateGroup && element == block<<8:
+			return block, d.dataset[el.value:el.end], true
+		}
+	}
+	return 0, nil, false
+}
+
+// withPrivatePayload returns the data set without the payload block of an earlier embed
+// and, unless payload is nil, with a new block holding payload. Elements are kept in tag
+// order and a group length element of the private group is updated.
+func (d *dicomFile) withPrivatePayload(payload []byte) ([]byte, error) {
+	old, _, _ := d.privateBlock()
+	used := map[uint32]bool{}
+	for _, el := range d.elements {
+		if el.tag>>16 == dicomPrivateGroup && el.tag&0xFFFF <= 0xFF {
+			used[el.tag&0xFFFF] = true
+		}
+	}
+
+	type element struct {
+		tag   uint32
+		bytes []byte
+	}
+	var added []element
+	if payload != nil {
+		block := old
+		for block == 0 {
+			for block = 0x10; block <= 0xFF && used[block]; block++ {
+			}
+			if block > 0xFF {
+				return nil, fmt.Errorf("no free private block left in group %04X", dicomPrivateGroup)
+			}
+		}
+		creator := []byte(dicomPrivateCreator)
+		if len(creator)%2 == 1 {
+			creator = append(creator, ' ')
+		}
+		added = []element{
+			{dicomPrivateGroup<<16 | block, d.enc.header(dicomPrivateGroup<<16|block, "LO", len(creator), creator)},
+			{dicomPrivateGroup<<16 | block<<8, d.enc.header(dicomPrivateGroup<<16|block<<8, "OB", len(payload), payload)},
+		}
+	}
+
+	out := make([]byte, 0, len(d.dataset)+len(payload)+64)
+	groupLength := -1 // offset of the value of the private group length
+	for _, el := range d.elements {
+		group, element := el.tag>>16, el.tag&0xFFFF
+		if old != 0 && group == dicomPrivateGroup && (element == old || element>>8 == old) {
+			continue
+		}
+		for len(added) > 0 && added[0].tag < el.tag {
+			out = append(out, added[0].bytes...)
+			added = added[1:]
+		}
+		if el.tag == dicomPrivateGroup<<16 {
+			groupLength = len(out) + el.value - el.start
+		}
+		out = append(out, d.dataset[el.start:el.end]...)
+	}
+	for _, el := range added {
+		out = append(out, el.bytes...)
+	}
+
+	if groupLength >= 0 {
+		// The group length counts the bytes of the other elements of the group
+		end := groupLength + 4
+		for pos := end; pos < len(out); {
+			el, err := d.enc.readElement(out, pos)
+			if err != nil || el.tag>>16 != dicomPrivateGroup {
+				break
+			}
+			pos = el.end
+			end = pos
+		}
+		d.enc.order.PutUint32(out[groupLength:], uint32(end-groupLength-4))
+	}
+	return out, nil
+}
+
+// header returns an element with its header in the data set encoding
+func (enc dicomEncoding) header(tag uint32, vr string, length int, value []byte) []byte {
+	var b []byte
+	b = enc.order.AppendUint16(b, uint16(tag>>16))
+	b = enc.order.AppendUint16(b, uint16(tag))
+	switch {
+	case !enc.explicit:
+		b = enc.order.AppendUint32(b, uint32(length))
+	case vr == "OB":
+		b = append(b, vr...)
+		b = append(b, 0, 0)
+		b = enc.order.AppendUint32(b, uint32(length))
+	default:
+		b = append(b, vr...)
+		b = enc.order.AppendUint16(b, uint16(length))
+	}
+	return append(b, value...)
+}
+
+// dicomPixels describes the native pixel data samples carrying the payload
+type dicomPixels struct {
+	samples []byte // the pixel data value, 16-bit samples
+	order   dicomByteOrder
+	lowBit  int // bit of the sample word holding the lowest stored bit
+	stored  int
+	signed  bool
+	avoid   []int // stored values whose lowest bit must not change, halved
+}
+
+// pixels finds the native 16-bit pixel data. Samples equal to the pixel padding value or
+// the smallest and largest pixel values declared in the data set, ignoring their lowest
+// bit, are skipped, so those values keep their meaning and their range stays valid.
+func (d *dicomFile) pixels() (*dicomPixels, error) {
+	el, ok := d.find(dicomPixelData)
+	if !ok {
+		return nil, errors.New("dicom file has no pixel data")
+	}
+	if el.undefined {
+		return nil, fmt.Errorf("dicom lsb mode needs native pixel data, transfer syntax %s is compressed; use %s mode",
+			d.syntax, DICOMModePrivate)
+	}
+
+	allocated, ok1 := d.uint16Value(dicomBitsAllocated)
+	stored, ok2 := d.uint16Value(dicomBitsStored)
+	high, ok3 := d.uint16Value(dicomHighBit)
+	signed, _ := d.uint16Value(dicomPixelSigned)
+	if !ok1 || !ok2 || !ok3 {
+		return nil, errors.New("dicom file has no pixel description (bits allocated, bits stored, high bit)")
+	}
+	if allocated != 16 || stored < 1 || stored > 16 || high >= 16 || high+1 < stored {
+		return nil, fmt.Errorf("dicom lsb mode needs 12 to 16-bit samples in 16 allocated bits, got %d bits in %d; use %s mode",
+			stored, allocated, DICOMModePrivate)
+	}
+
+	p := &dicomPixels{
+		samples: d.dataset[el.value:el.end],
+		order:   d.enc.order,
+		lowBit:  int(high + 1 - stored),
+		stored:  int(stored),
+		signed:  signed == 1,
+	}
+	for _, tag := range []uint32{dicomPixelPadding, dicomSmallestPixel, dicomLargestPixel} {
+		if v, ok := d.uint16Value(tag); ok {
+			value := int(v)
+			if p.signed {
+				value = int(int16(v))
+			}
+			p.avoid = append(p.avoid, value>>1)
+		}
+	}
+	return p, nil
+}
+
+// offset returns where the pixel data value of d sits in a rewritten data set. Only the
+// private group, which comes before the pixel data, changes size.
+func (p *dicomPixels) offset(d *dicomFile, dataset []byte) int {
+	el, _ := d.find(dicomPixelData)
+	return el.value + len(dataset) - len(d.dataset)
+}
+
+// usable reports whether the i-th sample carries a bit
+func (p *dicomPixels) usable(i int) bool {
+	if len(p.avoid) == 0 {
+		return true
+	}
+	v := int(p.order.Uint16(p.samples[2*i:])>>p.lowBit) & (1<<p.stored - 1)
+	if p.signed && v >= 1<<(p.stored-1) {
+		v -= 1 << p.stored
+	}
+	for _, a := range p.avoid {
+		if v>>1 == a {
+			return false
+		}
+	}
+	return true
+}
+
+// estimate reports the capacity of the usable samples
+func (p *dicomPixels) estimate() CapacityEstimate {
+	usable := 0
+	for i := 0; i < len(p.samples)/2; i++ {
+		if p.usable(i) {
+			usable++
+		}
+	}
+	return newEstimate("dicom", DICOMModeLSB, usable/8, fmt.Sprintf(
+		"1 bit in the lowest stored bit (bit %d) of %d of the %d pixel samples, "+
+			"samples at the padding and smallest/largest pixel values are skipped",
+		p.lowBit, usable, len(p.samples)/2))
+}
+
+// embed writes bits in the lowest stored bit of the usable samples of dst, the pixel data
+// value of the rewritten data set
+func (p *dicomPixels) embed(dst []byte, bits []uint8) {
+	for i := 0; i < len(p.samples)/2 && len(bits) > 0; i++ {
+		if !p.usable(i) {
+			continue
+		}
+		word := p.order.Uint16(dst[2*i:])&^(1<<p.lowBit) | uint16(bits[0])<<p.lowBit
+		p.order.PutUint16(dst[2*i:], word)
+		bits = bits[1:]
+	}
+}
+
+// extract reads the payload back from the lowest stored bit of the usable samples
+func (p *dicomPixels) extract() ([]byte, error) {
+	var bits []uint8
+	for i := 0; i < len(p.samples)/2; i++ {
+		if p.usable(i) {
+			bits = append(bits, uint8(p.order.Uint16(p.samples[2*i:])>>p.lowBit&1))
+		}
+	}
+	return parseHeaderedData(bitsToBytes(bits))
+}
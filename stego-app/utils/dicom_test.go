@@ -0,0 +1,254 @@
+package utils
+
+import (
+	"bytes"
+	"compress/flate"
+	"encoding/binary"
+	"testing"
+)
+
+// testDICOMElement encodes an element in enc, with the 32-bit length of the long VRs
+func testDICOMElement(enc dicomEncoding, tag uint32, vr string, value []byte) []byte {
+	var b []byte
+	b = enc.order.AppendUint16(b, uint16(tag>>16))
+	b = enc.order.AppendUint16(b, uint16(tag))
+	switch {
+	case !enc.explicit:
+		b = enc.order.AppendUint32(b, uint32(len(value)))
+	case vr == "OB" || vr == "OW" || vr == "SQ" || vr == "UN":
+		b = append(b, vr...)
+		b = append(b, 0, 0)
+		b = enc.order.AppendUint32(b, uint32(len(value)))
+	default:
+		b = append(b, vr...)
+		b = enc.order.AppendUint16(b, uint16(len(value)))
+	}
+	return append(b, value...)
+}
+
+// testDICOMUS encodes a US element
+func testDICOMUS(enc dicomEncoding, tag uint32, v uint16) []byte {
+	return testDICOMElement(enc, tag, "US", enc.order.AppendUint16(nil, v))
+}
+
+// testDICOMSyntaxes are the transfer syntaxes with their data set encoding
+var testDICOMSyntaxes = map[string]dicomEncoding{
+	"1.2.840.10008.1.2.1": {explicit: true, order: binary.LittleEndian},
+	dicomImplicitLE:       {order: binary.LittleEndian},
+	dicomExplicitBE:       {explicit: true, order: binary.BigEndian},
+	dicomDeflatedLE:       {explicit: true, order: binary.LittleEndian},
+}
+
+// testDICOM builds a CT-like file with 64x64 samples of stored bits, the lowest at bit
+// high+1-stored, a pixel padding value and another private block in group 0009.
+// pixelData replaces the native pixel data element when set.
+func testDICOM(syntax string, stored, high uint16, pixelData []byte) []byte {
+	meta := dicomEncoding{explicit: true, order: binary.LittleEndian}
+	uid := []byte(syntax)
+	if len(uid)%2 == 1 {
+		uid = append(uid, 0)
+	}
+	group := testDICOMElement(meta, 0x00020001, "OB", []byte{0, 1})
+	group = append(group, testDICOMElement(meta, dicomTransferSyntax, "UI", uid)...)
+	out := append(make([]byte, 128), "DICM"...)
+	out = append(out, testDICOMElement(meta, 0x00020000, "UL", binary.LittleEndian.AppendUint32(nil, uint32(len(group))))...)
+	out = append(out, group...)
+
+	enc, ok := testDICOMSyntaxes[syntax]
+	if !ok {
+		enc = testDICOMSyntaxes["1.2.840.10008.1.2.1"] // compressed syntaxes
+	}
+	privateGroup := testDICOMElement(enc, 0x00090010, "LO", []byte("OTHER "))
+	privateGroup = append(privateGroup, testDICOMElement(enc, 0x00091000, "LO", []byte("kept"))...)
+	var ds []byte
+	ds = append(ds, testDICOMElement(enc, 0x00080060, "CS", []byte("CT"))...)
+	ds = append(ds, testDICOMElement(enc, 0x00090000, "UL", enc.order.AppendUint32(nil, uint32(len(privateGroup))))...)
+	ds = append(ds, privateGroup...)
+	ds = append(ds, testDICOMUS(enc, dicomBitsAllocated, 16)...)
+	ds = append(ds, testDICOMUS(enc, dicomBitsStored, stored)...)
+	ds = append(ds, testDICOMUS(enc, dicomHighBit, high)...)
+	ds = append(ds, testDICOMUS(enc, dicomPixelSigned, 0)...)
+	ds = append(ds, testDICOMUS(enc, dicomPixelPadding, 0)...)
+	if pixelData != nil {
+		ds = append(ds, pixelData...)
+	} else {
+		samples := make([]byte, 0, 64*64*2)
+		for i := 0; i < 64*64; i++ {
+			v := uint16(i*7%(1<<stored)) << (high + 1 - stored)
+			if i%10 == 0 {
+				v = 0 // padding
+			}
+			samples = enc.order.AppendUint16(samples, v)
+		}
+		ds = append(ds, testDICOMElement(enc, dicomPixelData, "OW", samples)...)
+	}
+
+	if syntax == dicomDeflatedLE {
+		var z bytes.Buffer
+		w, _ := flate.NewWriter(&z, flate.DefaultCompression)
+		w.Write(ds)
+		w.Close()
+		ds = z.Bytes()
+	}
+	return append(out, ds...)
+}
+
+// checkDICOMPixels checks that only the lowest stored bit of the samples changed, that
+// padding samples are untouched and that the private group length is right
+func checkDICOMPixels(t *testing.T, name string, carrier, out []byte) {
+	t.Helper()
+	a, _ := parseDICOM(carrier)
+	b, err := parseDICOM(out)
+	if err != nil {
+		t.Fatalf("%s: %v", name, err)
+	}
+	pa, _ := a.pixels()
+	pb, err := b.pixels()
+	if err != nil {
+		t.Fatalf("%s: %v", name, err)
+	}
+	for i := 0; i < len(pa.samples)/2; i++ {
+		x, y := pa.order.Uint16(pa.samples[2*i:]), pb.order.Uint16(pb.samples[2*i:])
+		if d := x ^ y; d != 0 && (d != 1<<pa.lowBit || i%10 == 0) {
+			t.Fatalf("%s: sample %d changed from %04X to %04X", name, i, x, y)
+		}
+	}
+
+	groupLength, _ := b.find(0x00090000)
+	end := groupLength.end
+	for _, el := range b.elements {
+		if el.tag>>16 == dicomPrivateGroup {
+			end = el.end
+		}
+	}
+	if got := int(b.enc.order.Uint32(b.dataset[groupLength.value:])); got != end-groupLength.end {
+		t.Fatalf("%s: private group length %d, want %d", name, got, end-groupLength.end)
+	}
+	if kept, ok := b.find(0x00091000); !ok || string(b.dataset[kept.value:kept.end]) != "kept" {
+		t.Fatalf("%s: other private block lost", name)
+	}
+}
+
+func TestDICOMRoundTrip(t *testing.T) {
+	data := bytes.Repeat([]byte("dicom "), 20)
+	for syntax := range testDICOMSyntaxes {
+		for _, bits := range [][2]uint16{{12, 11}, {12, 15}, {16, 15}} {
+			carrier := testDICOM(syntax, bits[0], bits[1], nil)
+			for _, mode := range []string{"", DICOMModeLSB, DICOMModePrivate} {
+				out, err := EmbedDataInDICOM(carrier, data, mode)
+				if err != nil {
+					t.Fatalf("%s %v, %q mode: %v", syntax, bits, mode, err)
+				}
+				got, err := ExtractDataFromDICOM(out)
+				if err != nil || !bytes.Equal(got, data) {
+					t.Fatalf("%s %v, %q mode: got %q, %v", syntax, bits, mode, got, err)
+				}
+				checkDICOMPixels(t, syntax+" "+mode, carrier, out)
+
+				d, _ := parseDICOM(out)
+				if block, _, ok := d.privateBlock(); (mode == DICOMModePrivate) != ok || ok && block != 0x11 {
+					t.Fatalf("%s %v, %q mode: private block %X, %v", syntax, bits, mode, block, ok)
+				}
+				if !bytes.Equal(out[:len(d.meta)], carrier[:len(d.meta)]) {
+					t.Fatalf("%s %v, %q mode: file meta group changed", syntax, bits, mode)
+				}
+			}
+		}
+	}
+}
+
+func TestDICOMReembedAcrossModes(t *testing.T) {
+	for syntax := range testDICOMSyntaxes {
+		carrier := testDICOM(syntax, 12, 11, nil)
+		out := carrier
+		modes := []string{DICOMModePrivate, DICOMModeLSB, DICOMModeLSB, DICOMModePrivate, DICOMModePrivate, DICOMModeLSB}
+		for i, mode := range modes {
+			data := bytes.Repeat([]byte{byte('a' + i)}, 30+5*i)
+			var err error
+			out, err = EmbedDataInDICOM(out, data, mode)
+			if err != nil {
+				t.Fatalf("%s, step %d (%s): %v", syntax, i, mode, err)
+			}
+			got, err := ExtractDataFromDICOM(out)
+			if err != nil || !bytes.Equal(got, data) {
+				t.Fatalf("%s, step %d (%s): got %q, %v", syntax, i, mode, got, err)
+			}
+			checkDICOMPixels(t, syntax, carrier, out)
+			d, _ := parseDICOM(out)
+			if bytes.Count(d.dataset, []byte(dicomPrivateCreator)) > 1 {
+				t.Fatalf("%s, step %d (%s): private block duplicated", syntax, i, mode)
+			}
+		}
+	}
+}
+
+func TestDICOMEncapsulatedPixelData(t *testing.T) {
+	fragments := []byte{0xFE, 0xFF, 0x00, 0xE0, 0, 0, 0, 0} // empty offset table
+	fragments = append(fragments, 0xFE, 0xFF, 0x00, 0xE0, 4, 0, 0, 0, 0xFF, 0xD8, 0xFF, 0xD9)
+	fragments = append(fragments, 0xFE, 0xFF, 0xDD, 0xE0, 0, 0, 0, 0)
+	pixelData := []byte{0xE0, 0x7F, 0x10, 0x00, 'O', 'B', 0, 0, 0xFF, 0xFF, 0xFF, 0xFF}
+	carrier := testDICOM("1.2.840.10008.1.2.4.50", 12, 11, append(pixelData, fragments...))
+
+	if _, err := EmbedDataInDICOM(carrier, []byte("x"), DICOMModeLSB); err == nil {
+		t.Fatal("compressed pixel data accepted in lsb mode")
+	}
+	out, err := EmbedDataInDICOM(carrier, []byte("jpeg"), DICOMModePrivate)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, err := ExtractDataFromDICOM(out); err != nil || string(got) != "jpeg" {
+		t.Fatalf("got %q, %v", got, err)
+	}
+	if !bytes.HasSuffix(out, fragments) {
+		t.Fatal("pixel data fragments changed")
+	}
+}
+
+func TestDICOMMalformed(t *testing.T) {
+	carrier := testDICOM(dicomImplicitLE, 12, 11, nil)
+	estimate, err := EstimateDICOMCapacity(carrier, DICOMModeLSB)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Every tenth sample is padding, and so is 7*3511 % 4096 = 1 when the lowest bit is ignored
+	if estimate.Capacity != (64*64-410-1)/8-8 {
+		t.Fatalf("capacity %d", estimate.Capacity)
+	}
+	if _, err := EmbedDataInDICOM(carrier, make([]byte, estimate.Capacity+1), DICOMModeLSB); err == nil {
+		t.Error("data larger than the capacity accepted")
+	}
+	if _, err := EmbedDataInDICOM(carrier, []byte("x"), "overlay"); err == nil {
+		t.Error("invalid mode accepted")
+	}
+	if _, err := EstimateDICOMCapacity(carrier, "overlay"); err == nil {
+		t.Error("invalid mode estimated")
+	}
+	if _, err := EmbedDataInDICOM(carrier, nil, ""); err == nil {
+		t.Error("empty data accepted")
+	}
+
+	enc := testDICOMSyntaxes[dicomImplicitLE]
+	unterminated := append(bytes.Clone(carrier), testDICOMElement(enc, 0x7FE10010, "", nil)[:4]...)
+	unterminated = append(unterminated, 0xFF, 0xFF, 0xFF, 0xFF)
+	eightBit := bytes.Replace(carrier, testDICOMUS(enc, dicomBitsAllocated, 16), testDICOMUS(enc, dicomBitsAllocated, 8), 1)
+	noSyntax := bytes.Replace(carrier, []byte(dicomImplicitLE+"\x00"), []byte("\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00"), 1)
+	deflated := testDICOM(dicomDeflatedLE, 12, 11, nil)
+	for name, bad := range map[string][]byte{
+		"not dicom":             make([]byte, 200),
+		"truncated":             carrier[:len(carrier)-10],
+		"unterminated sequence": unterminated,
+		"no transfer syntax":    noSyntax,
+		"8-bit samples":         eightBit,
+		"truncated deflate":     deflated[:len(deflated)-100],
+	} {
+		if _, err := EmbedDataInDICOM(bad, []byte("x"), DICOMModeLSB); err == nil {
+			t.Errorf("%s accepted", name)
+		}
+		if _, err := ExtractDataFromDICOM(bad); err == nil {
+			t.Errorf("%s extracted", name)
+		}
+	}
+	if _, err := ExtractDataFromDICOM(carrier); err == nil {
+		t.Error("clean file extracted")
+	}
+}
@@ -0,0 +1,382 @@
+package utils
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"regexp"
+)
+
+// The file carrier appends the payload to any file, like the append fallback of the other
+// carriers, but first finds where the data of common formats really ends. Bytes already
+// present after that point are kept and reported, since the payload then does not follow
+// the format data directly and tools may trip over them.
+
+// FileInfo describes a file carrier
+type FileInfo struct {
+	Format   string // "jpeg", "png", "gif", "pdf", "zip" or "unknown"
+	End      int64  // where the format data ends; the file size for unknown formats
+	Trailing int64  // bytes between End and the payload of an earlier embed or the end of the file
+	Warning  string // set when there are trailing bytes or the format is not recognized
+}
+
+// InspectFile finds the end of the format data of the size byte file read from src.
+// A payload appended by an earlier embed is not counted as trailing data.
+func InspectFile(src io.ReaderAt, size int64) (FileInfo, error) {
+	if size == 0 {
+		return FileInfo{}, errors.New("file data cannot be empty")
+	}
+
+	payloadStart := size
+	if offset, ok := footerOffsetAt(src, size); ok {
+		if _, err := findTrailerAt(src, size); err == nil {
+			payloadStart = offset
+		}
+	}
+
+	head, err := readHead(src, payloadStart)
+	if err != nil {
+		return FileInfo{}, err
+	}
+	info := FileInfo{Format: "unknown", End: payloadStart}
+	var end int64
+	var ok bool
+	switch {
+	case bytes.HasPrefix(head, []byte{0xFF, 0xD8, 0xFF}):
+		info.Format = "jpeg"
+		end, ok = jpegEnd(src, payloadStart)
+	case bytes.HasPrefix(head, []byte("\x89PNG\r\n\x1a\n")):
+		info.Format = "png"
+		end, ok = pngEnd(src, payloadStart)
+	case bytes.HasPrefix(head, []byte("GIF87a")) || bytes.HasPrefix(head, []byte("GIF89a")):
+		info.Format = "gif"
+		end, ok = gifEnd(src, payloadStart)
+	case IsPDF(head):
+		info.Format = "pdf"
+		end, ok = pdfFileEnd(src, payloadStart)
+	case IsZIP(head):
+		info.Format = "zip"
+		end, ok = zipEnd(src, payloadStart)
+	default:
+		info.Warning = "file format not recognized, the payload is appended after the last byte"
+		return info, nil
+	}
+	if !ok {
+		info.Warning = fmt.Sprintf("end of the %s data not found, the payload is appended after the last byte", info.Format)
+		return info, nil
+	}
+
+	info.End = end
+	info.Trailing = payloadStart - end
+	if info.Trailing > 0 {
+		info.Warning = fmt.Sprintf("%d bytes of other data found after the end of the %s data at offset %d; "+
+			"they are kept and the payload is appended after them", info.Trailing, info.Format, end)
+	}
+	return info, nil
+}
+
+// EmbedDataInFile appends data to any file
+func EmbedDataInFile(fileData []byte, data []byte) ([]byte, FileInfo, error) {
+	var out bytes.Buffer
+	info, err := EmbedDataInFileStream(bytes.NewReader(fileData), int64(len(fileData)), data, &out)
+	if err != nil {
+		return nil, info, err
+	}
+	return out.Bytes(), info, nil
+}
+
+// EmbedDataInFileStream is EmbedDataInFile reading the size byte file from src and writing to dst.
+// A payload of an earlier embed is replaced; other trailing data is kept and reported in the FileInfo.
+func EmbedDataInFileStream(src io.ReaderAt, size int64, data []byte, dst io.Writer) (FileInfo, error) {
+	info, err := InspectFile(src, size)
+	if err != nil {
+		return info, err
+	}
+	return info, appendPayload(src, info.End+info.Trailing, data, dst)
+}
+
+// ExtractDataFromFile extracts data appended to any file
+func ExtractDataFromFile(fileData []byte) ([]byte, error) {
+	return ExtractDataFromFileStream(bytes.NewReader(fileData), int64(len(fileData)))
+}
+
+// ExtractDataFromFileStream is ExtractDataFromFile for the size byte file read from src
+func ExtractDataFromFileStream(src io.ReaderAt, size int64) ([]byte, error) {
+	if size == 0 {
+		return nil, errors.New("file data cannot be empty")
+	}
+
+	data, err := extractTrailerAt(src, size)
+	if errors.Is(err, errNoTrailer) {
+		return nil, errors.New("no embedded data found in file")
+	}
+	return data, err
+}
+
+// EstimateFileCapacityStream is EstimateFileCapacity for the size byte file read from src
+func EstimateFileCapacityStream(src io.ReaderAt, size int64) (CapacityEstimate, error) {
+	info, err := InspectFile(src, size)
+	if err != nil {
+		return CapacityEstimate{}, err
+	}
+	estimate := newEstimate(info.Format, "append", math.MaxInt32, fmt.Sprintf(
+		"payload is appended after the %s data ending at offset %d, so only the payload size limit applies",
+		info.Format, info.End))
+	estimate.Warning = info.Warning
+	return estimate, nil
+}
+
+// fileScanner reads a file sequentially, keeping track of the position
+type fileScanner struct {
+	r   *bufio.Reader
+	pos int64
+}
+
+func newFileScanner(src io.ReaderAt, start, end int64) *fileScanner {
+	return &fileScanner{r: bufio.NewReaderSize(io.NewSectionReader(src, start, end-start), 64*1024), pos: start}
+}
+
+func (s *fileScanner) readByte() (byte, error) {
+	b, err := s.r.ReadByte()
+	if err == nil {
+		s.pos++
+	}
+	return b, err
+}
+
+func (s *fileScanner) skip(n int64) error {
+	skipped, err := s.r.Discard(int(n))
+	s.pos += int64(skipped)
+	return err
+}
+
+// jpegEnd walks the JPEG segments and entropy-coded data to the end of the EOI marker
+func jpegEnd(src io.ReaderAt, size int64) (int64, bool) {
+	s := newFileScanner(src, 2, size)
+	marker := false // the 0xFF of the next marker was already read
+	for {
+		if !marker {
+			if b, err := s.readByte(); err != nil || b != 0xFF {
+				return 0, false
+			}
+		}
+		marker = false
+		code := byte(0xFF)
+		var err error
+		for code == 0xFF { // fill bytes
+			if code, err = s.readByte(); err != nil {
+				return 0, false
+			}
+		}
+
+		switch {
+		case code == 0xD9:
+			return s.pos, true
+		case code >= 0xD0 && code <= 0xD7, code == 0x01:
+			continue // no length
+		}
+		hi, err1 := s.readByte()
+		lo, err2 := s.readByte()
+		length := int64(hi)<<8 | int64(lo)
+		if err1 != nil || err2 != nil || length < 2 || s.skip(length-2) != nil {
+			return 0, false
+		}
+		if code != 0xDA {
+			continue
+		}
+
+		// Entropy-coded data after SOS runs to the next marker other than a stuffed
+		// zero or a restart marker
+		for !marker {
+			b, err := s.readByte()
+			if err != nil {
+				return 0, false
+			}
+			if b != 0xFF {
+				continue
+			}
+			next, err := s.r.Peek(1)
+			if err != nil {
+				return 0, false
+			}
+			if next[0] == 0x00 || next[0] >= 0xD0 && next[0] <= 0xD7 {
+				s.skip(1)
+				continue
+			}
+			marker = true
+		}
+	}
+}
+
+// pngEnd walks the PNG chunks to the end of the IEND chunk
+func pngEnd(src io.ReaderAt, size int64) (int64, bool) {
+	header := make([]byte, 8)
+	for offset := int64(8); offset+12 <= size; {
+		if _, err := src.ReadAt(header, offset); err != nil {
+			return 0, false
+		}
+		next := offset + 12 + int64(binary.BigEndian.Uint32(header[0:4]))
+		if string(header[4:8]) == "IEND" {
+			return next, next <= size
+		}
+		offset = next
+	}
+	return 0, false
+}
+
+// gifEnd walks the GIF blocks to the end of the trailer byte
+func gifEnd(src io.ReaderAt, size int64) (int64, bool) {
+	s := newFileScanner(src, 0, size)
+	header := make([]byte, 13)
+	if _, err := io.ReadFull(s.r, header); err != nil {
+		return 0, false
+	}
+	s.pos = 13
+	if header[10]&0x80 != 0 {
+		if s.skip(3<<(header[10]&0x07+1)) != nil {
+			return 0, false
+		}
+	}
+
+	subBlocks := func() bool {
+		for {
+			n, err := s.readByte()
+			if err != nil {
+				return false
+			}
+			if n == 0 {
+				return true
+			}
+			if s.skip(int64(n)) != nil {
+				return false
+			}
+		}
+	}
+
+	for {
+		b, err := s.readByte()
+		if err != nil {
+			return 0, false
+		}
+		switch b {
+		case 0x3B:
+			return s.pos, true
+		case 0x21: // extension: label and sub-blocks
+			if _, err := s.readByte(); err != nil || !subBlocks() {
+				return 0, false
+			}
+		case 0x2C: // image descriptor, local color table, LZW code size and sub-blocks
+			desc := make([]byte, 9)
+			if _, err := io.ReadFull(s.r, desc); err != nil {
+				return 0, false
+			}
+			s.pos += 9
+			if desc[8]&0x80 != 0 {
+				if s.skip(3<<(desc[8]&0x07+1)) != nil {
+					return 0, false
+				}
+			}
+			if _, err := s.readByte(); err != nil || !subBlocks() {
+				return 0, false
+			}
+		default:
+			return 0, false
+		}
+	}
+}
+
+// pdfStartxrefPattern matches the startxref offset right before a %%EOF marker
+var pdfStartxrefPattern = regexp.MustCompile(`startxref\s+\d+\s*$`)
+
+// pdfFileEnd returns the end of the last %%EOF marker and its line ending. Incremental
+// updates each end with a marker, so only the last one counts; a marker must follow a
+// startxref offset to count, which skips markers in data appended after the file.
+func pdfFileEnd(src io.ReaderAt, size int64) (int64, bool) {
+	for end := size; end > 0; {
+		i := lastIndexAt(src, end, []byte("%%EOF"))
+		if i < 0 {
+			return 0, false
+		}
+		end = i + 4
+
+		around, err := readRange(src, int(max(0, i-64)), int(min(size, i+8)))
+		if err != nil {
+			return 0, false
+		}
+		marker := int(i - max(0, i-64))
+		if !pdfStartxrefPattern.Match(around[:marker]) {
+			continue
+		}
+		eof, _ := pdfEOFEnd(around, marker)
+		return max(0, i-64) + int64(eof), true
+	}
+	return 0, false
+}
+
+// zipEnd finds the end of central directory record whose central directory ends right
+// before it, and returns the end of its comment
+func zipEnd(src io.ReaderAt, size int64) (int64, bool) {
+	record := make([]byte, 22)
+	for end := size; end > 0; {
+		i := lastIndexAt(src, end, []byte("PK\x05\x06"))
+		if i < 0 {
+			return 0, false
+		}
+		end = i + 3 // continue before this candidate if it does not check out
+
+		if _, err := src.ReadAt(record, i); err != nil && err != io.EOF {
+			continue
+		}
+		recordEnd := i + 22 + int64(binary.LittleEndian.Uint16(record[20:22]))
+		if recordEnd > size {
+			continue
+		}
+		cdSize := int64(binary.LittleEndian.Uint32(record[12:16]))
+		cdOffset := int64(binary.LittleEndian.Uint32(record[16:20]))
+		if cdOffset == 0xFFFFFFFF || cdSize == 0xFFFFFFFF {
+			// ZIP64: the locator sits right before the record
+			locator := make([]byte, 4)
+			if i >= 20 {
+				if _, err := src.ReadAt(locator, i-20); err == nil && string(locator) == "PK\x06\x07" {
+					return recordEnd, true
+				}
+			}
+			continue
+		}
+		if cdOffset+cdSize > i {
+			continue
+		}
+		if cdSize == 0 {
+			return recordEnd, true
+		}
+		sig := make([]byte, 4)
+		// Archives with data in front (self-extractors) have their offsets shifted by it
+		base := i - cdSize - cdOffset
+		if _, err := src.ReadAt(sig, base+cdOffset); err == nil && string(sig) == "PK\x01\x02" {
+			return recordEnd, true
+		}
+	}
+	return 0, false
+}
+
+// lastIndexAt returns the offset of the last sep that ends before end, or -1
+func lastIndexAt(src io.ReaderAt, end int64, sep []byte) int64 {
+	const chunk = 64 * 1024
+	buf := make([]byte, chunk+len(sep)-1)
+	for start := end; start > 0; {
+		from := max(0, start-chunk)
+		window := buf[:min(int64(len(buf)), end-from)]
+		if _, err := src.ReadAt(window, from); err != nil && err != io.EOF {
+			return -1
+		}
+		if i := bytes.LastIndex(window, sep); i >= 0 {
+			return from + int64(i)
+		}
+		start = from
+	}
+	return -1
+}
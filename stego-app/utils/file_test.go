@@ -0,0 +1,137 @@
+package utils
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image"
+	"image/color"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	"testing"
+)
+
+// testFileImage is a small gradient encoded by the image packages
+var testFileImage = func() image.Image {
+	img := image.NewPaletted(image.Rect(0, 0, 32, 32), color.Palette{color.Black, color.White, color.Gray{0x80}})
+	for y := 0; y < 32; y++ {
+		for x := 0; x < 32; x++ {
+			img.SetColorIndex(x, y, uint8((x+y)%3))
+		}
+	}
+	return img
+}()
+
+// testFiles are carriers of each recognized format
+func testFiles() map[string][]byte {
+	var jpg, pngData, gifData bytes.Buffer
+	jpeg.Encode(&jpg, testFileImage, nil)
+	png.Encode(&pngData, testFileImage)
+	gif.Encode(&gifData, testFileImage, nil)
+	return map[string][]byte{
+		"jpeg": jpg.Bytes(),
+		"png":  pngData.Bytes(),
+		"gif":  gifData.Bytes(),
+		"pdf":  testPDFUpdate(testPDF(false, false, "")),
+		"zip":  testZIP("comment", "a.txt", "hello"),
+	}
+}
+
+func TestInspectFile(t *testing.T) {
+	for format, carrier := range testFiles() {
+		info, err := InspectFile(bytes.NewReader(carrier), int64(len(carrier)))
+		if err != nil || info.Format != format || info.End != int64(len(carrier)) || info.Trailing != 0 || info.Warning != "" {
+			t.Fatalf("%s: %+v, %v", format, info, err)
+		}
+
+		// Trailing bytes are found, also behind a payload of an earlier embed
+		trailing := append(bytes.Clone(carrier), "trailing data"...)
+		out, _, err := EmbedDataInFile(trailing, []byte("payload"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, data := range [][]byte{trailing, out} {
+			info, err = InspectFile(bytes.NewReader(data), int64(len(data)))
+			if err != nil || info.Format != format || info.End != int64(len(carrier)) || info.Trailing != 13 || info.Warning == "" {
+				t.Fatalf("%s: %+v, %v", format, info, err)
+			}
+		}
+	}
+}
+
+func TestFileRoundTrip(t *testing.T) {
+	carriers := testFiles()
+	carriers["unknown"] = []byte("plain text file")
+	for name, carrier := range carriers {
+		out := carrier
+		for _, data := range []string{"first payload", "second", "the third payload"} {
+			var err error
+			out, _, err = EmbedDataInFile(out, []byte(data))
+			if err != nil {
+				t.Fatalf("%s: %v", name, err)
+			}
+			if got, err := ExtractDataFromFile(out); err != nil || string(got) != data {
+				t.Fatalf("%s: got %q, %v", name, got, err)
+			}
+			// A payload of an earlier embed is replaced
+			if len(out) != len(carrier)+8+len(data)+FooterSize || !bytes.HasPrefix(out, carrier) {
+				t.Fatalf("%s: %d bytes after embedding %q", name, len(out), data)
+			}
+		}
+	}
+
+	estimate, err := EstimateFileCapacity([]byte("plain text file"))
+	if err != nil || estimate.Format != "unknown" || estimate.Warning == "" {
+		t.Fatalf("estimate %+v, %v", estimate, err)
+	}
+}
+
+func TestFileFooter(t *testing.T) {
+	carrier := testFiles()["png"]
+	out, _, _ := EmbedDataInFile(carrier, []byte("footer"))
+
+	corrupt := bytes.Clone(out)
+	corrupt[len(carrier)+9] ^= 1
+	if _, err := ExtractDataFromFile(corrupt); err == nil {
+		t.Error("payload with a bad checksum extracted")
+	}
+	badOffset := bytes.Clone(out)
+	binary.LittleEndian.PutUint64(badOffset[len(out)-FooterSize+8:], uint64(len(out)))
+	if _, err := ExtractDataFromFile(badOffset); err == nil {
+		t.Error("footer pointing past the file accepted")
+	}
+	version := bytes.Clone(out)
+	version[len(out)-FooterSize+4] = 2
+	if _, err := ExtractDataFromFile(version); err == nil {
+		t.Error("unknown footer version accepted")
+	}
+
+	// Files written before the footer existed end with the payload
+	legacy := append(bytes.Clone(carrier), prepareDataWithHeader([]byte("legacy"))...)
+	if got, err := ExtractDataFromFile(legacy); err != nil || string(got) != "legacy" {
+		t.Fatalf("got %q, %v", got, err)
+	}
+	if _, err := ExtractDataFromFile(append(legacy, "more"...)); err == nil {
+		t.Error("payload header inside the file extracted")
+	}
+}
+
+func TestFileMalformed(t *testing.T) {
+	if _, _, err := EmbedDataInFile(nil, []byte("x")); err == nil {
+		t.Error("empty file accepted")
+	}
+	if _, _, err := EmbedDataInFile([]byte("file"), nil); err == nil {
+		t.Error("empty data accepted")
+	}
+	if _, err := ExtractDataFromFile([]byte("clean file")); err == nil {
+		t.Error("clean file extracted")
+	}
+	// A pdf cut in its last update ends at the %%EOF of the revision before
+	for format, carrier := range testFiles() {
+		truncated := carrier[:len(carrier)-2]
+		info, err := InspectFile(bytes.NewReader(truncated), int64(len(truncated)))
+		if err != nil || info.Format != format || info.End+info.Trailing != int64(len(truncated)) || info.Warning == "" {
+			t.Errorf("%s truncated: %+v, %v", format, info, err)
+		}
+	}
+}
@@ -0,0 +1,176 @@
+package utils
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+// FLAC metadata block types (see https://xiph.org/flac/format.html)
+const (
+	flacBlockStreamInfo  = 0
+	flacBlockPadding     = 1
+	flacBlockApplication = 2
+
+	// Maximum length of a single metadata block body (24-bit length field)
+	flacMaxBlockLength = 1<<24 - 1
+)
+
+// flacMarker is the stream marker every FLAC file starts with
+var flacMarker = []byte("fLaC")
+
+// flacApplicationID identifies the APPLICATION block that carries our payload
+var flacApplicationID = []byte("SGAP")
+
+// flacBlock is a single metadata block of a FLAC stream
+type flacBlock struct {
+	Type byte
+	Body []byte
+}
+
+// IsFLAC reports whether data looks like a FLAC stream (optionally behind an ID3v2 tag)
+func IsFLAC(data []byte) bool {
+	start := skipID3v2(data)
+	return bytes.HasPrefix(data[start:], flacMarker)
+}
+
+// EmbedDataInFLAC stores data in an APPLICATION metadata block of a FLAC file.
+// Audio frames are copied untouched, so the STREAMINFO MD5 keeps matching the samples.
+func EmbedDataInFLAC(flacData []byte, data []byte) ([]byte, error) {
+	if len(data) == 0 {
+		return nil, errors.New("data to embed cannot be empty")
+	}
+
+	if len(data) > MaxDataSize {
+		return nil, fmt.Errorf("data too large: %d bytes, max allowed: %d bytes", len(data), MaxDataSize)
+	}
+
+	prefix, blocks, frames, err := parseFLAC(flacData)
+	if err != nil {
+		return nil, err
+	}
+
+	body := make([]byte, 0, len(flacApplicationID)+len(data)+8)
+	body = append(body, flacApplicationID...)
+	body = append(body, prepareDataWithHeader(data)...)
+	if len(body) > flacMaxBlockLength {
+		return nil, fmt.Errorf("data too large for a FLAC metadata block: %d bytes", len(body))
+	}
+
+	// Drop a payload left by a previous embed and place the new one right after STREAMINFO
+	var newBlocks []flacBlock
+	for _, b := range blocks {
+		if isPayloadApplicationBlock(b) {
+			continue
+		}
+		newBlocks = append(newBlocks, b)
+	}
+	newBlocks = append(newBlocks[:1], append([]flacBlock{{Type: flacBlockApplication, Body: body}}, newBlocks[1:]...)...)
+
+	// Take the space out of an existing PADDING block when it is large enough,
+	// which keeps the overall file size the same as the original
+	for i := range newBlocks {
+		if newBlocks[i].Type == flacBlockPadding && len(newBlocks[i].Body) >= len(body)+4 {
+			newBlocks[i].Body = newBlocks[i].Body[:len(newBlocks[i].Body)-len(body)-4]
+			break
+		}
+	}
+
+	var buf bytes.Buffer
+	buf.Grow(len(flacData) + len(body) + 4)
+	buf.Write(prefix)
+	buf.Write(flacMarker)
+	for i, b := range newBlocks {
+		header := b.Type & 0x7F
+		if i == len(newBlocks)-1 {
+			header |= 0x80
+		}
+		buf.WriteByte(header)
+		buf.Write([]byte{byte(len(b.Body) >> 16), byte(len(b.Body) >> 8), byte(len(b.Body))})
+		buf.Write(b.Body)
+	}
+	buf.Write(frames)
+
+	return buf.Bytes(), nil
+}
+
+// ExtractDataFromFLAC extracts data stored by EmbedDataInFLAC
+func ExtractDataFromFLAC(flacData []byte) ([]byte, error) {
+	_, blocks, _, err := parseFLAC(flacData)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, b := range blocks {
+		if !isPayloadApplicationBlock(b) {
+			continue
+		}
+		payload := b.Body[len(flacApplicationID):]
+		if len(payload) < 8 || binary.LittleEndian.Uint32(payload[:4]) != MagicNumber {
+			continue
+		}
+		dataLength := binary.LittleEndian.Uint32(payload[4:8])
+		if dataLength == 0 || dataLength > MaxDataSize || int(dataLength) > len(payload)-8 {
+			return nil, errors.New("corrupted flac payload block")
+		}
+		return payload[8 : 8+int(dataLength)], nil
+	}
+
+	return nil, errors.New("no embedded data found in flac")
+}
+
+// parseFLAC splits a FLAC file into the bytes before the marker (ID3v2 tag),
+// its metadata blocks and the remaining audio frames
+func parseFLAC(data []byte) ([]byte, []flacBlock, []byte, error) {
+	start := skipID3v2(data)
+	if !bytes.HasPrefix(data[start:], flacMarker) {
+		return nil, nil, nil, errors.New("not a flac file")
+	}
+
+	pos := start + len(flacMarker)
+	var blocks []flacBlock
+	for {
+		if pos+4 > len(data) {
+			return nil, nil, nil, errors.New("truncated flac metadata block header")
+		}
+		header := data[pos]
+		length := int(data[pos+1])<<16 | int(data[pos+2])<<8 | int(data[pos+3])
+		pos += 4
+		if pos+length > len(data) {
+			return nil, nil, nil, errors.New("truncated flac metadata block")
+		}
+		blocks = append(blocks, flacBlock{Type: header & 0x7F, Body: data[pos : pos+length]})
+		pos += length
+		if header&0x80 != 0 {
+			break
+		}
+	}
+
+	if blocks[0].Type != flacBlockStreamInfo {
+		return nil, nil, nil, errors.New("flac stream does not start with STREAMINFO")
+	}
+
+	return data[:start], blocks, data[pos:], nil
+}
+
+// isPayloadApplicationBlock reports whether b is an APPLICATION block written by EmbedDataInFLAC
+func isPayloadApplicationBlock(b flacBlock) bool {
+	return b.Type == flacBlockApplication && bytes.HasPrefix(b.Body, flacApplicationID)
+}
+
+// skipID3v2 returns the offset just past a leading ID3v2 tag, or 0 if there is none
+func skipID3v2(data []byte) int {
+	if len(data) < 10 || !bytes.HasPrefix(data, []byte("ID3")) {
+		return 0
+	}
+	size := int(data[6]&0x7F)<<21 | int(data[7]&0x7F)<<14 | int(data[8]&0x7F)<<7 | int(data[9]&0x7F)
+	end := 10 + size
+	if data[5]&0x10 != 0 { // footer present
+		end += 10
+	}
+	if end > len(data) {
+		return 0
+	}
+	return end
+}
@@ -0,0 +1,119 @@
+package utils
+
+import (
+	"bytes"
+	"testing"
+)
+
+// testFLAC builds a FLAC stream with STREAMINFO, the given blocks and fake audio frames
+func testFLAC(blocks ...flacBlock) []byte {
+	blocks = append([]flacBlock{{Type: flacBlockStreamInfo, Body: bytes.Repeat([]byte{0x5A}, 34)}}, blocks...)
+	out := bytes.Clone(flacMarker)
+	for i, b := range blocks {
+		header := b.Type
+		if i == len(blocks)-1 {
+			header |= 0x80
+		}
+		out = append(out, header, byte(len(b.Body)>>16), byte(len(b.Body)>>8), byte(len(b.Body)))
+		out = append(out, b.Body...)
+	}
+	return append(out, testFLACFrames...)
+}
+
+var testFLACFrames = append([]byte{0xFF, 0xF8}, bytes.Repeat([]byte("audio frame "), 20)...)
+
+func TestFLACRoundTrip(t *testing.T) {
+	id3 := append([]byte("ID3\x04\x00\x00\x00\x00\x00\x05"), "TAG12"...)
+	carriers := map[string][]byte{
+		"streaminfo only": testFLAC(),
+		"vorbis comment":  testFLAC(flacBlock{Type: 4, Body: []byte("comment")}),
+		"small padding":   testFLAC(flacBlock{Type: flacBlockPadding, Body: make([]byte, 10)}),
+		"id3":             append(id3, testFLAC()...),
+	}
+	data := []byte("flac payload")
+	for name, carrier := range carriers {
+		out, err := EmbedDataInFLAC(carrier, data)
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		got, err := ExtractDataFromFLAC(out)
+		if err != nil || !bytes.Equal(got, data) {
+			t.Fatalf("%s: got %q, %v", name, got, err)
+		}
+		if !bytes.HasSuffix(out, testFLACFrames) {
+			t.Fatalf("%s: audio frames changed", name)
+		}
+		if _, blocks, _, err := parseFLAC(out); err != nil || blocks[0].Type != flacBlockStreamInfo {
+			t.Fatalf("%s: STREAMINFO is not first, %v", name, err)
+		}
+	}
+}
+
+func TestFLACPaddingKeepsSize(t *testing.T) {
+	carrier := testFLAC(flacBlock{Type: flacBlockPadding, Body: make([]byte, 200)})
+	out, err := EmbedDataInFLAC(carrier, []byte("fits in the padding"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(out) != len(carrier) {
+		t.Fatalf("size changed from %d to %d", len(carrier), len(out))
+	}
+}
+
+func TestFLACReembed(t *testing.T) {
+	out := testFLAC(flacBlock{Type: flacBlockApplication, Body: []byte("riffxxxx")})
+	for _, data := range []string{"first payload", "second", "third, the longest payload of all"} {
+		var err error
+		out, err = EmbedDataInFLAC(out, []byte(data))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got, err := ExtractDataFromFLAC(out); err != nil || string(got) != data {
+			t.Fatalf("got %q, %v", got, err)
+		}
+	}
+	_, blocks, _, _ := parseFLAC(out)
+	payloads, others := 0, 0
+	for _, b := range blocks {
+		if isPayloadApplicationBlock(b) {
+			payloads++
+		} else if b.Type == flacBlockApplication {
+			others++
+		}
+	}
+	if payloads != 1 || others != 1 {
+		t.Fatalf("%d payload blocks and %d other application blocks", payloads, others)
+	}
+}
+
+func TestFLACMalformed(t *testing.T) {
+	carrier := testFLAC()
+	noStreamInfo := bytes.Clone(carrier)
+	noStreamInfo[4] = 0x80 | flacBlockPadding
+	corrupt, _ := EmbedDataInFLAC(carrier, []byte("payload"))
+	at := bytes.Index(corrupt, flacApplicationID) + len(flacApplicationID) + 4
+	corrupt[at] = 0xFF
+
+	for name, bad := range map[string][]byte{
+		"not flac":         []byte("OggS not flac"),
+		"truncated header": carrier[:6],
+		"truncated block":  carrier[:20],
+		"no streaminfo":    noStreamInfo,
+	} {
+		if _, err := EmbedDataInFLAC(bad, []byte("x")); err == nil {
+			t.Errorf("%s accepted", name)
+		}
+		if _, err := ExtractDataFromFLAC(bad); err == nil {
+			t.Errorf("%s extracted", name)
+		}
+	}
+	if _, err := ExtractDataFromFLAC(corrupt); err == nil {
+		t.Error("corrupt payload length extracted")
+	}
+	if _, err := EmbedDataInFLAC(carrier, nil); err == nil {
+		t.Error("empty data accepted")
+	}
+	if _, err := ExtractDataFromFLAC(carrier); err == nil {
+		t.Error("clean file extracted")
+	}
+}
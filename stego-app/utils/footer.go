@@ -0,0 +1,128 @@
+package utils
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"io"
+)
+
+// Appended payloads end with a fixed-size footer so extraction reads the last
+// FooterSize bytes instead of scanning backwards for the magic number:
+//
+//	0  "SGFT"
+//	4  version (1), 3 reserved bytes
+//	8  uint64 offset of the payload header in the file
+//	16 uint32 payload length
+//	20 first 16 bytes of SHA-256 over bytes 0-19 and the payload
+//	36 "SGFT"
+//
+// The hash is an unkeyed checksum: it catches corruption and stray footer-like bytes, not
+// forgery. The payload itself is authenticated by its AES-GCM encryption.
+const (
+	FooterSize    = 40
+	footerMagic   = "SGFT"
+	footerVersion = 1
+)
+
+// errNoTrailer means the file carries neither a footer nor a legacy appended payload
+var errNoTrailer = errors.New("no appended payload found")
+
+// makeTrailer frames data with the payload header and a footer locating it at offset,
+// the size of the carrier it is appended to
+func makeTrailer(offset int64, data []byte) []byte {
+	trailer := prepareDataWithHeader(data)
+
+	footer := make([]byte, FooterSize)
+	copy(footer[0:4], footerMagic)
+	footer[4] = footerVersion
+	binary.LittleEndian.PutUint64(footer[8:16], uint64(offset))
+	binary.LittleEndian.PutUint32(footer[16:20], uint32(len(data)))
+	sum := footerChecksum(footer[:20], data)
+	copy(footer[20:36], sum[:16])
+	copy(footer[36:40], footerMagic)
+
+	return append(trailer, footer...)
+}
+
+// extractTrailer returns the payload appended to data, see extractTrailerAt
+func extractTrailer(data []byte) ([]byte, error) {
+	return extractTrailerAt(bytes.NewReader(data), int64(len(data)))
+}
+
+// extractTrailerAt is findTrailerAt for extraction, which also reads files written before the
+// footer existed. Their payload ends exactly at the end of the file, so a magic number that
+// merely occurs in the carrier does not count.
+func extractTrailerAt(src io.ReaderAt, size int64) ([]byte, error) {
+	data, err := findTrailerAt(src, size)
+	if !errors.Is(err, errNoTrailer) {
+		return data, err
+	}
+	if data, ok := scanTrailerAt(src, size); ok {
+		return data, nil
+	}
+	return nil, errNoTrailer
+}
+
+// findTrailerAt locates an appended payload through the footer and verifies its checksum;
+// errNoTrailer is returned when the file has no footer
+func findTrailerAt(src io.ReaderAt, size int64) ([]byte, error) {
+	footer, ok := readFooterAt(src, size)
+	if !ok {
+		return nil, errNoTrailer
+	}
+
+	if footer[4] != footerVersion {
+		return nil, errors.New("unsupported payload footer version")
+	}
+	offset := int64(binary.LittleEndian.Uint64(footer[8:16]))
+	length := int64(binary.LittleEndian.Uint32(footer[16:20]))
+	if length == 0 || length > MaxDataSize || offset < 0 || offset > size-FooterSize-8-length {
+		return nil, errors.New("invalid payload footer")
+	}
+
+	data, err := readHeaderedDataAt(src, int(offset), int(size-FooterSize))
+	if err != nil || int64(len(data)) != length {
+		return nil, errors.New("payload footer does not match the embedded data")
+	}
+	sum := footerChecksum(footer[:20], data)
+	if !bytes.Equal(sum[:16], footer[20:36]) {
+		return nil, errors.New("embedded data checksum mismatch")
+	}
+
+	return data, nil
+}
+
+// readFooterAt returns the last FooterSize bytes of the file when they look like a footer
+func readFooterAt(src io.ReaderAt, size int64) ([]byte, bool) {
+	if size < FooterSize {
+		return nil, false
+	}
+	footer := make([]byte, FooterSize)
+	if _, err := src.ReadAt(footer, size-FooterSize); err != nil && err != io.EOF {
+		return nil, false
+	}
+	return footer, string(footer[0:4]) == footerMagic && string(footer[36:40]) == footerMagic
+}
+
+// footerOffsetAt returns where the appended payload described by a footer starts,
+// which is the size of the original carrier
+func footerOffsetAt(src io.ReaderAt, size int64) (int64, bool) {
+	footer, ok := readFooterAt(src, size)
+	if !ok {
+		return 0, false
+	}
+	offset := int64(binary.LittleEndian.Uint64(footer[8:16]))
+	return offset, offset >= 0 && offset <= size-FooterSize-8
+}
+
+// footerChecksum hashes the footer fields together with the payload
+func footerChecksum(fields, data []byte) [sha256.Size]byte {
+	h := sha256.New()
+	h.Write(fields)
+	h.Write(data)
+	var sum [sha256.Size]byte
+	copy(sum[:], h.Sum(nil))
+	return sum
+}
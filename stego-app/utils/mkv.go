@@ -0,0 +1,507 @@
+package utils
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+// Matroska carrier modes
+const (
+	MKVModeAttachment = "attachment" // payload as an attached file
+	MKVModeVoid       = "void"       // payload inside a Void element
+)
+
+// EBML element IDs used by the Matroska carrier (IDs keep their length marker)
+const (
+	ebmlIDHeader       = 0x1A45DFA3
+	ebmlIDSegment      = 0x18538067
+	ebmlIDSeekHead     = 0x114D9B74
+	ebmlIDSeek         = 0x4DBB
+	ebmlIDSeekID       = 0x53AB
+	ebmlIDSeekPosition = 0x53AC
+	ebmlIDAttachments  = 0x1941A469
+	ebmlIDAttachedFile = 0x61A7
+	ebmlIDFileName     = 0x466E
+	ebmlIDFileMimeType = 0x4660
+	ebmlIDFileData     = 0x465C
+	ebmlIDFileUID      = 0x46AE
+	ebmlIDVoid         = 0xEC
+	ebmlIDCRC32        = 0xBF
+)
+
+// Name and MIME type of the attachment carrying the payload
+const (
+	mkvAttachmentName = "thumbnails.dat"
+	mkvAttachmentMime = "application/octet-stream"
+)
+
+// ebmlElement is an element located inside the file
+type ebmlElement struct {
+	ID         uint32
+	Offset     int // offset of the element ID
+	DataOffset int // offset of the element data
+	Size       int // data size
+	Unknown    bool
+}
+
+// end returns the offset just past the element
+func (e ebmlElement) end() int {
+	return e.DataOffset + e.Size
+}
+
+// IsMKV reports whether data starts with an EBML header (Matroska/WebM)
+func IsMKV(data []byte) bool {
+	return len(data) >= 4 && binary.BigEndian.Uint32(data[:4]) == ebmlIDHeader
+}
+
+// EmbedDataInMKV stores data as an attachment or inside a Void element of a Matroska/WebM file.
+// The Segment size and the SeekHead entry for Attachments are kept consistent, and payloads
+// of earlier embeds are cleared whichever mode wrote them.
+func EmbedDataInMKV(mkvData []byte, data []byte, mode string) ([]byte, error) {
+	if len(data) == 0 {
+		return nil, errors.New("data to embed cannot be empty")
+	}
+
+	if len(data) > MaxDataSize {
+		return nil, fmt.Errorf("data too large: %d bytes, max allowed: %d bytes", len(data), MaxDataSize)
+	}
+
+	segment, children, err := parseMKVSegment(mkvData)
+	if err != nil {
+		return nil, err
+	}
+
+	payload := prepareDataWithHeader(data)
+	result := make([]byte, segment.end(), len(mkvData)+len(payload)+256)
+	copy(result, mkvData[:segment.end()])
+	tail := mkvData[segment.end():]
+
+	// A payload left by an earlier embed in either mode would be found first on extraction
+	if err := clearMKVPayloads(result, children); err != nil {
+		return nil, err
+	}
+
+	switch mode {
+	case MKVModeVoid:
+		// An existing Void element large enough is filled in place
+		for _, c := range children {
+			if c.ID == ebmlIDVoid && c.Size >= len(payload) {
+				body := result[c.DataOffset:c.end()]
+				copy(body, payload)
+				clear(body[len(payload):])
+				return append(result, tail...), nil
+			}
+		}
+		result = append(result, encodeEBMLElement(ebmlIDVoid, payload)...)
+
+	case "", MKVModeAttachment:
+		attachedFile, err := makeMKVAttachedFile(payload)
+		if err != nil {
+			return nil, err
+		}
+
+		var existing *ebmlElement
+		for i := range children {
+			if children[i].ID == ebmlIDAttachments {
+				existing = &children[i]
+				break
+			}
+		}
+
+		// Keep the other attachments, drop the Void left by a cleared payload and a stale CRC-32
+		var body []byte
+		if existing != nil {
+			files, _ := parseEBMLChildren(result, existing.DataOffset, existing.end())
+			for _, f := range files {
+				if f.ID == ebmlIDCRC32 || f.ID == ebmlIDVoid {
+					continue
+				}
+				body = append(body, result[f.Offset:f.end()]...)
+			}
+		}
+		body = append(body, attachedFile...)
+		attachments := encodeEBMLElement(ebmlIDAttachments, body)
+
+		if existing != nil && existing.end() == segment.end() {
+			// Last element of the segment: rewrite it where it is, no position changes
+			result = append(result[:existing.Offset], attachments...)
+		} else {
+			if existing != nil {
+				if err := voidEBMLElement(result, *existing); err != nil {
+					return nil, err
+				}
+			}
+			position := len(result) - segment.DataOffset
+			result = append(result, attachments...)
+			if err := setMKVSeekPosition(result, segment, children, ebmlIDAttachments, position); err != nil {
+				return nil, err
+			}
+		}
+
+	default:
+		return nil, fmt.Errorf("invalid mkv mode %q. Must be: %s or %s", mode, MKVModeAttachment, MKVModeVoid)
+	}
+
+	// Update the Segment size; positions inside the segment are relative to its data and stay valid
+	if !segment.Unknown {
+		newSize := len(result) - segment.DataOffset
+		header := append(encodeEBMLID(ebmlIDSegment), encodeEBMLSize(newSize, segment.DataOffset-segment.Offset-4)...)
+		result = append(append(append([]byte{}, result[:segment.Offset]...), header...), result[segment.DataOffset:]...)
+	}
+
+	return append(result, tail...), nil
+}
+
+// ExtractDataFromMKV finds the payload stored by EmbedDataInMKV by walking the Segment
+func ExtractDataFromMKV(mkvData []byte) ([]byte, error) {
+	segment, children, err := parseMKVSegment(mkvData)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, c := range children {
+		switch c.ID {
+		case ebmlIDAttachments:
+			files, _ := parseEBMLChildren(mkvData, c.DataOffset, c.end())
+			for _, f := range files {
+				if f.ID != ebmlIDAttachedFile {
+					continue
+				}
+				if payload := mkvAttachedFilePayload(mkvData, f); payload != nil {
+					return parseHeaderedData(payload)
+				}
+			}
+		case ebmlIDVoid:
+			if data, err := parseHeaderedData(mkvData[c.DataOffset:c.end()]); err == nil {
+				return data, nil
+			}
+		}
+	}
+
+	// Files embedded before the EBML-aware carrier have the payload appended after the segment
+	if data, err := parseHeaderedData(mkvData[segment.end():]); err == nil {
+		return data, nil
+	}
+
+	return nil, errors.New("no embedded data found in mkv")
+}
+
+// clearMKVPayloads turns the payload Void elements and payload attachments of earlier
+// embeds into empty Void elements of the same size, so no position in the segment moves
+func clearMKVPayloads(data []byte, children []ebmlElement) error {
+	for _, c := range children {
+		switch c.ID {
+		case ebmlIDVoid:
+			if _, err := parseHeaderedData(data[c.DataOffset:c.end()]); err == nil {
+				clear(data[c.DataOffset:c.end()])
+			}
+		case ebmlIDAttachments:
+			files, _ := parseEBMLChildren(data, c.DataOffset, c.end())
+			cleared := false
+			for _, f := range files {
+				if f.ID == ebmlIDAttachedFile && mkvAttachedFilePayload(data, f) != nil {
+					if err := voidEBMLElement(data, f); err != nil {
+						return err
+					}
+					cleared = true
+				}
+			}
+			// A CRC-32 of Attachments would no longer match
+			for _, f := range files {
+				if cleared && f.ID == ebmlIDCRC32 {
+					if err := voidEBMLElement(data, f); err != nil {
+						return err
+					}
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// parseMKVSegment locates the first Segment and its top-level children
+func parseMKVSegment(data []byte) (ebmlElement, []ebmlElement, error) {
+	top, _ := parseEBMLChildren(data, 0, len(data))
+	if len(top) == 0 || top[0].ID != ebmlIDHeader {
+		return ebmlElement{}, nil, errors.New("not an mkv file")
+	}
+
+	for _, e := range top {
+		if e.ID != ebmlIDSegment {
+			continue
+		}
+		children, end := parseEBMLChildren(data, e.DataOffset, e.end())
+		if end != e.end() {
+			return ebmlElement{}, nil, errors.New("mkv segment could not be parsed completely")
+		}
+		for _, c := range children {
+			if c.Unknown {
+				return ebmlElement{}, nil, errors.New("mkv files with unknown-size elements (live streams) are not supported")
+			}
+		}
+		return e, children, nil
+	}
+
+	return ebmlElement{}, nil, errors.New("mkv file has no segment")
+}
+
+// parseEBMLChildren parses consecutive elements between start and end, stopping at
+// the first one that does not fit; it returns the offset where parsing ended
+func parseEBMLChildren(data []byte, start, end int) ([]ebmlElement, int) {
+	var elements []ebmlElement
+	pos := start
+	for pos < end {
+		id, idWidth, ok := readEBMLID(data[pos:end])
+		if !ok {
+			return elements, pos
+		}
+		size, sizeWidth, unknown, ok := readEBMLSize(data[pos+idWidth : end])
+		if !ok {
+			return elements, pos
+		}
+
+		e := ebmlElement{ID: id, Offset: pos, DataOffset: pos + idWidth + sizeWidth, Unknown: unknown}
+		if unknown {
+			e.Size = end - e.DataOffset // only valid for the last element, e.g. a live Segment
+		} else {
+			if size > uint64(end-e.DataOffset) {
+				return elements, pos
+			}
+			e.Size = int(size)
+		}
+
+		elements = append(elements, e)
+		pos = e.end()
+	}
+	return elements, pos
+}
+
+// readEBMLID reads an element ID, keeping its length marker
+func readEBMLID(b []byte) (uint32, int, bool) {
+	if len(b) == 0 || b[0] == 0 {
+		return 0, 0, false
+	}
+	width := 1
+	for mask := byte(0x80); b[0]&mask == 0; mask >>= 1 {
+		width++
+	}
+	if width > 4 || width > len(b) {
+		return 0, 0, false
+	}
+	var id uint32
+	for i := 0; i < width; i++ {
+		id = id<<8 | uint32(b[i])
+	}
+	return id, width, true
+}
+
+// readEBMLSize reads a data size VINT; all value bits set means unknown size
+func readEBMLSize(b []byte) (uint64, int, bool, bool) {
+	if len(b) == 0 || b[0] == 0 {
+		return 0, 0, false, false
+	}
+	width := 1
+	for mask := byte(0x80); b[0]&mask == 0; mask >>= 1 {
+		width++
+	}
+	if width > len(b) {
+		return 0, 0, false, false
+	}
+	value := uint64(b[0] & (0xFF >> width))
+	for i := 1; i < width; i++ {
+		value = value<<8 | uint64(b[i])
+	}
+	unknown := value == 1<<(7*width)-1
+	return value, width, unknown, true
+}
+
+// encodeEBMLID serializes an element ID
+func encodeEBMLID(id uint32) []byte {
+	switch {
+	case id > 0xFFFFFF:
+		return []byte{byte(id >> 24), byte(id >> 16), byte(id >> 8), byte(id)}
+	case id > 0xFFFF:
+		return []byte{byte(id >> 16), byte(id >> 8), byte(id)}
+	case id > 0xFF:
+		return []byte{byte(id >> 8), byte(id)}
+	default:
+		return []byte{byte(id)}
+	}
+}
+
+// encodeEBMLSize serializes a data size using at least minWidth bytes
+func encodeEBMLSize(size int, minWidth int) []byte {
+	width := max(1, minWidth)
+	for width < 8 && uint64(size) >= 1<<(7*width)-1 {
+		width++
+	}
+	b := make([]byte, width)
+	v := uint64(size)
+	for i := width - 1; i >= 0; i-- {
+		b[i] = byte(v)
+		v >>= 8
+	}
+	b[0] |= 0x80 >> (width - 1)
+	return b
+}
+
+// encodeEBMLElement serializes an element with the shortest size field
+func encodeEBMLElement(id uint32, body []byte) []byte {
+	out := append(encodeEBMLID(id), encodeEBMLSize(len(body), 1)...)
+	return append(out, body...)
+}
+
+// encodeEBMLUint serializes an unsigned integer element
+func encodeEBMLUint(id uint32, v uint64, width int) []byte {
+	b := make([]byte, width)
+	for i := width - 1; i >= 0; i-- {
+		b[i] = byte(v)
+		v >>= 8
+	}
+	return encodeEBMLElement(id, b)
+}
+
+// makeMKVAttachedFile builds the AttachedFile element carrying payload
+func makeMKVAttachedFile(payload []byte) ([]byte, error) {
+	uid := make([]byte, 8)
+	if _, err := rand.Read(uid); err != nil {
+		return nil, errors.New("failed to generate attachment uid")
+	}
+	uid[0] |= 0x01 // FileUID must not be zero
+
+	var body []byte
+	body = append(body, encodeEBMLElement(ebmlIDFileName, []byte(mkvAttachmentName))...)
+	body = append(body, encodeEBMLElement(ebmlIDFileMimeType, []byte(mkvAttachmentMime))...)
+	body = append(body, encodeEBMLElement(ebmlIDFileData, payload)...)
+	body = append(body, encodeEBMLElement(ebmlIDFileUID, uid)...)
+	return encodeEBMLElement(ebmlIDAttachedFile, body), nil
+}
+
+// mkvAttachedFilePayload returns the FileData of an AttachedFile if it holds an embedded payload
+func mkvAttachedFilePayload(data []byte, file ebmlElement) []byte {
+	fields, _ := parseEBMLChildren(data, file.DataOffset, file.end())
+	for _, f := range fields {
+		if f.ID != ebmlIDFileData {
+			continue
+		}
+		fileData := data[f.DataOffset:f.end()]
+		if _, err := parseHeaderedData(fileData); err == nil {
+			return fileData
+		}
+	}
+	return nil
+}
+
+// voidEBMLElement turns an element into a Void element of exactly the same total size
+func voidEBMLElement(data []byte, e ebmlElement) error {
+	total := e.end() - e.Offset
+	for width := 1; width <= 8; width++ {
+		size := total - 1 - width
+		if size < 0 {
+			break
+		}
+		header := encodeEBMLSize(size, width)
+		if len(header) != width {
+			continue
+		}
+		data[e.Offset] = ebmlIDVoid
+		copy(data[e.Offset+1:], header)
+		clear(data[e.Offset+1+width : e.end()])
+		return nil
+	}
+	return errors.New("element cannot be replaced by a void element")
+}
+
+// setMKVSeekPosition points the SeekHead entry for id at position (relative to the segment data).
+// The SeekHead is rewritten in place; growth is taken from a Void element right after it.
+func setMKVSeekPosition(data []byte, segment ebmlElement, children []ebmlElement, id uint32, position int) error {
+	head, newHead, rest, err := mkvSeekHead(data, children, id, position)
+	if err != nil || newHead == nil {
+		return err
+	}
+
+	copy(data[head.Offset:], newHead)
+	if rest > 0 {
+		return voidEBMLElement(data, ebmlElement{Offset: head.Offset + len(newHead), Size: rest, DataOffset: head.Offset + len(newHead)})
+	}
+	return nil
+}
+
+// mkvSeekHead builds the SeekHead with the entry for id pointing at position, without changing
+// data, and returns the SeekHead it replaces and the bytes left for a Void element after it.
+// The new SeekHead is nil when the segment has none.
+func mkvSeekHead(data []byte, children []ebmlElement, id uint32, position int) (ebmlElement, []byte, int, error) {
+	headIndex := -1
+	for i, c := range children {
+		if c.ID == ebmlIDSeekHead {
+			headIndex = i
+			break
+		}
+	}
+	if headIndex < 0 {
+		return ebmlElement{}, nil, 0, nil // no SeekHead, demuxers scan the top-level elements
+	}
+	head := children[headIndex]
+
+	// Rebuild the Seek entries, replacing the one for id
+	targetID := encodeEBMLID(id)
+	var body []byte
+	seeks, _ := parseEBMLChildren(data, head.DataOffset, head.end())
+	for _, s := range seeks {
+		if s.ID == ebmlIDCRC32 || (s.ID == ebmlIDSeek && mkvSeekTargets(data, s, targetID)) {
+			continue // a CRC-32 would no longer match, the entry for id is replaced below
+		}
+		body = append(body, data[s.Offset:s.end()]...)
+	}
+
+	seek := append(encodeEBMLElement(ebmlIDSeekID, targetID), encodeEBMLUint(ebmlIDSeekPosition, uint64(position), 8)...)
+	body = append(body, encodeEBMLElement(ebmlIDSeek, seek)...)
+
+	// Space available: the SeekHead itself plus a directly following Void element
+	available := head.end() - head.Offset
+	if headIndex+1 < len(children) && children[headIndex+1].ID == ebmlIDVoid {
+		available = children[headIndex+1].end() - head.Offset
+	}
+
+	newHead := encodeEBMLElement(ebmlIDSeekHead, body)
+	rest := available - len(newHead)
+	if rest == 1 {
+		// A Void element needs at least 2 bytes, widen the size field instead
+		newHead = append(encodeEBMLID(ebmlIDSeekHead), encodeEBMLSize(len(body), len(newHead)-len(body)-4+1)...)
+		newHead = append(newHead, body...)
+		rest = 0
+	}
+	if rest < 0 {
+		return head, nil, 0, errors.New("no room to update the mkv SeekHead, use void mode")
+	}
+	return head, newHead, rest, nil
+}
+
+// checkMKVAttachmentsSeek reports whether attachments mode can update the SeekHead. Unless
+// Attachments already ends the segment, it moves to the end and its Seek entry changes.
+func checkMKVAttachmentsSeek(data []byte, segment ebmlElement, children []ebmlElement) error {
+	for _, c := range children {
+		if c.ID == ebmlIDAttachments {
+			if c.end() == segment.end() {
+				return nil
+			}
+			break
+		}
+	}
+	_, _, _, err := mkvSeekHead(data, children, ebmlIDAttachments, 0)
+	return err
+}
+
+// mkvSeekTargets reports whether a Seek entry points at the element with the given ID
+func mkvSeekTargets(data []byte, seek ebmlElement, targetID []byte) bool {
+	fields, _ := parseEBMLChildren(data, seek.DataOffset, seek.end())
+	for _, f := range fields {
+		if f.ID == ebmlIDSeekID && bytes.Equal(data[f.DataOffset:f.end()], targetID) {
+			return true
+		}
+	}
+	return false
+}
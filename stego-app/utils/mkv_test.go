@@ -0,0 +1,234 @@
+package utils
+
+import (
+	"bytes"
+	"testing"
+)
+
+// testMKV builds an EBML header and a Segment with a SeekHead pointing at Info, a Void
+// after it, Info, a Cluster and the extra top-level elements
+func testMKV(extra ...[]byte) []byte {
+	const (
+		idDocType       = 0x4282
+		idInfo          = 0x1549A966
+		idTimecodeScale = 0x2AD7B1
+		idCluster       = 0x1F43B675
+		idTimecode      = 0xE7
+		idSimpleBlock   = 0xA3
+	)
+	header := encodeEBMLElement(ebmlIDHeader, encodeEBMLElement(idDocType, []byte("matroska")))
+	info := encodeEBMLElement(idInfo, encodeEBMLUint(idTimecodeScale, 1000000, 3))
+	cluster := encodeEBMLElement(idCluster, append(encodeEBMLUint(idTimecode, 0, 1),
+		encodeEBMLElement(idSimpleBlock, bytes.Repeat([]byte("FRAME"), 40))...))
+
+	seekHead := func(infoPosition int) []byte {
+		seek := append(encodeEBMLElement(ebmlIDSeekID, encodeEBMLID(idInfo)), encodeEBMLUint(ebmlIDSeekPosition, uint64(infoPosition), 8)...)
+		return encodeEBMLElement(ebmlIDSeekHead, encodeEBMLElement(ebmlIDSeek, seek))
+	}
+	void := encodeEBMLElement(ebmlIDVoid, make([]byte, 60))
+	head := seekHead(len(seekHead(0)) + len(void)) // the SeekHead size does not depend on the position
+	body := bytes.Join([][]byte{head, void, info, cluster, bytes.Join(extra, nil)}, nil)
+	return append(header, encodeEBMLElement(ebmlIDSegment, body)...)
+}
+
+// testMKVAttachment is an AttachedFile of the user, which embedding must keep
+func testMKVAttachment() []byte {
+	var body []byte
+	body = append(body, encodeEBMLElement(ebmlIDFileName, []byte("cover.jpg"))...)
+	body = append(body, encodeEBMLElement(ebmlIDFileMimeType, []byte("image/jpeg"))...)
+	body = append(body, encodeEBMLElement(ebmlIDFileData, []byte("\xFF\xD8 not really a jpeg"))...)
+	body = append(body, encodeEBMLUint(ebmlIDFileUID, 42, 8)...)
+	return encodeEBMLElement(ebmlIDAttachedFile, body)
+}
+
+// checkMKVStructure checks that the segment spans the file and that every Seek entry
+// points at an element with its ID
+func checkMKVStructure(t *testing.T, name string, data []byte) {
+	t.Helper()
+	segment, children, err := parseMKVSegment(data)
+	if err != nil {
+		t.Fatalf("%s: %v", name, err)
+	}
+	if !segment.Unknown && segment.end() != len(data) {
+		t.Fatalf("%s: segment ends at %d of %d", name, segment.end(), len(data))
+	}
+	for _, c := range children {
+		if c.ID != ebmlIDSeekHead {
+			continue
+		}
+		seeks, _ := parseEBMLChildren(data, c.DataOffset, c.end())
+		for _, s := range seeks {
+			fields, _ := parseEBMLChildren(data, s.DataOffset, s.end())
+			var id []byte
+			position := 0
+			for _, f := range fields {
+				switch f.ID {
+				case ebmlIDSeekID:
+					id = data[f.DataOffset:f.end()]
+				case ebmlIDSeekPosition:
+					for _, b := range data[f.DataOffset:f.end()] {
+						position = position<<8 | int(b)
+					}
+				}
+			}
+			at := segment.DataOffset + position
+			if at+len(id) > len(data) || !bytes.Equal(data[at:at+len(id)], id) {
+				t.Fatalf("%s: seek entry for % X points at offset %d", name, id, at)
+			}
+		}
+	}
+}
+
+func TestMKVRoundTrip(t *testing.T) {
+	attachments := encodeEBMLElement(ebmlIDAttachments, testMKVAttachment())
+	carriers := map[string][]byte{
+		"plain":            testMKV(),
+		"attachments last": testMKV(attachments),
+		"attachments":      testMKV(attachments, encodeEBMLElement(0x1254C367, nil)), // Tags after them
+		"large void":       testMKV(encodeEBMLElement(ebmlIDVoid, make([]byte, 300))),
+	}
+	data := bytes.Repeat([]byte("mkv payload "), 10)
+	for name, carrier := range carriers {
+		for _, mode := range []string{"", MKVModeAttachment, MKVModeVoid} {
+			out, err := EmbedDataInMKV(carrier, data, mode)
+			if err != nil {
+				t.Fatalf("%s, %q mode: %v", name, mode, err)
+			}
+			got, err := ExtractDataFromMKV(out)
+			if err != nil || !bytes.Equal(got, data) {
+				t.Fatalf("%s, %q mode: got %q, %v", name, mode, got, err)
+			}
+			checkMKVStructure(t, name+" "+mode, out)
+			if bytes.Contains(carrier, []byte("cover.jpg")) && !bytes.Contains(out, testMKVAttachment()) {
+				t.Fatalf("%s, %q mode: attachment of the user lost", name, mode)
+			}
+		}
+	}
+}
+
+func TestMKVVoidModeFillsVoidInPlace(t *testing.T) {
+	carrier := testMKV(encodeEBMLElement(ebmlIDVoid, make([]byte, 300)))
+	out, err := EmbedDataInMKV(carrier, []byte("in place"), MKVModeVoid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(out) != len(carrier) {
+		t.Fatalf("size changed from %d to %d", len(carrier), len(out))
+	}
+}
+
+func TestMKVReembedAcrossModes(t *testing.T) {
+	attachments := encodeEBMLElement(ebmlIDAttachments, testMKVAttachment())
+	for name, carrier := range map[string][]byte{
+		"plain":       testMKV(),
+		"attachments": testMKV(attachments, encodeEBMLElement(0x1254C367, nil)),
+	} {
+		out := carrier
+		modes := []string{MKVModeAttachment, MKVModeVoid, MKVModeVoid, MKVModeAttachment, MKVModeAttachment, MKVModeVoid}
+		for i, mode := range modes {
+			data := bytes.Repeat([]byte{byte('a' + i)}, 30+5*i)
+			var err error
+			out, err = EmbedDataInMKV(out, data, mode)
+			if err != nil {
+				t.Fatalf("%s, step %d (%s): %v", name, i, mode, err)
+			}
+			got, err := ExtractDataFromMKV(out)
+			if err != nil || !bytes.Equal(got, data) {
+				t.Fatalf("%s, step %d (%s): got %q, %v", name, i, mode, got, err)
+			}
+			checkMKVStructure(t, name, out)
+			if i > 0 && bytes.Contains(out, bytes.Repeat([]byte{byte('a' + i - 1)}, 30)) {
+				t.Fatalf("%s, step %d (%s): previous payload left in the file", name, i, mode)
+			}
+		}
+	}
+}
+
+func TestMKVAttachmentsCRCDropped(t *testing.T) {
+	carrier := testMKV(encodeEBMLElement(ebmlIDAttachments, testMKVAttachment()))
+	out, err := EmbedDataInMKV(carrier, []byte("first"), MKVModeAttachment)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Add a CRC-32 to Attachments as muxers do, then embed again
+	segment, children, _ := parseMKVSegment(out)
+	var withCRC []byte
+	for _, c := range children {
+		if c.ID == ebmlIDAttachments {
+			body := append(encodeEBMLElement(ebmlIDCRC32, []byte{1, 2, 3, 4}), out[c.DataOffset:c.end()]...)
+			withCRC = append(append(bytes.Clone(out[:c.Offset]), encodeEBMLElement(ebmlIDAttachments, body)...), out[c.end():]...)
+		}
+	}
+	size := len(withCRC) - segment.DataOffset
+	withCRC = append(append(bytes.Clone(withCRC[:segment.Offset]), append(encodeEBMLID(ebmlIDSegment), encodeEBMLSize(size, 8)...)...), withCRC[segment.DataOffset:]...)
+
+	out, err = EmbedDataInMKV(withCRC, []byte("second"), MKVModeVoid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(out, []byte{ebmlIDCRC32, 0x84, 1, 2, 3, 4}) {
+		t.Fatal("stale CRC-32 left in Attachments")
+	}
+	if got, err := ExtractDataFromMKV(out); err != nil || string(got) != "second" {
+		t.Fatalf("got %q, %v", got, err)
+	}
+}
+
+func TestMKVUnknownSizeSegment(t *testing.T) {
+	carrier := testMKV()
+	segment, _, _ := parseMKVSegment(carrier)
+	live := append(bytes.Clone(carrier[:segment.Offset]), 0x18, 0x53, 0x80, 0x67, 0x01, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF)
+	live = append(live, carrier[segment.DataOffset:]...)
+
+	out, err := EmbedDataInMKV(live, []byte("live"), MKVModeVoid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, err := ExtractDataFromMKV(out); err != nil || string(got) != "live" {
+		t.Fatalf("got %q, %v", got, err)
+	}
+}
+
+func TestMKVLegacyAppendedPayload(t *testing.T) {
+	out := append(testMKV(), prepareDataWithHeader([]byte("appended"))...)
+	got, err := ExtractDataFromMKV(out)
+	if err != nil || string(got) != "appended" {
+		t.Fatalf("got %q, %v", got, err)
+	}
+}
+
+func TestMKVMalformed(t *testing.T) {
+	carrier := testMKV()
+	if _, err := EmbedDataInMKV([]byte("not an mkv file"), []byte("x"), ""); err == nil {
+		t.Error("non-mkv data accepted")
+	}
+	if _, err := EmbedDataInMKV(carrier, []byte("x"), "chapters"); err == nil {
+		t.Error("invalid mode accepted")
+	}
+	if _, err := EmbedDataInMKV(carrier, nil, ""); err == nil {
+		t.Error("empty data accepted")
+	}
+	header := encodeEBMLElement(ebmlIDHeader, nil)
+	if _, err := EmbedDataInMKV(header, []byte("x"), ""); err == nil {
+		t.Error("file without segment accepted")
+	}
+	for _, n := range []int{len(carrier) - 1, len(carrier) / 2, 6} {
+		if _, err := EmbedDataInMKV(carrier[:n], []byte("x"), ""); err == nil {
+			t.Errorf("file truncated to %d bytes accepted", n)
+		}
+	}
+
+	// No Void after the SeekHead and a SeekHead too small for a new entry
+	noRoom := bytes.Replace(carrier, encodeEBMLElement(ebmlIDVoid, make([]byte, 60)), encodeEBMLElement(0x1254C367, make([]byte, 57)), 1)
+	if _, err := EmbedDataInMKV(noRoom, []byte("x"), MKVModeAttachment); err == nil {
+		t.Error("SeekHead without room accepted in attachment mode")
+	}
+	if _, err := EmbedDataInMKV(noRoom, []byte("x"), MKVModeVoid); err != nil {
+		t.Errorf("void mode: %v", err)
+	}
+
+	if _, err := ExtractDataFromMKV(carrier); err == nil {
+		t.Error("clean file extracted")
+	}
+}
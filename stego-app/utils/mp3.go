@@ -0,0 +1,640 @@
+package utils
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+// MP3 carrier modes
+const (
+	MP3ModeID3       = "id3"       // payload in an ID3v2 PRIV frame
+	MP3ModeAncillary = "ancillary" // payload in the unused bytes between Layer III main data blocks
+)
+
+// mp3PrivOwner is the owner identifier of the PRIV frame carrying the payload
+const mp3PrivOwner = "stego-app/payload"
+
+var (
+	mp3BitratesV1 = [3][16]int{
+		{0, 32, 64, 96, 128, 160, 192, 224, 256, 288, 320, 352, 384, 416, 448, 0}, // Layer I
+		{0, 32, 48, 56, 64, 80, 96, 112, 128, 160, 192, 224, 256, 320, 384, 0},    // Layer II
+		{0, 32, 40, 48, 56, 64, 80, 96, 112, 128, 160, 192, 224, 256, 320, 0},     // Layer III
+	}
+	mp3BitratesV2 = [3][16]int{
+		{0, 32, 48, 56, 64, 80, 96, 112, 128, 144, 160, 176, 192, 224, 256, 0}, // Layer I
+		{0, 8, 16, 24, 32, 40, 48, 56, 64, 80, 96, 112, 128, 144, 160, 0},      // Layer II
+		{0, 8, 16, 24, 32, 40, 48, 56, 64, 80, 96, 112, 128, 144, 160, 0},      // Layer III
+	}
+	mp3SampleRates = map[int][3]int{
+		1: {44100, 48000, 32000},
+		2: {22050, 24000, 16000},
+		3: {11025, 12000, 8000}, // MPEG 2.5
+	}
+)
+
+// mp3Frame describes one MPEG audio frame inside the file
+type mp3Frame struct {
+	Offset   int
+	Length   int
+	Version  int // 1 = MPEG1, 2 = MPEG2, 3 = MPEG2.5
+	Layer    int // 1, 2 or 3
+	CRC      bool
+	Channels int
+}
+
+// sideInfoLength returns the size of the Layer III side information
+func (f mp3Frame) sideInfoLength() int {
+	if f.Version == 1 {
+		if f.Channels == 1 {
+			return 17
+		}
+		return 32
+	}
+	if f.Channels == 1 {
+		return 9
+	}
+	return 17
+}
+
+// dataOffset returns the file offset of the first byte after the header, CRC and side info
+func (f mp3Frame) dataOffset() int {
+	offset := f.Offset + 4
+	if f.CRC {
+		offset += 2
+	}
+	return offset + f.sideInfoLength()
+}
+
+// IsMP3 reports whether data looks like an MPEG audio stream
+func IsMP3(data []byte) bool {
+	frames := parseMP3Frames(data)
+	return len(frames) >= 2
+}
+
+// EmbedDataInMP3 embeds data into an MP3 file using the given mode
+func EmbedDataInMP3(mp3Data []byte, data []byte, mode string) ([]byte, error) {
+	if len(data) == 0 {
+		return nil, errors.New("data to embed cannot be empty")
+	}
+
+	if len(data) > MaxDataSize {
+		return nil, fmt.Errorf("data too large: %d bytes, max allowed: %d bytes", len(data), MaxDataSize)
+	}
+
+	// The payload of an earlier embed in either mode is removed, extraction would find it first
+	switch mode {
+	case "", MP3ModeID3:
+		return embedMP3PrivFrame(clearMP3Ancillary(mp3Data), prepareDataWithHeader(data))
+	case MP3ModeAncillary:
+		stripped, err := removeMP3PrivFrame(mp3Data)
+		if err != nil {
+			return nil, err
+		}
+		return embedMP3Ancillary(clearMP3Ancillary(stripped), prepareDataWithHeader(data))
+	default:
+		return nil, fmt.Errorf("invalid mp3 mode %q. Must be: %s or %s", mode, MP3ModeID3, MP3ModeAncillary)
+	}
+}
+
+// ExtractDataFromMP3 extracts data stored by EmbedDataInMP3 in either mode
+func ExtractDataFromMP3(mp3Data []byte) ([]byte, error) {
+	if data, err := extractMP3PrivFrame(mp3Data); err == nil {
+		return data, nil
+	}
+	if data, err := extractMP3Ancillary(mp3Data); err == nil {
+		return data, nil
+	}
+	return nil, errors.New("no embedded data found in mp3")
+}
+
+// CalculateMP3AncillaryCapacity returns how many payload bytes fit in the ancillary mode
+func CalculateMP3AncillaryCapacity(mp3Data []byte) int {
+	capacity := 0
+	for _, r := range mp3AncillaryRanges(mp3Data) {
+		capacity += r[1] - r[0]
+	}
+	return max(0, capacity-8) // Reserve 8 bytes for header
+}
+
+// ID3v2 PRIV frame mode
+
+// id3Frame is a raw ID3v2.3/2.4 frame
+type id3Frame struct {
+	ID    string
+	Flags [2]byte
+	Body  []byte
+}
+
+// embedMP3PrivFrame writes payload into a PRIV frame of the leading ID3v2 tag, creating the tag if needed
+func embedMP3PrivFrame(mp3Data []byte, payload []byte) ([]byte, error) {
+	version, frames, audio, err := parseID3v2(mp3Data)
+	if err != nil {
+		return nil, err
+	}
+
+	var kept []id3Frame
+	for _, f := range frames {
+		if _, ok := privPayload(f); !ok {
+			kept = append(kept, f)
+		}
+	}
+	body := append([]byte(mp3PrivOwner+"\x00"), payload...)
+	kept = append(kept, id3Frame{ID: "PRIV", Body: body})
+	return encodeID3v2(version, kept, audio)
+}
+
+// removeMP3PrivFrame drops the PRIV frame written by embedMP3PrivFrame, files without one
+// are returned unchanged
+func removeMP3PrivFrame(mp3Data []byte) ([]byte, error) {
+	version, frames, audio, err := parseID3v2(mp3Data)
+	if err != nil {
+		return nil, err
+	}
+
+	var kept []id3Frame
+	for _, f := range frames {
+		if _, ok := privPayload(f); !ok {
+			kept = append(kept, f)
+		}
+	}
+	if len(kept) == len(frames) {
+		return mp3Data, nil
+	}
+	return encodeID3v2(version, kept, audio)
+}
+
+// encodeID3v2 writes an ID3v2 tag holding frames in front of audio
+func encodeID3v2(version int, frames []id3Frame, audio []byte) ([]byte, error) {
+	var tagBody bytes.Buffer
+	for _, f := range frames {
+		tagBody.WriteString(f.ID)
+		size := make([]byte, 4)
+		if version == 4 {
+			putSyncsafe(size, len(f.Body))
+		} else {
+			binary.BigEndian.PutUint32(size, uint32(len(f.Body)))
+		}
+		tagBody.Write(size)
+		tagBody.Write(f.Flags[:])
+		tagBody.Write(f.Body)
+	}
+
+	if tagBody.Len() >= 1<<28 {
+		return nil, errors.New("id3v2 tag too large")
+	}
+
+	var buf bytes.Buffer
+	buf.Grow(10 + tagBody.Len() + len(audio))
+	buf.WriteString("ID3")
+	buf.WriteByte(byte(version))
+	buf.WriteByte(0)
+	buf.WriteByte(0) // extended header and footer are not carried over, their CRC would be stale
+	size := make([]byte, 4)
+	putSyncsafe(size, tagBody.Len())
+	buf.Write(size)
+	buf.Write(tagBody.Bytes())
+	buf.Write(audio)
+
+	return buf.Bytes(), nil
+}
+
+// extractMP3PrivFrame reads the payload from the PRIV frame written by embedMP3PrivFrame
+func extractMP3PrivFrame(mp3Data []byte) ([]byte, error) {
+	_, frames, _, err := parseID3v2(mp3Data)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, f := range frames {
+		payload, ok := privPayload(f)
+		if !ok {
+			continue
+		}
+		if data, err := parseHeaderedData(payload); err == nil {
+			return data, nil
+		}
+	}
+
+	return nil, errors.New("no payload frame in id3v2 tag")
+}
+
+// parseID3v2 splits the leading ID3v2 tag (if any) into its version and frames.
+// The returned audio slice holds everything after the tag.
+func parseID3v2(data []byte) (int, []id3Frame, []byte, error) {
+	if len(data) < 10 || !bytes.HasPrefix(data, []byte("ID3")) {
+		// No tag yet, a new ID3v2.3 tag will be created
+		return 3, nil, data, nil
+	}
+
+	version := int(data[3])
+	flags := data[5]
+	if version != 3 && version != 4 {
+		return 0, nil, nil, fmt.Errorf("unsupported id3v2 version 2.%d", version)
+	}
+	if flags&0x80 != 0 {
+		return 0, nil, nil, errors.New("unsynchronised id3v2 tags are not supported")
+	}
+
+	tagSize := readSyncsafe(data[6:10])
+	end := 10 + tagSize
+	if end > len(data) {
+		return 0, nil, nil, errors.New("truncated id3v2 tag")
+	}
+	audioStart := end
+	if flags&0x10 != 0 {
+		audioStart += 10 // footer
+	}
+	if audioStart > len(data) {
+		return 0, nil, nil, errors.New("truncated id3v2 tag")
+	}
+
+	pos := 10
+	if flags&0x40 != 0 {
+		if pos+4 > end {
+			return 0, nil, nil, errors.New("truncated id3v2 extended header")
+		}
+		extSize := int(binary.BigEndian.Uint32(data[pos : pos+4]))
+		if version == 3 {
+			extSize += 4 // v2.3 size excludes the size field itself
+		} else {
+			extSize = readSyncsafe(data[pos : pos+4])
+		}
+		if pos+extSize > end {
+			return 0, nil, nil, errors.New("truncated id3v2 extended header")
+		}
+		pos += extSize
+	}
+
+	var frames []id3Frame
+	for pos+10 <= end {
+		if data[pos] == 0 {
+			break // padding
+		}
+		var size int
+		if version == 4 {
+			size = readSyncsafe(data[pos+4 : pos+8])
+		} else {
+			size = int(binary.BigEndian.Uint32(data[pos+4 : pos+8]))
+		}
+		if pos+10+size > end {
+			return 0, nil, nil, errors.New("truncated id3v2 frame")
+		}
+		frames = append(frames, id3Frame{
+			ID:    string(data[pos : pos+4]),
+			Flags: [2]byte{data[pos+8], data[pos+9]},
+			Body:  data[pos+10 : pos+10+size],
+		})
+		pos += 10 + size
+	}
+
+	return version, frames, data[audioStart:], nil
+}
+
+// privPayload returns the private data of a PRIV frame written by embedMP3PrivFrame
+func privPayload(f id3Frame) ([]byte, bool) {
+	if f.ID != "PRIV" {
+		return nil, false
+	}
+	return bytes.CutPrefix(f.Body, []byte(mp3PrivOwner+"\x00"))
+}
+
+// readSyncsafe decodes a 4-byte syncsafe integer
+func readSyncsafe(b []byte) int {
+	return int(b[0]&0x7F)<<21 | int(b[1]&0x7F)<<14 | int(b[2]&0x7F)<<7 | int(b[3]&0x7F)
+}
+
+// putSyncsafe encodes v as a 4-byte syncsafe integer
+func putSyncsafe(b []byte, v int) {
+	b[0] = byte(v>>21) & 0x7F
+	b[1] = byte(v>>14) & 0x7F
+	b[2] = byte(v>>7) & 0x7F
+	b[3] = byte(v) & 0x7F
+}
+
+// Ancillary data mode
+
+// embedMP3Ancillary spreads payload over the bytes that no Layer III frame uses for main data
+func embedMP3Ancillary(mp3Data []byte, payload []byte) ([]byte, error) {
+	ranges := mp3AncillaryRanges(mp3Data)
+	capacity := 0
+	for _, r := range ranges {
+		capacity += r[1] - r[0]
+	}
+	if len(payload) > capacity {
+		return nil, fmt.Errorf("mp3 too small to embed data: need %d bytes, have %d bytes of ancillary space",
+			len(payload), capacity)
+	}
+
+	result := make([]byte, len(mp3Data))
+	copy(result, mp3Data)
+
+	written := 0
+	for _, r := range ranges {
+		if written == len(payload) {
+			break
+		}
+		written += copy(result[r[0]:r[1]], payload[written:])
+	}
+
+	return result, nil
+}
+
+// clearMP3Ancillary returns a copy of mp3Data with the payload written by embedMP3Ancillary
+// zeroed, as encoders leave unused space. Files without one are returned unchanged.
+func clearMP3Ancillary(mp3Data []byte) []byte {
+	data, err := extractMP3Ancillary(mp3Data)
+	if err != nil {
+		return mp3Data
+	}
+
+	result := make([]byte, len(mp3Data))
+	copy(result, mp3Data)
+
+	remaining := 8 + len(data)
+	for _, r := range mp3AncillaryRanges(result) {
+		n := min(remaining, r[1]-r[0])
+		clear(result[r[0] : r[0]+n])
+		remaining -= n
+		if remaining == 0 {
+			break
+		}
+	}
+	return result
+}
+
+// extractMP3Ancillary reads back the payload written by embedMP3Ancillary
+func extractMP3Ancillary(mp3Data []byte) ([]byte, error) {
+	ranges := mp3AncillaryRanges(mp3Data)
+
+	var stream []byte
+	for _, r := range ranges {
+		stream = append(stream, mp3Data[r[0]:r[1]]...)
+		if len(stream) >= 8 {
+			if binary.LittleEndian.Uint32(stream[:4]) != MagicNumber {
+				break
+			}
+			if len(stream) >= 8+int(binary.LittleEndian.Uint32(stream[4:8])) {
+				break
+			}
+		}
+	}
+
+	return parseHeaderedData(stream)
+}
+
+// mp3AncillaryRanges returns the [start, end) file ranges inside Layer III frames
+// that are not referenced by any frame's main data (ancillary data and unused padding)
+func mp3AncillaryRanges(mp3Data []byte) [][2]int {
+	frames := parseMP3Frames(mp3Data)
+
+	// Build the logical main data stream: the concatenated data areas of all frames
+	type segment struct{ fileStart, streamStart, length int }
+	var segments []segment
+	streamLength := 0
+	var used [][2]int // [start, end) in stream coordinates
+
+	for i, f := range frames {
+		if f.Layer != 3 {
+			return nil
+		}
+		dataStart := f.dataOffset()
+		dataEnd := f.Offset + f.Length
+		if dataEnd > len(mp3Data) || dataStart > dataEnd {
+			break
+		}
+		if i == 0 && isMP3InfoFrame(mp3Data, f) {
+			continue // Xing/Info/VBRI header frame, must stay intact
+		}
+
+		mainDataBegin, mainDataBits := readMP3SideInfo(mp3Data, f)
+		start := streamLength - mainDataBegin
+		if start < 0 {
+			start = 0
+		}
+		used = append(used, [2]int{start, start + (mainDataBits+7)/8})
+
+		segments = append(segments, segment{fileStart: dataStart, streamStart: streamLength, length: dataEnd - dataStart})
+		streamLength += dataEnd - dataStart
+	}
+
+	// Free stream ranges are the gaps between consecutive main data blocks
+	var free [][2]int
+	cursor := 0
+	for _, u := range used {
+		if u[0] > cursor {
+			free = append(free, [2]int{cursor, u[0]})
+		}
+		if u[1] > cursor {
+			cursor = u[1]
+		}
+	}
+	if cursor < streamLength {
+		free = append(free, [2]int{cursor, streamLength})
+	}
+
+	// Map stream ranges back to file ranges
+	var ranges [][2]int
+	for _, fr := range free {
+		for _, s := range segments {
+			lo := max(fr[0], s.streamStart)
+			hi := min(fr[1], s.streamStart+s.length)
+			if lo < hi {
+				ranges = append(ranges, [2]int{s.fileStart + lo - s.streamStart, s.fileStart + hi - s.streamStart})
+			}
+		}
+	}
+
+	return ranges
+}
+
+// readMP3SideInfo returns main_data_begin and the total main data size in bits of a Layer III frame
+func readMP3SideInfo(mp3Data []byte, f mp3Frame) (int, int) {
+	sideStart := f.Offset + 4
+	if f.CRC {
+		sideStart += 2
+	}
+	r := &bitReader{data: mp3Data[sideStart : sideStart+f.sideInfoLength()]}
+
+	var mainDataBegin, granules, perGranuleBits int
+	if f.Version == 1 {
+		mainDataBegin = int(r.read(9))
+		if f.Channels == 1 {
+			r.read(5)
+		} else {
+			r.read(3)
+		}
+		r.read(4 * f.Channels) // scfsi
+		granules = 2
+		perGranuleBits = 59
+	} else {
+		mainDataBegin = int(r.read(8))
+		if f.Channels == 1 {
+			r.read(1)
+		} else {
+			r.read(2)
+		}
+		granules = 1
+		perGranuleBits = 63
+	}
+
+	bits := 0
+	for gr := 0; gr < granules; gr++ {
+		for ch := 0; ch < f.Channels; ch++ {
+			bits += int(r.read(12)) // part2_3_length
+			r.read(perGranuleBits - 12)
+		}
+	}
+
+	return mainDataBegin, bits
+}
+
+// isMP3InfoFrame reports whether f carries a Xing, Info or VBRI header instead of audio
+func isMP3InfoFrame(mp3Data []byte, f mp3Frame) bool {
+	end := f.Offset + f.Length
+	for _, tag := range []string{"Xing", "Info"} {
+		pos := f.dataOffset()
+		if pos+4 <= end && string(mp3Data[pos:pos+4]) == tag {
+			return true
+		}
+	}
+	pos := f.Offset + 4 + 32
+	return pos+4 <= end && string(mp3Data[pos:pos+4]) == "VBRI"
+}
+
+// parseMP3Frames walks the MPEG audio frames following the leading ID3v2 tag
+func parseMP3Frames(data []byte) []mp3Frame {
+	pos := skipID3v2(data)
+
+	// Find the first header that is followed by another valid header,
+	// giving up after the first 64KB so other formats are not mistaken for MP3
+	limit := min(len(data), pos+64*1024)
+	for ; pos+4 <= limit; pos++ {
+		f, ok := parseMP3Header(data, pos)
+		if !ok {
+			continue
+		}
+		if _, ok := parseMP3Header(data, pos+f.Length); ok {
+			break
+		}
+	}
+	if pos+4 > limit {
+		return nil
+	}
+
+	var frames []mp3Frame
+	for pos+4 <= len(data) {
+		f, ok := parseMP3Header(data, pos)
+		if !ok || pos+f.Length > len(data) {
+			break
+		}
+		frames = append(frames, f)
+		pos += f.Length
+	}
+
+	return frames
+}
+
+// parseMP3Header decodes the 4-byte frame header at pos
+func parseMP3Header(data []byte, pos int) (mp3Frame, bool) {
+	if pos < 0 || pos+4 > len(data) {
+		return mp3Frame{}, false
+	}
+	h := data[pos : pos+4]
+	if h[0] != 0xFF || h[1]&0xE0 != 0xE0 {
+		return mp3Frame{}, false
+	}
+
+	var version int
+	switch (h[1] >> 3) & 0x03 {
+	case 0:
+		version = 3
+	case 2:
+		version = 2
+	case 3:
+		version = 1
+	default:
+		return mp3Frame{}, false
+	}
+
+	layer := 4 - int((h[1]>>1)&0x03)
+	if layer == 4 {
+		return mp3Frame{}, false
+	}
+
+	bitrateIndex := int(h[2] >> 4)
+	sampleRateIndex := int((h[2] >> 2) & 0x03)
+	if bitrateIndex == 0 || bitrateIndex == 15 || sampleRateIndex == 3 {
+		return mp3Frame{}, false
+	}
+
+	var bitrate int
+	if version == 1 {
+		bitrate = mp3BitratesV1[layer-1][bitrateIndex] * 1000
+	} else {
+		bitrate = mp3BitratesV2[layer-1][bitrateIndex] * 1000
+	}
+	sampleRate := mp3SampleRates[version][sampleRateIndex]
+	padding := int((h[2] >> 1) & 0x01)
+
+	var length int
+	switch {
+	case layer == 1:
+		length = (12*bitrate/sampleRate + padding) * 4
+	case layer == 3 && version != 1:
+		length = 72*bitrate/sampleRate + padding
+	default:
+		length = 144*bitrate/sampleRate + padding
+	}
+
+	channels := 2
+	if h[3]>>6 == 3 {
+		channels = 1
+	}
+
+	f := mp3Frame{
+		Offset:   pos,
+		Length:   length,
+		Version:  version,
+		Layer:    layer,
+		CRC:      h[1]&0x01 == 0,
+		Channels: channels,
+	}
+	if layer == 3 && f.dataOffset() > pos+length {
+		return mp3Frame{}, false
+	}
+
+	return f, true
+}
+
+// parseHeaderedData validates a magic+length header and returns the data behind it
+func parseHeaderedData(b []byte) ([]byte, error) {
+	if len(b) < 8 || binary.LittleEndian.Uint32(b[:4]) != MagicNumber {
+		return nil, errors.New("no valid embedded data header")
+	}
+	dataLength := binary.LittleEndian.Uint32(b[4:8])
+	if dataLength == 0 || dataLength > MaxDataSize || int(dataLength) > len(b)-8 {
+		return nil, errors.New("invalid embedded data length")
+	}
+	return b[8 : 8+int(dataLength)], nil
+}
+
+// bitReader reads big-endian bit fields
+type bitReader struct {
+	data []byte
+	pos  int // in bits
+}
+
+// read returns the next n bits (n <= 32); reading past the end yields zero bits
+func (r *bitReader) read(n int) uint32 {
+	var v uint32
+	for i := 0; i < n; i++ {
+		v <<= 1
+		if r.pos/8 < len(r.data) {
+			v |= uint32(r.data[r.pos/8]>>(7-r.pos%8)) & 1
+		}
+		r.pos++
+	}
+	return v
+}
@@ -0,0 +1,211 @@
+package utils
+
+import (
+	"bytes"
+	"testing"
+)
+
+// testMP3 builds MPEG-1 Layer III mono frames at 128 kbps whose main data uses mainBytes of
+// each 396-byte data area, leaving the rest as ancillary space. With info set, the first
+// frame is a Xing header.
+func testMP3(frames, mainBytes int, info bool) []byte {
+	const frameLength = 417 // 144 * 128000 / 44100
+	var out []byte
+	for i := 0; i < frames; i++ {
+		frame := make([]byte, frameLength)
+		copy(frame, []byte{0xFF, 0xFB, 0x90, 0xC0})
+		w := &testBitWriter{buf: frame[4:21]}
+		w.write(0, 9+5+4) // main_data_begin, private bits, scfsi
+		for gr := 0; gr < 2; gr++ {
+			w.write(uint32(mainBytes*8/2), 12) // part2_3_length
+			w.write(0, 59-12)
+		}
+		for j := 21; j < 21+mainBytes; j++ {
+			frame[j] = byte(0x80 | i)
+		}
+		if i == 0 && info {
+			copy(frame[21:], "Xing")
+		}
+		out = append(out, frame...)
+	}
+	return out
+}
+
+// testBitWriter writes big-endian bit fields
+type testBitWriter struct {
+	buf []byte
+	pos int
+}
+
+func (w *testBitWriter) write(v uint32, n int) {
+	for i := n - 1; i >= 0; i-- {
+		if v>>i&1 != 0 {
+			w.buf[w.pos/8] |= 0x80 >> (w.pos % 8)
+		}
+		w.pos++
+	}
+}
+
+// testID3 builds an ID3v2.3 or v2.4 tag holding a TIT2 frame and padding
+func testID3(version byte) []byte {
+	frame := append([]byte("TIT2\x00\x00\x00\x06\x00\x00"), "\x00title"...)
+	body := append(frame, make([]byte, 20)...)
+	size := make([]byte, 4)
+	putSyncsafe(size, len(body))
+	return append(append([]byte{'I', 'D', '3', version, 0, 0}, size...), body...)
+}
+
+// checkMP3MainData checks that the main data of every frame is unchanged
+func checkMP3MainData(t *testing.T, name string, carrier, out []byte, mainBytes int) {
+	t.Helper()
+	a, b := parseMP3Frames(carrier), parseMP3Frames(out)
+	if len(a) != len(b) {
+		t.Fatalf("%s: %d frames, want %d", name, len(b), len(a))
+	}
+	for i := range a {
+		if !bytes.Equal(carrier[a[i].Offset:a[i].dataOffset()+mainBytes], out[b[i].Offset:b[i].dataOffset()+mainBytes]) {
+			t.Fatalf("%s: frame %d main data changed", name, i)
+		}
+	}
+}
+
+func TestMP3RoundTrip(t *testing.T) {
+	carriers := map[string][]byte{
+		"bare":     testMP3(20, 200, false),
+		"id3v2.3":  append(testID3(3), testMP3(20, 200, false)...),
+		"id3v2.4":  append(testID3(4), testMP3(20, 200, false)...),
+		"xing":     testMP3(20, 200, true),
+		"trailing": append(testMP3(20, 200, false), "TAGid3v1"...),
+	}
+	data := bytes.Repeat([]byte("mp3!"), 100)
+	for name, carrier := range carriers {
+		for _, mode := range []string{"", MP3ModeID3, MP3ModeAncillary} {
+			out, err := EmbedDataInMP3(carrier, data, mode)
+			if err != nil {
+				t.Fatalf("%s, %q mode: %v", name, mode, err)
+			}
+			got, err := ExtractDataFromMP3(out)
+			if err != nil || !bytes.Equal(got, data) {
+				t.Fatalf("%s, %q mode: got %d bytes, %v", name, mode, len(got), err)
+			}
+			checkMP3MainData(t, name, carrier, out, 200)
+			if bytes.Contains(carrier, []byte("title")) && !bytes.Contains(out, []byte("TIT2\x00\x00\x00\x06\x00\x00\x00title")) {
+				t.Fatalf("%s, %q mode: title frame lost", name, mode)
+			}
+		}
+	}
+}
+
+func TestMP3AncillaryKeepsSize(t *testing.T) {
+	carrier := testMP3(20, 200, true)
+	capacity := CalculateMP3AncillaryCapacity(carrier)
+	if capacity != 19*196-8 {
+		t.Fatalf("capacity %d", capacity)
+	}
+	out, err := EmbedDataInMP3(carrier, make([]byte, capacity), MP3ModeAncillary)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(out) != len(carrier) || !bytes.Equal(out[:417], carrier[:417]) {
+		t.Fatal("size or Xing frame changed")
+	}
+	if _, err := EmbedDataInMP3(carrier, make([]byte, capacity+1), MP3ModeAncillary); err == nil {
+		t.Fatal("data larger than the capacity accepted")
+	}
+}
+
+func TestMP3BitReservoir(t *testing.T) {
+	// Each frame's main data starts 50 bytes back in the previous frame
+	carrier := testMP3(10, 200, false)
+	for _, f := range parseMP3Frames(carrier)[1:] {
+		(&testBitWriter{buf: carrier[f.Offset+4 : f.Offset+6]}).write(50, 9)
+	}
+	ranges := mp3AncillaryRanges(carrier)
+	total := 0
+	for _, r := range ranges {
+		total += r[1] - r[0]
+	}
+	if total != 10*196 {
+		t.Fatalf("%d bytes of ancillary space, want %d", total, 10*196)
+	}
+	for _, f := range parseMP3Frames(carrier)[1:] {
+		reused := [2]int{f.Offset - 50, f.Offset}
+		for _, r := range ranges {
+			if r[0] < reused[1] && r[1] > reused[0] {
+				t.Fatalf("range %v overlaps main data in the bit reservoir", r)
+			}
+		}
+	}
+}
+
+func TestMP3ReembedAcrossModes(t *testing.T) {
+	carrier := append(testID3(4), testMP3(20, 200, false)...)
+	out := carrier
+	modes := []string{MP3ModeID3, MP3ModeAncillary, MP3ModeAncillary, MP3ModeID3, MP3ModeID3, MP3ModeAncillary}
+	for i, mode := range modes {
+		data := bytes.Repeat([]byte{byte('a' + i)}, 30+5*i)
+		var err error
+		out, err = EmbedDataInMP3(out, data, mode)
+		if err != nil {
+			t.Fatalf("step %d (%s): %v", i, mode, err)
+		}
+		got, err := ExtractDataFromMP3(out)
+		if err != nil || !bytes.Equal(got, data) {
+			t.Fatalf("step %d (%s): got %q, %v", i, mode, got, err)
+		}
+		if i > 0 && bytes.Contains(out, bytes.Repeat([]byte{byte('a' + i - 1)}, 30)) {
+			t.Fatalf("step %d (%s): previous payload left in the file", i, mode)
+		}
+		checkMP3MainData(t, mode, carrier, out, 200)
+	}
+}
+
+func TestMP3Malformed(t *testing.T) {
+	carrier := testMP3(20, 200, false)
+	if _, err := EmbedDataInMP3(carrier, []byte("x"), "lyrics"); err == nil {
+		t.Error("invalid mode accepted")
+	}
+	if _, err := EmbedDataInMP3(carrier, nil, ""); err == nil {
+		t.Error("empty data accepted")
+	}
+
+	unsync := append(testID3(3), carrier...)
+	unsync[5] = 0x80
+	v22 := append(testID3(3), carrier...)
+	v22[3] = 2
+	truncatedTag := append(testID3(3), carrier...)
+	putSyncsafe(truncatedTag[6:10], len(truncatedTag))
+	truncatedFrame := append(testID3(3), carrier...)
+	truncatedFrame[17] = 0x7F
+	for name, bad := range map[string][]byte{
+		"unsynchronised":  unsync,
+		"id3v2.2":         v22,
+		"truncated tag":   truncatedTag,
+		"truncated frame": truncatedFrame,
+	} {
+		if _, err := EmbedDataInMP3(bad, []byte("x"), MP3ModeID3); err == nil {
+			t.Errorf("%s accepted", name)
+		}
+		if _, err := ExtractDataFromMP3(bad); err == nil {
+			t.Errorf("%s extracted", name)
+		}
+	}
+
+	full := testMP3(5, 396, false)
+	if _, err := EmbedDataInMP3(full, []byte("x"), MP3ModeAncillary); err == nil {
+		t.Error("frames without ancillary space accepted")
+	}
+	layer2 := testMP3(5, 0, false)
+	for i := 0; i < len(layer2); i += 417 {
+		layer2[i+1] = 0xFD
+	}
+	if CalculateMP3AncillaryCapacity(layer2) != 0 {
+		t.Error("layer II frames have ancillary capacity")
+	}
+	if IsMP3([]byte("not an mp3 \xFF\xFB")) {
+		t.Error("garbage detected as mp3")
+	}
+	if _, err := ExtractDataFromMP3(carrier); err == nil {
+		t.Error("clean file extracted")
+	}
+}
@@ -0,0 +1,397 @@
+package utils
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+)
+
+// MP4 carrier modes
+const (
+	MP4ModeUUID = "uuid" // payload in a top-level uuid box after the last box
+	MP4ModeFree = "free" // payload in a free box (an existing one when large enough, otherwise inserted before mdat)
+)
+
+// mp4PayloadUUID is the user type of the uuid box carrying the payload
+var mp4PayloadUUID = []byte{0x8a, 0x3c, 0x51, 0xe2, 0x6d, 0x0b, 0x4f, 0x97, 0xb1, 0x52, 0x2e, 0xc4, 0x90, 0x7a, 0x13, 0xd8}
+
+// mp4Box is a box header located inside the file
+type mp4Box struct {
+	Type       string
+	Offset     int // offset of the box header
+	HeaderSize int
+	Size       int  // total size including the header
+	ToEnd      bool // the header size is 0, the box extends to the end of the enclosing space
+}
+
+// body returns the box content without its header
+func (b mp4Box) body(data []byte) []byte {
+	return data[b.Offset+b.HeaderSize : b.Offset+b.Size]
+}
+
+// IsMP4 reports whether data looks like an ISO-BMFF (MP4/MOV) file
+func IsMP4(data []byte) bool {
+	if len(data) < 8 {
+		return false
+	}
+	switch string(data[4:8]) {
+	case "ftyp", "styp", "moov", "mdat", "free", "skip", "wide", "pdin":
+		return true
+	}
+	return false
+}
+
+// EmbedDataInMP4 stores data in a uuid or free box of an ISO-BMFF file
+func EmbedDataInMP4(mp4Data []byte, data []byte, mode string) ([]byte, error) {
+	var out bytes.Buffer
+	if err := EmbedDataInMP4Stream(bytes.NewReader(mp4Data), int64(len(mp4Data)), data, mode, &out); err != nil {
+		return nil, err
+	}
+	return out.Bytes(), nil
+}
+
+// EmbedDataInMP4Stream is EmbedDataInMP4 reading the size byte file from src and writing to dst.
+// Only box headers and the moov box are held in memory.
+func EmbedDataInMP4Stream(src io.ReaderAt, size int64, data []byte, mode string, dst io.Writer) error {
+	if len(data) == 0 {
+		return errors.New("data to embed cannot be empty")
+	}
+
+	if len(data) > MaxDataSize {
+		return fmt.Errorf("data too large: %d bytes, max allowed: %d bytes", len(data), MaxDataSize)
+	}
+
+	// Anything that does not parse as a box (e.g. a legacy appended payload) is dropped
+	boxes, _ := parseMP4BoxesAt(src, 0, int(size))
+	if len(boxes) == 0 {
+		return errors.New("not an mp4 file")
+	}
+
+	payload := prepareDataWithHeader(data)
+
+	switch mode {
+	case "", MP4ModeUUID:
+		// Replace a payload box written by a previous embed at the end of the file
+		if last := boxes[len(boxes)-1]; isMP4PayloadBox(src, last) {
+			boxes = boxes[:len(boxes)-1]
+		}
+
+		// A last box extending to the end of the file (often mdat from streaming writers)
+		// would swallow the payload box, so it gets its real size. A larger header would
+		// move the media data the chunk offsets point to.
+		if len(boxes) > 0 {
+			if last := boxes[len(boxes)-1]; last.ToEnd && last.Size > math.MaxUint32 {
+				return fmt.Errorf("mp4 %s box extends to the end of the file and is too large for a 32-bit size, use free mode", last.Type)
+			}
+		}
+
+		for _, b := range boxes {
+			switch {
+			case b.ToEnd:
+				header := binary.BigEndian.AppendUint32(nil, uint32(b.Size))
+				if _, err := dst.Write(append(header, b.Type...)); err != nil {
+					return err
+				}
+				if err := copyRange(dst, src, b.Offset+b.HeaderSize, b.Offset+b.Size); err != nil {
+					return err
+				}
+			case isMP4FreePayload(src, b):
+				// A payload of a free mode embed would be found before the uuid box
+				if err := writeMP4BoxContent(dst, src, b, nil); err != nil {
+					return err
+				}
+			default:
+				if err := copyRange(dst, src, b.Offset, b.Offset+b.Size); err != nil {
+					return err
+				}
+			}
+		}
+		_, err := dst.Write(makeMP4Box("uuid", append(append([]byte{}, mp4PayloadUUID...), payload...)))
+		return err
+
+	case MP4ModeFree:
+		return embedMP4FreeBox(src, boxes, payload, dst)
+
+	default:
+		return fmt.Errorf("invalid mp4 mode %q. Must be: %s or %s", mode, MP4ModeUUID, MP4ModeFree)
+	}
+}
+
+// ExtractDataFromMP4 walks the top-level boxes and returns the payload stored by EmbedDataInMP4
+func ExtractDataFromMP4(mp4Data []byte) ([]byte, error) {
+	return ExtractDataFromMP4Stream(bytes.NewReader(mp4Data), int64(len(mp4Data)))
+}
+
+// ExtractDataFromMP4Stream is ExtractDataFromMP4 reading the size byte file from src
+func ExtractDataFromMP4Stream(src io.ReaderAt, size int64) ([]byte, error) {
+	boxes, end := parseMP4BoxesAt(src, 0, int(size))
+	if len(boxes) == 0 {
+		return nil, errors.New("not an mp4 file")
+	}
+
+	for _, b := range boxes {
+		switch b.Type {
+		case "uuid":
+			if isMP4PayloadBox(src, b) {
+				return readHeaderedDataAt(src, b.Offset+b.HeaderSize+len(mp4PayloadUUID), b.Offset+b.Size)
+			}
+		case "free", "skip":
+			if data, err := readHeaderedDataAt(src, b.Offset+b.HeaderSize, b.Offset+b.Size); err == nil {
+				return data, nil
+			}
+		}
+	}
+
+	// Files embedded before the box-aware carrier have the payload appended after the last box
+	if data, err := readHeaderedDataAt(src, end, int(size)); err == nil {
+		return data, nil
+	}
+
+	return nil, errors.New("no embedded data found in mp4")
+}
+
+// isMP4PayloadBox reports whether b is the uuid box written by EmbedDataInMP4
+func isMP4PayloadBox(src io.ReaderAt, b mp4Box) bool {
+	if b.Type != "uuid" || b.Size-b.HeaderSize < len(mp4PayloadUUID) {
+		return false
+	}
+	userType, err := readRange(src, b.Offset+b.HeaderSize, b.Offset+b.HeaderSize+len(mp4PayloadUUID))
+	return err == nil && bytes.Equal(userType, mp4PayloadUUID)
+}
+
+// embedMP4FreeBox reuses a large enough free/skip box, or inserts a new free box
+// in front of the first mdat and shifts the chunk offsets that point past it.
+// Free boxes holding a payload from a previous embed are blanked and a uuid payload box
+// is dropped.
+func embedMP4FreeBox(src io.ReaderAt, boxes []mp4Box, payload []byte, dst io.Writer) error {
+	target, insertAt := -1, -1
+	for _, b := range boxes {
+		if (b.Type == "free" || b.Type == "skip") && b.Size-b.HeaderSize >= len(payload) {
+			target = b.Offset
+			break
+		}
+	}
+
+	var box []byte
+	moovs := make(map[int][]byte)
+	if target < 0 {
+		for _, b := range boxes {
+			switch b.Type {
+			case "moof":
+				// Fragment offsets (tfhd base_data_offset, sidx, mfra) are not rewritten
+				return errors.New("fragmented mp4 is not supported in free mode, use uuid mode")
+			case "mdat":
+				if insertAt < 0 {
+					insertAt = b.Offset
+				}
+			}
+		}
+		if insertAt < 0 {
+			return errors.New("mp4 file has no mdat box")
+		}
+
+		// moov is patched before anything is written, so a failure leaves dst untouched
+		box = makeMP4Box("free", payload)
+		for _, b := range boxes {
+			if b.Type != "moov" {
+				continue
+			}
+			moov, err := readRange(src, b.Offset, b.Offset+b.Size)
+			if err != nil {
+				return err
+			}
+			if err := shiftMP4ChunkOffsets(moov, mp4Box{Type: b.Type, HeaderSize: b.HeaderSize, Size: b.Size}, insertAt, len(box)); err != nil {
+				return err
+			}
+			moovs[b.Offset] = moov
+		}
+	}
+
+	for i, b := range boxes {
+		if b.Offset == insertAt {
+			if _, err := dst.Write(box); err != nil {
+				return err
+			}
+		}
+
+		if moov, ok := moovs[b.Offset]; ok {
+			if _, err := dst.Write(moov); err != nil {
+				return err
+			}
+			continue
+		}
+
+		var err error
+		switch {
+		case b.Offset == target:
+			err = writeMP4BoxContent(dst, src, b, payload)
+		case isMP4FreePayload(src, b):
+			err = writeMP4BoxContent(dst, src, b, nil)
+		case isMP4PayloadBox(src, b):
+			// A uuid mode payload box would be found first; it is the last box, so it is dropped
+			// when nothing follows, otherwise blanked after its user type to keep offsets
+			if i < len(boxes)-1 {
+				err = writeMP4BoxContent(dst, src, b, mp4PayloadUUID)
+			}
+		default:
+			err = copyRange(dst, src, b.Offset, b.Offset+b.Size)
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// isMP4FreePayload reports whether b is a free/skip box holding a payload of a free mode embed
+func isMP4FreePayload(src io.ReaderAt, b mp4Box) bool {
+	return (b.Type == "free" || b.Type == "skip") && hasHeaderedDataAt(src, b.Offset+b.HeaderSize, b.Offset+b.Size)
+}
+
+// writeMP4BoxContent writes the header of b followed by content, padded with zeros to the box size
+func writeMP4BoxContent(dst io.Writer, src io.ReaderAt, b mp4Box, content []byte) error {
+	if err := copyRange(dst, src, b.Offset, b.Offset+b.HeaderSize); err != nil {
+		return err
+	}
+	if _, err := dst.Write(content); err != nil {
+		return err
+	}
+	_, err := io.CopyN(dst, zeroReader{}, int64(b.Size-b.HeaderSize-len(content)))
+	return err
+}
+
+// shiftMP4ChunkOffsets adds delta to every stco/co64 entry inside moov that is >= from
+func shiftMP4ChunkOffsets(data []byte, moov mp4Box, from, delta int) error {
+	// moov > trak > mdia > minf > stbl > stco/co64
+	var walk func(parent mp4Box, path []string) error
+	walk = func(parent mp4Box, path []string) error {
+		children, _ := parseMP4Boxes(data, parent.Offset+parent.HeaderSize, parent.Offset+parent.Size)
+		for _, child := range children {
+			switch {
+			case len(path) > 0 && child.Type == path[0]:
+				if err := walk(child, path[1:]); err != nil {
+					return err
+				}
+			case len(path) == 0 && child.Type == "stco":
+				body := child.body(data)
+				if len(body) < 8 {
+					return errors.New("invalid stco box")
+				}
+				count := int(binary.BigEndian.Uint32(body[4:8]))
+				if 8+count*4 > len(body) {
+					return errors.New("invalid stco box")
+				}
+				for i := 0; i < count; i++ {
+					entry := body[8+i*4 : 12+i*4]
+					offset := uint64(binary.BigEndian.Uint32(entry))
+					if offset < uint64(from) {
+						continue
+					}
+					if offset+uint64(delta) > math.MaxUint32 {
+						return errors.New("chunk offsets would overflow stco, use uuid mode")
+					}
+					binary.BigEndian.PutUint32(entry, uint32(offset+uint64(delta)))
+				}
+			case len(path) == 0 && child.Type == "co64":
+				body := child.body(data)
+				if len(body) < 8 {
+					return errors.New("invalid co64 box")
+				}
+				count := int(binary.BigEndian.Uint32(body[4:8]))
+				if 8+count*8 > len(body) {
+					return errors.New("invalid co64 box")
+				}
+				for i := 0; i < count; i++ {
+					entry := body[8+i*8 : 16+i*8]
+					if offset := binary.BigEndian.Uint64(entry); offset >= uint64(from) {
+						binary.BigEndian.PutUint64(entry, offset+uint64(delta))
+					}
+				}
+			}
+		}
+		return nil
+	}
+
+	return walk(moov, []string{"trak", "mdia", "minf", "stbl"})
+}
+
+// parseMP4Boxes parses the boxes between start and end. It stops at the first
+// header that does not fit and returns the offset where parsing ended.
+func parseMP4Boxes(data []byte, start, end int) ([]mp4Box, int) {
+	return parseMP4BoxesAt(bytes.NewReader(data), start, end)
+}
+
+// parseMP4BoxesAt is parseMP4Boxes reading only the box headers from r
+func parseMP4BoxesAt(r io.ReaderAt, start, end int) ([]mp4Box, int) {
+	var boxes []mp4Box
+	var header [16]byte
+	pos := start
+	for pos+8 <= end {
+		if _, err := r.ReadAt(header[:8], int64(pos)); err != nil {
+			return boxes, pos
+		}
+		size := int(binary.BigEndian.Uint32(header[0:4]))
+		boxType := string(header[4:8])
+		headerSize := 8
+		toEnd := false
+
+		switch size {
+		case 0: // box extends to the end of the enclosing space
+			size, toEnd = end-pos, true
+		case 1: // 64-bit largesize follows the type
+			if pos+16 > end {
+				return boxes, pos
+			}
+			if _, err := r.ReadAt(header[8:16], int64(pos+8)); err != nil {
+				return boxes, pos
+			}
+			large := binary.BigEndian.Uint64(header[8:16])
+			if large > uint64(end-pos) {
+				return boxes, pos
+			}
+			size = int(large)
+			headerSize = 16
+		}
+
+		if size < headerSize || pos+size > end || !isMP4BoxType(boxType) {
+			return boxes, pos
+		}
+
+		boxes = append(boxes, mp4Box{Type: boxType, Offset: pos, HeaderSize: headerSize, Size: size, ToEnd: toEnd})
+		pos += size
+	}
+	return boxes, pos
+}
+
+// isMP4BoxType reports whether t is made of printable characters, as every box type is
+func isMP4BoxType(t string) bool {
+	for i := 0; i < len(t); i++ {
+		if t[i] < 0x20 || t[i] > 0x7E {
+			if t[i] != 0xA9 { // QuickTime uses © in udta atom names
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// makeMP4Box serializes a box with a 32-bit or 64-bit size as needed
+func makeMP4Box(boxType string, body []byte) []byte {
+	size := 8 + len(body)
+	if size <= math.MaxUint32 {
+		box := make([]byte, 8, size)
+		binary.BigEndian.PutUint32(box[0:4], uint32(size))
+		copy(box[4:8], boxType)
+		return append(box, body...)
+	}
+
+	box := make([]byte, 16, size+8)
+	binary.BigEndian.PutUint32(box[0:4], 1)
+	copy(box[4:8], boxType)
+	binary.BigEndian.PutUint64(box[8:16], uint64(size+8))
+	return append(box, body...)
+}
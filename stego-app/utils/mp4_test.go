@@ -0,0 +1,203 @@
+package utils
+
+import (
+	"bytes"
+	"encoding/binary"
+	"strings"
+	"testing"
+)
+
+// testMP4Chunks are the media samples of testMP4, each one chunk the stco box points to
+var testMP4Chunks = []string{"CHUNK-ZERO", "CHUNK-ONE", "CHUNK-TWO"}
+
+// testMP4 builds ftyp, moov with one track whose stco points into mdat, the boxes in
+// between and mdat. With toEnd the mdat size is 0, as streaming writers leave it.
+func testMP4(toEnd bool, between ...[]byte) []byte {
+	ftyp := makeMP4Box("ftyp", []byte("isom\x00\x00\x02\x00isomiso2"))
+	stco := func(offsets []int) []byte {
+		body := binary.BigEndian.AppendUint32(nil, 0)
+		body = binary.BigEndian.AppendUint32(body, uint32(len(offsets)))
+		for _, o := range offsets {
+			body = binary.BigEndian.AppendUint32(body, uint32(o))
+		}
+		return makeMP4Box("stco", body)
+	}
+	moov := func(offsets []int) []byte {
+		stbl := makeMP4Box("stbl", stco(offsets))
+		return makeMP4Box("moov", makeMP4Box("trak", makeMP4Box("mdia", makeMP4Box("minf", stbl))))
+	}
+
+	// The moov size does not depend on the offsets, so build it twice
+	mdatStart := len(ftyp) + len(moov(make([]int, len(testMP4Chunks)))) + len(bytes.Join(between, nil))
+	var offsets []int
+	pos := mdatStart + 8
+	for _, c := range testMP4Chunks {
+		offsets = append(offsets, pos)
+		pos += len(c)
+	}
+	mdat := makeMP4Box("mdat", []byte(strings.Join(testMP4Chunks, "")))
+	if toEnd {
+		binary.BigEndian.PutUint32(mdat, 0)
+	}
+	return bytes.Join([][]byte{ftyp, moov(offsets), bytes.Join(between, nil), mdat}, nil)
+}
+
+// checkMP4Chunks checks that every stco entry still points at its media sample
+func checkMP4Chunks(t *testing.T, name string, data []byte) {
+	t.Helper()
+	boxes, _ := parseMP4Boxes(data, 0, len(data))
+	found := false
+	for _, b := range boxes {
+		if b.Type != "moov" {
+			continue
+		}
+		i := bytes.Index(b.body(data), []byte("stco"))
+		body := b.body(data)[i+4:]
+		count := int(binary.BigEndian.Uint32(body[4:8]))
+		for j := 0; j < count; j++ {
+			offset := int(binary.BigEndian.Uint32(body[8+4*j:]))
+			if offset+len(testMP4Chunks[j]) > len(data) || string(data[offset:offset+len(testMP4Chunks[j])]) != testMP4Chunks[j] {
+				t.Fatalf("%s: chunk %d offset %d no longer points at its sample", name, j, offset)
+			}
+		}
+		found = true
+	}
+	if !found {
+		t.Fatalf("%s: moov box lost", name)
+	}
+}
+
+func TestMP4RoundTrip(t *testing.T) {
+	carriers := map[string][]byte{
+		"plain":       testMP4(false),
+		"mdat to end": testMP4(true),
+		"free box":    testMP4(false, makeMP4Box("free", make([]byte, 512))),
+		"small free":  testMP4(false, makeMP4Box("skip", make([]byte, 4))),
+	}
+	data := bytes.Repeat([]byte("mp4 payload "), 20)
+	for name, carrier := range carriers {
+		for _, mode := range []string{"", MP4ModeUUID, MP4ModeFree} {
+			out, err := EmbedDataInMP4(carrier, data, mode)
+			if err != nil {
+				t.Fatalf("%s, %q mode: %v", name, mode, err)
+			}
+			got, err := ExtractDataFromMP4(out)
+			if err != nil || !bytes.Equal(got, data) {
+				t.Fatalf("%s, %q mode: got %q, %v", name, mode, got, err)
+			}
+			checkMP4Chunks(t, name+" "+mode, out)
+			if boxes, end := parseMP4Boxes(out, 0, len(out)); end != len(out) || len(boxes) == 0 {
+				t.Fatalf("%s, %q mode: boxes end at %d of %d", name, mode, end, len(out))
+			}
+		}
+	}
+}
+
+func TestMP4FreeModeReusesFreeBox(t *testing.T) {
+	carrier := testMP4(false, makeMP4Box("free", make([]byte, 512)))
+	out, err := EmbedDataInMP4(carrier, []byte("in place"), MP4ModeFree)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(out) != len(carrier) {
+		t.Fatalf("size changed from %d to %d", len(carrier), len(out))
+	}
+}
+
+func TestMP4ReembedAcrossModes(t *testing.T) {
+	for name, carrier := range map[string][]byte{
+		"plain":       testMP4(false),
+		"mdat to end": testMP4(true),
+		"free box":    testMP4(false, makeMP4Box("free", make([]byte, 512))),
+	} {
+		out := carrier
+		modes := []string{MP4ModeUUID, MP4ModeFree, MP4ModeFree, MP4ModeUUID, MP4ModeUUID, MP4ModeFree}
+		for i, mode := range modes {
+			data := bytes.Repeat([]byte{byte('a' + i)}, 40+10*i)
+			var err error
+			out, err = EmbedDataInMP4(out, data, mode)
+			if err != nil {
+				t.Fatalf("%s, step %d (%s): %v", name, i, mode, err)
+			}
+			got, err := ExtractDataFromMP4(out)
+			if err != nil || !bytes.Equal(got, data) {
+				t.Fatalf("%s, step %d (%s): got %q, %v", name, i, mode, got, err)
+			}
+			checkMP4Chunks(t, name, out)
+
+			// Only the newest payload is left in the file
+			if i > 0 && bytes.Contains(out, bytes.Repeat([]byte{byte('a' + i - 1)}, 40)) {
+				t.Fatalf("%s, step %d (%s): previous payload left in the file", name, i, mode)
+			}
+		}
+	}
+}
+
+func TestMP4LegacyAppendedPayload(t *testing.T) {
+	out := append(testMP4(false), prepareDataWithHeader([]byte("appended"))...)
+	got, err := ExtractDataFromMP4(out)
+	if err != nil || string(got) != "appended" {
+		t.Fatalf("got %q, %v", got, err)
+	}
+
+	// Embedding again drops the appended payload
+	out, err = EmbedDataInMP4(out, []byte("boxed"), MP4ModeUUID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(out, []byte("appended")) {
+		t.Fatal("appended payload left in the file")
+	}
+}
+
+func TestMP4Malformed(t *testing.T) {
+	carrier := testMP4(false)
+	if _, err := EmbedDataInMP4([]byte("not an mp4 file at all"), []byte("x"), ""); err == nil {
+		t.Error("non-mp4 data accepted")
+	}
+	if _, err := EmbedDataInMP4(carrier, []byte("x"), "moov"); err == nil {
+		t.Error("invalid mode accepted")
+	}
+	if _, err := EmbedDataInMP4(carrier, nil, ""); err == nil {
+		t.Error("empty data accepted")
+	}
+
+	fragmented := append(testMP4(false), makeMP4Box("moof", make([]byte, 16))...)
+	if _, err := EmbedDataInMP4(fragmented, []byte("x"), MP4ModeFree); err == nil {
+		t.Error("fragmented mp4 accepted in free mode")
+	}
+	noMdat := makeMP4Box("ftyp", []byte("isom"))
+	if _, err := EmbedDataInMP4(noMdat, []byte("x"), MP4ModeFree); err == nil {
+		t.Error("mp4 without mdat accepted in free mode")
+	}
+
+	// A corrupt stco count must be reported, not read past the box
+	bad := testMP4(false)
+	i := bytes.Index(bad, []byte("stco"))
+	binary.BigEndian.PutUint32(bad[i+8:], 1000)
+	if _, err := EmbedDataInMP4(bad, []byte("x"), MP4ModeFree); err == nil {
+		t.Error("invalid stco accepted")
+	}
+
+	if _, err := ExtractDataFromMP4(carrier); err == nil {
+		t.Error("clean file extracted")
+	}
+	out, err := EmbedDataInMP4(carrier, []byte("truncated payload"), MP4ModeUUID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, n := range []int{len(out) - 5, len(carrier) + 12, 7} {
+		if _, err := ExtractDataFromMP4(out[:n]); err == nil {
+			t.Errorf("file truncated to %d bytes extracted", n)
+		}
+	}
+
+	// Box sizes larger than the file or smaller than their header end the box list
+	for _, size := range []uint32{4, 1 << 30} {
+		bad := bytes.Clone(carrier)
+		binary.BigEndian.PutUint32(bad, size)
+		if _, err := EmbedDataInMP4(bad, []byte("x"), ""); err == nil {
+			t.Errorf("box size %d accepted", size)
+		}
+	}
+}
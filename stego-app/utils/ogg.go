@@ -0,0 +1,439 @@
+package utils
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// Ogg page header flags
+const (
+	oggFlagContinued = 0x01
+	oggFlagBOS       = 0x02
+	oggFlagEOS       = 0x04
+
+	oggMaxSegments = 255
+)
+
+// oggCommentField is the comment name that carries the base64 encoded payload
+const oggCommentField = "STEGO_APP_PAYLOAD"
+
+var oggCapturePattern = []byte("OggS")
+
+// oggCRCTable is the lookup table for the Ogg CRC-32 (polynomial 0x04c11db7, no reflection)
+var oggCRCTable = func() [256]uint32 {
+	var table [256]uint32
+	for i := range table {
+		r := uint32(i) << 24
+		for j := 0; j < 8; j++ {
+			if r&0x80000000 != 0 {
+				r = r<<1 ^ 0x04C11DB7
+			} else {
+				r <<= 1
+			}
+		}
+		table[i] = r
+	}
+	return table
+}()
+
+// oggPage is a single parsed Ogg page
+type oggPage struct {
+	Flags    byte
+	Granule  uint64
+	Serial   uint32
+	Sequence uint32
+	Segments []byte // lacing values
+	Body     []byte
+	Raw      []byte // the page exactly as it appeared in the file
+}
+
+// oggCodec describes how the header packets of a supported codec look
+type oggCodec struct {
+	headerPackets int    // number of header packets before audio
+	commentPrefix []byte // magic at the start of the comment packet
+	framingBit    bool   // Vorbis terminates the comment packet with a framing bit
+}
+
+var (
+	oggVorbis = oggCodec{headerPackets: 3, commentPrefix: []byte("\x03vorbis"), framingBit: true}
+	oggOpus   = oggCodec{headerPackets: 2, commentPrefix: []byte("OpusTags")}
+)
+
+// IsOgg reports whether data starts with an Ogg page
+func IsOgg(data []byte) bool {
+	return bytes.HasPrefix(data, oggCapturePattern)
+}
+
+// EmbedDataInOgg stores data in a comment of the Vorbis or Opus comment header.
+// Header pages are re-paginated and every following page of the stream gets
+// its sequence number and CRC rewritten, so players keep accepting the file.
+func EmbedDataInOgg(oggData []byte, data []byte) ([]byte, error) {
+	if len(data) == 0 {
+		return nil, errors.New("data to embed cannot be empty")
+	}
+
+	if len(data) > MaxDataSize {
+		return nil, fmt.Errorf("data too large: %d bytes, max allowed: %d bytes", len(data), MaxDataSize)
+	}
+
+	pages, err := parseOggPages(oggData)
+	if err != nil {
+		return nil, err
+	}
+
+	serial, codec, err := findOggAudioStream(pages)
+	if err != nil {
+		return nil, err
+	}
+
+	packets, headerPages, err := readOggHeaderPackets(pages, serial, codec)
+	if err != nil {
+		return nil, err
+	}
+
+	value := base64.StdEncoding.EncodeToString(prepareDataWithHeader(data))
+	packets[1], err = setOggComment(packets[1], codec, oggCommentField+"="+value)
+	if err != nil {
+		return nil, err
+	}
+
+	// Header packets: the identification header alone on the BOS page,
+	// the remaining headers packed together and finishing their last page
+	bosPages := paginateOggPackets(packets[:1], serial, 0, oggFlagBOS)
+	restPages := paginateOggPackets(packets[1:], serial, uint32(len(bosPages)), 0)
+
+	var buf bytes.Buffer
+	buf.Grow(len(oggData) + len(value) + len(value)/oggMaxSegments + 1024)
+
+	sequence := uint32(len(bosPages) + len(restPages))
+	bosWritten, restWritten := false, false
+	for i, p := range pages {
+		// The BOS pages of all multiplexed streams come first, the other header pages after them
+		if bosWritten && !restWritten && p.Flags&oggFlagBOS == 0 {
+			for _, hp := range restPages {
+				buf.Write(hp)
+			}
+			restWritten = true
+		}
+		switch {
+		case p.Serial != serial:
+			buf.Write(p.Raw)
+		case i < headerPages:
+			if !bosWritten {
+				for _, hp := range bosPages {
+					buf.Write(hp)
+				}
+				bosWritten = true
+			}
+		default:
+			p.Sequence = sequence
+			sequence++
+			buf.Write(encodeOggPage(p))
+		}
+	}
+	if !restWritten {
+		for _, hp := range restPages {
+			buf.Write(hp)
+		}
+	}
+
+	return buf.Bytes(), nil
+}
+
+// ExtractDataFromOgg extracts data stored by EmbedDataInOgg
+func ExtractDataFromOgg(oggData []byte) ([]byte, error) {
+	pages, err := parseOggPages(oggData)
+	if err != nil {
+		return nil, err
+	}
+
+	serial, codec, err := findOggAudioStream(pages)
+	if err != nil {
+		return nil, err
+	}
+
+	packets, _, err := readOggHeaderPackets(pages, serial, codec)
+	if err != nil {
+		return nil, err
+	}
+
+	_, comments, _, err := parseOggComments(packets[1], codec)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, c := range comments {
+		if payload, ok := oggPayloadComment(c); ok {
+			if data, err := parseHeaderedData(payload); err == nil {
+				return data, nil
+			}
+		}
+	}
+
+	return nil, errors.New("no embedded data found in ogg")
+}
+
+// parseOggPages splits the file into pages, checking every CRC on the way
+func parseOggPages(data []byte) ([]oggPage, error) {
+	var pages []oggPage
+	pos := 0
+	for pos < len(data) {
+		if pos+27 > len(data) || !bytes.Equal(data[pos:pos+4], oggCapturePattern) {
+			if len(pages) > 0 {
+				break // trailing bytes after the last page
+			}
+			return nil, errors.New("not an ogg file")
+		}
+		if data[pos+4] != 0 {
+			return nil, fmt.Errorf("unsupported ogg version %d", data[pos+4])
+		}
+		numSegments := int(data[pos+26])
+		headerLength := 27 + numSegments
+		if pos+headerLength > len(data) {
+			return nil, errors.New("truncated ogg page header")
+		}
+		segments := data[pos+27 : pos+headerLength]
+		bodyLength := 0
+		for _, s := range segments {
+			bodyLength += int(s)
+		}
+		if pos+headerLength+bodyLength > len(data) {
+			return nil, errors.New("truncated ogg page")
+		}
+
+		raw := data[pos : pos+headerLength+bodyLength]
+		if oggChecksum(raw) != binary.LittleEndian.Uint32(raw[22:26]) {
+			return nil, fmt.Errorf("ogg page %d has a bad checksum", len(pages))
+		}
+
+		pages = append(pages, oggPage{
+			Flags:    raw[5],
+			Granule:  binary.LittleEndian.Uint64(raw[6:14]),
+			Serial:   binary.LittleEndian.Uint32(raw[14:18]),
+			Sequence: binary.LittleEndian.Uint32(raw[18:22]),
+			Segments: segments,
+			Body:     raw[headerLength:],
+			Raw:      raw,
+		})
+		pos += headerLength + bodyLength
+	}
+
+	return pages, nil
+}
+
+// findOggAudioStream returns the serial number and codec of the first Vorbis or Opus stream
+func findOggAudioStream(pages []oggPage) (uint32, oggCodec, error) {
+	for _, p := range pages {
+		if p.Flags&oggFlagBOS == 0 {
+			continue
+		}
+		switch {
+		case bytes.HasPrefix(p.Body, []byte("\x01vorbis")):
+			return p.Serial, oggVorbis, nil
+		case bytes.HasPrefix(p.Body, []byte("OpusHead")):
+			return p.Serial, oggOpus, nil
+		}
+	}
+	return 0, oggCodec{}, errors.New("no vorbis or opus stream found in ogg file")
+}
+
+// readOggHeaderPackets reassembles the header packets of a stream and returns them
+// together with the index just past the last page that holds header data
+func readOggHeaderPackets(pages []oggPage, serial uint32, codec oggCodec) ([][]byte, int, error) {
+	var packets [][]byte
+	var current []byte
+
+	for i, p := range pages {
+		if p.Serial != serial {
+			continue
+		}
+		offset := 0
+		for j, s := range p.Segments {
+			current = append(current, p.Body[offset:offset+int(s)]...)
+			offset += int(s)
+			if s == 255 {
+				continue
+			}
+			packets = append(packets, current)
+			current = nil
+			if len(packets) == codec.headerPackets {
+				if j != len(p.Segments)-1 {
+					return nil, 0, errors.New("ogg header page also carries audio data")
+				}
+				if !bytes.HasPrefix(packets[1], codec.commentPrefix) {
+					return nil, 0, errors.New("ogg comment header not found")
+				}
+				return packets, i + 1, nil
+			}
+		}
+	}
+
+	return nil, 0, errors.New("truncated ogg header packets")
+}
+
+// parseOggComments splits a comment packet into vendor string, comments and the trailing bytes
+func parseOggComments(packet []byte, codec oggCodec) (string, []string, []byte, error) {
+	r := packet[len(codec.commentPrefix):]
+	readString := func() (string, bool) {
+		if len(r) < 4 {
+			return "", false
+		}
+		n := binary.LittleEndian.Uint32(r[:4])
+		if uint64(n) > uint64(len(r)-4) {
+			return "", false
+		}
+		s := string(r[4 : 4+n])
+		r = r[4+n:]
+		return s, true
+	}
+
+	vendor, ok := readString()
+	if !ok || len(r) < 4 {
+		return "", nil, nil, errors.New("corrupted ogg comment header")
+	}
+	count := binary.LittleEndian.Uint32(r[:4])
+	r = r[4:]
+
+	var comments []string
+	for i := uint32(0); i < count; i++ {
+		c, ok := readString()
+		if !ok {
+			return "", nil, nil, errors.New("corrupted ogg comment header")
+		}
+		comments = append(comments, c)
+	}
+
+	// Vorbis framing bit or Opus binary extension data
+	return vendor, comments, r, nil
+}
+
+// oggPayloadComment returns the decoded value of a payload comment of an earlier embed
+func oggPayloadComment(comment string) ([]byte, bool) {
+	name, value, ok := strings.Cut(comment, "=")
+	if !ok || !strings.EqualFold(name, oggCommentField) {
+		return nil, false
+	}
+	decoded, err := base64.StdEncoding.DecodeString(value)
+	if err != nil || len(decoded) < 8 || binary.LittleEndian.Uint32(decoded) != MagicNumber {
+		return nil, false
+	}
+	return decoded, true
+}
+
+// setOggComment returns a copy of the comment packet with comment added and the payload
+// comments of earlier embeds removed
+func setOggComment(packet []byte, codec oggCodec, comment string) ([]byte, error) {
+	vendor, comments, tail, err := parseOggComments(packet, codec)
+	if err != nil {
+		return nil, err
+	}
+
+	var kept []string
+	for _, c := range comments {
+		if _, ok := oggPayloadComment(c); !ok {
+			kept = append(kept, c)
+		}
+	}
+	kept = append(kept, comment)
+
+	var buf bytes.Buffer
+	writeString := func(s string) {
+		binary.Write(&buf, binary.LittleEndian, uint32(len(s)))
+		buf.WriteString(s)
+	}
+	buf.Write(codec.commentPrefix)
+	writeString(vendor)
+	binary.Write(&buf, binary.LittleEndian, uint32(len(kept)))
+	for _, c := range kept {
+		writeString(c)
+	}
+	if codec.framingBit && len(tail) == 0 {
+		tail = []byte{0x01}
+	}
+	buf.Write(tail)
+
+	return buf.Bytes(), nil
+}
+
+// paginateOggPackets lays packets out on header pages (granule 0) starting at sequence.
+// The last packet always finishes its page.
+func paginateOggPackets(packets [][]byte, serial, sequence uint32, flags byte) [][]byte {
+	var segments []byte
+	var body []byte
+	for _, p := range packets {
+		for n := len(p); n >= 255; n -= 255 {
+			segments = append(segments, 255)
+		}
+		segments = append(segments, byte(len(p)%255))
+		body = append(body, p...)
+	}
+
+	var pages [][]byte
+	offset := 0
+	continued := false
+	for len(segments) > 0 {
+		n := min(len(segments), oggMaxSegments)
+		pageSegments := segments[:n]
+		segments = segments[n:]
+
+		length := 0
+		for _, s := range pageSegments {
+			length += int(s)
+		}
+
+		page := oggPage{
+			Flags:    flags,
+			Serial:   serial,
+			Sequence: sequence,
+			Segments: pageSegments,
+			Body:     body[offset : offset+length],
+		}
+		if continued {
+			page.Flags |= oggFlagContinued
+		}
+		// A page on which no packet ends carries granule position -1
+		if pageSegments[n-1] == 255 {
+			page.Granule = ^uint64(0)
+		}
+
+		pages = append(pages, encodeOggPage(page))
+		flags &^= oggFlagBOS
+		continued = pageSegments[n-1] == 255
+		offset += length
+		sequence++
+	}
+
+	return pages
+}
+
+// encodeOggPage serializes a page and fills in its CRC
+func encodeOggPage(p oggPage) []byte {
+	page := make([]byte, 27+len(p.Segments)+len(p.Body))
+	copy(page, oggCapturePattern)
+	page[4] = 0
+	page[5] = p.Flags
+	binary.LittleEndian.PutUint64(page[6:14], p.Granule)
+	binary.LittleEndian.PutUint32(page[14:18], p.Serial)
+	binary.LittleEndian.PutUint32(page[18:22], p.Sequence)
+	page[26] = byte(len(p.Segments))
+	copy(page[27:], p.Segments)
+	copy(page[27+len(p.Segments):], p.Body)
+	binary.LittleEndian.PutUint32(page[22:26], oggChecksum(page))
+	return page
+}
+
+// oggChecksum computes the page CRC with the checksum field treated as zero
+func oggChecksum(page []byte) uint32 {
+	var crc uint32
+	for i, b := range page {
+		if i >= 22 && i < 26 {
+			b = 0
+		}
+		crc = crc<<8 ^ oggCRCTable[byte(crc>>24)^b]
+	}
+	return crc
+}
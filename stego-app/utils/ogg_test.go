@@ -0,0 +1,187 @@
+package utils
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+)
+
+// testOggComment builds a comment header packet with a vendor string and the comments
+func testOggComment(codec oggCodec, comments ...string) []byte {
+	packet := bytes.Clone(codec.commentPrefix)
+	packet = binary.LittleEndian.AppendUint32(packet, 6)
+	packet = append(packet, "vendor"...)
+	packet = binary.LittleEndian.AppendUint32(packet, uint32(len(comments)))
+	for _, c := range comments {
+		packet = binary.LittleEndian.AppendUint32(packet, uint32(len(c)))
+		packet = append(packet, c...)
+	}
+	if codec.framingBit {
+		packet = append(packet, 1)
+	}
+	return packet
+}
+
+// testOgg builds an Ogg Vorbis or Opus stream with serial 1 and three audio pages. With
+// video set, a second stream with serial 2 is multiplexed in as Ogg Theora files do.
+func testOgg(codec oggCodec, video bool) []byte {
+	var packets [][]byte
+	if codec.headerPackets == 3 {
+		packets = [][]byte{[]byte("\x01vorbis identification"), testOggComment(codec, "TITLE=test"), []byte("\x05vorbis setup")}
+	} else {
+		packets = [][]byte{[]byte("OpusHead identification"), testOggComment(codec, "TITLE=test")}
+	}
+	var out []byte
+	bos := paginateOggPackets(packets[:1], 1, 0, oggFlagBOS)
+	for _, p := range bos {
+		out = append(out, p...)
+	}
+	if video {
+		for _, p := range paginateOggPackets([][]byte{[]byte("\x80theora")}, 2, 0, oggFlagBOS) {
+			out = append(out, p...)
+		}
+	}
+	for _, p := range paginateOggPackets(packets[1:], 1, uint32(len(bos)), 0) {
+		out = append(out, p...)
+	}
+	sequence := uint32(len(bos) + 1)
+	for i := 0; i < 3; i++ {
+		audio := bytes.Repeat([]byte{byte('A' + i)}, 100)
+		page := oggPage{Granule: uint64(1000 * (i + 1)), Serial: 1, Sequence: sequence, Segments: []byte{100}, Body: audio}
+		if i == 2 {
+			page.Flags = oggFlagEOS
+		}
+		out = append(out, encodeOggPage(page)...)
+		sequence++
+		if video {
+			out = append(out, encodeOggPage(oggPage{Serial: 2, Sequence: uint32(i + 1), Segments: []byte{5}, Body: []byte("frame")})...)
+		}
+	}
+	return out
+}
+
+// checkOggPages checks the CRCs, the per-stream sequence numbers and that the audio
+// pages of the carrier are kept
+func checkOggPages(t *testing.T, name string, carrier, out []byte) {
+	t.Helper()
+	pages, err := parseOggPages(out)
+	if err != nil {
+		t.Fatalf("%s: %v", name, err)
+	}
+	next := map[uint32]uint32{}
+	for _, p := range pages {
+		if p.Sequence != next[p.Serial] {
+			t.Fatalf("%s: stream %d page has sequence %d, want %d", name, p.Serial, p.Sequence, next[p.Serial])
+		}
+		next[p.Serial]++
+	}
+	if pages[0].Flags&oggFlagBOS == 0 || pages[len(pages)-1].Flags&oggFlagEOS == 0 && pages[len(pages)-1].Serial == 1 {
+		t.Fatalf("%s: BOS or EOS page misplaced", name)
+	}
+	for i := 0; i < 3; i++ {
+		if !bytes.Contains(out, bytes.Repeat([]byte{byte('A' + i)}, 100)) {
+			t.Fatalf("%s: audio page %d lost", name, i)
+		}
+	}
+	if bytes.Contains(carrier, []byte("theora")) && bytes.Count(out, []byte("frame")) != 3 {
+		t.Fatalf("%s: video pages lost", name)
+	}
+}
+
+func TestOggRoundTrip(t *testing.T) {
+	for _, codec := range []oggCodec{oggVorbis, oggOpus} {
+		for _, video := range []bool{false, true} {
+			carrier := testOgg(codec, video)
+			name := string(codec.commentPrefix)
+			if video {
+				name += " with video"
+			}
+			for _, data := range [][]byte{[]byte("ogg payload"), bytes.Repeat([]byte{0x37}, 100000)} {
+				out, err := EmbedDataInOgg(carrier, data)
+				if err != nil {
+					t.Fatalf("%s: %v", name, err)
+				}
+				got, err := ExtractDataFromOgg(out)
+				if err != nil || !bytes.Equal(got, data) {
+					t.Fatalf("%s: got %d bytes, %v", name, len(got), err)
+				}
+				checkOggPages(t, name, carrier, out)
+
+				packets, _, _ := readOggHeaderPackets(mustParseOggPages(t, out), 1, codec)
+				_, comments, tail, err := parseOggComments(packets[1], codec)
+				if err != nil || len(comments) != 2 || comments[0] != "TITLE=test" {
+					t.Fatalf("%s: comments %q, %v", name, comments, err)
+				}
+				if codec.framingBit != bytes.Equal(tail, []byte{1}) {
+					t.Fatalf("%s: comment header ends with %q", name, tail)
+				}
+			}
+		}
+	}
+}
+
+func mustParseOggPages(t *testing.T, data []byte) []oggPage {
+	t.Helper()
+	pages, err := parseOggPages(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pages
+}
+
+func TestOggReembed(t *testing.T) {
+	out := testOgg(oggVorbis, true)
+	for _, data := range []string{"first", "a second, longer payload", "third"} {
+		var err error
+		out, err = EmbedDataInOgg(out, []byte(data))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got, err := ExtractDataFromOgg(out); err != nil || string(got) != data {
+			t.Fatalf("got %q, %v", got, err)
+		}
+	}
+	if n := bytes.Count(out, []byte(oggCommentField)); n != 1 {
+		t.Fatalf("%d payload comments", n)
+	}
+	checkOggPages(t, "reembed", nil, out)
+}
+
+func TestOggMalformed(t *testing.T) {
+	carrier := testOgg(oggVorbis, false)
+	badCRC := bytes.Clone(carrier)
+	badCRC[len(badCRC)-1] ^= 1
+	version := bytes.Clone(carrier)
+	version[4] = 1
+	pages := mustParseOggPages(t, carrier)
+	first := pages[0]
+	first.Body = bytes.Replace(first.Body, []byte("vorbis"), []byte("vorbiz"), 1)
+	noAudio := append(encodeOggPage(first), carrier[len(first.Raw):]...)
+	badComment := testOggComment(oggVorbis)
+	binary.LittleEndian.PutUint32(badComment[len(oggVorbis.commentPrefix):], 1000)
+	corruptComments := bytes.Join(paginateOggPackets([][]byte{[]byte("\x01vorbis id")}, 1, 0, oggFlagBOS), nil)
+	corruptComments = append(corruptComments, bytes.Join(paginateOggPackets([][]byte{badComment, []byte("\x05vorbis")}, 1, 1, 0), nil)...)
+
+	for name, bad := range map[string][]byte{
+		"not ogg":          []byte("RIFF not ogg"),
+		"bad crc":          badCRC,
+		"version":          version,
+		"no audio stream":  noAudio,
+		"truncated page":   carrier[:40],
+		"missing headers":  carrier[:len(pages[0].Raw)],
+		"corrupt comments": corruptComments,
+	} {
+		if _, err := EmbedDataInOgg(bad, []byte("x")); err == nil {
+			t.Errorf("%s accepted", name)
+		}
+		if _, err := ExtractDataFromOgg(bad); err == nil {
+			t.Errorf("%s extracted", name)
+		}
+	}
+	if _, err := EmbedDataInOgg(carrier, nil); err == nil {
+		t.Error("empty data accepted")
+	}
+	if _, err := ExtractDataFromOgg(carrier); err == nil {
+		t.Error("clean file extracted")
+	}
+}
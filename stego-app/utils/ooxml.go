@@ -0,0 +1,354 @@
+package utils
+
+import (
+	"archive/zip"
+	"bytes"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// OOXML documents (docx/xlsx/pptx) carry the payload in a custom XML data store part,
+// the same kind of part Office writes for document properties bound to content controls.
+// It is registered in [Content_Types].xml and related from the main document part, so
+// Office and LibreOffice open the package without repair prompts.
+
+// OOXML embedding modes
+const (
+	OOXMLModeCustomXML = "customxml" // payload in a customXml/itemN.xml part (default)
+)
+
+// Custom XML namespace holding the base64 payload as its Data element
+const ooxmlPayloadNS = "http://ns.stego-app.local/ooxml/1.0/"
+
+// Package part names and content types
+const (
+	ooxmlContentTypes    = "[Content_Types].xml"
+	ooxmlPackageRels     = "_rels/.rels"
+	ooxmlRelsContentType = "application/vnd.openxmlformats-package.relationships+xml"
+	ooxmlPropsType       = "application/vnd.openxmlformats-officedocument.customXmlProperties+xml"
+	ooxmlRelsNS          = "http://schemas.openxmlformats.org/package/2006/relationships"
+	ooxmlDataStoreNS     = "http://schemas.openxmlformats.org/officeDocument/2006/customXml"
+)
+
+// ooxmlItemPattern matches the custom XML data parts of a package
+var ooxmlItemPattern = regexp.MustCompile(`^customXml/item\d+\.xml$`)
+
+// ooxmlRels is a relationships part
+type ooxmlRels struct {
+	Relationships []struct {
+		ID         string `xml:"Id,attr"`
+		Type       string `xml:"Type,attr"`
+		Target     string `xml:"Target,attr"`
+		TargetMode string `xml:"TargetMode,attr"`
+	} `xml:"Relationship"`
+}
+
+// ooxmlTypes is the [Content_Types].xml part
+type ooxmlTypes struct {
+	Defaults []struct {
+		Extension   string `xml:"Extension,attr"`
+		ContentType string `xml:"ContentType,attr"`
+	} `xml:"Default"`
+}
+
+// IsOOXML checks if data starts like an OOXML package: a ZIP archive whose
+// first entry is usually [Content_Types].xml
+func IsOOXML(data []byte) bool {
+	return bytes.HasPrefix(data, []byte("PK\x03\x04")) && bytes.Contains(data[:min(len(data), 512)], []byte(ooxmlContentTypes))
+}
+
+// EmbedDataInOOXML embeds data in a custom XML part of an OOXML document
+func EmbedDataInOOXML(docData []byte, data []byte, mode string) ([]byte, error) {
+	var out bytes.Buffer
+	if err := EmbedDataInOOXMLStream(bytes.NewReader(docData), int64(len(docData)), data, mode, &out); err != nil {
+		return nil, err
+	}
+	return out.Bytes(), nil
+}
+
+// EmbedDataInOOXMLStream is EmbedDataInOOXML reading the size byte document from src and writing to dst.
+// Parts that are not changed are copied without recompressing them.
+func EmbedDataInOOXMLStream(src io.ReaderAt, size int64, data []byte, mode string, dst io.Writer) error {
+	if size == 0 {
+		return errors.New("office document data cannot be empty")
+	}
+
+	if len(data) == 0 {
+		return errors.New("data to embed cannot be empty")
+	}
+
+	if len(data) > MaxDataSize {
+		return fmt.Errorf("data too large: %d bytes, max allowed: %d bytes", len(data), MaxDataSize)
+	}
+
+	if mode != "" && mode != OOXMLModeCustomXML {
+		return invalidOOXMLMode(mode)
+	}
+
+	r, err := zip.NewReader(src, size)
+	if err != nil {
+		return errors.New("invalid office document: " + err.Error())
+	}
+	files := make(map[string]*zip.File, len(r.File))
+	for _, f := range r.File {
+		files[f.Name] = f
+	}
+	types, ok := files[ooxmlContentTypes]
+	if !ok {
+		return errors.New("invalid office document: " + ooxmlContentTypes + " not found")
+	}
+
+	item := fmt.Sprintf(`<?xml version="1.0" encoding="UTF-8" standalone="no"?>`+"\n"+
+		`<stg:payload xmlns:stg="%s"><stg:Data>%s</stg:Data></stg:payload>`,
+		ooxmlPayloadNS, base64.StdEncoding.EncodeToString(prepareDataWithHeader(data)))
+
+	// A payload of an earlier embed is replaced in place, its part is already wired up
+	changed := map[string][]byte{}
+	var added []string
+	if name, ok := findOOXMLPayloadPart(r); ok {
+		changed[name] = []byte(item)
+	} else {
+		added, err = addOOXMLPayloadPart(files, []byte(item), changed)
+		if err != nil {
+			return err
+		}
+	}
+
+	w := zip.NewWriter(dst)
+	for _, f := range r.File {
+		if content, ok := changed[f.Name]; ok {
+			if err := writeZipEntry(w, f.Name, &f.FileHeader, content); err != nil {
+				return err
+			}
+			delete(changed, f.Name)
+			continue
+		}
+		if err := copyZipEntry(w, f, f.Extra); err != nil {
+			return err
+		}
+	}
+	for _, name := range added {
+		if err := writeZipEntry(w, name, &types.FileHeader, changed[name]); err != nil {
+			return err
+		}
+	}
+	if err := w.SetComment(r.Comment); err != nil {
+		return err
+	}
+	return w.Close()
+}
+
+// ExtractDataFromOOXML extracts data hidden in a custom XML part of an OOXML document
+func ExtractDataFromOOXML(docData []byte) ([]byte, error) {
+	return ExtractDataFromOOXMLStream(bytes.NewReader(docData), int64(len(docData)))
+}
+
+// ExtractDataFromOOXMLStream is ExtractDataFromOOXML for the size byte document read from src
+func ExtractDataFromOOXMLStream(src io.ReaderAt, size int64) ([]byte, error) {
+	if size == 0 {
+		return nil, errors.New("office document data cannot be empty")
+	}
+
+	r, err := zip.NewReader(src, size)
+	if err != nil {
+		return nil, errors.New("invalid office document: " + err.Error())
+	}
+	for _, f := range r.File {
+		if !ooxmlItemPattern.MatchString(f.Name) {
+			continue
+		}
+		if data, ok := ooxmlPayload(f); ok {
+			return data, nil
+		}
+	}
+	return nil, errors.New("no embedded data found in office document")
+}
+
+// invalidOOXMLMode reports a mode office documents do not support
+func invalidOOXMLMode(mode string) error {
+	return fmt.Errorf("invalid office mode %q. Must be: %s", mode, OOXMLModeCustomXML)
+}
+
+// findOOXMLPayloadPart returns the custom XML part holding a payload of an earlier embed
+func findOOXMLPayloadPart(r *zip.Reader) (string, bool) {
+	for _, f := range r.File {
+		if !ooxmlItemPattern.MatchString(f.Name) {
+			continue
+		}
+		if _, ok := ooxmlPayload(f); ok {
+			return f.Name, true
+		}
+	}
+	return "", false
+}
+
+// ooxmlPayload reads the payload from a custom XML part
+func ooxmlPayload(f *zip.File) ([]byte, bool) {
+	// base64 grows the payload by 4/3, anything much larger is not ours
+	if f.UncompressedSize64 > 2*MaxDataSize {
+		return nil, false
+	}
+	content, err := readZipEntry(f)
+	if err != nil {
+		return nil, false
+	}
+	return findXMLPayload(content, ooxmlPayloadNS, "Data")
+}
+
+// addOOXMLPayloadPart creates the custom XML part with its properties part and relationships,
+// relates it from the main document part and registers the content types. The new and
+// modified parts are stored in changed; the names of the new ones are returned in order.
+func addOOXMLPayloadPart(files map[string]*zip.File, item []byte, changed map[string][]byte) ([]string, error) {
+	main, relType, err := ooxmlMainPart(files)
+	if err != nil {
+		return nil, err
+	}
+
+	n := 1
+	for files[fmt.Sprintf("customXml/item%d.xml", n)] != nil || files[fmt.Sprintf("customXml/itemProps%d.xml", n)] != nil ||
+		files[fmt.Sprintf("customXml/_rels/item%d.xml.rels", n)] != nil {
+		n++
+	}
+	itemName := fmt.Sprintf("customXml/item%d.xml", n)
+	propsName := fmt.Sprintf("customXml/itemProps%d.xml", n)
+	itemRelsName := fmt.Sprintf("customXml/_rels/item%d.xml.rels", n)
+
+	// Relationship types share the namespace of the officeDocument relationship,
+	// which differs between transitional and strict documents
+	typeBase := strings.TrimSuffix(relType, "officeDocument")
+
+	guid := make([]byte, 16)
+	if _, err := rand.Read(guid); err != nil {
+		return nil, err
+	}
+	guid[6] = guid[6]&0x0f | 0x40
+	guid[8] = guid[8]&0x3f | 0x80
+	props := fmt.Sprintf(`<?xml version="1.0" encoding="UTF-8" standalone="no"?>`+"\n"+
+		`<ds:datastoreItem ds:itemID="{%X-%X-%X-%X-%X}" xmlns:ds="%s"><ds:schemaRefs><ds:schemaRef ds:uri="%s"/></ds:schemaRefs></ds:datastoreItem>`,
+		guid[0:4], guid[4:6], guid[6:8], guid[8:10], guid[10:16], ooxmlDataStoreNS, ooxmlPayloadNS)
+	itemRels := fmt.Sprintf(`<?xml version="1.0" encoding="UTF-8" standalone="yes"?>`+"\n"+
+		`<Relationships xmlns="%s"><Relationship Id="rId1" Type="%scustomXmlProps" Target="itemProps%d.xml"/></Relationships>`,
+		ooxmlRelsNS, typeBase, n)
+
+	// Relate the item from the main part, creating its relationships part if needed
+	mainRelsName := path.Join(path.Dir(main), "_rels", path.Base(main)+".rels")
+	mainRels := []byte(`<?xml version="1.0" encoding="UTF-8" standalone="yes"?>` + "\n" +
+		`<Relationships xmlns="` + ooxmlRelsNS + `"></Relationships>`)
+	added := []string{itemName, propsName, itemRelsName}
+	if f, ok := files[mainRelsName]; ok {
+		if mainRels, err = readZipEntry(f); err != nil {
+			return nil, err
+		}
+	} else {
+		added = append(added, mainRelsName)
+	}
+	var rels ooxmlRels
+	if err := xml.Unmarshal(mainRels, &rels); err != nil {
+		return nil, fmt.Errorf("invalid relationships part %s: %w", mainRelsName, err)
+	}
+	ids := map[string]bool{}
+	for _, rel := range rels.Relationships {
+		ids[rel.ID] = true
+	}
+	id := len(rels.Relationships) + 1
+	for ids["rId"+strconv.Itoa(id)] {
+		id++
+	}
+	target := strings.Repeat("../", ooxmlDepth(main)) + itemName
+	mainRels, err = insertBeforeClose(mainRels, "</Relationships>", fmt.Sprintf(
+		`<Relationship Id="rId%d" Type="%scustomXml" Target="%s"/>`, id, typeBase, target))
+	if err != nil {
+		return nil, fmt.Errorf("invalid relationships part %s: %w", mainRelsName, err)
+	}
+
+	// Register the content types of the new parts
+	types, err := readZipEntry(files[ooxmlContentTypes])
+	if err != nil {
+		return nil, err
+	}
+	var parsed ooxmlTypes
+	if err := xml.Unmarshal(types, &parsed); err != nil {
+		return nil, fmt.Errorf("invalid %s: %w", ooxmlContentTypes, err)
+	}
+	defaults := map[string]bool{}
+	for _, d := range parsed.Defaults {
+		defaults[strings.ToLower(d.Extension)] = true
+	}
+	overrides := fmt.Sprintf(`<Override PartName="/%s" ContentType="%s"/>`, propsName, ooxmlPropsType)
+	if !defaults["xml"] {
+		overrides += fmt.Sprintf(`<Override PartName="/%s" ContentType="application/xml"/>`, itemName)
+	}
+	if !defaults["rels"] {
+		overrides += fmt.Sprintf(`<Override PartName="/%s" ContentType="%s"/>`, itemRelsName, ooxmlRelsContentType)
+		if _, ok := files[mainRelsName]; !ok {
+			overrides += fmt.Sprintf(`<Override PartName="/%s" ContentType="%s"/>`, mainRelsName, ooxmlRelsContentType)
+		}
+	}
+	if types, err = insertBeforeClose(types, "</Types>", overrides); err != nil {
+		return nil, fmt.Errorf("invalid %s: %w", ooxmlContentTypes, err)
+	}
+
+	changed[itemName] = item
+	changed[propsName] = []byte(props)
+	changed[itemRelsName] = []byte(itemRels)
+	changed[mainRelsName] = mainRels
+	changed[ooxmlContentTypes] = types
+	return added, nil
+}
+
+// ooxmlMainPart returns the main document part named by the officeDocument relationship
+// of the package, with the type of that relationship
+func ooxmlMainPart(files map[string]*zip.File) (string, string, error) {
+	f, ok := files[ooxmlPackageRels]
+	if !ok {
+		return "", "", errors.New("invalid office document: " + ooxmlPackageRels + " not found")
+	}
+	content, err := readZipEntry(f)
+	if err != nil {
+		return "", "", err
+	}
+	var rels ooxmlRels
+	if err := xml.Unmarshal(content, &rels); err != nil {
+		return "", "", fmt.Errorf("invalid relationships part %s: %w", ooxmlPackageRels, err)
+	}
+
+	for _, rel := range rels.Relationships {
+		if !strings.HasSuffix(rel.Type, "/officeDocument") || rel.TargetMode == "External" {
+			continue
+		}
+		name := strings.TrimPrefix(path.Clean("/"+rel.Target), "/")
+		if _, ok := files[name]; !ok {
+			return "", "", fmt.Errorf("invalid office document: main part %s not found", name)
+		}
+		return name, rel.Type, nil
+	}
+	return "", "", errors.New("invalid office document: officeDocument relationship not found")
+}
+
+// ooxmlDepth returns the number of folders a part name is nested in
+func ooxmlDepth(name string) int {
+	return strings.Count(name, "/")
+}
+
+// insertBeforeClose inserts text before the closing tag of the root element
+func insertBeforeClose(content []byte, closing, text string) ([]byte, error) {
+	end := bytes.LastIndex(content, []byte(closing))
+	if end < 0 {
+		// An empty root element written as a self-closing tag
+		open := strings.TrimPrefix(strings.TrimSuffix(closing, ">"), "</")
+		loc := regexp.MustCompile(`<` + regexp.QuoteMeta(open) + `\b[^>]*/>`).FindIndex(content)
+		if loc == nil {
+			return nil, errors.New(closing + " not found")
+		}
+		return []byte(string(content[:loc[1]-2]) + ">" + text + closing + string(content[loc[1]:])), nil
+	}
+	return []byte(string(content[:end]) + text + string(content[end:])), nil
+}
@@ -0,0 +1,190 @@
+package utils
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/xml"
+	"path"
+	"strings"
+	"testing"
+)
+
+const (
+	testOOXMLTypes = `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>` + "\n" +
+		`<Types xmlns="http://schemas.openxmlformats.org/package/2006/content-types">` +
+		`<Default Extension="rels" ContentType="application/vnd.openxmlformats-package.relationships+xml"/>` +
+		`<Default Extension="xml" ContentType="application/xml"/>` +
+		`<Override PartName="/word/document.xml" ContentType="application/vnd.openxmlformats-officedocument.wordprocessingml.document.main+xml"/>` +
+		`</Types>`
+	testOOXMLRels = `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>` + "\n" +
+		`<Relationships xmlns="http://schemas.openxmlformats.org/package/2006/relationships">` +
+		`<Relationship Id="rId1" Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/officeDocument" Target="word/document.xml"/>` +
+		`</Relationships>`
+	testOOXMLDocumentRels = `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>` + "\n" +
+		`<Relationships xmlns="http://schemas.openxmlformats.org/package/2006/relationships">` +
+		`<Relationship Id="rId1" Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/styles" Target="styles.xml"/>` +
+		`<Relationship Id="rId3" Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/stylesWithEffects" Target="styles.xml"/>` +
+		`</Relationships>`
+)
+
+// testOOXML builds a minimal docx package; parts replaces or, with an empty content, removes parts
+func testOOXML(parts ...string) []byte {
+	content := map[string]string{
+		ooxmlContentTypes:              testOOXMLTypes,
+		ooxmlPackageRels:               testOOXMLRels,
+		"word/document.xml":            `<w:document xmlns:w="http://schemas.openxmlformats.org/wordprocessingml/2006/main"/>`,
+		"word/_rels/document.xml.rels": testOOXMLDocumentRels,
+		"word/styles.xml":              `<w:styles/>`,
+	}
+	names := []string{ooxmlContentTypes, ooxmlPackageRels, "word/document.xml", "word/_rels/document.xml.rels", "word/styles.xml"}
+	for i := 0; i+1 < len(parts); i += 2 {
+		if _, ok := content[parts[i]]; !ok {
+			names = append(names, parts[i])
+		}
+		content[parts[i]] = parts[i+1]
+	}
+	var entries []string
+	for _, name := range names {
+		if content[name] != "" {
+			entries = append(entries, name, content[name])
+		}
+	}
+	return testZIP("", entries...)
+}
+
+// checkOOXMLPackage checks that the payload part is related from the main part, that every
+// internal relationship target exists and that every part has a content type
+func checkOOXMLPackage(t *testing.T, name string, doc []byte) {
+	t.Helper()
+	r, err := zip.NewReader(bytes.NewReader(doc), int64(len(doc)))
+	if err != nil {
+		t.Fatalf("%s: %v", name, err)
+	}
+	files := map[string]*zip.File{}
+	for _, f := range r.File {
+		if _, ok := files[f.Name]; ok {
+			t.Fatalf("%s: duplicate part %s", name, f.Name)
+		}
+		files[f.Name] = f
+	}
+
+	payload, ok := findOOXMLPayloadPart(r)
+	if !ok {
+		t.Fatalf("%s: no payload part", name)
+	}
+	related := false
+	for partName, f := range files {
+		if !strings.HasSuffix(partName, ".rels") {
+			continue
+		}
+		content, _ := readZipEntry(f)
+		var rels ooxmlRels
+		if err := xml.Unmarshal(content, &rels); err != nil {
+			t.Fatalf("%s: %s: %v", name, partName, err)
+		}
+		base := path.Dir(path.Dir(partName))
+		for _, rel := range rels.Relationships {
+			target := path.Clean(path.Join(base, rel.Target))
+			if files[target] == nil {
+				t.Fatalf("%s: %s points at missing %s", name, partName, target)
+			}
+			if target == payload && partName == "word/_rels/document.xml.rels" && strings.HasSuffix(rel.Type, "/customXml") {
+				related = true
+			}
+		}
+	}
+	if !related {
+		t.Fatalf("%s: payload part %s is not related from the main part", name, payload)
+	}
+
+	types, _ := readZipEntry(files[ooxmlContentTypes])
+	for partName := range files {
+		if partName == ooxmlContentTypes {
+			continue
+		}
+		ext := path.Ext(partName)
+		if !bytes.Contains(types, []byte(`PartName="/`+partName+`"`)) && !bytes.Contains(types, []byte(`Extension="`+ext[1:]+`"`)) {
+			t.Fatalf("%s: part %s has no content type", name, partName)
+		}
+	}
+	if bytes.Count(types, []byte("customXmlProperties")) != 1 {
+		t.Fatalf("%s: content types %s", name, types)
+	}
+}
+
+func TestOOXMLRoundTrip(t *testing.T) {
+	noDefaults := strings.NewReplacer(`<Default Extension="rels" ContentType="application/vnd.openxmlformats-package.relationships+xml"/>`, "",
+		`<Default Extension="xml" ContentType="application/xml"/>`,
+		`<Override PartName="/_rels/.rels" ContentType="application/vnd.openxmlformats-package.relationships+xml"/>`+
+			`<Override PartName="/word/styles.xml" ContentType="application/xml"/>`).Replace(testOOXMLTypes)
+	carriers := map[string][]byte{
+		"docx":              testOOXML(),
+		"no main rels":      testOOXML("word/_rels/document.xml.rels", ""),
+		"no defaults":       testOOXML(ooxmlContentTypes, noDefaults, "word/_rels/document.xml.rels", ""),
+		"self-closing rels": testOOXML("word/_rels/document.xml.rels", `<Relationships xmlns="`+ooxmlRelsNS+`"/>`),
+		"office custom xml": testOOXML("customXml/item1.xml", `<b:Sources xmlns:b="bibliography"/>`),
+	}
+	data := bytes.Repeat([]byte("office payload "), 10)
+	for name, carrier := range carriers {
+		for _, mode := range []string{"", OOXMLModeCustomXML} {
+			out, err := EmbedDataInOOXML(carrier, data, mode)
+			if err != nil {
+				t.Fatalf("%s, %q mode: %v", name, mode, err)
+			}
+			got, err := ExtractDataFromOOXML(out)
+			if err != nil || !bytes.Equal(got, data) {
+				t.Fatalf("%s, %q mode: got %q, %v", name, mode, got, err)
+			}
+			checkOOXMLPackage(t, name, out)
+			if bytes.Contains(carrier, []byte("bibliography")) && !bytes.Contains(out, []byte("customXml/item2.xml")) {
+				t.Fatalf("%s: payload part does not skip the existing item", name)
+			}
+		}
+	}
+}
+
+func TestOOXMLReembed(t *testing.T) {
+	out := testOOXML()
+	for _, data := range []string{"first payload", "second", "a third, longer payload"} {
+		var err error
+		out, err = EmbedDataInOOXML(out, []byte(data), "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got, err := ExtractDataFromOOXML(out); err != nil || string(got) != data {
+			t.Fatalf("got %q, %v", got, err)
+		}
+		checkOOXMLPackage(t, data, out)
+	}
+	r, _ := zip.NewReader(bytes.NewReader(out), int64(len(out)))
+	if len(r.File) != 8 {
+		t.Fatalf("%d parts after embedding three times", len(r.File))
+	}
+}
+
+func TestOOXMLMalformed(t *testing.T) {
+	carrier := testOOXML()
+	if _, err := EmbedDataInOOXML(carrier, []byte("x"), "comments"); err == nil {
+		t.Error("invalid mode accepted")
+	}
+	if _, err := EmbedDataInOOXML(carrier, nil, ""); err == nil {
+		t.Error("empty data accepted")
+	}
+	externalMain := strings.Replace(testOOXMLRels, `Target="word/document.xml"`, `Target="http://example.com/doc.xml" TargetMode="External"`, 1)
+	for name, bad := range map[string][]byte{
+		"no content types": testOOXML(ooxmlContentTypes, ""),
+		"no package rels":  testOOXML(ooxmlPackageRels, ""),
+		"no main part":     testOOXML("word/document.xml", ""),
+		"external main":    testOOXML(ooxmlPackageRels, externalMain),
+		"broken rels":      testOOXML("word/_rels/document.xml.rels", "<Relationships"),
+		"broken types":     testOOXML(ooxmlContentTypes, "<Types><Default"),
+		"not zip":          []byte("PK\x03\x04[Content_Types].xml"),
+	} {
+		if _, err := EmbedDataInOOXML(bad, []byte("x"), ""); err == nil {
+			t.Errorf("%s accepted", name)
+		}
+	}
+	if _, err := ExtractDataFromOOXML(carrier); err == nil {
+		t.Error("clean document extracted")
+	}
+}
@@ -0,0 +1,321 @@
+package utils
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"iter"
+	"sort"
+)
+
+// minSilentRun is the number of consecutive near-zero samples (per channel)
+// that counts as digital silence and is left untouched by the embedder
+const minSilentRun = 64
+
+// maxSearchedChannels bounds the channel subsets tried when extracting without options
+const maxSearchedChannels = 8
+
+// pcmAudio is a view on the raw sample bytes of an uncompressed audio stream
+type pcmAudio struct {
+	Data           []byte // interleaved sample frames, modified in place when embedding
+	Channels       int
+	BytesPerSample int
+	BigEndian      bool
+	Unsigned       bool // 8-bit WAV samples are unsigned with 128 as zero
+	LSBShift       int  // position of the least significant used bit (non-zero for left-justified samples)
+
+	silent [][][2]int // per channel, the frame ranges [start, end) of digital silence runs
+}
+
+// pcmLayout selects which samples carry payload bits
+type pcmLayout struct {
+	Channels []int // channel indices, ascending
+	Spread   bool  // interleave bits across channels frame by frame instead of filling one channel after another
+}
+
+// newPCMAudio validates the sample layout and returns a view on data
+func newPCMAudio(data []byte, channels, bitsPerSample int, bigEndian bool) (*pcmAudio, error) {
+	if channels <= 0 {
+		return nil, errors.New("invalid channel count")
+	}
+	if bitsPerSample <= 0 || bitsPerSample > 32 {
+		return nil, fmt.Errorf("unsupported sample size: %d bits", bitsPerSample)
+	}
+
+	bytesPerSample := (bitsPerSample + 7) / 8
+	frameSize := bytesPerSample * channels
+	usable := len(data) - len(data)%frameSize
+
+	return &pcmAudio{
+		Data:           data[:usable],
+		Channels:       channels,
+		BytesPerSample: bytesPerSample,
+		BigEndian:      bigEndian,
+		LSBShift:       bytesPerSample*8 - bitsPerSample,
+	}, nil
+}
+
+// loadPCM returns a sample view and the sample rate of a PCM WAV or AIFF file
+func loadPCM(audioData []byte) (*pcmAudio, float64, error) {
+	if IsWAV(audioData) {
+		info, err := parseWAV(audioData)
+		if err != nil {
+			return nil, 0, err
+		}
+		pcm, err := info.pcm(audioData)
+		return pcm, float64(info.SampleRate), err
+	}
+	if IsAIFF(audioData) {
+		info, err := parseAIFF(audioData)
+		if err != nil {
+			return nil, 0, err
+		}
+		pcm, err := newPCMAudio(audioData[info.SoundStart:info.SoundEnd], info.Channels, info.BitsPerSample, !info.LittleEndian)
+		return pcm, info.SampleRate, err
+	}
+	return nil, 0, errors.New("not a pcm wav or aiff file")
+}
+
+// sampleCount returns the number of individual samples (frames * channels)
+func (p *pcmAudio) sampleCount() int {
+	return len(p.Data) / p.BytesPerSample
+}
+
+// frameCount returns the number of sample frames
+func (p *pcmAudio) frameCount() int {
+	return p.sampleCount() / p.Channels
+}
+
+// lsbIndex returns the index of the byte holding the least significant bit of sample i,
+// skipping whole padding bytes below it (e.g. 24 valid bits in a 32-bit WAV container)
+func (p *pcmAudio) lsbIndex(i int) int {
+	if p.BigEndian {
+		return i*p.BytesPerSample + p.BytesPerSample - 1 - p.LSBShift/8
+	}
+	return i*p.BytesPerSample + p.LSBShift/8
+}
+
+// getLSB returns the least significant bit of sample i
+func (p *pcmAudio) getLSB(i int) uint8 {
+	return (p.Data[p.lsbIndex(i)] >> (p.LSBShift % 8)) & 1
+}
+
+// setLSB sets the least significant bit of sample i
+func (p *pcmAudio) setLSB(i int, bit uint8) {
+	idx, shift := p.lsbIndex(i), p.LSBShift%8
+	p.Data[idx] = p.Data[idx]&^(1<<shift) | bit<<shift
+}
+
+// sample returns the signed value of sample i, right-aligned
+func (p *pcmAudio) sample(i int) int32 {
+	b := p.Data[i*p.BytesPerSample : (i+1)*p.BytesPerSample]
+	var v uint32
+	for k := 0; k < p.BytesPerSample; k++ {
+		if p.BigEndian {
+			v = v<<8 | uint32(b[k])
+		} else {
+			v |= uint32(b[k]) << (8 * k)
+		}
+	}
+
+	bits := p.BytesPerSample * 8
+	if p.Unsigned {
+		return int32(v) - 1<<(bits-1)
+	}
+	// Sign extend, then drop the unused low bits of left-justified samples
+	return int32(v<<(32-bits)) >> (32 - bits + p.LSBShift)
+}
+
+// silence returns the runs of digital silence of each channel, in frame order.
+// A sample counts as silent when its value is within {-2, -1, 0, 1}, a class
+// that flipping the LSB never leaves, so embedder and extractor agree on the runs.
+func (p *pcmAudio) silence() [][][2]int {
+	if p.silent == nil {
+		p.silent = make([][][2]int, p.Channels)
+		frames := p.frameCount()
+		for ch := 0; ch < p.Channels; ch++ {
+			runStart := 0
+			for f := 0; f <= frames; f++ {
+				if f < frames {
+					if v := p.sample(f*p.Channels+ch) >> 1; v == 0 || v == -1 {
+						continue
+					}
+				}
+				if f-runStart >= minSilentRun {
+					p.silent[ch] = append(p.silent[ch], [2]int{runStart, f})
+				}
+				runStart = f + 1
+			}
+		}
+	}
+	return p.silent
+}
+
+// samples yields the indices of the samples that carry payload bits for the layout, in order
+func (p *pcmAudio) samples(layout pcmLayout) iter.Seq[int] {
+	runs := p.silence()
+	frames := p.frameCount()
+	return func(yield func(int) bool) {
+		if layout.Spread {
+			next := make([]int, p.Channels) // per channel, the first run not ending before the frame
+			for f := 0; f < frames; f++ {
+				for _, ch := range layout.Channels {
+					r := runs[ch]
+					for next[ch] < len(r) && r[next[ch]][1] <= f {
+						next[ch]++
+					}
+					if next[ch] < len(r) && r[next[ch]][0] <= f {
+						continue
+					}
+					if !yield(f*p.Channels + ch) {
+						return
+					}
+				}
+			}
+			return
+		}
+
+		for _, ch := range layout.Channels {
+			f, r := 0, runs[ch]
+			for k := 0; f < frames; f++ {
+				if k < len(r) && f == r[k][0] {
+					f, k = r[k][1]-1, k+1
+					continue
+				}
+				if !yield(f*p.Channels + ch) {
+					return
+				}
+			}
+		}
+	}
+}
+
+// usable returns the number of samples that carry payload bits for the layout
+func (p *pcmAudio) usable(layout pcmLayout) int {
+	runs := p.silence()
+	n := 0
+	for _, ch := range layout.Channels {
+		n += p.frameCount()
+		for _, run := range runs[ch] {
+			n -= run[1] - run[0]
+		}
+	}
+	return n
+}
+
+// layout turns the user facing options into a sample layout
+func (p *pcmAudio) layout(opts AudioOptions) (pcmLayout, error) {
+	if len(opts.Channels) == 0 {
+		all := make([]int, p.Channels)
+		for i := range all {
+			all[i] = i
+		}
+		return pcmLayout{Channels: all, Spread: opts.Spread}, nil
+	}
+
+	// Channels are always used in ascending order so the extractor can find them without options
+	channels := append([]int(nil), opts.Channels...)
+	sort.Ints(channels)
+
+	seen := make(map[int]bool)
+	for _, ch := range channels {
+		if ch < 0 || ch >= p.Channels {
+			return pcmLayout{}, fmt.Errorf("invalid channel %d: audio has %d channels", ch, p.Channels)
+		}
+		if seen[ch] {
+			return pcmLayout{}, fmt.Errorf("channel %d listed twice", ch)
+		}
+		seen[ch] = true
+	}
+	return pcmLayout{Channels: channels, Spread: opts.Spread}, nil
+}
+
+// capacity returns how many payload bytes fit with the given options, minus the 8-byte header
+func (p *pcmAudio) capacity(opts AudioOptions) (int, error) {
+	layout, err := p.layout(opts)
+	if err != nil {
+		return 0, err
+	}
+	return max(0, p.usable(layout)/8-8), nil
+}
+
+// embed writes data (with magic/length header) into the sample LSBs
+func (p *pcmAudio) embed(data []byte, opts AudioOptions) error {
+	layout, err := p.layout(opts)
+	if err != nil {
+		return err
+	}
+
+	dataWithHeader := prepareDataWithHeader(data)
+	if len(dataWithHeader)*8 > p.usable(layout) {
+		available, _ := p.capacity(opts)
+		return fmt.Errorf("audio too small to embed data: need %d bytes, have %d bytes capacity (silent samples are skipped)",
+			len(data), available)
+	}
+
+	bits := bytesToBits(dataWithHeader)
+	i := 0
+	for pos := range p.samples(layout) {
+		if i == len(bits) {
+			break
+		}
+		p.setLSB(pos, bits[i])
+		i++
+	}
+	return nil
+}
+
+// extract reads data written by embed. Without explicit channels every channel
+// subset and both bit orders are tried, the magic number tells which one was used.
+func (p *pcmAudio) extract(opts AudioOptions) ([]byte, error) {
+	var layouts []pcmLayout
+	if len(opts.Channels) > 0 {
+		layout, err := p.layout(opts)
+		if err != nil {
+			return nil, err
+		}
+		layouts = append(layouts, layout, pcmLayout{Channels: layout.Channels, Spread: !layout.Spread})
+	} else {
+		searched := min(p.Channels, maxSearchedChannels)
+		for mask := 1<<searched - 1; mask > 0; mask-- {
+			var channels []int
+			for ch := 0; ch < searched; ch++ {
+				if mask&(1<<ch) != 0 {
+					channels = append(channels, ch)
+				}
+			}
+			layouts = append(layouts, pcmLayout{Channels: channels}, pcmLayout{Channels: channels, Spread: true})
+		}
+	}
+
+	for _, layout := range layouts {
+		header, ok := p.readBytes(layout, 8)
+		if !ok || binary.LittleEndian.Uint32(header[:4]) != MagicNumber {
+			continue
+		}
+		dataLength := int(binary.LittleEndian.Uint32(header[4:8]))
+		if dataLength == 0 || dataLength > MaxDataSize {
+			continue
+		}
+		if data, ok := p.readBytes(layout, 8+dataLength); ok {
+			return data[8:], nil
+		}
+	}
+
+	return nil, errors.New("no valid embedded data found in audio samples")
+}
+
+// readBytes reads n bytes back from the LSBs of the layout's samples, LSB first,
+// or reports false when there are fewer than n*8 samples
+func (p *pcmAudio) readBytes(layout pcmLayout, n int) ([]byte, bool) {
+	out := make([]byte, n)
+	i := 0
+	for pos := range p.samples(layout) {
+		if i == n*8 {
+			break
+		}
+		out[i/8] |= p.getLSB(pos) << (i % 8)
+		i++
+	}
+	return out, i == n*8
+}
@@ -0,0 +1,417 @@
+package utils
+
+import (
+	"bytes"
+	"cmp"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"math"
+	"slices"
+)
+
+// PDF carrier modes
+const (
+	PDFModeIncremental = "incremental" // payload in a stream object added by an incremental update
+	PDFModeKerning     = "kerning"     // payload bits in TJ kerning values and Td/TD operands of the pages
+	PDFModeAttachment  = "attachment"  // payload as an embedded file in the EmbeddedFiles name tree
+	PDFModeXMP         = "xmp"         // payload in a custom namespace of the XMP metadata stream
+)
+
+// pdfPayloadKey is the trailer entry referencing the payload stream object
+const pdfPayloadKey = "StegoPayload"
+
+// EmbedDataInPDF stores data in a PDF with the chosen mode, always written as an incremental update
+func EmbedDataInPDF(pdfData []byte, data []byte, mode string) ([]byte, error) {
+	var out bytes.Buffer
+	if err := EmbedDataInPDFStream(bytes.NewReader(pdfData), int64(len(pdfData)), data, mode, &out); err != nil {
+		return nil, err
+	}
+	return out.Bytes(), nil
+}
+
+// EmbedDataInPDFStream is EmbedDataInPDF reading the size byte PDF from src and writing to dst.
+// In incremental mode, files without a readable cross-reference chain get the payload appended as before.
+func EmbedDataInPDFStream(src io.ReaderAt, size int64, data []byte, mode string, dst io.Writer) error {
+	if size == 0 {
+		return errors.New("pdf data cannot be empty")
+	}
+
+	if len(data) == 0 {
+		return errors.New("data to embed cannot be empty")
+	}
+
+	if len(data) > MaxDataSize {
+		return fmt.Errorf("data too large: %d bytes, max allowed: %d bytes", len(data), MaxDataSize)
+	}
+
+	var embed func(e *pdfEdit, data []byte) error
+	switch mode {
+	case "", PDFModeIncremental:
+		embed = embedPDFIncremental
+	case PDFModeKerning:
+		embed = embedPDFKerning
+	case PDFModeAttachment:
+		embed = embedPDFAttachment
+	case PDFModeXMP:
+		embed = embedPDFXMP
+	default:
+		return invalidPDFMode(mode)
+	}
+
+	doc, err := openPDF(src, size)
+	if err != nil {
+		if mode == "" || mode == PDFModeIncremental {
+			return appendPayload(src, size, data, dst)
+		}
+		return err
+	}
+	if err := doc.checkEncryption(); err != nil {
+		return err
+	}
+	e, err := doc.beginEdit()
+	if err != nil {
+		return err
+	}
+	if err := embed(e, data); err != nil {
+		return err
+	}
+	return e.commit(dst)
+}
+
+// invalidPDFMode is the error for an unknown PDF mode
+func invalidPDFMode(mode string) error {
+	return fmt.Errorf("invalid pdf mode %q. Must be: %s, %s, %s or %s",
+		mode, PDFModeIncremental, PDFModeKerning, PDFModeAttachment, PDFModeXMP)
+}
+
+// ExtractDataFromPDF extracts data from a PDF file
+func ExtractDataFromPDF(pdfData []byte) ([]byte, error) {
+	return ExtractDataFromPDFStream(bytes.NewReader(pdfData), int64(len(pdfData)))
+}
+
+// ExtractDataFromPDFStream extracts data from the size byte PDF read from src
+func ExtractDataFromPDFStream(src io.ReaderAt, size int64) ([]byte, error) {
+	if size < 8 {
+		return nil, errors.New("pdf file too small")
+	}
+
+	if doc, err := openPDF(src, size); err == nil {
+		// Walk the trailer chain from the newest update, later incremental saves by
+		// other tools do not carry the payload entry over. Payloads blanked by a
+		// later embed no longer parse.
+		for _, section := range doc.sections {
+			stream, ok := doc.payloadStream(section)
+			if !ok {
+				continue
+			}
+			raw, err := doc.streamData(stream)
+			if err != nil {
+				continue
+			}
+			if data, err := parseHeaderedData(raw); err == nil {
+				return data, nil
+			}
+		}
+
+		if data, ok := doc.extractAttachment(); ok {
+			return data, nil
+		}
+		if data, ok := doc.extractXMP(); ok {
+			return data, nil
+		}
+		if data, err := extractPDFKerning(doc); err == nil {
+			return data, nil
+		}
+	}
+
+	// Files embedded before incremental updates carry the payload after %%EOF
+	if data, err := extractTrailerAt(src, size); !errors.Is(err, errNoTrailer) {
+		return data, err
+	}
+	return nil, errors.New("no embedded data found in pdf")
+}
+
+// openPDF loads the cross-reference chain, leaving out a payload appended by the older carrier
+func openPDF(src io.ReaderAt, size int64) (*pdfDoc, error) {
+	end, err := pdfLogicalEnd(src, size)
+	if err != nil {
+		return nil, err
+	}
+	return loadPDF(src, end)
+}
+
+// checkEncryption rejects encrypted files: objects added by an update would have to be
+// encrypted with the document key, and a copied /Encrypt would make readers decrypt them
+func (d *pdfDoc) checkEncryption() error {
+	if _, ok := d.trailer()["Encrypt"]; ok {
+		return errors.New("encrypted pdf files are not supported, remove the password protection first")
+	}
+	return nil
+}
+
+// payloadStream returns the payload stream referenced by the trailer of a section
+func (d *pdfDoc) payloadStream(section pdfXrefSection) (pdfStream, bool) {
+	ref, ok := section.Trailer[pdfPayloadKey].(pdfRef)
+	if !ok {
+		return pdfStream{}, false
+	}
+	// The payload object is written in the same update as the trailer referencing it
+	e, ok := section.Entries[ref.Num]
+	if !ok || e.Type != 1 {
+		return pdfStream{}, false
+	}
+	num, _, obj, err := d.readObjectAt(e.Offset)
+	stream, ok := obj.(pdfStream)
+	if err != nil || !ok || num != ref.Num {
+		return pdfStream{}, false
+	}
+	if _, ok := stream.Dict["Length"].(int); !ok {
+		return pdfStream{}, false
+	}
+	return stream, true
+}
+
+// embedPDFIncremental writes the payload as a stream object referenced from the trailer
+func embedPDFIncremental(e *pdfEdit, data []byte) error {
+	// A payload from an earlier embed keeps its object number, otherwise a new one is allocated
+	ref, ok := e.doc.trailer()[pdfPayloadKey].(pdfRef)
+	if !ok || ref.Num <= 0 || ref.Num >= e.next {
+		ref = pdfRef{Num: e.alloc()}
+	}
+
+	e.addStream(ref, pdfDict{}, prepareDataWithHeader(data))
+	e.update.Trailer = pdfDict{pdfPayloadKey: ref}
+	return nil
+}
+
+// pdfEdit collects what an embed changes on top of the newest revision. It starts with
+// the payloads of the incremental, attachment and XMP modes removed, so extraction never
+// finds a stale one; kerning bits need no removal as that mode is tried last.
+type pdfEdit struct {
+	doc    *pdfDoc
+	update pdfUpdate
+	next   int // next unused object number
+
+	rootRef        pdfRef
+	catalog        pdfDict // copy of the catalog, nil when it cannot be read
+	catalogChanged bool
+
+	attachments        []any // flattened EmbeddedFiles name tree: name, file specification pairs
+	attachmentsChanged bool
+
+	xmpRef     pdfRef // metadata stream, Num 0 when the catalog has none
+	xmpDict    pdfDict
+	xmpSpan    pdfSpan // data of the current metadata stream, set only when it holds a payload
+	xmp        []byte  // decoded XMP packet
+	xmpChanged bool
+}
+
+// beginEdit starts an edit of the newest revision
+func (d *pdfDoc) beginEdit() (*pdfEdit, error) {
+	size, ok := d.trailer()["Size"].(int)
+	if !ok || size <= 0 {
+		return nil, errors.New("invalid pdf trailer size")
+	}
+
+	e := &pdfEdit{doc: d, next: size, update: pdfUpdate{Blank: d.payloadSpans()}}
+	if ref, catalog, err := d.catalog(); err == nil {
+		e.rootRef, e.catalog = ref, maps.Clone(catalog)
+		e.loadAttachments()
+		e.loadXMP()
+	}
+	return e, nil
+}
+
+// alloc returns a new object number
+func (e *pdfEdit) alloc() int {
+	e.next++
+	return e.next - 1
+}
+
+// addObject writes a non-stream object
+func (e *pdfEdit) addObject(ref pdfRef, v any) {
+	var body bytes.Buffer
+	writePDFObject(&body, v)
+	e.update.Objects = append(e.update.Objects, pdfObject{Num: ref.Num, Gen: ref.Gen, Body: body.Bytes()})
+}
+
+// addStream writes an unfiltered stream object
+func (e *pdfEdit) addStream(ref pdfRef, dict pdfDict, data []byte) {
+	dict["Length"] = len(data)
+	var body bytes.Buffer
+	writePDFObject(&body, dict)
+	body.WriteString("\nstream\n")
+	body.Write(data)
+	body.WriteString("\nendstream")
+	e.update.Objects = append(e.update.Objects, pdfObject{Num: ref.Num, Gen: ref.Gen, Body: body.Bytes()})
+}
+
+// commit writes the changed catalog parts and the update
+func (e *pdfEdit) commit(dst io.Writer) error {
+	if e.attachmentsChanged {
+		e.storeAttachments()
+	}
+	if e.xmpChanged {
+		e.storeXMP()
+	}
+	if e.catalogChanged {
+		e.addObject(e.rootRef, e.catalog)
+	}
+	return e.doc.writeUpdate(e.update, dst)
+}
+
+// catalog returns the document catalog
+func (d *pdfDoc) catalog() (pdfRef, pdfDict, error) {
+	ref, ok := d.trailer()["Root"].(pdfRef)
+	if !ok {
+		return pdfRef{}, nil, errors.New("pdf catalog not found")
+	}
+	obj, err := d.resolve(ref)
+	if err != nil {
+		return pdfRef{}, nil, err
+	}
+	catalog, ok := obj.(pdfDict)
+	if !ok {
+		return pdfRef{}, nil, errors.New("pdf catalog not found")
+	}
+	return ref, catalog, nil
+}
+
+// payloadSpans returns the data of payload streams written by earlier incremental embeds
+func (d *pdfDoc) payloadSpans() []pdfSpan {
+	var spans []pdfSpan
+	for _, section := range d.sections {
+		if stream, ok := d.payloadStream(section); ok {
+			spans = append(spans, pdfSpan{stream.Offset, stream.Offset + int64(stream.Dict["Length"].(int))})
+		}
+	}
+	return spans
+}
+
+// pdfObject is an indirect object written by an update, Body being everything between
+// "num gen obj" and "endobj"
+type pdfObject struct {
+	Num, Gen int
+	Body     []byte
+}
+
+// pdfSpan is the byte range [Start, End) of the file
+type pdfSpan struct{ Start, End int64 }
+
+// pdfUpdate describes an incremental update
+type pdfUpdate struct {
+	Objects []pdfObject
+	Trailer pdfDict   // entries added to the new trailer
+	Blank   []pdfSpan // stream data superseded by the update, zeroed so no offset moves
+}
+
+// writeUpdate copies the PDF to dst with the Blank ranges zeroed and appends the objects,
+// a cross-reference section of the same kind as the newest one and a trailer whose /Prev
+// chains to it
+func (d *pdfDoc) writeUpdate(u pdfUpdate, dst io.Writer) error {
+	trailer := d.trailer()
+	size, ok := trailer["Size"].(int)
+	if !ok || size <= 0 {
+		return errors.New("invalid pdf trailer size")
+	}
+
+	slices.SortFunc(u.Blank, func(a, b pdfSpan) int { return cmp.Compare(a.Start, b.Start) })
+	pos := int64(0)
+	for _, s := range u.Blank {
+		if s.Start < pos || s.End > d.size {
+			continue
+		}
+		if err := copyRange(dst, d.src, int(pos), int(s.Start)); err != nil {
+			return err
+		}
+		if _, err := io.CopyN(dst, zeroReader{}, s.End-s.Start); err != nil {
+			return err
+		}
+		pos = s.End
+	}
+	if err := copyRange(dst, d.src, int(pos), int(d.size)); err != nil {
+		return err
+	}
+
+	var out bytes.Buffer
+	last, err := readRange(d.src, int(d.size-1), int(d.size))
+	if err != nil {
+		return err
+	}
+	if last[0] != '\n' && last[0] != '\r' {
+		out.WriteByte('\n')
+	}
+
+	objects := slices.Clone(u.Objects)
+	slices.SortFunc(objects, func(a, b pdfObject) int { return cmp.Compare(a.Num, b.Num) })
+	offsets := make([]int64, len(objects))
+	for i, obj := range objects {
+		offsets[i] = d.size + int64(out.Len())
+		fmt.Fprintf(&out, "%d %d obj\n", obj.Num, obj.Gen)
+		out.Write(obj.Body)
+		out.WriteString("\nendobj\n")
+		size = max(size, obj.Num+1)
+	}
+
+	newTrailer := pdfDict{"Prev": int(d.sections[0].Offset)}
+	for _, key := range []string{"Root", "Info", "ID", "Encrypt"} {
+		if v, ok := trailer[key]; ok {
+			newTrailer[key] = v
+		}
+	}
+	for key, v := range u.Trailer {
+		newTrailer[key] = v
+	}
+
+	xrefOffset := d.size + int64(out.Len())
+	if d.sections[0].IsXRefStream {
+		// The xref stream is an object of the update itself
+		objects = append(objects, pdfObject{Num: size})
+		offsets = append(offsets, xrefOffset)
+		size++
+
+		width := 4
+		if xrefOffset > math.MaxUint32 {
+			width = 8
+		}
+		var rows bytes.Buffer
+		index := []any{}
+		for i, obj := range objects {
+			row := make([]byte, 1+width+2)
+			row[0] = 1
+			var field [8]byte
+			binary.BigEndian.PutUint64(field[:], uint64(offsets[i]))
+			copy(row[1:1+width], field[8-width:])
+			binary.BigEndian.PutUint16(row[1+width:], uint16(obj.Gen))
+			rows.Write(row)
+			index = append(index, obj.Num, 1)
+		}
+
+		newTrailer["Type"] = pdfName("XRef")
+		newTrailer["Size"] = size
+		newTrailer["W"] = []any{1, width, 2}
+		newTrailer["Index"] = index
+		newTrailer["Length"] = rows.Len()
+		fmt.Fprintf(&out, "%d 0 obj\n", objects[len(objects)-1].Num)
+		writePDFObject(&out, newTrailer)
+		out.WriteString("\nstream\n")
+		out.Write(rows.Bytes())
+		out.WriteString("\nendstream\nendobj\n")
+	} else {
+		out.WriteString("xref\n")
+		for i, obj := range objects {
+			fmt.Fprintf(&out, "%d 1\n%010d %05d n\r\n", obj.Num, offsets[i], obj.Gen)
+		}
+		newTrailer["Size"] = size
+		out.WriteString("trailer\n")
+		writePDFObject(&out, newTrailer)
+		out.WriteByte('\n')
+	}
+	fmt.Fprintf(&out, "startxref\n%d\n%%%%EOF\n", xrefOffset)
+
+	_, err = dst.Write(out.Bytes())
+	return err
+}
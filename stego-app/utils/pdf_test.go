@@ -0,0 +1,380 @@
+package utils
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// testPDFContent is a page content stream with 40 TJ arrays of 8 kerning values and a Td
+// operator each, 400 carrier numbers in all
+var testPDFContent = func() string {
+	var b strings.Builder
+	b.WriteString("BT /F1 12 Tf\n")
+	for i := 0; i < 40; i++ {
+		fmt.Fprintf(&b, "0 -14.5 Td [(A) -12 (B) 30.25 (C) -4.5 (D) 7 (E) -100 (F) 3.333 (G) -0.5 (H) 250] TJ\n")
+	}
+	b.WriteString("ET\n")
+	return b.String()
+}()
+
+// testPDF builds a one-page PDF with a classic cross-reference table, or with a
+// cross-reference stream. The content stream is FlateDecode compressed when compress is set.
+// extraCatalog is added to the catalog dictionary.
+func testPDF(xrefStream, compress bool, extraCatalog string) []byte {
+	content, filter := []byte(testPDFContent), ""
+	if compress {
+		var z bytes.Buffer
+		w := zlib.NewWriter(&z)
+		w.Write(content)
+		w.Close()
+		content, filter = z.Bytes(), " /Filter /FlateDecode"
+	}
+	objects := []string{
+		"<< /Type /Catalog /Pages 2 0 R" + extraCatalog + " >>",
+		"<< /Type /Pages /Kids [3 0 R] /Count 1 >>",
+		"<< /Type /Page /Parent 2 0 R /MediaBox [0 0 612 792] /Contents 4 0 R >>",
+		fmt.Sprintf("<< /Length %d%s >>\nstream\n%s\nendstream", len(content), filter, content),
+		"<< /Producer (test) >>",
+	}
+
+	out := []byte("%PDF-1.7\n%\xE2\xE3\xCF\xD3\n")
+	offsets := make([]int, len(objects)+1)
+	for i, obj := range objects {
+		offsets[i] = len(out)
+		out = fmt.Appendf(out, "%d 0 obj\n%s\nendobj\n", i+1, obj)
+	}
+
+	xref := len(out)
+	if xrefStream {
+		offsets[len(objects)] = xref
+		var rows []byte
+		rows = append(rows, 0, 0, 0, 0, 0, 0xFF, 0xFF)
+		for _, o := range offsets {
+			rows = append(rows, 1)
+			rows = binary.BigEndian.AppendUint32(rows, uint32(o))
+			rows = append(rows, 0, 0)
+		}
+		out = fmt.Appendf(out, "%d 0 obj\n<< /Type /XRef /Size %d /W [1 4 2] /Root 1 0 R /Info 5 0 R /Length %d >>\nstream\n",
+			len(objects)+1, len(objects)+2, len(rows))
+		out = append(out, rows...)
+		out = append(out, "\nendstream\nendobj\n"...)
+	} else {
+		out = fmt.Appendf(out, "xref\n0 %d\n0000000000 65535 f\r\n", len(objects)+1)
+		for _, o := range offsets[:len(objects)] {
+			out = fmt.Appendf(out, "%010d 00000 n\r\n", o)
+		}
+		out = fmt.Appendf(out, "trailer\n<< /Size %d /Root 1 0 R /Info 5 0 R >>\n", len(objects)+1)
+	}
+	return fmt.Appendf(out, "startxref\n%d\n%%%%EOF\n", xref)
+}
+
+// testPDFUpdate appends an incremental update by another tool that rewrites the Info
+// dictionary and drops every other trailer entry
+func testPDFUpdate(pdf []byte) []byte {
+	doc, err := loadPDF(bytes.NewReader(pdf), int64(len(pdf)))
+	if err != nil {
+		panic(err)
+	}
+	size := doc.trailer()["Size"].(int)
+	out := bytes.Clone(pdf)
+	offset := len(out)
+	out = append(out, "5 0 obj\n<< /Producer (other tool) >>\nendobj\n"...)
+	xref := len(out)
+	out = fmt.Appendf(out, "xref\n5 1\n%010d 00000 n\r\ntrailer\n<< /Size %d /Root 1 0 R /Prev %d >>\nstartxref\n%d\n%%%%EOF\n",
+		offset, size, doc.sections[0].Offset, xref)
+	return out
+}
+
+// checkPDFKerning checks that the carrier numbers of the output differ from the original
+// ones by less than the rounding to two decimals and the added thousandth
+func checkPDFKerning(t *testing.T, name string, carrier, out []byte) {
+	t.Helper()
+	before, _ := loadPDF(bytes.NewReader(carrier), int64(len(carrier)))
+	after, err := loadPDF(bytes.NewReader(out), int64(len(out)))
+	if err != nil {
+		t.Fatalf("%s: %v", name, err)
+	}
+	a, _, _ := before.pageContents()
+	b, pages, err := after.pageContents()
+	if err != nil || pages != 1 || len(a) != len(b) {
+		t.Fatalf("%s: %d pages, %v", name, pages, err)
+	}
+	for i := range a {
+		if len(a[i].Numbers) != len(b[i].Numbers) {
+			t.Fatalf("%s: %d carrier numbers, want %d", name, len(b[i].Numbers), len(a[i].Numbers))
+		}
+		for j, n := range a[i].Numbers {
+			m := b[i].Numbers[j]
+			x, _ := strconv.ParseFloat(string(a[i].Data[n[0]:n[1]]), 64)
+			y, _ := strconv.ParseFloat(string(b[i].Data[m[0]:m[1]]), 64)
+			if math.Abs(x-y) > 0.0061 {
+				t.Fatalf("%s: %v rewritten as %v", name, x, y)
+			}
+		}
+	}
+}
+
+func TestPDFRoundTrip(t *testing.T) {
+	carriers := map[string][]byte{
+		"classic":            testPDF(false, false, ""),
+		"xref stream":        testPDF(true, false, ""),
+		"compressed content": testPDF(false, true, ""),
+		"updated":            testPDFUpdate(testPDF(true, true, "")),
+		"no trailing eol":    bytes.TrimRight(testPDF(false, false, ""), "\n"),
+	}
+	data := []byte("pdf payload")
+	for name, carrier := range carriers {
+		for _, mode := range []string{"", PDFModeIncremental, PDFModeKerning, PDFModeAttachment, PDFModeXMP} {
+			out, err := EmbedDataInPDF(carrier, data, mode)
+			if err != nil {
+				t.Fatalf("%s, %q mode: %v", name, mode, err)
+			}
+			got, err := ExtractDataFromPDF(out)
+			if err != nil || !bytes.Equal(got, data) {
+				t.Fatalf("%s, %q mode: got %q, %v", name, mode, got, err)
+			}
+			// Incremental updates leave the original revision byte for byte
+			if !bytes.HasPrefix(out, carrier) {
+				t.Fatalf("%s, %q mode: original revision changed", name, mode)
+			}
+			checkPDFKerning(t, name+" "+mode, carrier, out)
+
+			before, _ := loadPDF(bytes.NewReader(carrier), int64(len(carrier)))
+			after, _ := loadPDF(bytes.NewReader(out), int64(len(out)))
+			if before.trailer()["Info"] != after.trailer()["Info"] || before.trailer()["Root"] != after.trailer()["Root"] {
+				t.Fatalf("%s, %q mode: trailer entries not carried over", name, mode)
+			}
+		}
+	}
+}
+
+func TestPDFXMPKeepsMetadata(t *testing.T) {
+	packet := strings.Replace(emptyXMPPacket, "</rdf:RDF>",
+		"<rdf:Description rdf:about=\"\" xmlns:dc=\"http://purl.org/dc/elements/1.1/\"><dc:format>application/pdf</dc:format></rdf:Description>\n</rdf:RDF>", 1)
+	carrier := testPDF(false, false, " /Metadata 6 0 R")
+	carrier = testPDFObject(carrier, 6, fmt.Sprintf("<< /Type /Metadata /Subtype /XML /Length %d >>\nstream\n%s\nendstream", len(packet), packet))
+
+	out := carrier
+	for _, data := range []string{"first", "second"} {
+		var err error
+		out, err = EmbedDataInPDF(out, []byte(data), PDFModeXMP)
+		if err != nil {
+			t.Fatal(err)
+		}
+		doc, _ := loadPDF(bytes.NewReader(out), int64(len(out)))
+		_, catalog, _ := doc.catalog()
+		obj, _ := doc.resolve(catalog["Metadata"])
+		xmp, _ := doc.decodeStream(obj.(pdfStream))
+		if !bytes.Contains(xmp, []byte("<dc:format>application/pdf</dc:format>")) || bytes.Count(xmp, []byte(xmpPayloadNS)) != 1 {
+			t.Fatalf("metadata packet %s", xmp)
+		}
+		if catalog["Metadata"] != (pdfRef{Num: 6}) {
+			t.Fatalf("metadata moved to %v", catalog["Metadata"])
+		}
+	}
+}
+
+// testPDFObject adds object num with body to pdf in an incremental update
+func testPDFObject(pdf []byte, num int, body string) []byte {
+	doc, err := loadPDF(bytes.NewReader(pdf), int64(len(pdf)))
+	if err != nil {
+		panic(err)
+	}
+	var out bytes.Buffer
+	if err := doc.writeUpdate(pdfUpdate{Objects: []pdfObject{{Num: num, Body: []byte(body)}}}, &out); err != nil {
+		panic(err)
+	}
+	return out.Bytes()
+}
+
+func TestPDFAttachmentKeepsUserFiles(t *testing.T) {
+	carrier := testPDF(false, false, " /Names << /EmbeddedFiles << /Names [(notes.txt) 7 0 R] >> >>")
+	carrier = testPDFObject(carrier, 6, "<< /Type /EmbeddedFile /Length 5 >>\nstream\nnotes\nendstream")
+	carrier = testPDFObject(carrier, 7, "<< /Type /Filespec /F (notes.txt) /EF << /F 6 0 R >> >>")
+
+	out := carrier
+	for _, data := range []string{"first", "second", "third"} {
+		var err error
+		out, err = EmbedDataInPDF(out, []byte(data), PDFModeAttachment)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got, err := ExtractDataFromPDF(out); err != nil || string(got) != data {
+			t.Fatalf("got %q, %v", got, err)
+		}
+	}
+	doc, _ := loadPDF(bytes.NewReader(out), int64(len(out)))
+	_, catalog, _ := doc.catalog()
+	names, _ := doc.resolve(catalog["Names"])
+	entries := doc.nameTreeEntries(names.(pdfDict)["EmbeddedFiles"], 0, map[pdfRef]bool{})
+	if len(entries) != 4 || string(entries[0].(pdfString)) != pdfAttachmentName || string(entries[2].(pdfString)) != "notes.txt" {
+		t.Fatalf("name tree %v", entries)
+	}
+}
+
+func TestPDFReembedAcrossModes(t *testing.T) {
+	for name, carrier := range map[string][]byte{
+		"classic":     testPDF(false, false, ""),
+		"xref stream": testPDF(true, true, ""),
+	} {
+		out := carrier
+		modes := []string{PDFModeIncremental, PDFModeAttachment, PDFModeXMP, PDFModeKerning, PDFModeIncremental,
+			PDFModeXMP, PDFModeAttachment, PDFModeKerning, PDFModeXMP, PDFModeIncremental, PDFModeAttachment}
+		var previous []byte
+		for i, mode := range modes {
+			data := bytes.Repeat([]byte{byte('a' + i)}, 20+i)
+			var err error
+			out, err = EmbedDataInPDF(out, data, mode)
+			if err != nil {
+				t.Fatalf("%s, step %d (%s): %v", name, i, mode, err)
+			}
+			got, err := ExtractDataFromPDF(out)
+			if err != nil || !bytes.Equal(got, data) {
+				t.Fatalf("%s, step %d (%s): got %q, %v", name, i, mode, got, err)
+			}
+			if previous != nil {
+				framed := prepareDataWithHeader(previous)
+				if bytes.Contains(out, framed) || bytes.Contains(out, []byte(base64.StdEncoding.EncodeToString(framed))) {
+					t.Fatalf("%s, step %d (%s): previous payload left in the file", name, i, mode)
+				}
+			}
+			previous = data
+			if mode == PDFModeKerning {
+				previous = nil // its bits are only superseded
+			}
+			checkPDFKerning(t, name, carrier, out)
+		}
+	}
+}
+
+func TestPDFPayloadSurvivesLaterUpdate(t *testing.T) {
+	for _, mode := range []string{PDFModeIncremental, PDFModeAttachment, PDFModeXMP, PDFModeKerning} {
+		out, err := EmbedDataInPDF(testPDF(false, false, ""), []byte("kept"), mode)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got, err := ExtractDataFromPDF(testPDFUpdate(out)); err != nil || string(got) != "kept" {
+			t.Fatalf("%s: got %q, %v", mode, got, err)
+		}
+	}
+}
+
+func TestPDFLegacyAppendedPayload(t *testing.T) {
+	carrier := testPDF(false, false, "")
+	for name, legacy := range map[string][]byte{
+		"footer":    append(bytes.Clone(carrier), makeTrailer(int64(len(carrier)), []byte("appended"))...),
+		"no footer": append(bytes.Clone(carrier), prepareDataWithHeader([]byte("appended"))...),
+	} {
+		if got, err := ExtractDataFromPDF(legacy); err != nil || string(got) != "appended" {
+			t.Fatalf("%s: got %q, %v", name, got, err)
+		}
+		out, err := EmbedDataInPDF(legacy, []byte("update"), PDFModeIncremental)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got, err := ExtractDataFromPDF(out); err != nil || string(got) != "update" {
+			t.Fatalf("%s: got %q, %v", name, got, err)
+		}
+		if bytes.Contains(out, []byte("appended")) {
+			t.Fatalf("%s: appended payload left in the file", name)
+		}
+	}
+}
+
+func TestPDFKerningCapacity(t *testing.T) {
+	carrier := testPDF(false, true, "")
+	estimate, err := EstimatePDFCapacity(carrier, PDFModeKerning)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if estimate.Capacity != 400/8-8 || len(estimate.PageBits) != 1 || estimate.PageBits[0] != 400 {
+		t.Fatalf("estimate %+v", estimate)
+	}
+	if _, err := EmbedDataInPDF(carrier, make([]byte, estimate.Capacity), PDFModeKerning); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := EmbedDataInPDF(carrier, make([]byte, estimate.Capacity+1), PDFModeKerning); err == nil {
+		t.Fatal("data larger than the capacity accepted")
+	}
+}
+
+func TestPDFFlateBomb(t *testing.T) {
+	var z bytes.Buffer
+	w := zlib.NewWriter(&z)
+	w.Write(make([]byte, 1<<20))
+	w.Close()
+	if _, err := flateDecode(z.Bytes(), nil, 1000); err == nil {
+		t.Fatal("stream inflating past the limit accepted")
+	}
+	if data, err := flateDecode(z.Bytes(), nil, 1<<20); err != nil || len(data) != 1<<20 {
+		t.Fatalf("got %d bytes, %v", len(data), err)
+	}
+}
+
+func TestPDFMalformed(t *testing.T) {
+	carrier := testPDF(false, false, "")
+	if _, err := EmbedDataInPDF(carrier, []byte("x"), "annotation"); err == nil {
+		t.Error("invalid mode accepted")
+	}
+	if _, err := EmbedDataInPDF(carrier, nil, ""); err == nil {
+		t.Error("empty data accepted")
+	}
+	if _, err := EmbedDataInPDF(nil, []byte("x"), ""); err == nil {
+		t.Error("empty pdf accepted")
+	}
+
+	encrypted := bytes.Replace(carrier, []byte("/Info 5 0 R >>"), []byte("/Info 5 0 R /Encrypt 5 0 R >>"), 1)
+	for _, mode := range []string{"", PDFModeKerning, PDFModeAttachment, PDFModeXMP} {
+		if _, err := EmbedDataInPDF(encrypted, []byte("x"), mode); err == nil {
+			t.Errorf("encrypted pdf accepted in %q mode", mode)
+		}
+		if _, err := EstimatePDFCapacity(encrypted, mode); err == nil {
+			t.Errorf("encrypted pdf estimated in %q mode", mode)
+		}
+	}
+
+	xref := bytes.LastIndex(carrier, []byte("startxref"))
+	looping := bytes.Replace(carrier, []byte("/Info 5 0 R >>"), fmt.Appendf(nil, "/Info 5 0 R /Prev %d >>", bytes.LastIndex(carrier, []byte("xref\n"))), 1)
+	for name, bad := range map[string][]byte{
+		"no startxref":  carrier[:xref],
+		"bad startxref": append(bytes.Clone(carrier[:xref]), "startxref\n999999\n%%EOF\n"...),
+		"not a section": append(bytes.Clone(carrier[:xref]), "startxref\n9\n%%EOF\n"...),
+	} {
+		for _, mode := range []string{PDFModeKerning, PDFModeAttachment, PDFModeXMP} {
+			if _, err := EmbedDataInPDF(bad, []byte("x"), mode); err == nil {
+				t.Errorf("%s accepted in %s mode", name, mode)
+			}
+		}
+		// Incremental mode appends the payload to files it cannot read
+		out, err := EmbedDataInPDF(bad, []byte("appended"), "")
+		if err != nil || !bytes.HasPrefix(out, bad) {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if got, err := ExtractDataFromPDF(out); err != nil || string(got) != "appended" {
+			t.Fatalf("%s: got %q, %v", name, got, err)
+		}
+	}
+
+	// A /Prev pointing back at the same section is read once
+	out, err := EmbedDataInPDF(looping, []byte("loop"), PDFModeIncremental)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, err := ExtractDataFromPDF(out); err != nil || string(got) != "loop" {
+		t.Fatalf("got %q, %v", got, err)
+	}
+
+	if _, err := ExtractDataFromPDF(carrier); err == nil {
+		t.Error("clean file extracted")
+	}
+	if _, err := ExtractDataFromPDF([]byte("%PDF")); err == nil {
+		t.Error("tiny file extracted")
+	}
+}
@@ -0,0 +1,280 @@
+package utils
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"maps"
+	"regexp"
+	"slices"
+)
+
+// Attachment and XMP modes hang the payload off the catalog, so it survives tools that
+// rewrite the file and drop the incremental update history.
+
+// pdfAttachmentName is the decoy file name of the payload in the EmbeddedFiles name tree
+const pdfAttachmentName = "ColorProfile.icc"
+
+// Custom XMP namespace holding the base64 payload as its Data property
+const (
+	xmpPayloadNS     = "http://ns.stego-app.local/xmp/1.0/"
+	xmpPayloadPrefix = "stg"
+)
+
+// xmpPayloadPattern matches the rdf:Description written for the payload
+var xmpPayloadPattern = regexp.MustCompile(`(?s)\s*<rdf:Description\b[^>]*\bxmlns:` + xmpPayloadPrefix +
+	`="` + regexp.QuoteMeta(xmpPayloadNS) + `"[^>]*?(?:/>|>.*?</rdf:Description>)`)
+
+// emptyXMPPacket is the metadata stream created for documents without one
+const emptyXMPPacket = "<?xpacket begin=\"\ufeff\" id=\"W5M0MpCehiHzreSzNTczkc9d\"?>\n" +
+	"<x:xmpmeta xmlns:x=\"adobe:ns:meta/\">\n" +
+	"<rdf:RDF xmlns:rdf=\"http://www.w3.org/1999/02/22-rdf-syntax-ns#\">\n" +
+	"</rdf:RDF>\n" +
+	"</x:xmpmeta>\n" +
+	"<?xpacket end=\"w\"?>"
+
+// embedPDFAttachment stores the payload as an embedded file under the decoy name
+func embedPDFAttachment(e *pdfEdit, data []byte) error {
+	if e.catalog == nil {
+		return errors.New("pdf catalog not found")
+	}
+
+	payload := prepareDataWithHeader(data)
+	file := pdfRef{Num: e.alloc()}
+	e.addStream(file, pdfDict{
+		"Type":    pdfName("EmbeddedFile"),
+		"Subtype": pdfName("application/vnd.iccprofile"),
+		"Params":  pdfDict{"Size": len(payload)},
+	}, payload)
+
+	spec := pdfRef{Num: e.alloc()}
+	e.addObject(spec, pdfDict{
+		"Type": pdfName("Filespec"),
+		"F":    pdfString(pdfAttachmentName),
+		"UF":   pdfString(pdfAttachmentName),
+		"EF":   pdfDict{"F": file},
+	})
+
+	e.attachments = append(e.attachments, pdfString(pdfAttachmentName), spec)
+	e.attachmentsChanged = true
+	return nil
+}
+
+// embedPDFXMP stores the payload base64 encoded in a custom namespace of the XMP metadata
+func embedPDFXMP(e *pdfEdit, data []byte) error {
+	if e.catalog == nil {
+		return errors.New("pdf catalog not found")
+	}
+
+	xmp := e.xmp
+	if xmp == nil {
+		xmp = []byte(emptyXMPPacket)
+	}
+	end := bytes.LastIndex(xmp, []byte("</rdf:RDF>"))
+	if end < 0 {
+		return errors.New("invalid xmp metadata: rdf:RDF element not found")
+	}
+
+	desc := fmt.Sprintf("<rdf:Description rdf:about=\"\" xmlns:%[1]s=\"%[2]s\"><%[1]s:Data>%[3]s</%[1]s:Data></rdf:Description>\n",
+		xmpPayloadPrefix, xmpPayloadNS, base64.StdEncoding.EncodeToString(prepareDataWithHeader(data)))
+	e.xmp = slices.Concat(xmp[:end], []byte(desc), xmp[end:])
+	e.xmpChanged = true
+	return nil
+}
+
+// loadAttachments reads the EmbeddedFiles name tree, dropping payloads of earlier embeds
+func (e *pdfEdit) loadAttachments() {
+	names, _ := e.doc.resolve(e.catalog["Names"])
+	namesDict, _ := names.(pdfDict)
+	entries := e.doc.nameTreeEntries(namesDict["EmbeddedFiles"], 0, map[pdfRef]bool{})
+
+	for i := 0; i+1 < len(entries); i += 2 {
+		if stream, _, ok := e.doc.attachmentPayload(entries[i], entries[i+1]); ok {
+			if length, err := e.doc.streamLength(stream); err == nil {
+				e.update.Blank = append(e.update.Blank, pdfSpan{stream.Offset, stream.Offset + int64(length)})
+			}
+			e.attachmentsChanged = true
+			continue
+		}
+		e.attachments = append(e.attachments, entries[i], entries[i+1])
+	}
+}
+
+// storeAttachments writes the attachments as a single leaf EmbeddedFiles name tree
+func (e *pdfEdit) storeAttachments() {
+	names := pdfDict{}
+	if v, err := e.doc.resolve(e.catalog["Names"]); err == nil {
+		if d, ok := v.(pdfDict); ok {
+			names = maps.Clone(d)
+		}
+	}
+
+	// Name tree keys are sorted by their bytes
+	type entry struct {
+		key   []byte
+		value any
+	}
+	var entries []entry
+	for i := 0; i+1 < len(e.attachments); i += 2 {
+		key, _ := e.attachments[i].(pdfString)
+		entries = append(entries, entry{key, e.attachments[i+1]})
+	}
+	slices.SortStableFunc(entries, func(a, b entry) int { return bytes.Compare(a.key, b.key) })
+
+	if len(entries) == 0 {
+		delete(names, "EmbeddedFiles")
+	} else {
+		arr := make([]any, 0, 2*len(entries))
+		for _, en := range entries {
+			arr = append(arr, pdfString(en.key), en.value)
+		}
+		names["EmbeddedFiles"] = pdfDict{"Names": arr}
+	}
+
+	if len(names) == 0 {
+		delete(e.catalog, "Names")
+	} else {
+		e.catalog["Names"] = names
+	}
+	e.catalogChanged = true
+}
+
+// loadXMP reads the metadata stream of the catalog, dropping a payload of an earlier embed
+func (e *pdfEdit) loadXMP() {
+	ref, ok := e.catalog["Metadata"].(pdfRef)
+	if !ok {
+		return
+	}
+	obj, err := e.doc.resolve(ref)
+	stream, ok := obj.(pdfStream)
+	if err != nil || !ok {
+		return
+	}
+	xmp, err := e.doc.decodeStream(stream)
+	if err != nil {
+		return
+	}
+	length, err := e.doc.streamLength(stream)
+	if err != nil {
+		return
+	}
+
+	e.xmpRef, e.xmpDict, e.xmp = ref, stream.Dict, xmp
+	if loc := xmpPayloadPattern.FindIndex(xmp); loc != nil {
+		e.xmp = slices.Concat(xmp[:loc[0]], xmp[loc[1]:])
+		e.xmpSpan = pdfSpan{stream.Offset, stream.Offset + int64(length)}
+		e.xmpChanged = true
+	}
+}
+
+// storeXMP writes the metadata stream uncompressed, as XMP readers expect
+func (e *pdfEdit) storeXMP() {
+	dict := pdfDict{"Type": pdfName("Metadata"), "Subtype": pdfName("XML")}
+	if e.xmpRef.Num == 0 {
+		e.xmpRef = pdfRef{Num: e.alloc()}
+		e.catalog["Metadata"] = e.xmpRef
+		e.catalogChanged = true
+	} else {
+		dict = maps.Clone(e.xmpDict)
+		for _, key := range []string{"Filter", "DecodeParms", "DL"} {
+			delete(dict, key)
+		}
+		// Earlier revisions stay byte for byte unless they hold a payload
+		if e.xmpSpan != (pdfSpan{}) {
+			e.update.Blank = append(e.update.Blank, e.xmpSpan)
+		}
+	}
+	e.addStream(e.xmpRef, dict, e.xmp)
+}
+
+// extractAttachment returns the payload stored under the decoy attachment name
+func (d *pdfDoc) extractAttachment() ([]byte, bool) {
+	_, catalog, err := d.catalog()
+	if err != nil {
+		return nil, false
+	}
+	names, _ := d.resolve(catalog["Names"])
+	namesDict, _ := names.(pdfDict)
+	entries := d.nameTreeEntries(namesDict["EmbeddedFiles"], 0, map[pdfRef]bool{})
+	for i := 0; i+1 < len(entries); i += 2 {
+		if _, data, ok := d.attachmentPayload(entries[i], entries[i+1]); ok {
+			return data, true
+		}
+	}
+	return nil, false
+}
+
+// extractXMP returns the payload stored in the custom XMP namespace
+func (d *pdfDoc) extractXMP() ([]byte, bool) {
+	_, catalog, err := d.catalog()
+	if err != nil {
+		return nil, false
+	}
+	obj, err := d.resolve(catalog["Metadata"])
+	stream, ok := obj.(pdfStream)
+	if err != nil || !ok {
+		return nil, false
+	}
+	xmp, err := d.decodeStream(stream)
+	if err != nil {
+		return nil, false
+	}
+
+	return findXMLPayload(xmp, xmpPayloadNS, "Data")
+}
+
+// attachmentPayload checks whether a name tree entry is a payload written by an embed
+// and returns its stream and data
+func (d *pdfDoc) attachmentPayload(name, spec any) (pdfStream, []byte, bool) {
+	if key, ok := name.(pdfString); !ok || string(key) != pdfAttachmentName {
+		return pdfStream{}, nil, false
+	}
+	v, _ := d.resolve(spec)
+	specDict, _ := v.(pdfDict)
+	v, _ = d.resolve(specDict["EF"])
+	ef, _ := v.(pdfDict)
+	v, err := d.resolve(ef["F"])
+	stream, ok := v.(pdfStream)
+	if err != nil || !ok {
+		return pdfStream{}, nil, false
+	}
+
+	// Tools rewriting the file may have compressed the embedded file
+	raw, err := d.decodeStream(stream)
+	if err != nil {
+		return pdfStream{}, nil, false
+	}
+	data, err := parseHeaderedData(raw)
+	if err != nil {
+		return pdfStream{}, nil, false
+	}
+	return stream, data, true
+}
+
+// nameTreeEntries flattens a name tree into key, value pairs
+func (d *pdfDoc) nameTreeEntries(node any, depth int, seen map[pdfRef]bool) []any {
+	if ref, ok := node.(pdfRef); ok {
+		if seen[ref] {
+			return nil
+		}
+		seen[ref] = true
+	}
+	v, err := d.resolve(node)
+	dict, ok := v.(pdfDict)
+	if err != nil || !ok || depth > 32 {
+		return nil
+	}
+
+	var entries []any
+	if names, _ := d.resolve(dict["Names"]); names != nil {
+		arr, _ := names.([]any)
+		entries = append(entries, arr[:len(arr)/2*2]...)
+	}
+	kids, _ := d.resolve(dict["Kids"])
+	arr, _ := kids.([]any)
+	for _, kid := range arr {
+		entries = append(entries, d.nameTreeEntries(kid, depth+1, seen)...)
+	}
+	return entries
+}
@@ -0,0 +1,322 @@
+package utils
+
+import (
+	"bytes"
+	"compress/zlib"
+	"errors"
+	"fmt"
+	"maps"
+	"math"
+	"strconv"
+)
+
+// In kerning mode the numbers of TJ arrays and the Td/TD operands on the pages carry one bit
+// each in their third decimal: the value is rounded to two decimals and 0.001 is written
+// after them for a 1. That is a millionth of an em for kerning and 1/72000 inch for text
+// positions, far below anything a renderer can show. Only the numbers the payload needs are
+// rewritten, everything after them and the streams they do not reach stay byte for byte.
+
+// pdfContent is a page content stream with the carrier numbers found in it
+type pdfContent struct {
+	Page    int
+	Ref     pdfRef
+	Stream  pdfStream
+	Data    []byte   // decoded content
+	Numbers [][2]int // [start, end) of each carrier number in Data
+}
+
+// embedPDFKerning rewrites the page content streams with the payload bits
+func embedPDFKerning(e *pdfEdit, data []byte) error {
+	doc := e.doc
+	contents, pages, err := doc.pageContents()
+	if err != nil {
+		return err
+	}
+	if err := kerningEstimate(contents, pages).checkCapacity(len(data)); err != nil {
+		return err
+	}
+
+	bits := bytesToBits(prepareDataWithHeader(data))
+	for _, c := range contents {
+		if len(bits) == 0 {
+			break
+		}
+		if len(c.Numbers) == 0 {
+			continue
+		}
+
+		var content bytes.Buffer
+		pos := 0
+		for _, n := range c.Numbers[:min(len(c.Numbers), len(bits))] {
+			v, err := strconv.ParseFloat(string(c.Data[n[0]:n[1]]), 64)
+			if err != nil {
+				return err
+			}
+			content.Write(c.Data[pos:n[0]])
+			content.WriteString(kerningNumber(v, bits[0]))
+			pos = n[1]
+			bits = bits[1:]
+		}
+		content.Write(c.Data[pos:])
+		if bytes.Equal(content.Bytes(), c.Data) {
+			continue
+		}
+
+		// The new stream object goes into the update, the original revision is left as it is
+		body, err := streamObjectBody(c.Stream.Dict, content.Bytes())
+		if err != nil {
+			return err
+		}
+		e.update.Objects = append(e.update.Objects, pdfObject{Num: c.Ref.Num, Gen: c.Ref.Gen, Body: body})
+	}
+	return nil
+}
+
+// extractPDFKerning reads the payload bits back from the page content streams
+func extractPDFKerning(doc *pdfDoc) ([]byte, error) {
+	contents, _, err := doc.pageContents()
+	if err != nil {
+		return nil, err
+	}
+	var bits []uint8
+	for _, c := range contents {
+		for _, n := range c.Numbers {
+			bits = append(bits, kerningBit(c.Data[n[0]:n[1]]))
+		}
+	}
+	return parseHeaderedData(bitsToBytes(bits))
+}
+
+// kerningEstimate reports the capacity of the content streams, with the bits of each page
+func kerningEstimate(contents []pdfContent, pages int) CapacityEstimate {
+	pageBits := make([]int, pages)
+	total := 0
+	for _, c := range contents {
+		pageBits[c.Page] += len(c.Numbers)
+		total += len(c.Numbers)
+	}
+	estimate := newEstimate("pdf", PDFModeKerning, total/8, fmt.Sprintf(
+		"1 bit in the third decimal of each of %d TJ kerning values and Td/TD operands over %d page(s)",
+		total, pages))
+	estimate.PageBits = pageBits
+	return estimate
+}
+
+// kerningNumber formats v rounded to two decimals, with 0.001 added in writing for a 1 bit
+func kerningNumber(v float64, bit uint8) string {
+	r := math.Round(v*100) / 100
+	if bit == 0 {
+		return strconv.FormatFloat(r, 'f', -1, 64)
+	}
+	return strconv.FormatFloat(r, 'f', 2, 64) + "1"
+}
+
+// kerningBit reads the bit from the third decimal of a number
+func kerningBit(number []byte) uint8 {
+	i := bytes.IndexByte(number, '.')
+	if i < 0 || i+3 >= len(number) {
+		return 0
+	}
+	return (number[i+3] - '0') & 1
+}
+
+// pageContents decodes the content streams of all pages in page order; a stream
+// shared by several pages is listed once and streams that cannot be decoded are left out
+func (d *pdfDoc) pageContents() ([]pdfContent, int, error) {
+	pages, err := d.pages()
+	if err != nil {
+		return nil, 0, err
+	}
+
+	var contents []pdfContent
+	seen := map[pdfRef]bool{}
+	for i, page := range pages {
+		v := page["Contents"]
+		if ref, ok := v.(pdfRef); ok {
+			// Either a single stream or an indirect array of streams
+			obj, err := d.resolve(ref)
+			if err != nil {
+				continue
+			}
+			if arr, ok := obj.([]any); ok {
+				v = arr
+			}
+		}
+		refs, ok := v.([]any)
+		if !ok {
+			refs = []any{v}
+		}
+
+		for _, r := range refs {
+			ref, ok := r.(pdfRef)
+			if !ok || seen[ref] {
+				continue
+			}
+			seen[ref] = true
+			obj, err := d.resolve(ref)
+			stream, ok := obj.(pdfStream)
+			if err != nil || !ok {
+				continue
+			}
+			data, err := d.decodeStream(stream)
+			if err != nil {
+				continue
+			}
+			contents = append(contents, pdfContent{
+				Page:    i,
+				Ref:     ref,
+				Stream:  stream,
+				Data:    data,
+				Numbers: kerningNumbers(data),
+			})
+		}
+	}
+	return contents, len(pages), nil
+}
+
+// pages returns the page dictionaries in document order
+func (d *pdfDoc) pages() ([]pdfDict, error) {
+	root, err := d.resolve(d.trailer()["Root"])
+	if err != nil {
+		return nil, err
+	}
+	catalog, ok := root.(pdfDict)
+	if !ok {
+		return nil, errors.New("pdf catalog not found")
+	}
+
+	var pages []pdfDict
+	seen := map[pdfRef]bool{}
+	var walk func(v any, depth int)
+	walk = func(v any, depth int) {
+		if ref, ok := v.(pdfRef); ok {
+			if seen[ref] {
+				return
+			}
+			seen[ref] = true
+		}
+		obj, err := d.resolve(v)
+		node, ok := obj.(pdfDict)
+		if err != nil || !ok || depth > 64 {
+			return
+		}
+		if _, ok := node["Kids"]; !ok {
+			pages = append(pages, node)
+			return
+		}
+		kids, _ := d.resolve(node["Kids"])
+		arr, _ := kids.([]any)
+		for _, kid := range arr {
+			walk(kid, depth+1)
+		}
+	}
+	walk(catalog["Pages"], 0)
+	return pages, nil
+}
+
+// kerningNumbers returns the carrier numbers of a content stream: the numbers inside
+// the array operand of TJ and both operands of Td and TD
+func kerningNumbers(content []byte) [][2]int {
+	var numbers [][2]int
+	var operands [][2]int // numbers, or {-1, -1} for any other operand
+	var array, lastArray [][2]int
+	depth := 0
+
+	l := &pdfLexer{buf: content}
+	for {
+		l.skipSpace()
+		start := l.pos
+		tok, err := l.token()
+		if err != nil {
+			return numbers
+		}
+		span := [2]int{start, l.pos}
+
+		switch t := tok.(type) {
+		case int, float64:
+			if depth > 0 {
+				array = append(array, span)
+			} else {
+				operands = append(operands, span)
+			}
+		case pdfKeyword:
+			switch t {
+			case "[":
+				if depth == 0 {
+					array = nil
+				}
+				depth++
+			case "]":
+				if depth > 0 {
+					depth--
+					if depth == 0 {
+						lastArray = array
+					}
+				}
+			case "<<", ">>", "{", "}", "true", "false", "null":
+			case "ID":
+				skipInlineImage(l)
+				operands, lastArray = nil, nil
+			default:
+				switch t {
+				case "TJ":
+					numbers = append(numbers, lastArray...)
+				case "Td", "TD":
+					if n := len(operands); n >= 2 && operands[n-2][0] >= 0 && operands[n-1][0] >= 0 {
+						numbers = append(numbers, operands[n-2:]...)
+					}
+				}
+				operands, lastArray = nil, nil
+			}
+		default:
+			if depth == 0 {
+				operands = append(operands, [2]int{-1, -1})
+			}
+		}
+	}
+}
+
+// skipInlineImage moves past the binary data of an inline image to its EI operator
+func skipInlineImage(l *pdfLexer) {
+	for i := l.pos + 1; i < len(l.buf); {
+		j := bytes.Index(l.buf[i:], []byte("EI"))
+		if j < 0 {
+			break
+		}
+		k := i + j
+		if isPDFSpace(l.buf[k-1]) && (k+2 == len(l.buf) || isPDFSpace(l.buf[k+2]) || isPDFDelimiter(l.buf[k+2])) {
+			l.pos = k + 2
+			return
+		}
+		i = k + 2
+	}
+	l.pos = len(l.buf)
+}
+
+// streamObjectBody serializes a stream object with new decoded data, compressing it
+// with FlateDecode when the original stream was filtered
+func streamObjectBody(dict pdfDict, data []byte) ([]byte, error) {
+	dict = maps.Clone(dict)
+	delete(dict, "DecodeParms")
+	delete(dict, "DL")
+	if dict["Filter"] != nil {
+		var compressed bytes.Buffer
+		zw := zlib.NewWriter(&compressed)
+		if _, err := zw.Write(data); err != nil {
+			return nil, err
+		}
+		if err := zw.Close(); err != nil {
+			return nil, err
+		}
+		data = compressed.Bytes()
+		dict["Filter"] = pdfName("FlateDecode")
+	}
+	dict["Length"] = len(data)
+
+	var body bytes.Buffer
+	writePDFObject(&body, dict)
+	body.WriteString("\nstream\n")
+	body.Write(data)
+	body.WriteString("\nendstream")
+	return body.Bytes(), nil
+}
@@ -0,0 +1,944 @@
+package utils
+
+import (
+	"bytes"
+	"compress/zlib"
+	"errors"
+	"fmt"
+	"io"
+	"slices"
+	"strconv"
+)
+
+// PDF object model used by the PDF carriers: integers are int, reals float64,
+// dictionaries map names (without the slash) to values, arrays are []any and null is nil
+type (
+	pdfName    string
+	pdfString  []byte
+	pdfDict    map[string]any
+	pdfKeyword string // obj, endobj, R, stream, ... and the [ ] << >> delimiters
+	pdfRef     struct{ Num, Gen int }
+)
+
+// pdfStream is a stream object whose data starts at Offset in the file
+type pdfStream struct {
+	Dict   pdfDict
+	Offset int64
+}
+
+// pdfXrefEntry locates an object: Type 1 at Offset in the file, Type 2 as the Index-th
+// object of object stream Stream, Type 0 is a free entry
+type pdfXrefEntry struct {
+	Type   int
+	Offset int64
+	Gen    int
+	Stream int
+	Index  int
+}
+
+// pdfXrefSection is one cross-reference section together with its trailer
+type pdfXrefSection struct {
+	Offset       int64 // startxref value pointing at the section
+	Trailer      pdfDict
+	Entries      map[int]pdfXrefEntry
+	IsXRefStream bool
+}
+
+// pdfDoc is a PDF read through its cross-reference chain
+type pdfDoc struct {
+	src      io.ReaderAt
+	size     int64            // logical end of the PDF, bytes appended after %%EOF excluded
+	sections []pdfXrefSection // newest first
+	xref     map[int]pdfXrefEntry
+	objStms  map[int][]any // decoded object streams
+	inflated int           // bytes decoded by FlateDecode so far, bounded by maxPDFInflated
+}
+
+// maxPDFInflated bounds the decoded size of all the streams read from one file, so a
+// small deflate bomb cannot exhaust memory
+const maxPDFInflated = MaxInMemoryCarrier
+
+// errPDFShort means the lexer ran out of buffered bytes before the end of the file
+var errPDFShort = errors.New("pdf: buffer too short")
+
+// orPDFErr returns err, or a new error with message when err is nil
+func orPDFErr(err error, message string) error {
+	if err != nil {
+		return err
+	}
+	return errors.New(message)
+}
+
+// IsPDF reports whether data starts with a PDF header
+func IsPDF(data []byte) bool {
+	return bytes.HasPrefix(data, []byte("%PDF-"))
+}
+
+// loadPDF reads the cross-reference chain of the size byte PDF from src,
+// size being its logical end (see pdfLogicalEnd)
+func loadPDF(src io.ReaderAt, size int64) (*pdfDoc, error) {
+	tailStart := max(0, size-1024)
+	tail, err := readRange(src, int(tailStart), int(size))
+	if err != nil {
+		return nil, err
+	}
+	i := bytes.LastIndex(tail, []byte("startxref"))
+	if i < 0 {
+		return nil, errors.New("pdf startxref not found")
+	}
+	l := &pdfLexer{buf: tail, pos: i + len("startxref")}
+	tok, err := l.token()
+	start, ok := tok.(int)
+	if err != nil || !ok {
+		return nil, errors.New("invalid pdf startxref")
+	}
+
+	doc := &pdfDoc{src: src, size: size, xref: map[int]pdfXrefEntry{}, objStms: map[int][]any{}}
+	seen := map[int64]bool{}
+	for offset := int64(start); ; {
+		if seen[offset] || offset < 0 || offset >= size {
+			if len(doc.sections) == 0 {
+				return nil, errors.New("invalid pdf startxref")
+			}
+			break // Damaged or looping /Prev, keep what was read
+		}
+		seen[offset] = true
+
+		section, err := doc.readXrefSection(offset)
+		if err != nil {
+			if len(doc.sections) == 0 {
+				return nil, err
+			}
+			break
+		}
+		doc.sections = append(doc.sections, section)
+		doc.mergeXref(section.Entries)
+
+		// Hybrid files keep the entries of compressed objects in a separate xref stream
+		if stm, ok := section.Trailer["XRefStm"].(int); ok && !seen[int64(stm)] {
+			seen[int64(stm)] = true
+			if hybrid, err := doc.readXrefSection(int64(stm)); err == nil {
+				doc.mergeXref(hybrid.Entries)
+			}
+		}
+
+		prev, ok := section.Trailer["Prev"].(int)
+		if !ok {
+			break
+		}
+		offset = int64(prev)
+	}
+	return doc, nil
+}
+
+// mergeXref adds entries not already defined by a newer section
+func (d *pdfDoc) mergeXref(entries map[int]pdfXrefEntry) {
+	for num, e := range entries {
+		if _, ok := d.xref[num]; !ok {
+			d.xref[num] = e
+		}
+	}
+}
+
+// trailer returns the newest trailer dictionary
+func (d *pdfDoc) trailer() pdfDict {
+	return d.sections[0].Trailer
+}
+
+// readXrefSection reads a classic xref table with its trailer or an xref stream at offset
+func (d *pdfDoc) readXrefSection(offset int64) (pdfXrefSection, error) {
+	section := pdfXrefSection{Offset: offset, Entries: map[int]pdfXrefEntry{}}
+
+	head, err := readRange(d.src, int(offset), int(min(d.size, offset+16)))
+	if err != nil {
+		return section, err
+	}
+	if !bytes.HasPrefix(bytes.TrimLeft(head, "\x00\t\n\f\r "), []byte("xref")) {
+		_, _, obj, err := d.readObjectAt(offset)
+		if err != nil {
+			return section, err
+		}
+		stream, ok := obj.(pdfStream)
+		if !ok || stream.Dict["Type"] != pdfName("XRef") {
+			return section, errors.New("pdf startxref does not point at a cross-reference section")
+		}
+		section.Trailer = stream.Dict
+		section.IsXRefStream = true
+		err = d.parseXrefStream(stream, section.Entries)
+		return section, err
+	}
+
+	err = d.parseAt(offset, func(l *pdfLexer) error {
+		clear(section.Entries)
+		if tok, err := l.token(); err != nil || tok != pdfKeyword("xref") {
+			return orPDFErr(err, "invalid pdf xref table")
+		}
+		for {
+			tok, err := l.token()
+			if err != nil {
+				return err
+			}
+			if tok == pdfKeyword("trailer") {
+				break
+			}
+			first, ok := tok.(int)
+			count, err2 := l.token()
+			n, ok2 := count.(int)
+			if !ok || !ok2 || err2 != nil || n < 0 {
+				return orPDFErr(err2, "invalid pdf xref subsection")
+			}
+			for num := first; num < first+n; num++ {
+				off, err1 := l.token()
+				gen, err2 := l.token()
+				kind, err3 := l.token()
+				if err := errors.Join(err1, err2, err3); err != nil {
+					return err
+				}
+				o, ok1 := off.(int)
+				g, ok2 := gen.(int)
+				if !ok1 || !ok2 || (kind != pdfKeyword("n") && kind != pdfKeyword("f")) {
+					return errors.New("invalid pdf xref entry")
+				}
+				if _, ok := section.Entries[num]; ok {
+					continue // The first entry for a number wins
+				}
+				if kind == pdfKeyword("n") {
+					section.Entries[num] = pdfXrefEntry{Type: 1, Offset: int64(o), Gen: g}
+				} else {
+					section.Entries[num] = pdfXrefEntry{Type: 0, Gen: g}
+				}
+			}
+		}
+		trailer, err := l.object()
+		if err != nil {
+			return err
+		}
+		dict, ok := trailer.(pdfDict)
+		if !ok {
+			return errors.New("invalid pdf trailer")
+		}
+		section.Trailer = dict
+		return nil
+	})
+	return section, err
+}
+
+// parseXrefStream decodes the entries of a cross-reference stream
+func (d *pdfDoc) parseXrefStream(stream pdfStream, entries map[int]pdfXrefEntry) error {
+	data, err := d.decodeStream(stream)
+	if err != nil {
+		return err
+	}
+
+	widths, ok := stream.Dict["W"].([]any)
+	if !ok || len(widths) != 3 {
+		return errors.New("invalid pdf xref stream widths")
+	}
+	var w [3]int
+	for i, v := range widths {
+		if w[i], ok = v.(int); !ok || w[i] < 0 || w[i] > 8 {
+			return errors.New("invalid pdf xref stream widths")
+		}
+	}
+	size, _ := stream.Dict["Size"].(int)
+	index := []any{0, size}
+	if ix, ok := stream.Dict["Index"].([]any); ok {
+		index = ix
+	}
+
+	rowSize := w[0] + w[1] + w[2]
+	if rowSize == 0 {
+		return errors.New("invalid pdf xref stream widths")
+	}
+	field := func(b []byte) int64 {
+		var v int64
+		for _, c := range b {
+			v = v<<8 | int64(c)
+		}
+		return v
+	}
+
+	pos := 0
+	for i := 0; i+1 < len(index); i += 2 {
+		first, ok1 := index[i].(int)
+		count, ok2 := index[i+1].(int)
+		if !ok1 || !ok2 {
+			return errors.New("invalid pdf xref stream index")
+		}
+		for num := first; num < first+count; num++ {
+			if pos+rowSize > len(data) {
+				return errors.New("pdf xref stream is truncated")
+			}
+			row := data[pos : pos+rowSize]
+			pos += rowSize
+
+			kind := int64(1) // Default when the type field is omitted
+			if w[0] > 0 {
+				kind = field(row[:w[0]])
+			}
+			f2 := field(row[w[0] : w[0]+w[1]])
+			f3 := field(row[w[0]+w[1]:])
+			if _, ok := entries[num]; ok {
+				continue
+			}
+			switch kind {
+			case 0:
+				entries[num] = pdfXrefEntry{Type: 0, Gen: int(f3)}
+			case 1:
+				entries[num] = pdfXrefEntry{Type: 1, Offset: f2, Gen: int(f3)}
+			case 2:
+				entries[num] = pdfXrefEntry{Type: 2, Stream: int(f2), Index: int(f3)}
+			}
+		}
+	}
+	return nil
+}
+
+// resolve follows an indirect reference, other values are returned as they are
+func (d *pdfDoc) resolve(v any) (any, error) {
+	ref, ok := v.(pdfRef)
+	if !ok {
+		return v, nil
+	}
+	e, ok := d.xref[ref.Num]
+	switch {
+	case !ok || e.Type == 0:
+		return nil, nil // References to missing objects are null
+	case e.Type == 2:
+		return d.objectFromStream(e.Stream, e.Index)
+	}
+	_, _, obj, err := d.readObjectAt(e.Offset)
+	return obj, err
+}
+
+// objectFromStream returns the index-th object stored in object stream num
+func (d *pdfDoc) objectFromStream(num, index int) (any, error) {
+	objs, ok := d.objStms[num]
+	if !ok {
+		e, ok := d.xref[num]
+		if !ok || e.Type != 1 {
+			return nil, fmt.Errorf("pdf object stream %d not found", num)
+		}
+		_, _, obj, err := d.readObjectAt(e.Offset)
+		if err != nil {
+			return nil, err
+		}
+		stream, ok := obj.(pdfStream)
+		if !ok {
+			return nil, fmt.Errorf("pdf object %d is not an object stream", num)
+		}
+		data, err := d.decodeStream(stream)
+		if err != nil {
+			return nil, err
+		}
+		n, _ := stream.Dict["N"].(int)
+		first, _ := stream.Dict["First"].(int)
+		if n < 0 || first < 0 || first > len(data) {
+			return nil, fmt.Errorf("invalid pdf object stream %d", num)
+		}
+
+		header := &pdfLexer{buf: data[:first]}
+		for range n {
+			_, err1 := header.token()
+			off, err2 := header.token()
+			o, ok := off.(int)
+			if err := errors.Join(err1, err2); err != nil || !ok || first+o > len(data) {
+				return nil, fmt.Errorf("invalid pdf object stream %d", num)
+			}
+			obj, err := (&pdfLexer{buf: data, pos: first + o}).object()
+			if err != nil {
+				return nil, err
+			}
+			objs = append(objs, obj)
+		}
+		d.objStms[num] = objs
+	}
+
+	if index < 0 || index >= len(objs) {
+		return nil, fmt.Errorf("pdf object stream %d has no object %d", num, index)
+	}
+	return objs[index], nil
+}
+
+// readObjectAt parses the indirect object "num gen obj ... endobj" at offset
+func (d *pdfDoc) readObjectAt(offset int64) (num, gen int, obj any, err error) {
+	err = d.parseAt(offset, func(l *pdfLexer) error {
+		t1, err1 := l.token()
+		t2, err2 := l.token()
+		t3, err3 := l.token()
+		if err := errors.Join(err1, err2, err3); err != nil {
+			return err
+		}
+		var ok1, ok2 bool
+		num, ok1 = t1.(int)
+		gen, ok2 = t2.(int)
+		if !ok1 || !ok2 || t3 != pdfKeyword("obj") {
+			return fmt.Errorf("no pdf object at offset %d", offset)
+		}
+
+		if obj, err = l.object(); err != nil {
+			return err
+		}
+		if dict, ok := obj.(pdfDict); ok {
+			if start, ok := l.streamStart(); ok {
+				obj = pdfStream{Dict: dict, Offset: offset + int64(start)}
+			}
+		}
+		return nil
+	})
+	return num, gen, obj, err
+}
+
+// parseAt runs parse on a window of the file starting at offset, growing the window
+// while parse runs out of bytes
+func (d *pdfDoc) parseAt(offset int64, parse func(l *pdfLexer) error) error {
+	for window := int64(4096); ; window *= 4 {
+		end := min(d.size, offset+window)
+		buf, err := readRange(d.src, int(offset), int(end))
+		if err != nil {
+			return err
+		}
+		err = parse(&pdfLexer{buf: buf, short: end < d.size})
+		if !errors.Is(err, errPDFShort) {
+			return err
+		}
+	}
+}
+
+// streamLength returns the /Length of a stream, which may be an indirect object
+func (d *pdfDoc) streamLength(s pdfStream) (int, error) {
+	v, err := d.resolve(s.Dict["Length"])
+	if err != nil {
+		return 0, err
+	}
+	length, ok := v.(int)
+	if !ok || length < 0 || s.Offset+int64(length) > d.size {
+		return 0, errors.New("invalid pdf stream length")
+	}
+	return length, nil
+}
+
+// streamData reads the raw (still encoded) data of a stream
+func (d *pdfDoc) streamData(s pdfStream) ([]byte, error) {
+	length, err := d.streamLength(s)
+	if err != nil {
+		return nil, err
+	}
+	return readRange(d.src, int(s.Offset), int(s.Offset)+length)
+}
+
+// decodeStream reads a stream and applies its filters; only FlateDecode is supported
+func (d *pdfDoc) decodeStream(s pdfStream) ([]byte, error) {
+	data, err := d.streamData(s)
+	if err != nil {
+		return nil, err
+	}
+
+	filters, err := d.resolve(s.Dict["Filter"])
+	if err != nil {
+		return nil, err
+	}
+	params, err := d.resolve(s.Dict["DecodeParms"])
+	if err != nil {
+		return nil, err
+	}
+	if name, ok := filters.(pdfName); ok {
+		filters, params = []any{name}, []any{params}
+	}
+	filterList, _ := filters.([]any)
+	paramList, _ := params.([]any)
+
+	for i, f := range filterList {
+		if f != pdfName("FlateDecode") {
+			return nil, fmt.Errorf("unsupported pdf stream filter %v", f)
+		}
+		var p pdfDict
+		if i < len(paramList) {
+			v, err := d.resolve(paramList[i])
+			if err != nil {
+				return nil, err
+			}
+			p, _ = v.(pdfDict)
+		}
+		if data, err = flateDecode(data, p, maxPDFInflated-d.inflated); err != nil {
+			return nil, err
+		}
+		d.inflated += len(data)
+	}
+	return data, nil
+}
+
+// flateDecode inflates zlib data to at most limit bytes and undoes a PNG predictor
+func flateDecode(data []byte, params pdfDict, limit int) ([]byte, error) {
+	zr, err := zlib.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode pdf stream: %w", err)
+	}
+	out, err := io.ReadAll(io.LimitReader(zr, int64(max(0, limit))+1))
+	if err != nil && len(out) == 0 {
+		return nil, fmt.Errorf("failed to decode pdf stream: %w", err)
+	}
+	if len(out) > limit {
+		return nil, fmt.Errorf("pdf streams decode to more than %d bytes", maxPDFInflated)
+	}
+
+	predictor, _ := params["Predictor"].(int)
+	if predictor < 10 {
+		return out, nil // 1 is no prediction; TIFF predictors never occur in the streams read here
+	}
+	columns, colors, bpc := 1, 1, 8
+	if v, ok := params["Columns"].(int); ok {
+		columns = v
+	}
+	if v, ok := params["Colors"].(int); ok {
+		colors = v
+	}
+	if v, ok := params["BitsPerComponent"].(int); ok {
+		bpc = v
+	}
+	bpp := max(1, colors*bpc/8)
+	rowSize := (columns*colors*bpc + 7) / 8
+	if rowSize <= 0 {
+		return nil, errors.New("invalid pdf predictor parameters")
+	}
+
+	var result []byte
+	prev := make([]byte, rowSize)
+	for pos := 0; pos+1+rowSize <= len(out); pos += 1 + rowSize {
+		filter, row := out[pos], out[pos+1:pos+1+rowSize]
+		for i := range row {
+			var left, upLeft byte
+			if i >= bpp {
+				left, upLeft = row[i-bpp], prev[i-bpp]
+			}
+			up := prev[i]
+			switch filter {
+			case 1:
+				row[i] += left
+			case 2:
+				row[i] += up
+			case 3:
+				row[i] += byte((int(left) + int(up)) / 2)
+			case 4:
+				row[i] += paeth(left, up, upLeft)
+			}
+		}
+		result = append(result, row...)
+		prev = row
+	}
+	return result, nil
+}
+
+// paeth is the PNG Paeth predictor
+func paeth(a, b, c byte) byte {
+	p := int(a) + int(b) - int(c)
+	pa, pb, pc := abs(p-int(a)), abs(p-int(b)), abs(p-int(c))
+	switch {
+	case pa <= pb && pa <= pc:
+		return a
+	case pb <= pc:
+		return b
+	}
+	return c
+}
+
+func abs(x int) int {
+	if x < 0 {
+		return -x
+	}
+	return x
+}
+
+// pdfLogicalEnd returns where the PDF itself ends: a payload appended after %%EOF
+// by the older append carrier is left out, anything else after %%EOF is kept
+func pdfLogicalEnd(src io.ReaderAt, size int64) (int64, error) {
+	if offset, ok := footerOffsetAt(src, size); ok {
+		return offset, nil
+	}
+
+	start := max(0, size-1024)
+	tail, err := readRange(src, int(start), int(size))
+	if err != nil {
+		return 0, err
+	}
+	if i := bytes.LastIndex(tail, []byte("startxref")); i >= 0 {
+		// A small payload appended without a footer sits right after %%EOF
+		if end, ok := pdfEOFEnd(tail, i); ok {
+			if _, ok := scanTrailer(tail[end:]); ok {
+				return start + int64(end), nil
+			}
+		}
+		return size, nil
+	}
+	if _, ok := scanTrailerAt(src, size); !ok {
+		return size, nil // loadPDF reports the missing startxref
+	}
+
+	// Larger payload appended without a footer: cut after the last %%EOF before it
+	start = max(0, size-MaxDataSize-8-1024)
+	if tail, err = readRange(src, int(start), int(size)); err != nil {
+		return 0, err
+	}
+	end, ok := pdfEOFEnd(tail, bytes.LastIndex(tail, []byte("%%EOF")))
+	if !ok {
+		return 0, errors.New("pdf %EOF marker not found")
+	}
+	return start + int64(end), nil
+}
+
+// pdfEOFEnd returns the position after the first %%EOF marker at or after from
+// and its end-of-line
+func pdfEOFEnd(b []byte, from int) (int, bool) {
+	if from < 0 {
+		return 0, false
+	}
+	i := bytes.Index(b[from:], []byte("%%EOF"))
+	if i < 0 {
+		return 0, false
+	}
+	i += from + len("%%EOF")
+	for i < len(b) && (b[i] == '\r' || b[i] == '\n') {
+		i++
+	}
+	return i, true
+}
+
+// pdfLexer tokenizes PDF syntax from buf
+type pdfLexer struct {
+	buf   []byte
+	pos   int
+	short bool // buf stops before the end of the file
+}
+
+func isPDFSpace(c byte) bool {
+	return c == 0 || c == '\t' || c == '\n' || c == '\f' || c == '\r' || c == ' '
+}
+
+func isPDFDelimiter(c byte) bool {
+	return bytes.IndexByte([]byte("()<>[]{}/%"), c) >= 0
+}
+
+// eof is the error for running off the end of buf
+func (l *pdfLexer) eof() error {
+	if l.short {
+		return errPDFShort
+	}
+	return io.ErrUnexpectedEOF
+}
+
+// skipSpace skips white space and comments
+func (l *pdfLexer) skipSpace() {
+	for l.pos < len(l.buf) {
+		switch c := l.buf[l.pos]; {
+		case isPDFSpace(c):
+			l.pos++
+		case c == '%':
+			for l.pos < len(l.buf) && l.buf[l.pos] != '\n' && l.buf[l.pos] != '\r' {
+				l.pos++
+			}
+		default:
+			return
+		}
+	}
+}
+
+// token returns the next int, float64, pdfName, pdfString or pdfKeyword
+func (l *pdfLexer) token() (any, error) {
+	l.skipSpace()
+	if l.pos >= len(l.buf) {
+		return nil, l.eof()
+	}
+
+	switch c := l.buf[l.pos]; c {
+	case '[', ']', '{', '}':
+		l.pos++
+		return pdfKeyword(c), nil
+	case '<':
+		if l.pos+1 < len(l.buf) && l.buf[l.pos+1] == '<' {
+			l.pos += 2
+			return pdfKeyword("<<"), nil
+		}
+		return l.hexString()
+	case '>':
+		if l.pos+1 >= len(l.buf) {
+			return nil, l.eof()
+		}
+		if l.buf[l.pos+1] != '>' {
+			return nil, errors.New("invalid pdf token '>'")
+		}
+		l.pos += 2
+		return pdfKeyword(">>"), nil
+	case '(':
+		return l.literalString()
+	case '/':
+		l.pos++
+		return pdfName(unescapePDFName(l.regular())), nil
+	case ')':
+		return nil, errors.New("invalid pdf token ')'")
+	}
+
+	word := l.regular()
+	if l.pos >= len(l.buf) && l.short {
+		return nil, errPDFShort // The word may continue past the buffer
+	}
+	if n, err := strconv.Atoi(string(word)); err == nil {
+		return n, nil
+	}
+	if f, err := strconv.ParseFloat(string(word), 64); err == nil && bytes.ContainsAny(word, "0123456789") {
+		return f, nil
+	}
+	return pdfKeyword(word), nil
+}
+
+// regular reads a run of regular characters
+func (l *pdfLexer) regular() []byte {
+	start := l.pos
+	for l.pos < len(l.buf) && !isPDFSpace(l.buf[l.pos]) && !isPDFDelimiter(l.buf[l.pos]) {
+		l.pos++
+	}
+	return l.buf[start:l.pos]
+}
+
+// unescapePDFName decodes #xx escapes in a name
+func unescapePDFName(b []byte) string {
+	if bytes.IndexByte(b, '#') < 0 {
+		return string(b)
+	}
+	var out []byte
+	for i := 0; i < len(b); i++ {
+		if b[i] == '#' && i+2 < len(b) {
+			if v, err := strconv.ParseUint(string(b[i+1:i+3]), 16, 8); err == nil {
+				out = append(out, byte(v))
+				i += 2
+				continue
+			}
+		}
+		out = append(out, b[i])
+	}
+	return string(out)
+}
+
+// hexString reads <...>
+func (l *pdfLexer) hexString() (any, error) {
+	end := bytes.IndexByte(l.buf[l.pos:], '>')
+	if end < 0 {
+		return nil, l.eof()
+	}
+	var digits []byte
+	for _, c := range l.buf[l.pos+1 : l.pos+end] {
+		if !isPDFSpace(c) {
+			digits = append(digits, c)
+		}
+	}
+	l.pos += end + 1
+	if len(digits)%2 == 1 {
+		digits = append(digits, '0')
+	}
+	out := make([]byte, len(digits)/2)
+	for i := range out {
+		v, err := strconv.ParseUint(string(digits[2*i:2*i+2]), 16, 8)
+		if err != nil {
+			return nil, errors.New("invalid pdf hex string")
+		}
+		out[i] = byte(v)
+	}
+	return pdfString(out), nil
+}
+
+// literalString reads (...) with nested parentheses and escapes
+func (l *pdfLexer) literalString() (any, error) {
+	var out []byte
+	depth := 0
+	for l.pos++; l.pos < len(l.buf); l.pos++ {
+		c := l.buf[l.pos]
+		switch c {
+		case '(':
+			depth++
+		case ')':
+			if depth == 0 {
+				l.pos++
+				return pdfString(out), nil
+			}
+			depth--
+		case '\\':
+			l.pos++
+			if l.pos >= len(l.buf) {
+				return nil, l.eof()
+			}
+			switch e := l.buf[l.pos]; e {
+			case 'n':
+				c = '\n'
+			case 'r':
+				c = '\r'
+			case 't':
+				c = '\t'
+			case 'b':
+				c = '\b'
+			case 'f':
+				c = '\f'
+			case '\r':
+				if l.pos+1 < len(l.buf) && l.buf[l.pos+1] == '\n' {
+					l.pos++
+				}
+				continue
+			case '\n':
+				continue
+			default:
+				if e >= '0' && e <= '7' {
+					v := 0
+					for n := 0; n < 3 && l.pos < len(l.buf) && l.buf[l.pos] >= '0' && l.buf[l.pos] <= '7'; n++ {
+						v = v*8 + int(l.buf[l.pos]-'0')
+						l.pos++
+					}
+					l.pos--
+					c = byte(v)
+				} else {
+					c = e
+				}
+			}
+		}
+		out = append(out, c)
+	}
+	return nil, l.eof()
+}
+
+// object reads a complete object, combining "num gen R" into a pdfRef
+func (l *pdfLexer) object() (any, error) {
+	tok, err := l.token()
+	if err != nil {
+		return nil, err
+	}
+
+	switch t := tok.(type) {
+	case int:
+		save := l.pos
+		gen, err1 := l.token()
+		r, err2 := l.token()
+		if g, ok := gen.(int); ok && r == pdfKeyword("R") && err1 == nil && err2 == nil {
+			return pdfRef{Num: t, Gen: g}, nil
+		}
+		if errors.Is(err1, errPDFShort) || errors.Is(err2, errPDFShort) {
+			return nil, errPDFShort
+		}
+		l.pos = save
+		return t, nil
+
+	case pdfKeyword:
+		switch t {
+		case "true":
+			return true, nil
+		case "false":
+			return false, nil
+		case "null":
+			return nil, nil
+		case "[":
+			arr := []any{}
+			for {
+				l.skipSpace()
+				if l.pos >= len(l.buf) {
+					return nil, l.eof()
+				}
+				if l.buf[l.pos] == ']' {
+					l.pos++
+					return arr, nil
+				}
+				v, err := l.object()
+				if err != nil {
+					return nil, err
+				}
+				arr = append(arr, v)
+			}
+		case "<<":
+			dict := pdfDict{}
+			for {
+				key, err := l.token()
+				if err != nil {
+					return nil, err
+				}
+				if key == pdfKeyword(">>") {
+					return dict, nil
+				}
+				name, ok := key.(pdfName)
+				if !ok {
+					return nil, errors.New("invalid pdf dictionary key")
+				}
+				v, err := l.object()
+				if err != nil {
+					return nil, err
+				}
+				dict[string(name)] = v
+			}
+		}
+		return nil, fmt.Errorf("unexpected pdf token %q", string(t))
+	}
+	return tok, nil
+}
+
+// streamStart checks for the stream keyword after a dictionary and returns
+// the buffer position of the first data byte
+func (l *pdfLexer) streamStart() (int, bool) {
+	l.skipSpace()
+	if !bytes.HasPrefix(l.buf[l.pos:], []byte("stream")) {
+		return 0, false
+	}
+	p := l.pos + len("stream")
+	if p < len(l.buf) && l.buf[p] == '\r' {
+		p++
+	}
+	if p < len(l.buf) && l.buf[p] == '\n' {
+		p++
+	}
+	return p, true
+}
+
+// writePDFObject serializes v, dictionary keys in sorted order
+func writePDFObject(w *bytes.Buffer, v any) {
+	switch t := v.(type) {
+	case nil:
+		w.WriteString("null")
+	case bool:
+		w.WriteString(strconv.FormatBool(t))
+	case int:
+		w.WriteString(strconv.Itoa(t))
+	case float64:
+		w.WriteString(strconv.FormatFloat(t, 'f', -1, 64))
+	case pdfName:
+		w.WriteByte('/')
+		for _, c := range []byte(t) {
+			if c < '!' || c > '~' || c == '#' || isPDFDelimiter(c) {
+				fmt.Fprintf(w, "#%02X", c)
+			} else {
+				w.WriteByte(c)
+			}
+		}
+	case pdfString:
+		fmt.Fprintf(w, "<%X>", []byte(t))
+	case pdfRef:
+		fmt.Fprintf(w, "%d %d R", t.Num, t.Gen)
+	case []any:
+		w.WriteByte('[')
+		for i, e := range t {
+			if i > 0 {
+				w.WriteByte(' ')
+			}
+			writePDFObject(w, e)
+		}
+		w.WriteByte(']')
+	case pdfDict:
+		w.WriteString("<<")
+		keys := make([]string, 0, len(t))
+		for k := range t {
+			keys = append(keys, k)
+		}
+		slices.Sort(keys)
+		for _, k := range keys {
+			w.WriteByte(' ')
+			writePDFObject(w, pdfName(k))
+			w.WriteByte(' ')
+			writePDFObject(w, t[k])
+		}
+		w.WriteString(" >>")
+	case pdfKeyword:
+		w.WriteString(string(t))
+	}
+}
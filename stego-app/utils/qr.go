@@ -0,0 +1,616 @@
+package utils
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"iter"
+)
+
+// A generated QR code shows an innocuous visible content, usually a URL, and carries the
+// payload in its error correction: codewords at positions chosen with the passphrase are
+// XORed with payload bytes. At most a quarter of the error correction codewords of each
+// Reed-Solomon block are changed, half of what scanners repair, so the code still scans
+// when printed or photographed. The decoder repairs the blocks too and reads the payload
+// from the difference between the codewords read and the repaired ones.
+
+// QR code embedding modes, the error correction level of the generated symbol
+const (
+	QRModeLow      = "l" // recovers 7% of the codewords
+	QRModeMedium   = "m" // 15%
+	QRModeQuartile = "q" // 25%
+	QRModeHigh     = "h" // 30%, the most room for the payload (default)
+)
+
+// Rendering of generated symbols: pixels per module and the quiet zone in modules
+const (
+	qrModulePixels = 8
+	qrQuietZone    = 4
+)
+
+// Error correction codewords per block and number of blocks, by level (L, M, Q, H) and version
+var qrECCPerBlock = [4][41]int{
+	{0, 7, 10, 15, 20, 26, 18, 20, 24, 30, 18, 20, 24, 26, 30, 22, 24, 28, 30, 28, 28, 28, 28, 30, 30, 26, 28, 30, 30, 30, 30, 30, 30, 30, 30, 30, 30, 30, 30, 30, 30},
+	{0, 10, 16, 26, 18, 24, 16, 18, 22, 22, 26, 30, 22, 22, 24, 24, 28, 28, 26, 26, 26, 26, 28, 28, 28, 28, 28, 28, 28, 28, 28, 28, 28, 28, 28, 28, 28, 28, 28, 28, 28},
+	{0, 13, 22, 18, 26, 18, 24, 18, 22, 20, 24, 28, 26, 24, 20, 30, 24, 28, 28, 26, 30, 28, 30, 30, 30, 30, 28, 30, 30, 30, 30, 30, 30, 30, 30, 30, 30, 30, 30, 30, 30},
+	{0, 17, 28, 22, 16, 22, 28, 26, 26, 24, 28, 24, 28, 22, 24, 24, 30, 28, 28, 26, 28, 30, 24, 30, 30, 30, 30, 30, 30, 30, 30, 30, 30, 30, 30, 30, 30, 30, 30, 30, 30},
+}
+
+var qrBlockCount = [4][41]int{
+	{0, 1, 1, 1, 1, 1, 2, 2, 2, 2, 4, 4, 4, 4, 4, 6, 6, 6, 6, 7, 8, 8, 9, 9, 10, 12, 12, 12, 13, 14, 15, 16, 17, 18, 19, 19, 20, 21, 22, 24, 25},
+	{0, 1, 1, 1, 2, 2, 4, 4, 4, 5, 5, 5, 8, 9, 9, 10, 10, 11, 13, 14, 16, 17, 17, 18, 20, 21, 23, 25, 26, 28, 29, 31, 33, 35, 37, 38, 40, 43, 45, 47, 49},
+	{0, 1, 1, 2, 2, 4, 4, 6, 6, 8, 8, 8, 10, 12, 16, 12, 17, 16, 18, 21, 20, 23, 23, 25, 27, 29, 34, 34, 35, 38, 40, 43, 45, 48, 51, 53, 56, 59, 62, 65, 68},
+	{0, 1, 1, 2, 4, 4, 4, 5, 6, 8, 8, 11, 11, 16, 16, 18, 16, 19, 21, 25, 25, 25, 34, 30, 32, 35, 37, 40, 42, 45, 48, 51, 54, 57, 60, 63, 66, 70, 74, 77, 81},
+}
+
+// qrFormatLevel is the level field of the format information, by level index
+var qrFormatLevel = [4]int{1, 0, 3, 2}
+
+// GenerateQRCode renders a QR code showing content with data hidden in its error correction,
+// as a PNG. The smallest version that fits both is used.
+func GenerateQRCode(content string, data []byte, mode, passphrase string) ([]byte, error) {
+	if len(data) == 0 {
+		return nil, errors.New("data to embed cannot be empty")
+	}
+
+	if len(data) > MaxDataSize {
+		return nil, fmt.Errorf("data too large: %d bytes, max allowed: %d bytes", len(data), MaxDataSize)
+	}
+
+	estimate, err := EstimateQRCapacity(content, mode)
+	if err != nil {
+		return nil, err
+	}
+	if err := estimate.checkCapacity(len(data)); err != nil {
+		return nil, err
+	}
+	level, _ := qrLevel(mode)
+
+	payload := prepareDataWithHeader(data)
+	version := 1
+	for !qrContentFits(content, version, level) || qrSecretRoom(version, level) < len(payload) {
+		version++
+	}
+
+	dataLens, ecc := qrBlockLayout(version, level)
+	codewords := qrEncodeContent(content, version, level)
+	blocks := make([][]byte, len(dataLens))
+	for i, n := range dataLens {
+		blocks[i] = append(codewords[:n:n], rsEncode(codewords[:n], ecc)...)
+		codewords = codewords[n:]
+	}
+	for i, p := range qrSecretPositions(dataLens, ecc, passphrase) {
+		if i == len(payload) {
+			break
+		}
+		blocks[p.block][p.index] ^= payload[i]
+	}
+
+	s := newQRSymbol(version, level)
+	s.placeCodewords(qrInterleave(blocks, dataLens, ecc))
+
+	// Keep the mask with the lowest penalty, as scanners expect
+	best, bestPenalty := 0, -1
+	for mask := 0; mask < 8; mask++ {
+		s.applyMask(mask)
+		s.drawFormat(level, mask)
+		if penalty := s.penalty(); bestPenalty < 0 || penalty < bestPenalty {
+			best, bestPenalty = mask, penalty
+		}
+		s.applyMask(mask)
+	}
+	s.applyMask(best)
+	s.drawFormat(level, best)
+	return s.render()
+}
+
+// EstimateQRCapacity reports how much data a QR code showing content can hide at the chosen level
+func EstimateQRCapacity(content string, mode string) (CapacityEstimate, error) {
+	if content == "" {
+		return CapacityEstimate{}, errors.New("qr content cannot be empty")
+	}
+
+	level, err := qrLevel(mode)
+	if err != nil {
+		return CapacityEstimate{}, err
+	}
+	if !qrContentFits(content, 40, level) {
+		return CapacityEstimate{}, fmt.Errorf("qr content too long: %d bytes, max allowed at level %s: %d bytes",
+			len(content), qrLevelNames[level], (qrDataCodewords(40, level)*8-4-qrCountBits(40))/8)
+	}
+	return newEstimate("qr", qrLevelNames[level], qrSecretRoom(40, level), fmt.Sprintf(
+		"one codeword changed per 4 error correction codewords in each of the %d Reed-Solomon blocks of a "+
+			"version 40 symbol, half of what scanners repair; the smallest version fitting the content and "+
+			"the payload is generated", qrBlockCount[level][40])), nil
+}
+
+// qrLevelNames are the modes by level index
+var qrLevelNames = [4]string{QRModeLow, QRModeMedium, QRModeQuartile, QRModeHigh}
+
+// qrLevel returns the level index of a mode
+func qrLevel(mode string) (int, error) {
+	if mode == "" {
+		return 3, nil
+	}
+	for i, name := range qrLevelNames {
+		if mode == name {
+			return i, nil
+		}
+	}
+	return 0, fmt.Errorf("invalid qr mode %q. Must be: %s, %s, %s or %s",
+		mode, QRModeLow, QRModeMedium, QRModeQuartile, QRModeHigh)
+}
+
+// qrRawCodewords returns the number of codewords of a version, data and error correction
+func qrRawCodewords(version int) int {
+	modules := (16*version+128)*version + 64
+	if version >= 2 {
+		n := version/7 + 2
+		modules -= (25*n-10)*n - 55
+		if version >= 7 {
+			modules -= 36
+		}
+	}
+	return modules / 8
+}
+
+func qrDataCodewords(version, level int) int {
+	return qrRawCodewords(version) - qrBlockCount[level][version]*qrECCPerBlock[level][version]
+}
+
+// qrBlockLayout returns the data codewords of each block and the error correction
+// codewords per block. The last blocks are one data codeword longer when needed.
+func qrBlockLayout(version, level int) ([]int, int) {
+	blocks, ecc := qrBlockCount[level][version], qrECCPerBlock[level][version]
+	raw := qrRawCodewords(version)
+	short := blocks - raw%blocks
+	dataLens := make([]int, blocks)
+	for i := range dataLens {
+		dataLens[i] = raw/blocks - ecc
+		if i >= short {
+			dataLens[i]++
+		}
+	}
+	return dataLens, ecc
+}
+
+// qrCountBits is the width of the byte mode character count
+func qrCountBits(version int) int {
+	if version < 10 {
+		return 8
+	}
+	return 16
+}
+
+func qrContentFits(content string, version, level int) bool {
+	return 4+qrCountBits(version)+8*len(content) <= 8*qrDataCodewords(version, level)
+}
+
+// qrSecretRoom is the number of codewords that may be changed: a quarter of the error
+// correction codewords of every block
+func qrSecretRoom(version, level int) int {
+	return qrBlockCount[level][version] * (qrECCPerBlock[level][version] / 4)
+}
+
+// qrEncodeContent writes content as a byte mode segment padded to the data codewords
+func qrEncodeContent(content string, version, level int) []byte {
+	capacity := qrDataCodewords(version, level)
+	out := make([]byte, 0, capacity)
+	var acc uint64
+	bits := 0
+	write := func(v uint64, n int) {
+		acc = acc<<n | v
+		for bits += n; bits >= 8; bits -= 8 {
+			out = append(out, byte(acc>>(bits-8)))
+		}
+	}
+
+	write(0b0100, 4)
+	write(uint64(len(content)), qrCountBits(version))
+	for i := 0; i < len(content); i++ {
+		write(uint64(content[i]), 8)
+	}
+	// Terminator of up to four zero bits, then zero bits to the byte boundary
+	write(0, min(4, 8*capacity-8*len(out)-bits))
+	if bits > 0 {
+		write(0, 8-bits)
+	}
+	for pad := byte(0xEC); len(out) < capacity; pad ^= 0xEC ^ 0x11 {
+		out = append(out, pad)
+	}
+	return out
+}
+
+// qrInterleave orders the codewords of the blocks as they are placed in the symbol:
+// the data codewords of the blocks in turn, then their error correction codewords
+func qrInterleave(blocks [][]byte, dataLens []int, ecc int) []byte {
+	var out []byte
+	for i := 0; i < dataLens[len(dataLens)-1]; i++ {
+		for b, block := range blocks {
+			if i < dataLens[b] {
+				out = append(out, block[i])
+			}
+		}
+	}
+	for i := 0; i < ecc; i++ {
+		for b, block := range blocks {
+			out = append(out, block[dataLens[b]+i])
+		}
+	}
+	return out
+}
+
+// qrDeinterleave splits placed codewords back into their blocks
+func qrDeinterleave(codewords []byte, dataLens []int, ecc int) [][]byte {
+	blocks := make([][]byte, len(dataLens))
+	for b, n := range dataLens {
+		blocks[b] = make([]byte, n+ecc)
+	}
+	k := 0
+	for i := 0; i < dataLens[len(dataLens)-1]; i++ {
+		for b := range blocks {
+			if i < dataLens[b] {
+				blocks[b][i] = codewords[k]
+				k++
+			}
+		}
+	}
+	for i := 0; i < ecc; i++ {
+		for b := range blocks {
+			blocks[b][dataLens[b]+i] = codewords[k]
+			k++
+		}
+	}
+	return blocks
+}
+
+// qrPosition is a codeword of a block
+type qrPosition struct {
+	block, index int
+}
+
+// qrSecretPositions returns the codewords that carry the payload, in payload order. They
+// are drawn over the whole symbol with the passphrase, skipping blocks already holding a
+// quarter of their error correction codewords in changes.
+func qrSecretPositions(dataLens []int, ecc int, passphrase string) []qrPosition {
+	var all []qrPosition
+	for b, n := range dataLens {
+		for i := 0; i < n+ecc; i++ {
+			all = append(all, qrPosition{b, i})
+		}
+	}
+
+	budget := ecc / 4
+	used := make([]int, len(dataLens))
+	positions := make([]qrPosition, 0, len(dataLens)*budget)
+	for i := range keyedPermutation(len(all), qrSecretSeed(passphrase)) {
+		if len(positions) == cap(positions) {
+			break
+		}
+		if p := all[i]; used[p.block] < budget {
+			used[p.block]++
+			positions = append(positions, p)
+		}
+	}
+	return positions
+}
+
+// qrSecretSeed derives the codeword order seed from the passphrase
+func qrSecretSeed(passphrase string) [32]byte {
+	mac := hmac.New(sha256.New, []byte(passphrase))
+	mac.Write([]byte("qr-error-positions"))
+
+	var seed [32]byte
+	copy(seed[:], mac.Sum(nil))
+	return seed
+}
+
+// qrSymbol is the module grid of a QR code, with the function patterns marked
+type qrSymbol struct {
+	version  int
+	size     int
+	dark     []bool
+	function []bool
+}
+
+// newQRSymbol draws the function patterns of a version: finders, timing, alignment,
+// version information and format information for mask 0
+func newQRSymbol(version, level int) *qrSymbol {
+	size := 17 + 4*version
+	s := &qrSymbol{version: version, size: size, dark: make([]bool, size*size), function: make([]bool, size*size)}
+
+	for i := 0; i < size; i++ {
+		s.set(6, i, i%2 == 0)
+		s.set(i, 6, i%2 == 0)
+	}
+
+	// Finders with their light separators
+	for _, c := range [][2]int{{3, 3}, {size - 4, 3}, {3, size - 4}} {
+		for dy := -4; dy <= 4; dy++ {
+			for dx := -4; dx <= 4; dx++ {
+				x, y := c[0]+dx, c[1]+dy
+				if x >= 0 && x < size && y >= 0 && y < size {
+					d := max(abs(dx), abs(dy))
+					s.set(x, y, d != 2 && d != 4)
+				}
+			}
+		}
+	}
+
+	// Alignment patterns, except where they would overlap a finder
+	align := qrAlignment(version)
+	last := len(align) - 1
+	for i, x := range align {
+		for j, y := range align {
+			if i == 0 && j == 0 || i == 0 && j == last || i == last && j == 0 {
+				continue
+			}
+			for dy := -2; dy <= 2; dy++ {
+				for dx := -2; dx <= 2; dx++ {
+					s.set(x+dx, y+dy, max(abs(dx), abs(dy)) != 1)
+				}
+			}
+		}
+	}
+
+	s.drawFormat(level, 0)
+
+	if version >= 7 {
+		rem := version
+		for i := 0; i < 12; i++ {
+			rem = rem<<1 ^ rem>>11*0x1F25
+		}
+		bits := version<<12 | rem
+		for i := 0; i < 18; i++ {
+			dark := bits>>i&1 == 1
+			a, b := size-11+i%3, i/3
+			s.set(a, b, dark)
+			s.set(b, a, dark)
+		}
+	}
+	return s
+}
+
+// qrAlignment returns the centre coordinates of the alignment patterns of a version
+func qrAlignment(version int) []int {
+	if version == 1 {
+		return nil
+	}
+	n := version/7 + 2
+	step := 26
+	if version != 32 {
+		step = (version*4 + n*2 + 1) / (n*2 - 2) * 2
+	}
+	positions := make([]int, n)
+	positions[0] = 6
+	for i, p := n-1, 17+4*version-7; i >= 1; i, p = i-1, p-step {
+		positions[i] = p
+	}
+	return positions
+}
+
+func (s *qrSymbol) set(x, y int, dark bool) {
+	s.dark[y*s.size+x] = dark
+	s.function[y*s.size+x] = true
+}
+
+// qrFormatPositions returns the modules of the two copies of the format information, bit 0 first
+func qrFormatPositions(size int) (first, second [15][2]int) {
+	for i := 0; i < 15; i++ {
+		switch {
+		case i < 6:
+			first[i] = [2]int{8, i}
+		case i < 8:
+			first[i] = [2]int{8, i + 1}
+		case i == 8:
+			first[i] = [2]int{7, 8}
+		default:
+			first[i] = [2]int{14 - i, 8}
+		}
+		if i < 8 {
+			second[i] = [2]int{size - 1 - i, 8}
+		} else {
+			second[i] = [2]int{8, size - 15 + i}
+		}
+	}
+	return first, second
+}
+
+// qrFormatBits returns the 15-bit format information of a level and mask
+func qrFormatBits(level, mask int) int {
+	data := qrFormatLevel[level]<<3 | mask
+	rem := data
+	for i := 0; i < 10; i++ {
+		rem = rem<<1 ^ rem>>9*0x537
+	}
+	return (data<<10 | rem) ^ 0x5412
+}
+
+// drawFormat writes the format information twice, along with the dark module next to it
+func (s *qrSymbol) drawFormat(level, mask int) {
+	bits := qrFormatBits(level, mask)
+	first, second := qrFormatPositions(s.size)
+	for i := 0; i < 15; i++ {
+		dark := bits>>i&1 == 1
+		s.set(first[i][0], first[i][1], dark)
+		s.set(second[i][0], second[i][1], dark)
+	}
+	s.set(8, s.size-8, true)
+}
+
+// dataModules yields the modules that are not part of a function pattern in placement
+// order: two-module wide columns from the right, going up and down in turn
+func (s *qrSymbol) dataModules() iter.Seq2[int, int] {
+	return func(yield func(int, int) bool) {
+		for right := s.size - 1; right >= 1; right -= 2 {
+			if right == 6 {
+				right = 5 // skip the vertical timing pattern
+			}
+			upward := (right+1)&2 == 0
+			for v := 0; v < s.size; v++ {
+				y := v
+				if upward {
+					y = s.size - 1 - v
+				}
+				for x := right; x > right-2; x-- {
+					if !s.function[y*s.size+x] && !yield(x, y) {
+						return
+					}
+				}
+			}
+		}
+	}
+}
+
+// placeCodewords writes the codewords most significant bit first; remainder modules stay light
+func (s *qrSymbol) placeCodewords(codewords []byte) {
+	i := 0
+	for x, y := range s.dataModules() {
+		if i == len(codewords)*8 {
+			return
+		}
+		s.dark[y*s.size+x] = codewords[i/8]>>(7-i%8)&1 == 1
+		i++
+	}
+}
+
+// readCodewords reads n codewords back from the data modules
+func (s *qrSymbol) readCodewords(n int) []byte {
+	codewords := make([]byte, n)
+	i := 0
+	for x, y := range s.dataModules() {
+		if i == n*8 {
+			break
+		}
+		if s.dark[y*s.size+x] {
+			codewords[i/8] |= 0x80 >> (i % 8)
+		}
+		i++
+	}
+	return codewords
+}
+
+// applyMask inverts the data modules selected by a mask pattern; applying it again undoes it
+func (s *qrSymbol) applyMask(mask int) {
+	for x, y := range s.dataModules() {
+		var invert bool
+		switch mask {
+		case 0:
+			invert = (x+y)%2 == 0
+		case 1:
+			invert = y%2 == 0
+		case 2:
+			invert = x%3 == 0
+		case 3:
+			invert = (x+y)%3 == 0
+		case 4:
+			invert = (x/3+y/2)%2 == 0
+		case 5:
+			invert = x*y%2+x*y%3 == 0
+		case 6:
+			invert = (x*y%2+x*y%3)%2 == 0
+		case 7:
+			invert = ((x+y)%2+x*y%3)%2 == 0
+		}
+		if invert {
+			s.dark[y*s.size+x] = !s.dark[y*s.size+x]
+		}
+	}
+}
+
+// penalty scores how hard the symbol is to scan: long runs, 2x2 blocks, finder-like
+// patterns and an unbalanced dark ratio
+func (s *qrSymbol) penalty() int {
+	n := s.size
+	at := func(x, y int, vertical bool) bool {
+		if vertical {
+			x, y = y, x
+		}
+		if x < 0 || x >= n || y < 0 || y >= n {
+			return false // the quiet zone is light
+		}
+		return s.dark[y*n+x]
+	}
+	finder := [11]bool{true, false, true, true, true, false, true, false, false, false, false}
+
+	penalty := 0
+	for _, vertical := range []bool{false, true} {
+		for line := 0; line < n; line++ {
+			run := 0
+			for i := 0; i < n; i++ {
+				if i > 0 && at(i, line, vertical) == at(i-1, line, vertical) {
+					run++
+				} else {
+					run = 1
+				}
+				if run == 5 {
+					penalty += 3
+				} else if run > 5 {
+					penalty++
+				}
+			}
+			for i := -4; i < n; i++ {
+				forward, backward := true, true
+				for k, dark := range finder {
+					forward = forward && at(i+k, line, vertical) == dark
+					backward = backward && at(i+10-k, line, vertical) == dark
+				}
+				if forward {
+					penalty += 40
+				}
+				if backward {
+					penalty += 40
+				}
+			}
+		}
+	}
+
+	dark := 0
+	for y := 0; y < n; y++ {
+		for x := 0; x < n; x++ {
+			if s.dark[y*n+x] {
+				dark++
+			}
+			if x+1 < n && y+1 < n {
+				c := s.dark[y*n+x]
+				if s.dark[y*n+x+1] == c && s.dark[(y+1)*n+x] == c && s.dark[(y+1)*n+x+1] == c {
+					penalty += 3
+				}
+			}
+		}
+	}
+	total := n * n
+	return penalty + ((abs(dark*20-total*10)+total-1)/total-1)*10
+}
+
+// render draws the symbol with its quiet zone as a black and white PNG
+func (s *qrSymbol) render() ([]byte, error) {
+	width := (s.size + 2*qrQuietZone) * qrModulePixels
+	img := image.NewGray(image.Rect(0, 0, width, width))
+	for i := range img.Pix {
+		img.Pix[i] = 0xFF
+	}
+	for y := 0; y < s.size; y++ {
+		for x := 0; x < s.size; x++ {
+			if !s.dark[y*s.size+x] {
+				continue
+			}
+			for py := 0; py < qrModulePixels; py++ {
+				for px := 0; px < qrModulePixels; px++ {
+					img.SetGray((x+qrQuietZone)*qrModulePixels+px, (y+qrQuietZone)*qrModulePixels+py, color.Gray{})
+				}
+			}
+		}
+	}
+
+	var out bytes.Buffer
+	if err := png.Encode(&out, img); err != nil {
+		return nil, err
+	}
+	return out.Bytes(), nil
+}
@@ -0,0 +1,142 @@
+package utils
+
+import (
+	"bytes"
+	"image"
+	"image/draw"
+	"image/png"
+	"strings"
+	"testing"
+)
+
+func decodeQRPNG(t *testing.T, data []byte) image.Image {
+	t.Helper()
+	img, err := png.Decode(bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("png.Decode: %v", err)
+	}
+	return img
+}
+
+func TestQRCodeRoundTrip(t *testing.T) {
+	tests := []struct {
+		content string
+		mode    string
+		size    int
+	}{
+		{"https://example.com/", "", 16},
+		{"HELLO WORLD 123", QRModeLow, 4},
+		{"0123456789", QRModeMedium, 30},
+		{"xin chào", QRModeQuartile, 50},
+		{"https://example.com/a/long/path?q=" + strings.Repeat("x", 100), QRModeHigh, 200},
+	}
+	for _, tt := range tests {
+		data := bytes.Repeat([]byte{0xA5, 0x3C}, tt.size/2)
+		out, err := GenerateQRCode(tt.content, data, tt.mode, "secret")
+		if err != nil {
+			t.Fatalf("GenerateQRCode(%q, %q): %v", tt.content, tt.mode, err)
+		}
+
+		content, got, err := ExtractDataFromQRCode(decodeQRPNG(t, out), "secret")
+		if err != nil {
+			t.Fatalf("ExtractDataFromQRCode(%q, %q): %v", tt.content, tt.mode, err)
+		}
+		if content != tt.content || !bytes.Equal(got, data) {
+			t.Fatalf("mode %q: got content %q and %d bytes, want %q and %d bytes", tt.mode, content, len(got), tt.content, len(data))
+		}
+	}
+}
+
+func TestQRCodeScaledImage(t *testing.T) {
+	out, err := GenerateQRCode("https://example.com/", []byte("scaled"), "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	src := decodeQRPNG(t, out)
+
+	// Half size: each module is 4 pixels instead of 8
+	b := src.Bounds()
+	small := image.NewGray(image.Rect(0, 0, b.Dx()/2, b.Dy()/2))
+	for y := 0; y < b.Dy()/2; y++ {
+		for x := 0; x < b.Dx()/2; x++ {
+			small.Set(x, y, src.At(2*x, 2*y))
+		}
+	}
+	_, got, err := ExtractDataFromQRCode(small, "")
+	if err != nil || string(got) != "scaled" {
+		t.Fatalf("got %q, %v", got, err)
+	}
+}
+
+func TestQRCodeWrongPassphrase(t *testing.T) {
+	out, err := GenerateQRCode("https://example.com/", []byte("hidden"), "", "right")
+	if err != nil {
+		t.Fatal(err)
+	}
+	content, _, err := ExtractDataFromQRCode(decodeQRPNG(t, out), "wrong")
+	if err == nil {
+		t.Fatal("expected an error with the wrong passphrase")
+	}
+	if content != "https://example.com/" {
+		t.Fatalf("visible content %q not read", content)
+	}
+}
+
+func TestQRCodeSurvivesDamage(t *testing.T) {
+	out, err := GenerateQRCode("https://example.com/", []byte("dirty"), QRModeHigh, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	src := decodeQRPNG(t, out)
+	img := image.NewGray(src.Bounds())
+	draw.Draw(img, img.Bounds(), src, image.Point{}, draw.Src)
+
+	// Flip a 2x2 module patch in the data area, away from the finders and timing patterns
+	at := (qrQuietZone + 12) * qrModulePixels
+	for y := at; y < at+2*qrModulePixels; y++ {
+		for x := at; x < at+2*qrModulePixels; x++ {
+			img.Pix[y*img.Stride+x] ^= 0xFF
+		}
+	}
+	_, got, err := ExtractDataFromQRCode(img, "")
+	if err != nil || string(got) != "dirty" {
+		t.Fatalf("got %q, %v", got, err)
+	}
+}
+
+func TestQRCodeInvalidInput(t *testing.T) {
+	if _, err := GenerateQRCode("", []byte("x"), "", ""); err == nil {
+		t.Error("empty content accepted")
+	}
+	if _, err := GenerateQRCode("https://example.com/", nil, "", ""); err == nil {
+		t.Error("empty data accepted")
+	}
+	if _, err := GenerateQRCode("https://example.com/", []byte("x"), "z", ""); err == nil {
+		t.Error("invalid mode accepted")
+	}
+	if _, err := GenerateQRCode(strings.Repeat("x", 4000), []byte("x"), "", ""); err == nil {
+		t.Error("content larger than version 40 accepted")
+	}
+	estimate, err := EstimateQRCapacity("https://example.com/", QRModeHigh)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := GenerateQRCode("https://example.com/", make([]byte, estimate.Capacity+1), QRModeHigh, ""); err == nil {
+		t.Error("data larger than the capacity accepted")
+	}
+
+	blank := image.NewGray(image.Rect(0, 0, 200, 200))
+	for i := range blank.Pix {
+		blank.Pix[i] = 0xFF
+	}
+	if _, _, err := ExtractDataFromQRCode(blank, ""); err == nil {
+		t.Error("blank image decoded")
+	}
+	noise := image.NewGray(image.Rect(0, 0, 200, 200))
+	for i := range noise.Pix {
+		noise.Pix[i] = byte(i * 7919 % 251)
+	}
+	if _, _, err := ExtractDataFromQRCode(noise, ""); err == nil {
+		t.Error("noise decoded")
+	}
+}
@@ -0,0 +1,198 @@
+package utils
+
+import (
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"math"
+	"math/bits"
+	"slices"
+	"unicode/utf8"
+)
+
+// The decoder reads QR codes from clean renderings such as the PNG GenerateQRCode writes,
+// scaled or not: upright, with a light quiet zone and no perspective. It does not locate
+// codes in photos.
+
+// ExtractDataFromQRCode decodes a QR code image and returns its visible content and the data
+// hidden in its error correction with the passphrase
+func ExtractDataFromQRCode(img image.Image, passphrase string) (string, []byte, error) {
+	s, err := sampleQRCode(img)
+	if err != nil {
+		return "", nil, err
+	}
+	level, mask, err := s.readFormat()
+	if err != nil {
+		return "", nil, err
+	}
+
+	s.function = newQRSymbol(s.version, level).function
+	s.applyMask(mask)
+	dataLens, ecc := qrBlockLayout(s.version, level)
+	received := qrDeinterleave(s.readCodewords(qrRawCodewords(s.version)), dataLens, ecc)
+
+	var content []byte
+	repaired := make([][]byte, len(received))
+	for i, block := range received {
+		repaired[i] = slices.Clone(block)
+		if _, err := rsCorrect(repaired[i], ecc); err != nil {
+			return "", nil, errors.New("qr code has too many errors to correct")
+		}
+		content = append(content, repaired[i][:dataLens[i]]...)
+	}
+	visible, err := qrDecodeContent(content, s.version)
+	if err != nil {
+		return "", nil, err
+	}
+
+	positions := qrSecretPositions(dataLens, ecc, passphrase)
+	payload := make([]byte, len(positions))
+	for i, p := range positions {
+		payload[i] = received[p.block][p.index] ^ repaired[p.block][p.index]
+	}
+	data, err := parseHeaderedData(payload)
+	if err != nil {
+		return visible, nil, errors.New("no embedded data found in qr code")
+	}
+	return visible, data, nil
+}
+
+// sampleQRCode reads the module grid of a QR code image. The dark bounding box is the
+// symbol, since the finders fill three of its corners, and the top row of the top left
+// finder is 7 modules wide, which gives the module size and so the version.
+func sampleQRCode(img image.Image) (*qrSymbol, error) {
+	bounds := img.Bounds()
+	dark := func(x, y int) bool {
+		return color.GrayModel.Convert(img.At(x, y)).(color.Gray).Y < 128
+	}
+
+	minX, minY, maxX, maxY := bounds.Max.X, bounds.Max.Y, bounds.Min.X-1, bounds.Min.Y-1
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			if dark(x, y) {
+				minX, minY, maxX, maxY = min(minX, x), min(minY, y), max(maxX, x), max(maxY, y)
+			}
+		}
+	}
+	if maxX < minX {
+		return nil, errors.New("no qr code found in image")
+	}
+
+	run := 0
+	for x := minX; x <= maxX && dark(x, minY); x++ {
+		run++
+	}
+	width, height := float64(maxX-minX+1), float64(maxY-minY+1)
+	version := int(math.Round((width*7/float64(run) - 17) / 4))
+	if version < 1 || version > 40 || math.Abs(width-height) > width/20 {
+		return nil, errors.New("no qr code found in image")
+	}
+
+	size := 17 + 4*version
+	s := &qrSymbol{version: version, size: size, dark: make([]bool, size*size)}
+	for y := 0; y < size; y++ {
+		for x := 0; x < size; x++ {
+			s.dark[y*size+x] = dark(minX+int((float64(x)+0.5)*width/float64(size)),
+				minY+int((float64(y)+0.5)*height/float64(size)))
+		}
+	}
+	return s, nil
+}
+
+// readFormat returns the level and mask of the format information copy closest to a valid one
+func (s *qrSymbol) readFormat() (int, int, error) {
+	first, second := qrFormatPositions(s.size)
+	var read [2]int
+	for i := 0; i < 15; i++ {
+		for c, pos := range [2][2]int{first[i], second[i]} {
+			if s.dark[pos[1]*s.size+pos[0]] {
+				read[c] |= 1 << i
+			}
+		}
+	}
+
+	bestLevel, bestMask, bestDistance := 0, 0, 16
+	for level := range qrFormatLevel {
+		for mask := 0; mask < 8; mask++ {
+			code := qrFormatBits(level, mask)
+			for _, r := range read {
+				if d := bits.OnesCount(uint(code ^ r)); d < bestDistance {
+					bestLevel, bestMask, bestDistance = level, mask, d
+				}
+			}
+		}
+	}
+	if bestDistance > 3 {
+		return 0, 0, errors.New("qr format information is unreadable")
+	}
+	return bestLevel, bestMask, nil
+}
+
+// qrAlphanumeric is the alphanumeric mode character set
+const qrAlphanumeric = "0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZ $%*+-./:"
+
+// qrDecodeContent reads the numeric, alphanumeric and byte segments of the data codewords.
+// Byte segments are read as UTF-8, or as ISO-8859-1 when they are not valid UTF-8.
+func qrDecodeContent(data []byte, version int) (string, error) {
+	r := &bitReader{data: data}
+	total := len(data) * 8
+	countBits := func(small, medium, large int) int {
+		switch {
+		case version < 10:
+			return small
+		case version < 27:
+			return medium
+		}
+		return large
+	}
+
+	var out []byte
+	for total-r.pos >= 4 {
+		mode := r.read(4)
+		switch mode {
+		case 0: // terminator
+			return qrText(out), nil
+		case 1:
+			for n := int(r.read(countBits(10, 12, 14))); n > 0; n -= 3 {
+				digits := min(n, 3)
+				out = fmt.Appendf(out, "%0*d", digits, r.read([4]int{0, 4, 7, 10}[digits]))
+			}
+		case 2:
+			for n := int(r.read(countBits(9, 11, 13))); n > 0; n -= 2 {
+				if n == 1 {
+					out = append(out, qrAlphanumeric[r.read(6)%45])
+					break
+				}
+				v := r.read(11)
+				out = append(out, qrAlphanumeric[v/45%45], qrAlphanumeric[v%45])
+			}
+		case 4:
+			for n := int(r.read(countBits(8, 16, 16))); n > 0; n-- {
+				out = append(out, byte(r.read(8)))
+			}
+		case 7: // ECI designator, 1 to 3 bytes; byte segments are read as UTF-8 anyway
+			if first := r.read(8); first&0x80 != 0 {
+				r.read(8 << (first >> 6 & 1))
+			}
+		default:
+			return "", fmt.Errorf("unsupported qr data mode %d", mode)
+		}
+		if r.pos > total {
+			return "", errors.New("qr data is truncated")
+		}
+	}
+	return qrText(out), nil
+}
+
+// qrText converts byte segment content to a string
+func qrText(content []byte) string {
+	if utf8.Valid(content) {
+		return string(content)
+	}
+	runes := make([]rune, len(content))
+	for i, b := range content {
+		runes[i] = rune(b)
+	}
+	return string(runes)
+}
@@ -0,0 +1,173 @@
+package utils
+
+import "errors"
+
+// Reed-Solomon coding over GF(256) with the QR code field polynomial x^8+x^4+x^3+x^2+1.
+// Codewords are stored highest degree first and the generator has the roots α^0 … α^(n-1).
+
+var gfExp, gfLog = gfTables()
+
+// gfTables builds the exponent table, doubled so products need no modulo, and the log table
+func gfTables() (exp [510]byte, log [256]byte) {
+	x := 1
+	for i := 0; i < 255; i++ {
+		exp[i], exp[i+255] = byte(x), byte(x)
+		log[x] = byte(i)
+		x <<= 1
+		if x&0x100 != 0 {
+			x ^= 0x11d
+		}
+	}
+	return exp, log
+}
+
+func gfMul(a, b byte) byte {
+	if a == 0 || b == 0 {
+		return 0
+	}
+	return gfExp[int(gfLog[a])+int(gfLog[b])]
+}
+
+func gfDiv(a, b byte) byte {
+	if a == 0 {
+		return 0
+	}
+	return gfExp[int(gfLog[a])+255-int(gfLog[b])]
+}
+
+// gfPow returns α^e
+func gfPow(e int) byte {
+	return gfExp[(e%255+255)%255]
+}
+
+// gfEval evaluates a polynomial stored lowest degree first at x
+func gfEval(poly []byte, x byte) byte {
+	var y byte
+	for i := len(poly) - 1; i >= 0; i-- {
+		y = gfMul(y, x) ^ poly[i]
+	}
+	return y
+}
+
+// rsGenerator returns the generator polynomial of degree n without its leading 1
+func rsGenerator(n int) []byte {
+	gen := make([]byte, n)
+	gen[n-1] = 1
+	root := byte(1)
+	for i := 0; i < n; i++ {
+		for j := range gen {
+			gen[j] = gfMul(gen[j], root)
+			if j+1 < n {
+				gen[j] ^= gen[j+1]
+			}
+		}
+		root = gfMul(root, 2)
+	}
+	return gen
+}
+
+// rsEncode returns the n error correction codewords of data
+func rsEncode(data []byte, n int) []byte {
+	gen := rsGenerator(n)
+	ecc := make([]byte, n)
+	for _, b := range data {
+		factor := b ^ ecc[0]
+		copy(ecc, ecc[1:])
+		ecc[n-1] = 0
+		for i, coef := range gen {
+			ecc[i] ^= gfMul(coef, factor)
+		}
+	}
+	return ecc
+}
+
+// rsCorrect corrects up to n/2 wrong codewords of a block ending with n error correction
+// codewords in place, and returns how many it corrected
+func rsCorrect(block []byte, n int) (int, error) {
+	syndromes := make([]byte, n)
+	clean := true
+	for j := range syndromes {
+		x := gfPow(j)
+		for _, b := range block {
+			syndromes[j] = gfMul(syndromes[j], x) ^ b
+		}
+		clean = clean && syndromes[j] == 0
+	}
+	if clean {
+		return 0, nil
+	}
+
+	// Berlekamp-Massey finds the error locator, lowest degree first
+	locator, prev := []byte{1}, []byte{1}
+	errs, shift, scale := 0, 1, byte(1)
+	for r := 0; r < n; r++ {
+		d := syndromes[r]
+		for i := 1; i <= errs && i < len(locator); i++ {
+			d ^= gfMul(locator[i], syndromes[r-i])
+		}
+		if d == 0 {
+			shift++
+			continue
+		}
+		next := append([]byte(nil), locator...)
+		for len(next) < len(prev)+shift {
+			next = append(next, 0)
+		}
+		factor := gfDiv(d, scale)
+		for i, c := range prev {
+			next[i+shift] ^= gfMul(factor, c)
+		}
+		if 2*errs <= r {
+			prev, errs, scale, shift = locator, r+1-errs, d, 1
+		} else {
+			shift++
+		}
+		locator = next
+	}
+	if 2*errs > n {
+		return 0, errors.New("too many errors to correct")
+	}
+
+	// The evaluator is the syndrome polynomial times the locator, modulo x^n
+	evaluator := make([]byte, n)
+	for i, c := range locator {
+		for j := 0; i+j < n; j++ {
+			evaluator[i+j] ^= gfMul(c, syndromes[j])
+		}
+	}
+	// The formal derivative keeps the odd degree terms
+	derivative := make([]byte, len(locator))
+	for i := 1; i < len(locator); i += 2 {
+		derivative[i-1] = locator[i]
+	}
+
+	// Chien search over the codeword positions, Forney for the error values
+	found := 0
+	for k := range block {
+		degree := len(block) - 1 - k
+		inverse := gfPow(-degree)
+		if gfEval(locator, inverse) != 0 {
+			continue
+		}
+		denominator := gfEval(derivative, inverse)
+		if denominator == 0 {
+			return 0, errors.New("too many errors to correct")
+		}
+		block[k] ^= gfMul(gfPow(degree), gfDiv(gfEval(evaluator, inverse), denominator))
+		found++
+	}
+	if found != errs {
+		return 0, errors.New("too many errors to correct")
+	}
+	for j := 0; j < n; j++ {
+		x := gfPow(j)
+		var s byte
+		for _, b := range block {
+			s = gfMul(s, x) ^ b
+		}
+		if s != 0 {
+			return 0, errors.New("too many errors to correct")
+		}
+	}
+	return found, nil
+}
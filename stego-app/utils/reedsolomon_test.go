@@ -0,0 +1,60 @@
+package utils
+
+import (
+	"bytes"
+	"math/rand"
+	"testing"
+)
+
+func TestRSCorrectRepairsUpToHalfTheECC(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	for _, ecc := range []int{7, 10, 17, 30} {
+		for errs := 0; errs <= ecc/2; errs++ {
+			data := make([]byte, 40)
+			rng.Read(data)
+			block := append(bytes.Clone(data), rsEncode(data, ecc)...)
+			want := bytes.Clone(block)
+			for _, i := range rng.Perm(len(block))[:errs] {
+				block[i] ^= byte(1 + rng.Intn(255))
+			}
+
+			n, err := rsCorrect(block, ecc)
+			if err != nil {
+				t.Fatalf("ecc %d, %d errors: %v", ecc, errs, err)
+			}
+			if n != errs || !bytes.Equal(block, want) {
+				t.Fatalf("ecc %d, %d errors: corrected %d, block repaired: %v", ecc, errs, n, bytes.Equal(block, want))
+			}
+		}
+	}
+}
+
+func TestRSCorrectRejectsTooManyErrors(t *testing.T) {
+	rng := rand.New(rand.NewSource(2))
+	const ecc = 10
+	failures := 0
+	for range 50 {
+		data := make([]byte, 30)
+		rng.Read(data)
+		block := append(data, rsEncode(data, ecc)...)
+		for _, i := range rng.Perm(len(block))[:ecc] {
+			block[i] ^= byte(1 + rng.Intn(255))
+		}
+		if _, err := rsCorrect(block, ecc); err != nil {
+			failures++
+		}
+	}
+	// A few patterns decode to another codeword, most must be reported
+	if failures < 45 {
+		t.Fatalf("only %d of 50 uncorrectable blocks reported", failures)
+	}
+}
+
+func TestRSEncodeKnownVector(t *testing.T) {
+	// Version 1-M "01234567" example from ISO/IEC 18004 Annex I
+	data := []byte{0x10, 0x20, 0x0C, 0x56, 0x61, 0x80, 0xEC, 0x11, 0xEC, 0x11, 0xEC, 0x11, 0xEC, 0x11, 0xEC, 0x11}
+	want := []byte{0xA5, 0x24, 0xD4, 0xC1, 0xED, 0x36, 0xC7, 0x87, 0x2C, 0x55}
+	if got := rsEncode(data, 10); !bytes.Equal(got, want) {
+		t.Fatalf("rsEncode = % X, want % X", got, want)
+	}
+}
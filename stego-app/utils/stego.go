@@ -4,13 +4,17 @@ import (
 	"bytes"
 	"crypto/aes"
 	"crypto/cipher"
+	"encoding/base64"
 	"encoding/binary"
+	"encoding/xml"
 	"errors"
 	"fmt"
 	"image"
 	"image/color"
 	"image/png"
+	"iter"
 	"math"
+	"strings"
 )
 
 // Constants for steganography
@@ -138,58 +142,10 @@ func EmbedDataInImage(img image.Image, data []byte) ([]byte, error) {
 			len(dataWithHeader), capacity)
 	}
 
-	// Create new RGBA image
-	newImg := image.NewRGBA(bounds)
+	// Copy the image, then write the bits into the R, G, B LSBs of consecutive pixels
+	newImg := imageToRGBA(img)
+	embedBitsLSB(newImg.Pix, rgbSamplePositions(len(newImg.Pix)), bytesToBits(dataWithHeader))
 
-	// Convert data to bits
-	dataBits := bytesToBits(dataWithHeader)
-	bitIndex := 0
-
-	// Embed data using LSB
-	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
-		for x := bounds.Min.X; x < bounds.Max.X; x++ {
-			oldPixel := color.RGBAModel.Convert(img.At(x, y)).(color.RGBA)
-			newPixel := oldPixel
-
-			// Embed in R channel
-			if bitIndex < len(dataBits) {
-				newPixel.R = (oldPixel.R & LSBMask) | dataBits[bitIndex]
-				bitIndex++
-			}
-
-			// Embed in G channel
-			if bitIndex < len(dataBits) {
-				newPixel.G = (oldPixel.G & LSBMask) | dataBits[bitIndex]
-				bitIndex++
-			}
-
-			// Embed in B channel
-			if bitIndex < len(dataBits) {
-				newPixel.B = (oldPixel.B & LSBMask) | dataBits[bitIndex]
-				bitIndex++
-			}
-
-			newImg.SetRGBA(x, y, newPixel)
-
-			// Break if all data is embedded
-			if bitIndex >= len(dataBits) {
-				// Fill remaining pixels with original data
-				for yy := y; yy < bounds.Max.Y; yy++ {
-					startX := bounds.Min.X
-					if yy == y {
-						startX = x + 1
-					}
-					for xx := startX; xx < bounds.Max.X; xx++ {
-						originalPixel := color.RGBAModel.Convert(img.At(xx, yy)).(color.RGBA)
-						newImg.SetRGBA(xx, yy, originalPixel)
-					}
-				}
-				goto embedComplete
-			}
-		}
-	}
-
-embedComplete:
 	// Encode to PNG
 	var buf bytes.Buffer
 	encoder := png.Encoder{
@@ -215,48 +171,28 @@ func ExtractDataFromImage(img image.Image) ([]byte, error) {
 		return nil, errors.New("invalid image dimensions")
 	}
 
-	var extractedBits []uint8
-
-	// Extract LSBs from each channel
-	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
-		for x := bounds.Min.X; x < bounds.Max.X; x++ {
-			pixel := color.RGBAModel.Convert(img.At(x, y)).(color.RGBA)
-
-			// Extract from R, G, B channels
-			extractedBits = append(extractedBits, pixel.R&ExtractMask)
-			extractedBits = append(extractedBits, pixel.G&ExtractMask)
-			extractedBits = append(extractedBits, pixel.B&ExtractMask)
-
-			// Check if we have enough bits for header
-			if len(extractedBits) >= 64 { // 8 bytes * 8 bits = 64 bits for header
-				// Try to extract header at 64-bit boundaries
-				if len(extractedBits)%64 == 0 {
-					headerBytes := bitsToBytes(extractedBits[:64])
-					if len(headerBytes) >= 8 {
-						magic := binary.LittleEndian.Uint32(headerBytes[:4])
-						if magic == MagicNumber {
-							dataLength := binary.LittleEndian.Uint32(headerBytes[4:8])
-							if dataLength > 0 && dataLength <= MaxDataSize {
-								totalBitsNeeded := 64 + int(dataLength)*8
-
-								// Continue extracting if we don't have enough bits yet
-								if len(extractedBits) >= totalBitsNeeded {
-									dataBytes := bitsToBytes(extractedBits[64:totalBitsNeeded])
-									return dataBytes, nil
-								}
-							}
-						}
-					}
-				}
-			}
-		}
+	rgba := imageToRGBA(img)
+	data, err := extractHeaderedLSB(rgba.Pix, rgbSamplePositions(len(rgba.Pix)))
+	if err != nil {
+		return nil, errors.New("no valid embedded data found in image")
 	}
+	return data, nil
+}
 
-	return nil, errors.New("no valid embedded data found in image")
+// VideoOptions selects how data is embedded into a video carrier
+type VideoOptions struct {
+	// Mode picks the strategy for formats that offer several
+	// (MP4/MOV: "uuid" or "free", MKV/WebM: "attachment" or "void",
+	// MPEG-TS: "pid" or "pmt", Y4M: "lsb")
+	Mode string
+	// Frames lists the frame indices used by pixel-domain carriers (Y4M), empty means all
+	Frames []int
+	// Passphrase keys the per-frame sample selection of pixel-domain carriers
+	Passphrase string
 }
 
 // EmbedDataInVideo embeds data into video file
-func EmbedDataInVideo(videoData []byte, data []byte) ([]byte, error) {
+func EmbedDataInVideo(videoData []byte, data []byte, opts VideoOptions) ([]byte, error) {
 	if len(videoData) == 0 {
 		return nil, errors.New("video data cannot be empty")
 	}
@@ -269,57 +205,91 @@ func EmbedDataInVideo(videoData []byte, data []byte) ([]byte, error) {
 		return nil, fmt.Errorf("data too large: %d bytes, max allowed: %d bytes", len(data), MaxDataSize)
 	}
 
-	// For a complete implementation, you would parse video container format
-	// This is a simplified approach: append encrypted data at the end
-	dataWithHeader := prepareDataWithHeader(data)
+	// Check the capacity of the container and strategy before touching the file
+	estimate, err := EstimateVideoCapacity(videoData, opts)
+	if err != nil {
+		return nil, err
+	}
+	if err := estimate.checkCapacity(len(data)); err != nil {
+		return nil, err
+	}
 
-	// Check if video file has enough space (heuristic check)
-	if len(dataWithHeader) > len(videoData)/100 { // Data shouldn't be more than 1% of video size
-		return nil, errors.New("data too large relative to video file size")
+	// Formats with a dedicated carrier keep the payload inside the container structure
+	if IsY4M(videoData) {
+		return EmbedDataInY4M(videoData, data, opts)
+	}
+	if IsMP4(videoData) {
+		return EmbedDataInMP4(videoData, data, opts.Mode)
+	}
+	if IsMKV(videoData) {
+		return EmbedDataInMKV(videoData, data, opts.Mode)
 	}
+	if IsAVI(videoData) {
+		return EmbedDataInAVI(videoData, data)
+	}
+	if IsTS(videoData) {
+		return EmbedDataInTS(videoData, data, opts.Mode)
+	}
+
+	// Other containers: append encrypted data and its footer at the end
+	trailer := makeTrailer(int64(len(videoData)), data)
 
 	// Create new video data by appending our data
-	result := make([]byte, len(videoData)+len(dataWithHeader))
+	result := make([]byte, len(videoData)+len(trailer))
 	copy(result, videoData)
-	copy(result[len(videoData):], dataWithHeader)
+	copy(result[len(videoData):], trailer)
 
 	return result, nil
 }
 
 // ExtractDataFromVideo extracts data from video file
-func ExtractDataFromVideo(videoData []byte) ([]byte, error) {
+func ExtractDataFromVideo(videoData []byte, opts VideoOptions) ([]byte, error) {
 	if len(videoData) < 8 {
 		return nil, errors.New("video file too small")
 	}
 
-	// Look for magic number in the last part of file
-	// Start search from end, looking backwards
-	searchStart := len(videoData) - MaxDataSize - 8
-	if searchStart < 0 {
-		searchStart = 0
-	}
-
-	// Search for magic number
-	for i := len(videoData) - 8; i >= searchStart; i-- {
-		if i+8 <= len(videoData) {
-			magic := binary.LittleEndian.Uint32(videoData[i : i+4])
-			if magic == MagicNumber {
-				dataLength := binary.LittleEndian.Uint32(videoData[i+4 : i+8])
-				if dataLength > 0 && dataLength <= MaxDataSize {
-					totalLength := 8 + int(dataLength)
-					if i+totalLength <= len(videoData) {
-						return videoData[i+8 : i+totalLength], nil
-					}
-				}
-			}
+	if IsMP4(videoData) {
+		return ExtractDataFromMP4(videoData)
+	}
+	if IsMKV(videoData) {
+		return ExtractDataFromMKV(videoData)
+	}
+	if IsAVI(videoData) {
+		return ExtractDataFromAVI(videoData)
+	}
+	if IsTS(videoData) {
+		if data, err := ExtractDataFromTS(videoData); err == nil {
+			return data, nil
+		}
+	}
+	if IsY4M(videoData) {
+		if data, err := ExtractDataFromY4M(videoData, opts); err == nil {
+			return data, nil
 		}
 	}
 
+	// Read the footer at the end of the file, older files are scanned for the magic number
+	if data, err := extractTrailer(videoData); !errors.Is(err, errNoTrailer) {
+		return data, err
+	}
+
 	return nil, errors.New("no embedded data found in video")
 }
 
+// AudioOptions selects how data is embedded into an audio carrier
+type AudioOptions struct {
+	// Mode picks the strategy for formats that offer several (MP3: "id3" or "ancillary")
+	Mode string
+
+	// Channels restricts sample embedding (WAV, AIFF) to these channel indices, nil means all
+	Channels []int
+
+	// Spread interleaves bits across the channels frame by frame instead of filling one channel after another
+	Spread bool
+}
+
 // EmbedDataInAudio embeds data into audio file
-func EmbedDataInAudio(audioData []byte, data []byte) ([]byte, error) {
+func EmbedDataInAudio(audioData []byte, data []byte, opts AudioOptions) ([]byte, error) {
 	if len(audioData) == 0 {
 		return nil, errors.New("audio data cannot be empty")
 	}
@@ -332,106 +302,121 @@ func EmbedDataInAudio(audioData []byte, data []byte) ([]byte, error) {
 		return nil, fmt.Errorf("data too large: %d bytes, max allowed: %d bytes", len(data), MaxDataSize)
 	}
 
+	estimate, err := EstimateAudioCapacity(audioData, opts)
+	if err != nil {
+		return nil, err
+	}
+	if err := estimate.checkCapacity(len(data)); err != nil {
+		return nil, err
+	}
+
+	// Formats with a dedicated carrier keep the payload inside the file structure
+	if IsFLAC(audioData) {
+		return EmbedDataInFLAC(audioData, data)
+	}
+	if _, err := parseWAV(audioData); err == nil {
+		return EmbedDataInWAV(audioData, data, opts)
+	}
+	if IsAIFF(audioData) {
+		return EmbedDataInAIFF(audioData, data, opts)
+	}
+	if IsOgg(audioData) {
+		return EmbedDataInOgg(audioData, data)
+	}
+	if IsMP3(audioData) {
+		return EmbedDataInMP3(audioData, data, opts.Mode)
+	}
+
 	// Phương pháp đơn giản: nối dữ liệu vào cuối file, giống như video
-	dataWithHeader := prepareDataWithHeader(data)
+	trailer := makeTrailer(int64(len(audioData)), data)
 
-	// Tạo dữ liệu audio mới bằng cách nối thêm dữ liệu của chúng ta
-	result := make([]byte, len(audioData)+len(dataWithHeader))
+	// Tạo dữ liệu audio mới bằng cách nối thêm dữ liệu và footer của chúng ta
+	result := make([]byte, len(audioData)+len(trailer))
 	copy(result, audioData)
-	copy(result[len(audioData):], dataWithHeader)
+	copy(result[len(audioData):], trailer)
 
 	return result, nil
 }
 
 // ExtractDataFromAudio extracts data from audio file
-func ExtractDataFromAudio(audioData []byte) ([]byte, error) {
+func ExtractDataFromAudio(audioData []byte, opts AudioOptions) ([]byte, error) {
 	if len(audioData) < 8 {
 		return nil, errors.New("audio file too small")
 	}
 
-	// Tìm magic number ở phần cuối của file, giống như video
-	searchStart := len(audioData) - MaxDataSize - 8
-	if searchStart < 0 {
-		searchStart = 0
-	}
-
-	// Tìm kiếm magic number
-	for i := len(audioData) - 8; i >= searchStart; i-- {
-		if i+8 <= len(audioData) {
-			magic := binary.LittleEndian.Uint32(audioData[i : i+4])
-			if magic == MagicNumber {
-				dataLength := binary.LittleEndian.Uint32(audioData[i+4 : i+8])
-				if dataLength > 0 && dataLength <= MaxDataSize {
-					totalLength := 8 + int(dataLength)
-					if i+totalLength <= len(audioData) {
-						return audioData[i+8 : i+totalLength], nil
-					}
-				}
-			}
+	if IsFLAC(audioData) {
+		if data, err := ExtractDataFromFLAC(audioData); err == nil {
+			return data, nil
 		}
 	}
-
-	return nil, errors.New("no embedded data found in audio")
-}
-
-// EmbedDataInPDF embeds data into a PDF file by appending it.
-func EmbedDataInPDF(pdfData []byte, data []byte) ([]byte, error) {
-	if len(pdfData) == 0 {
-		return nil, errors.New("pdf data cannot be empty")
+	if IsWAV(audioData) {
+		if data, err := ExtractDataFromWAV(audioData, opts); err == nil {
+			return data, nil
+		}
 	}
-
-	if len(data) == 0 {
-		return nil, errors.New("data to embed cannot be empty")
+	if IsAIFF(audioData) {
+		return ExtractDataFromAIFF(audioData, opts)
 	}
-
-	if len(data) > MaxDataSize {
-		return nil, fmt.Errorf("data too large: %d bytes, max allowed: %d bytes", len(data), MaxDataSize)
+	if IsOgg(audioData) {
+		if data, err := ExtractDataFromOgg(audioData); err == nil {
+			return data, nil
+		}
+	}
+	if IsMP3(audioData) {
+		if data, err := ExtractDataFromMP3(audioData); err == nil {
+			return data, nil
+		}
 	}
 
-	// Phương pháp đơn giản: nối dữ liệu vào cuối file
-	dataWithHeader := prepareDataWithHeader(data)
-
-	// Tạo dữ liệu PDF mới bằng cách nối thêm dữ liệu của chúng ta
-	result := make([]byte, len(pdfData)+len(dataWithHeader))
-	copy(result, pdfData)
-	copy(result[len(pdfData):], dataWithHeader)
+	// Đọc footer ở cuối file (file cũ thì tìm magic number), giống như video
+	if data, err := extractTrailer(audioData); !errors.Is(err, errNoTrailer) {
+		return data, err
+	}
 
-	return result, nil
+	return nil, errors.New("no embedded data found in audio")
 }
 
-// ExtractDataFromPDF extracts data from a PDF file.
-func ExtractDataFromPDF(pdfData []byte) ([]byte, error) {
-	if len(pdfData) < 8 {
-		return nil, errors.New("pdf file too small")
-	}
-
-	// Tìm magic number ở phần cuối của file
-	searchStart := len(pdfData) - MaxDataSize - 8
-	if searchStart < 0 {
-		searchStart = 0
-	}
-
-	// Tìm kiếm magic number
-	for i := len(pdfData) - 8; i >= searchStart; i-- {
-		if i+8 <= len(pdfData) {
-			magic := binary.LittleEndian.Uint32(pdfData[i : i+4])
-			if magic == MagicNumber {
-				dataLength := binary.LittleEndian.Uint32(pdfData[i+4 : i+8])
-				if dataLength > 0 && dataLength <= MaxDataSize {
-					totalLength := 8 + int(dataLength)
-					if i+totalLength <= len(pdfData) {
-						return pdfData[i+8 : i+totalLength], nil
-					}
-				}
+// Helper functions
+
+// findXMLPayload looks for a base64 payload in the element or attribute local of namespace.
+// The namespace is matched rather than the prefix, and the element form is also found after
+// tools rewriting the XML turned it into an attribute.
+func findXMLPayload(doc []byte, namespace, local string) ([]byte, bool) {
+	dec := xml.NewDecoder(bytes.NewReader(doc))
+	for {
+		tok, err := dec.Token()
+		if err != nil {
+			return nil, false
+		}
+		start, ok := tok.(xml.StartElement)
+		if !ok {
+			continue
+		}
+		value, found := "", false
+		for _, attr := range start.Attr {
+			if attr.Name.Space == namespace && attr.Name.Local == local {
+				value, found = attr.Value, true
 			}
 		}
-	}
+		if !found && start.Name.Space == namespace && start.Name.Local == local {
+			if dec.DecodeElement(&value, &start) != nil {
+				return nil, false
+			}
+			found = true
+		}
+		if !found {
+			continue
+		}
 
-	return nil, errors.New("no embedded data found in pdf")
+		raw, err := base64.StdEncoding.DecodeString(strings.Join(strings.Fields(value), ""))
+		if err != nil {
+			return nil, false
+		}
+		data, err := parseHeaderedData(raw)
+		return data, err == nil
+	}
 }
 
-// Helper functions
-
 // prepareDataWithHeader adds magic number and length header to data
 func prepareDataWithHeader(data []byte) []byte {
 	if len(data) > MaxDataSize {
@@ -450,6 +435,23 @@ func prepareDataWithHeader(data []byte) []byte {
 	return result
 }
 
+// scanTrailer looks backwards through data for a payload appended after the carrier without
+// a footer. Such a payload ends exactly at the end of the data, other matches do not count.
+func scanTrailer(data []byte) ([]byte, bool) {
+	// Start search from end, looking backwards
+	searchStart := max(0, len(data)-MaxDataSize-8)
+
+	for i := len(data) - 8; i >= searchStart; i-- {
+		if binary.LittleEndian.Uint32(data[i:i+4]) == MagicNumber {
+			dataLength := binary.LittleEndian.Uint32(data[i+4 : i+8])
+			if dataLength > 0 && dataLength <= MaxDataSize && i+8+int(dataLength) == len(data) {
+				return data[i+8 : i+8+int(dataLength)], true
+			}
+		}
+	}
+	return nil, false
+}
+
 // bytesToBits converts bytes to individual bits (LSB first)
 func bytesToBits(data []byte) []uint8 {
 	var bits []uint8
@@ -485,6 +487,71 @@ func bitsToBytes(bits []uint8) []byte {
 	return bytes
 }
 
+// imageToRGBA copies img into a new RGBA image
+func imageToRGBA(img image.Image) *image.RGBA {
+	bounds := img.Bounds()
+	rgba := image.NewRGBA(bounds)
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			rgba.SetRGBA(x, y, color.RGBAModel.Convert(img.At(x, y)).(color.RGBA))
+		}
+	}
+	return rgba
+}
+
+// rgbSamplePositions yields the R, G and B offsets of RGBA pixel data, skipping alpha
+func rgbSamplePositions(n int) iter.Seq[int] {
+	return func(yield func(int) bool) {
+		for i := 0; i < n; i++ {
+			if i%4 != 3 && !yield(i) {
+				return
+			}
+		}
+	}
+}
+
+// embedBitsLSB writes bits into the LSB of buf[p] for each position p, in order.
+// It reports whether the positions were enough to hold all bits.
+func embedBitsLSB(buf []byte, positions iter.Seq[int], bits []uint8) bool {
+	if len(bits) == 0 {
+		return true
+	}
+	i := 0
+	for p := range positions {
+		buf[p] = (buf[p] & LSBMask) | bits[i]
+		i++
+		if i == len(bits) {
+			return true
+		}
+	}
+	return false
+}
+
+// extractHeaderedLSB reads a payload written by prepareDataWithHeader back
+// from the LSB of buf[p] for each position p
+func extractHeaderedLSB(buf []byte, positions iter.Seq[int]) ([]byte, error) {
+	var bits []uint8
+	needed := 64 // 8 bytes * 8 bits for the header
+	for p := range positions {
+		bits = append(bits, buf[p]&ExtractMask)
+
+		if len(bits) == 64 {
+			header := bitsToBytes(bits)
+			if binary.LittleEndian.Uint32(header[:4]) != MagicNumber {
+				return nil, errors.New("no embedded data header found")
+			}
+			dataLength := binary.LittleEndian.Uint32(header[4:8])
+			if dataLength == 0 || dataLength > MaxDataSize {
+				return nil, errors.New("invalid embedded data length")
+			}
+			needed = 64 + int(dataLength)*8
+		} else if len(bits) == needed {
+			return bitsToBytes(bits[64:]), nil
+		}
+	}
+	return nil, errors.New("embedded data is truncated")
+}
+
 // calculateImageCapacity calculates how many bytes can be embedded in an image
 func CalculateImageCapacity(width, height int) int {
 	if width <= 0 || height <= 0 {
@@ -496,12 +563,21 @@ func CalculateImageCapacity(width, height int) int {
 }
 
 // calculateAudioCapacity calculates how many bytes can be embedded in audio
-func CalculateAudioCapacity(audioDataSize int) int {
-	if audioDataSize <= 44 {
+func CalculateAudioCapacity(audioData []byte, opts AudioOptions) int {
+	// PCM carriers: 1 bit per usable sample, digital silence and unselected channels excluded
+	if pcm, _, err := loadPCM(audioData); err == nil {
+		capacity, err := pcm.capacity(opts)
+		if err != nil {
+			return 0
+		}
+		return capacity
+	}
+
+	if len(audioData) <= 44 {
 		return 0
 	}
 	// 1 bit per sample byte, minus header size and overhead
-	capacity := (audioDataSize - 44) / 8
+	capacity := (len(audioData) - 44) / 8
 	return int(math.Max(0, float64(capacity-8))) // Reserve 8 bytes for header
 }
 
@@ -522,8 +598,8 @@ func ValidateImageForSteganography(img image.Image, dataSize int) error {
 }
 
 // validateAudioForSteganography checks if audio file is suitable for steganography
-func ValidateAudioForSteganography(audioDataSize, dataSize int) error {
-	capacity := CalculateAudioCapacity(audioDataSize)
+func ValidateAudioForSteganography(audioData []byte, opts AudioOptions, dataSize int) error {
+	capacity := CalculateAudioCapacity(audioData, opts)
 
 	if dataSize > capacity {
 		return fmt.Errorf("audio file too small: need %d bytes capacity, have %d bytes", dataSize, capacity)
@@ -0,0 +1,455 @@
+package utils
+
+import (
+	"archive/zip"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+)
+
+// MaxInMemoryCarrier is the largest carrier loaded fully into memory. MP4 and AVI files
+// and carriers that get the payload appended are streamed and have no such limit; larger
+// files of the other video and audio formats get the payload appended when no mode asks
+// for their dedicated carrier.
+const MaxInMemoryCarrier = 512 * 1024 * 1024 // 512MB
+
+// sniffSize is how much of the start of a carrier is read to detect its format
+const sniffSize = 1024 * 1024
+
+// EmbedDataInVideoStream embeds data into the size byte video read from src and writes the result to dst
+func EmbedDataInVideoStream(src io.ReaderAt, size int64, data []byte, opts VideoOptions, dst io.Writer) error {
+	if size == 0 {
+		return errors.New("video data cannot be empty")
+	}
+
+	head, err := readHead(src, size)
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case IsMP4(head):
+		estimate, err := estimateMP4Capacity(src, size, opts.Mode)
+		if err != nil {
+			return err
+		}
+		if err := estimate.checkCapacity(len(data)); err != nil {
+			return err
+		}
+		return EmbedDataInMP4Stream(src, size, data, opts.Mode, dst)
+
+	case IsAVI(head):
+		estimate, err := estimateAVICapacity(src, size)
+		if err != nil {
+			return err
+		}
+		if err := estimate.checkCapacity(len(data)); err != nil {
+			return err
+		}
+		return EmbedDataInAVIStream(src, size, data, dst)
+
+	case isInMemoryVideo(head, size):
+		if size <= MaxInMemoryCarrier {
+			videoData, err := readCarrier(src, size, "video")
+			if err != nil {
+				return err
+			}
+			result, err := EmbedDataInVideo(videoData, data, opts)
+			if err != nil {
+				return err
+			}
+			// The result has to stay small enough to be loaded again for extraction
+			if len(result) <= MaxInMemoryCarrier {
+				_, err = dst.Write(result)
+				return err
+			}
+		}
+		if opts.Mode != "" || len(opts.Frames) > 0 {
+			return inMemoryLimitError("video", size)
+		}
+	}
+
+	return appendPayload(src, size, data, dst)
+}
+
+// ExtractDataFromVideoStream extracts data from the size byte video read from src
+func ExtractDataFromVideoStream(src io.ReaderAt, size int64, opts VideoOptions) ([]byte, error) {
+	if size < 8 {
+		return nil, errors.New("video file too small")
+	}
+
+	head, err := readHead(src, size)
+	if err != nil {
+		return nil, err
+	}
+
+	switch {
+	case IsMP4(head):
+		return ExtractDataFromMP4Stream(src, size)
+
+	case IsAVI(head):
+		return ExtractDataFromAVIStream(src, size)
+
+	case isInMemoryVideo(head, size) && size <= MaxInMemoryCarrier:
+		videoData, err := readCarrier(src, size, "video")
+		if err != nil {
+			return nil, err
+		}
+		return ExtractDataFromVideo(videoData, opts)
+	}
+
+	if data, err := extractTrailerAt(src, size); !errors.Is(err, errNoTrailer) {
+		return data, err
+	}
+	return nil, errors.New("no embedded data found in video")
+}
+
+// EstimateVideoCapacityStream is EstimateVideoCapacity for the size byte video read from src
+func EstimateVideoCapacityStream(src io.ReaderAt, size int64, opts VideoOptions) (CapacityEstimate, error) {
+	if size == 0 {
+		return CapacityEstimate{}, errors.New("video data cannot be empty")
+	}
+
+	head, err := readHead(src, size)
+	if err != nil {
+		return CapacityEstimate{}, err
+	}
+
+	switch {
+	case IsMP4(head):
+		return estimateMP4Capacity(src, size, opts.Mode)
+
+	case IsAVI(head):
+		return estimateAVICapacity(src, size)
+
+	case isInMemoryVideo(head, size):
+		if size > MaxInMemoryCarrier {
+			if opts.Mode != "" || len(opts.Frames) > 0 {
+				return CapacityEstimate{}, inMemoryLimitError("video", size)
+			}
+			return largeCarrierEstimate("video"), nil
+		}
+		videoData, err := readCarrier(src, size, "video")
+		if err != nil {
+			return CapacityEstimate{}, err
+		}
+		return EstimateVideoCapacity(videoData, opts)
+	}
+
+	return appendEstimate("video"), nil
+}
+
+// EmbedDataInAudioStream embeds data into the size byte audio file read from src and writes the result to dst
+func EmbedDataInAudioStream(src io.ReaderAt, size int64, data []byte, opts AudioOptions, dst io.Writer) error {
+	if size == 0 {
+		return errors.New("audio data cannot be empty")
+	}
+
+	head, err := readHead(src, size)
+	if err != nil {
+		return err
+	}
+
+	if isStructuredAudio(head) {
+		if size <= MaxInMemoryCarrier {
+			audioData, err := readCarrier(src, size, "audio")
+			if err != nil {
+				return err
+			}
+			result, err := EmbedDataInAudio(audioData, data, opts)
+			if err != nil {
+				return err
+			}
+			// The result has to stay small enough to be loaded again for extraction
+			if len(result) <= MaxInMemoryCarrier {
+				_, err = dst.Write(result)
+				return err
+			}
+		}
+		if hasAudioCarrierOptions(opts) {
+			return inMemoryLimitError("audio", size)
+		}
+	}
+
+	return appendPayload(src, size, data, dst)
+}
+
+// ExtractDataFromAudioStream extracts data from the size byte audio file read from src
+func ExtractDataFromAudioStream(src io.ReaderAt, size int64, opts AudioOptions) ([]byte, error) {
+	if size < 8 {
+		return nil, errors.New("audio file too small")
+	}
+
+	head, err := readHead(src, size)
+	if err != nil {
+		return nil, err
+	}
+
+	if isStructuredAudio(head) && size <= MaxInMemoryCarrier {
+		audioData, err := readCarrier(src, size, "audio")
+		if err != nil {
+			return nil, err
+		}
+		return ExtractDataFromAudio(audioData, opts)
+	}
+
+	if data, err := extractTrailerAt(src, size); !errors.Is(err, errNoTrailer) {
+		return data, err
+	}
+	return nil, errors.New("no embedded data found in audio")
+}
+
+// EstimateAudioCapacityStream is EstimateAudioCapacity for the size byte audio file read from src
+func EstimateAudioCapacityStream(src io.ReaderAt, size int64, opts AudioOptions) (CapacityEstimate, error) {
+	if size == 0 {
+		return CapacityEstimate{}, errors.New("audio data cannot be empty")
+	}
+
+	head, err := readHead(src, size)
+	if err != nil {
+		return CapacityEstimate{}, err
+	}
+
+	if isStructuredAudio(head) {
+		if size > MaxInMemoryCarrier {
+			if hasAudioCarrierOptions(opts) {
+				return CapacityEstimate{}, inMemoryLimitError("audio", size)
+			}
+			return largeCarrierEstimate("audio"), nil
+		}
+		audioData, err := readCarrier(src, size, "audio")
+		if err != nil {
+			return CapacityEstimate{}, err
+		}
+		return EstimateAudioCapacity(audioData, opts)
+	}
+
+	return appendEstimate("audio"), nil
+}
+
+// EstimatePDFCapacityStream is EstimatePDFCapacity for the size byte PDF read from src
+func EstimatePDFCapacityStream(src io.ReaderAt, size int64, mode string) (CapacityEstimate, error) {
+	if size == 0 {
+		return CapacityEstimate{}, errors.New("pdf data cannot be empty")
+	}
+
+	switch mode {
+	case "", PDFModeIncremental:
+		doc, err := openPDF(src, size)
+		if err != nil {
+			return appendEstimate("pdf"), nil
+		}
+		if err := doc.checkEncryption(); err != nil {
+			return CapacityEstimate{}, err
+		}
+		return newEstimate("pdf", PDFModeIncremental, math.MaxInt32,
+			"payload is stored in a stream object added by an incremental update with its own cross-reference "+
+				"section and trailer /Prev, stream lengths are not limited"), nil
+
+	case PDFModeKerning:
+		doc, err := openPDF(src, size)
+		if err != nil {
+			return CapacityEstimate{}, err
+		}
+		if err := doc.checkEncryption(); err != nil {
+			return CapacityEstimate{}, err
+		}
+		contents, pages, err := doc.pageContents()
+		if err != nil {
+			return CapacityEstimate{}, err
+		}
+		return kerningEstimate(contents, pages), nil
+
+	case PDFModeAttachment:
+		doc, err := openPDF(src, size)
+		if err != nil {
+			return CapacityEstimate{}, err
+		}
+		if err := doc.checkEncryption(); err != nil {
+			return CapacityEstimate{}, err
+		}
+		return newEstimate("pdf", PDFModeAttachment, math.MaxInt32, fmt.Sprintf(
+			"payload is stored as an embedded file named %q in the EmbeddedFiles name tree of the catalog, "+
+				"stream lengths are not limited", pdfAttachmentName)), nil
+
+	case PDFModeXMP:
+		doc, err := openPDF(src, size)
+		if err != nil {
+			return CapacityEstimate{}, err
+		}
+		if err := doc.checkEncryption(); err != nil {
+			return CapacityEstimate{}, err
+		}
+		return newEstimate("pdf", PDFModeXMP, math.MaxInt32/4*3,
+			"payload is stored base64 encoded in a custom namespace of the XMP metadata stream, which grows by about 4/3 of the payload"), nil
+	}
+	return CapacityEstimate{}, invalidPDFMode(mode)
+}
+
+// EstimateOOXMLCapacityStream is EstimateOOXMLCapacity for the size byte document read from src
+func EstimateOOXMLCapacityStream(src io.ReaderAt, size int64, mode string) (CapacityEstimate, error) {
+	if size == 0 {
+		return CapacityEstimate{}, errors.New("office document data cannot be empty")
+	}
+	if mode != "" && mode != OOXMLModeCustomXML {
+		return CapacityEstimate{}, invalidOOXMLMode(mode)
+	}
+
+	r, err := zip.NewReader(src, size)
+	if err != nil {
+		return CapacityEstimate{}, errors.New("invalid office document: " + err.Error())
+	}
+	files := make(map[string]*zip.File, len(r.File))
+	for _, f := range r.File {
+		files[f.Name] = f
+	}
+	if _, _, err := ooxmlMainPart(files); err != nil {
+		return CapacityEstimate{}, err
+	}
+	return newEstimate("ooxml", OOXMLModeCustomXML, math.MaxInt32/4*3,
+		"payload is stored base64 encoded in a custom XML part related from the main document part, "+
+			"which grows by about 4/3 of the payload"), nil
+}
+
+// isInMemoryVideo reports whether the video needs the whole file in memory
+func isInMemoryVideo(head []byte, size int64) bool {
+	if IsY4M(head) || IsMKV(head) {
+		return true
+	}
+
+	// Transport streams are recognized by the sync byte of the first packets
+	for _, stride := range []int64{tsPacketSize, tsPacketSize + 4} {
+		packets := min(int64(len(head)), size) / stride
+		if packets > 0 && IsTS(head[:packets*stride]) {
+			return true
+		}
+	}
+	return false
+}
+
+// isStructuredAudio reports whether the audio file has a dedicated (in-memory) carrier
+func isStructuredAudio(head []byte) bool {
+	return IsFLAC(head) || IsWAV(head) || IsAIFF(head) || IsOgg(head) || IsMP3(head)
+}
+
+// hasAudioCarrierOptions reports whether opts ask for a dedicated carrier rather than any strategy
+func hasAudioCarrierOptions(opts AudioOptions) bool {
+	return opts.Mode != "" || opts.Channels != nil || opts.Spread
+}
+
+// inMemoryLimitError reports a carrier too large for the dedicated carrier its options ask for
+func inMemoryLimitError(mediaType string, size int64) error {
+	return fmt.Errorf("%s carriers of this format are processed in memory and limited to %d bytes including the payload, "+
+		"got %d bytes; without a mode the payload is appended instead", mediaType, MaxInMemoryCarrier, size)
+}
+
+// largeCarrierEstimate is the append estimate for carriers too large for their in-memory carrier
+func largeCarrierEstimate(format string) CapacityEstimate {
+	estimate := appendEstimate(format)
+	estimate.Warning = fmt.Sprintf("carriers of this format larger than %dMB are not loaded into memory, "+
+		"the payload is appended after the last byte instead of being stored inside the file structure",
+		MaxInMemoryCarrier>>20)
+	return estimate
+}
+
+// appendPayload copies src to dst and appends the payload and its footer after it
+func appendPayload(src io.ReaderAt, size int64, data []byte, dst io.Writer) error {
+	if len(data) == 0 {
+		return errors.New("data to embed cannot be empty")
+	}
+
+	if len(data) > MaxDataSize {
+		return fmt.Errorf("data too large: %d bytes, max allowed: %d bytes", len(data), MaxDataSize)
+	}
+
+	if _, err := io.Copy(dst, io.NewSectionReader(src, 0, size)); err != nil {
+		return fmt.Errorf("failed to copy carrier: %w", err)
+	}
+	_, err := dst.Write(makeTrailer(size, data))
+	return err
+}
+
+// scanTrailerAt looks for an appended payload in the last part of the file
+func scanTrailerAt(src io.ReaderAt, size int64) ([]byte, bool) {
+	start := max(0, size-MaxDataSize-8)
+	tail := make([]byte, size-start)
+	if _, err := src.ReadAt(tail, start); err != nil && err != io.EOF {
+		return nil, false
+	}
+	return scanTrailer(tail)
+}
+
+// readHead reads the start of the file used for format detection
+func readHead(src io.ReaderAt, size int64) ([]byte, error) {
+	head := make([]byte, min(size, sniffSize))
+	if _, err := src.ReadAt(head, 0); err != nil && err != io.EOF {
+		return nil, fmt.Errorf("failed to read carrier: %w", err)
+	}
+	return head, nil
+}
+
+// readCarrier loads a whole carrier for formats that are processed in memory
+func readCarrier(src io.ReaderAt, size int64, mediaType string) ([]byte, error) {
+	if size > MaxInMemoryCarrier {
+		return nil, fmt.Errorf("%s carriers of this format are processed in memory and limited to %d bytes, got %d bytes",
+			mediaType, MaxInMemoryCarrier, size)
+	}
+	data := make([]byte, size)
+	if _, err := src.ReadAt(data, 0); err != nil && err != io.EOF {
+		return nil, fmt.Errorf("failed to read carrier: %w", err)
+	}
+	return data, nil
+}
+
+// readRange reads the bytes [start, end) of src
+func readRange(src io.ReaderAt, start, end int) ([]byte, error) {
+	b := make([]byte, end-start)
+	if _, err := src.ReadAt(b, int64(start)); err != nil && err != io.EOF {
+		return nil, err
+	}
+	return b, nil
+}
+
+// readHeaderedDataAt reads a payload written by prepareDataWithHeader that starts at start
+// and must end before end, reading the header first so no large region is loaded for nothing
+func readHeaderedDataAt(src io.ReaderAt, start, end int) ([]byte, error) {
+	if !hasHeaderedDataAt(src, start, end) {
+		return nil, errors.New("no valid embedded data header")
+	}
+	header, err := readRange(src, start, start+8)
+	if err != nil {
+		return nil, err
+	}
+	return readRange(src, start+8, start+8+int(binary.LittleEndian.Uint32(header[4:8])))
+}
+
+// hasHeaderedDataAt reports whether a payload header at start describes data that fits before end
+func hasHeaderedDataAt(src io.ReaderAt, start, end int) bool {
+	if end-start < 8 {
+		return false
+	}
+	header, err := readRange(src, start, start+8)
+	if err != nil || binary.LittleEndian.Uint32(header[:4]) != MagicNumber {
+		return false
+	}
+	dataLength := int(binary.LittleEndian.Uint32(header[4:8]))
+	return dataLength > 0 && dataLength <= MaxDataSize && dataLength <= end-start-8
+}
+
+// copyRange copies the bytes [start, end) of src to dst
+func copyRange(dst io.Writer, src io.ReaderAt, start, end int) error {
+	if _, err := io.Copy(dst, io.NewSectionReader(src, int64(start), int64(end-start))); err != nil {
+		return fmt.Errorf("failed to copy carrier: %w", err)
+	}
+	return nil
+}
+
+// zeroReader is an endless source of zero bytes
+type zeroReader struct{}
+
+func (zeroReader) Read(p []byte) (int, error) {
+	clear(p)
+	return len(p), nil
+}
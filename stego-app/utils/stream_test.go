@@ -0,0 +1,164 @@
+package utils
+
+import (
+	"bytes"
+	"io"
+	"testing"
+)
+
+// testLargeFile is a carrier larger than MaxInMemoryCarrier without the memory: head, then
+// zero bytes, then tail at the end of the file
+type testLargeFile struct {
+	head, tail []byte
+	size       int64
+}
+
+func (f *testLargeFile) ReadAt(p []byte, off int64) (int, error) {
+	if off >= f.size {
+		return 0, io.EOF
+	}
+	n := int(min(int64(len(p)), f.size-off))
+	clear(p[:n])
+	if off < int64(len(f.head)) {
+		copy(p[:n], f.head[off:])
+	}
+	if tailStart := f.size - int64(len(f.tail)); off+int64(n) > tailStart {
+		from := max(0, tailStart-off)
+		copy(p[from:n], f.tail[max(0, off-tailStart):])
+	}
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+// testTail keeps the last bytes written to it
+type testTail struct {
+	n    int64
+	tail []byte
+}
+
+func (w *testTail) Write(p []byte) (int, error) {
+	w.n += int64(len(p))
+	w.tail = append(w.tail, p...)
+	if len(w.tail) > 1<<16 {
+		w.tail = w.tail[len(w.tail)-1<<16:]
+	}
+	return len(p), nil
+}
+
+// embedLarge embeds into a large carrier starting with head and returns the result as a
+// testLargeFile
+func embedLarge(t *testing.T, embed func(src io.ReaderAt, size int64, dst io.Writer) error, head []byte) *testLargeFile {
+	t.Helper()
+	carrier := &testLargeFile{head: head, size: MaxInMemoryCarrier + 1}
+	var out testTail
+	if err := embed(carrier, carrier.size, &out); err != nil {
+		t.Fatal(err)
+	}
+	return &testLargeFile{head: head, tail: out.tail, size: out.n}
+}
+
+func TestLargeAudioIsAppended(t *testing.T) {
+	head := testWAV(1, 16, 16, 1000)
+	out := embedLarge(t, func(src io.ReaderAt, size int64, dst io.Writer) error {
+		return EmbedDataInAudioStream(src, size, []byte("large"), AudioOptions{}, dst)
+	}, head)
+	if out.size != MaxInMemoryCarrier+1+8+5+FooterSize {
+		t.Fatalf("%d bytes", out.size)
+	}
+	if got, err := ExtractDataFromAudioStream(out, out.size, AudioOptions{}); err != nil || string(got) != "large" {
+		t.Fatalf("got %q, %v", got, err)
+	}
+
+	carrier := &testLargeFile{head: head, size: MaxInMemoryCarrier + 1}
+	estimate, err := EstimateAudioCapacityStream(carrier, carrier.size, AudioOptions{})
+	if err != nil || estimate.Warning == "" {
+		t.Fatalf("estimate %+v, %v", estimate, err)
+	}
+	for _, opts := range []AudioOptions{{Spread: true}, {Channels: []int{0}}, {Mode: MP3ModeAncillary}} {
+		if err := EmbedDataInAudioStream(carrier, carrier.size, []byte("x"), opts, io.Discard); err == nil {
+			t.Errorf("%+v: carrier option accepted for a large file", opts)
+		}
+		if _, err := EstimateAudioCapacityStream(carrier, carrier.size, opts); err == nil {
+			t.Errorf("%+v: carrier option estimated for a large file", opts)
+		}
+	}
+}
+
+func TestLargeVideoIsAppended(t *testing.T) {
+	head := testY4M(16, 16, 2, 16*16*3/2, "420")
+	out := embedLarge(t, func(src io.ReaderAt, size int64, dst io.Writer) error {
+		return EmbedDataInVideoStream(src, size, []byte("large"), VideoOptions{}, dst)
+	}, head)
+	if got, err := ExtractDataFromVideoStream(out, out.size, VideoOptions{}); err != nil || string(got) != "large" {
+		t.Fatalf("got %q, %v", got, err)
+	}
+
+	carrier := &testLargeFile{head: head, size: MaxInMemoryCarrier + 1}
+	estimate, err := EstimateVideoCapacityStream(carrier, carrier.size, VideoOptions{})
+	if err != nil || estimate.Warning == "" {
+		t.Fatalf("estimate %+v, %v", estimate, err)
+	}
+	for _, opts := range []VideoOptions{{Mode: "lsb"}, {Frames: []int{0}}} {
+		if err := EmbedDataInVideoStream(carrier, carrier.size, []byte("x"), opts, io.Discard); err == nil {
+			t.Errorf("%+v: carrier option accepted for a large file", opts)
+		}
+		if _, err := EstimateVideoCapacityStream(carrier, carrier.size, opts); err == nil {
+			t.Errorf("%+v: carrier option estimated for a large file", opts)
+		}
+	}
+}
+
+func TestStreamDispatch(t *testing.T) {
+	audio := map[string][]byte{
+		"wav":  testWAV(2, 16, 16, 2000),
+		"aiff": testAIFF("", 2, 2000, 0),
+		"flac": testFLAC(),
+		"ogg":  testOgg(oggOpus, false),
+		"mp3":  testMP3(20, 200, false),
+	}
+	for name, carrier := range audio {
+		var out bytes.Buffer
+		if err := EmbedDataInAudioStream(bytes.NewReader(carrier), int64(len(carrier)), []byte("audio"), AudioOptions{}, &out); err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		// The dedicated carrier is used, not the appended footer
+		if _, err := findTrailerAt(bytes.NewReader(out.Bytes()), int64(out.Len())); err == nil {
+			t.Fatalf("%s: payload appended", name)
+		}
+		if got, err := ExtractDataFromAudioStream(bytes.NewReader(out.Bytes()), int64(out.Len()), AudioOptions{}); err != nil || string(got) != "audio" {
+			t.Fatalf("%s: got %q, %v", name, got, err)
+		}
+	}
+
+	video := map[string][]byte{
+		"mp4": testMP4(false),
+		"avi": testAVI(0, false),
+		"mkv": testMKV(),
+		"ts":  testTS(20, 0),
+		"y4m": testY4M(16, 16, 2, 16*16*3/2, "420"),
+	}
+	for name, carrier := range video {
+		var out bytes.Buffer
+		if err := EmbedDataInVideoStream(bytes.NewReader(carrier), int64(len(carrier)), []byte("video"), VideoOptions{}, &out); err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if _, err := findTrailerAt(bytes.NewReader(out.Bytes()), int64(out.Len())); err == nil {
+			t.Fatalf("%s: payload appended", name)
+		}
+		if got, err := ExtractDataFromVideoStream(bytes.NewReader(out.Bytes()), int64(out.Len()), VideoOptions{}); err != nil || string(got) != "video" {
+			t.Fatalf("%s: got %q, %v", name, got, err)
+		}
+	}
+
+	// Unknown formats get the payload appended
+	var out bytes.Buffer
+	unknown := []byte("not an audio format")
+	if err := EmbedDataInAudioStream(bytes.NewReader(unknown), int64(len(unknown)), []byte("x"), AudioOptions{}, &out); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := ExtractDataFromAudioStream(bytes.NewReader(out.Bytes()), int64(out.Len()), AudioOptions{}); err != nil || string(got) != "x" {
+		t.Fatalf("got %q, %v", got, err)
+	}
+}
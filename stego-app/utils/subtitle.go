@@ -0,0 +1,232 @@
+package utils
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"regexp"
+	"strconv"
+)
+
+// SRT and WebVTT files are only changed inside their cue timings: a timestamp is rewritten
+// in place with its own hour width and decimal separator, so cue numbers, settings, styles,
+// comments, line endings and the text encoding stay as they were. Every start and end time
+// after the first carries 2 payload bits in its distance to the timestamp before it, modulo
+// 4 ms. Starts only move later and ends only earlier, by 3 ms at most, so cues never start
+// to overlap, and as only distances count the payload survives shifting all cues to resync.
+
+// SubtitleModeJitter hides the payload in millisecond jitter of the cue start and end times
+const SubtitleModeJitter = "jitter"
+
+// subtitleJitter is the number of distinct jitters, 2 bits per timestamp
+const subtitleJitter = 4
+
+// subtitleTiming matches the start and end timestamps of a cue timing line; hours are
+// optional in WebVTT and SRT files written with a period instead of a comma are common
+var subtitleTiming = regexp.MustCompile(
+	`(?m)^[ \t]*((?:\d+:)?\d{2}:\d{2}[,.]\d{3})[ \t]+-->[ \t]+((?:\d+:)?\d{2}:\d{2}[,.]\d{3})(?:[ \t\r]|$)`)
+
+// subtitleTime is a cue timestamp and where it is written
+type subtitleTime struct {
+	start, end int // byte range of the timestamp in the file
+	ms         int
+	hourWidth  int  // digits of the hours field, 0 without one
+	separator  byte // ',' in SRT, '.' in WebVTT
+	cueEnd     bool
+}
+
+// subtitleFile is the cue timestamps of a subtitle file in file order, start before end
+type subtitleFile struct {
+	format string // "srt" or "vtt"
+	times  []subtitleTime
+}
+
+// IsWebVTT checks for the WEBVTT signature, after a byte order mark if there is one
+func IsWebVTT(data []byte) bool {
+	return bytes.HasPrefix(bytes.TrimPrefix(data, []byte("\xEF\xBB\xBF")), []byte("WEBVTT"))
+}
+
+// EmbedDataInSubtitle embeds data in the cue timings of an SRT or WebVTT file
+func EmbedDataInSubtitle(subData []byte, data []byte, mode string) ([]byte, error) {
+	if len(data) == 0 {
+		return nil, errors.New("data to embed cannot be empty")
+	}
+
+	if len(data) > MaxDataSize {
+		return nil, fmt.Errorf("data too large: %d bytes, max allowed: %d bytes", len(data), MaxDataSize)
+	}
+
+	if mode != "" && mode != SubtitleModeJitter {
+		return nil, invalidSubtitleMode(mode)
+	}
+
+	sub, err := parseSubtitle(subData)
+	if err != nil {
+		return nil, err
+	}
+	if err := sub.estimate().checkCapacity(len(data)); err != nil {
+		return nil, err
+	}
+
+	bits := bytesToBits(prepareDataWithHeader(data))
+	out := make([]byte, 0, len(subData)+len(subData)/64)
+	written := 0
+	prev := sub.times[0].ms
+	for i, t := range sub.times[1:] {
+		if 2*i >= len(bits) {
+			break
+		}
+		ms := t.jitter(prev, int(bits[2*i]|bits[2*i+1]<<1))
+		if ms != t.ms {
+			out = append(out, subData[written:t.start]...)
+			out = t.appendFormat(out, ms)
+			written = t.end
+		}
+		prev = ms
+	}
+	return append(out, subData[written:]...), nil
+}
+
+// ExtractDataFromSubtitle extracts data hidden in the cue timings of an SRT or WebVTT file
+func ExtractDataFromSubtitle(subData []byte) ([]byte, error) {
+	sub, err := parseSubtitle(subData)
+	if err != nil {
+		return nil, err
+	}
+
+	bits := make([]uint8, 0, 2*len(sub.times))
+	for i := 1; i < len(sub.times); i++ {
+		d := subtitleDistance(sub.times[i].ms, sub.times[i-1].ms)
+		bits = append(bits, uint8(d&1), uint8(d>>1))
+	}
+	data, err := parseHeaderedData(bitsToBytes(bits))
+	if err != nil {
+		return nil, errors.New("no embedded data found in subtitle file")
+	}
+	return data, nil
+}
+
+// EstimateSubtitleCapacity estimates the capacity of an SRT or WebVTT file from its cue count
+func EstimateSubtitleCapacity(subData []byte, mode string) (CapacityEstimate, error) {
+	if mode != "" && mode != SubtitleModeJitter {
+		return CapacityEstimate{}, invalidSubtitleMode(mode)
+	}
+
+	sub, err := parseSubtitle(subData)
+	if err != nil {
+		return CapacityEstimate{}, err
+	}
+	return sub.estimate(), nil
+}
+
+// EmbedDataInSubtitleStream is EmbedDataInSubtitle reading the size byte file from src and writing to dst
+func EmbedDataInSubtitleStream(src io.ReaderAt, size int64, data []byte, mode string, dst io.Writer) error {
+	subData, err := readCarrier(src, size, "subtitle")
+	if err != nil {
+		return err
+	}
+	result, err := EmbedDataInSubtitle(subData, data, mode)
+	if err != nil {
+		return err
+	}
+	_, err = dst.Write(result)
+	return err
+}
+
+// ExtractDataFromSubtitleStream is ExtractDataFromSubtitle for the size byte file read from src
+func ExtractDataFromSubtitleStream(src io.ReaderAt, size int64) ([]byte, error) {
+	subData, err := readCarrier(src, size, "subtitle")
+	if err != nil {
+		return nil, err
+	}
+	return ExtractDataFromSubtitle(subData)
+}
+
+// EstimateSubtitleCapacityStream is EstimateSubtitleCapacity for the size byte file read from src
+func EstimateSubtitleCapacityStream(src io.ReaderAt, size int64, mode string) (CapacityEstimate, error) {
+	subData, err := readCarrier(src, size, "subtitle")
+	if err != nil {
+		return CapacityEstimate{}, err
+	}
+	return EstimateSubtitleCapacity(subData, mode)
+}
+
+// invalidSubtitleMode reports a mode subtitle files do not support
+func invalidSubtitleMode(mode string) error {
+	return fmt.Errorf("invalid subtitle mode %q. Must be: %s", mode, SubtitleModeJitter)
+}
+
+// parseSubtitle finds the cue timestamps of an SRT or WebVTT file
+func parseSubtitle(subData []byte) (*subtitleFile, error) {
+	if len(subData) == 0 {
+		return nil, errors.New("subtitle data cannot be empty")
+	}
+
+	sub := &subtitleFile{format: "srt"}
+	if IsWebVTT(subData) {
+		sub.format = "vtt"
+	}
+	for _, m := range subtitleTiming.FindAllSubmatchIndex(subData, -1) {
+		for i, span := range [][2]int{{m[2], m[3]}, {m[4], m[5]}} {
+			sub.times = append(sub.times, parseSubtitleTime(subData, span[0], span[1], i == 1))
+		}
+	}
+	if len(sub.times) == 0 {
+		return nil, errors.New("not an srt or webvtt file: no cue timings found")
+	}
+	return sub, nil
+}
+
+// parseSubtitleTime reads the timestamp at subData[start:end], which the timing pattern matched
+func parseSubtitleTime(subData []byte, start, end int, cueEnd bool) subtitleTime {
+	t := subtitleTime{start: start, end: end, separator: subData[end-4], cueEnd: cueEnd}
+	fields := bytes.Split(subData[start:end-4], []byte(":"))
+	if len(fields) == 3 {
+		t.hourWidth = len(fields[0])
+	}
+	for _, f := range fields {
+		n, _ := strconv.Atoi(string(f))
+		t.ms = t.ms*60 + n
+	}
+	millis, _ := strconv.Atoi(string(subData[end-3 : end]))
+	t.ms = t.ms*1000 + millis
+	return t
+}
+
+// jitter returns the time within 3 ms of t, later for a start and earlier for an end, whose
+// distance to prev encodes value. An end that would not come after its start moves later.
+func (t subtitleTime) jitter(prev, value int) int {
+	lo := t.ms
+	if t.cueEnd {
+		lo = t.ms - (subtitleJitter - 1)
+		if lo <= prev {
+			lo = prev + 1
+		}
+	}
+	return lo + subtitleDistance(value, subtitleDistance(lo, prev))
+}
+
+// appendFormat appends ms formatted like t, adding hours when they no longer fit in minutes
+func (t subtitleTime) appendFormat(b []byte, ms int) []byte {
+	hours, minutes, seconds, millis := ms/3600000, ms/60000%60, ms/1000%60, ms%1000
+	if t.hourWidth > 0 {
+		b = fmt.Appendf(b, "%0*d:", t.hourWidth, hours)
+	} else if hours > 0 {
+		b = fmt.Appendf(b, "%02d:", hours)
+	}
+	return fmt.Appendf(b, "%02d:%02d%c%03d", minutes, seconds, t.separator, millis)
+}
+
+// estimate sums 2 bits for each timestamp after the first
+func (s *subtitleFile) estimate() CapacityEstimate {
+	bits := 2 * (len(s.times) - 1)
+	return newEstimate(s.format, SubtitleModeJitter, bits/8, fmt.Sprintf(
+		"2 bits in the millisecond jitter of each start and end time of %d cues except the first start, "+
+			"cues start at most 3ms later and end at most 3ms earlier", len(s.times)/2))
+}
+
+// subtitleDistance returns a - b modulo the jitter count
+func subtitleDistance(a, b int) int {
+	return ((a-b)%subtitleJitter + subtitleJitter) % subtitleJitter
+}
@@ -0,0 +1,169 @@
+package utils
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+// testSRT builds an SRT file of n cues, 2 seconds apart
+func testSRT(n int, sep, newline string) []byte {
+	var b strings.Builder
+	for i := 0; i < n; i++ {
+		start, end := i*2000+100, i*2000+1500
+		fmt.Fprintf(&b, "%d%s%02d:%02d:%02d%s%03d --> %02d:%02d:%02d%s%03d%sLine %d%s%s", i+1, newline,
+			start/3600000, start/60000%60, start/1000%60, sep, start%1000,
+			end/3600000, end/60000%60, end/1000%60, sep, end%1000, newline, i, newline, newline)
+	}
+	return []byte(b.String())
+}
+
+// testVTT builds a WebVTT file of n cues without hours, with cue settings and a note
+func testVTT(n int) []byte {
+	var b strings.Builder
+	b.WriteString("\xEF\xBB\xBFWEBVTT\n\nNOTE written by a test\n\n")
+	for i := 0; i < n; i++ {
+		start, end := i*2000+100, i*2000+1500
+		fmt.Fprintf(&b, "%02d:%02d.%03d --> %02d:%02d.%03d line:90%% align:center\n<v Speaker>Line %d\n\n",
+			start/60000%60, start/1000%60, start%1000, end/60000%60, end/1000%60, end%1000, i)
+	}
+	return []byte(b.String())
+}
+
+func TestSubtitleRoundTrip(t *testing.T) {
+	carriers := map[string][]byte{
+		"srt":        testSRT(200, ",", "\n"),
+		"srt crlf":   testSRT(200, ",", "\r\n"),
+		"srt period": testSRT(200, ".", "\n"),
+		"vtt":        testVTT(200),
+	}
+	data := []byte("subtitle payload")
+	for name, carrier := range carriers {
+		out, err := EmbedDataInSubtitle(carrier, data, "")
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if len(out) != len(carrier) {
+			t.Fatalf("%s: size changed from %d to %d", name, len(carrier), len(out))
+		}
+		got, err := ExtractDataFromSubtitle(out)
+		if err != nil || !bytes.Equal(got, data) {
+			t.Fatalf("%s: got %q, %v", name, got, err)
+		}
+		checkSubtitleTimings(t, name, carrier, out)
+	}
+}
+
+// checkSubtitleTimings checks that only timestamps changed, starts later and ends earlier
+// by 3 ms at most, and that no cue ends before it starts
+func checkSubtitleTimings(t *testing.T, name string, before, after []byte) {
+	t.Helper()
+	if !bytes.Equal(subtitleTiming.ReplaceAll(before, nil), subtitleTiming.ReplaceAll(after, nil)) {
+		t.Fatalf("%s: text outside the timings changed", name)
+	}
+	a, _ := parseSubtitle(before)
+	b, _ := parseSubtitle(after)
+	for i, ta := range a.times {
+		d := b.times[i].ms - ta.ms
+		if ta.cueEnd && (d > 0 || d < -3) || !ta.cueEnd && (d < 0 || d > 3) {
+			t.Fatalf("%s: timestamp %d moved by %d ms", name, i, d)
+		}
+		if ta.cueEnd && b.times[i].ms <= b.times[i-1].ms {
+			t.Fatalf("%s: cue %d ends before it starts", name, i/2)
+		}
+	}
+}
+
+func TestSubtitleSurvivesResync(t *testing.T) {
+	out, err := EmbedDataInSubtitle(testSRT(100, ",", "\n"), []byte("resync"), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Shift every cue by 1.234 s as a player or editor resync would
+	sub, _ := parseSubtitle(out)
+	var shifted []byte
+	written := 0
+	for _, ts := range sub.times {
+		shifted = append(shifted, out[written:ts.start]...)
+		shifted = ts.appendFormat(shifted, ts.ms+1234)
+		written = ts.end
+	}
+	shifted = append(shifted, out[written:]...)
+
+	got, err := ExtractDataFromSubtitle(shifted)
+	if err != nil || string(got) != "resync" {
+		t.Fatalf("got %q, %v", got, err)
+	}
+}
+
+func TestSubtitleReembed(t *testing.T) {
+	carrier := testSRT(200, ",", "\n")
+	first, err := EmbedDataInSubtitle(carrier, []byte("first payload, longer"), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := EmbedDataInSubtitle(first, []byte("second"), SubtitleModeJitter)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := ExtractDataFromSubtitle(second)
+	if err != nil || string(got) != "second" {
+		t.Fatalf("got %q, %v", got, err)
+	}
+}
+
+func TestSubtitleHoursOverflow(t *testing.T) {
+	// A timestamp without hours that moves past 59:59.999 gains an hours field
+	cue := "WEBVTT\n\n59:59.998 --> 59:59.999\na\n\n"
+	sub, err := parseSubtitle([]byte(cue))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := string(sub.times[0].appendFormat(nil, 3600001)); got != "01:00:00.001" {
+		t.Fatalf("appendFormat = %q", got)
+	}
+}
+
+func TestSubtitleMalformed(t *testing.T) {
+	if _, err := EmbedDataInSubtitle(testSRT(10, ",", "\n"), make([]byte, 100), ""); err == nil {
+		t.Error("data larger than the capacity accepted")
+	}
+	if _, err := EmbedDataInSubtitle(testSRT(10, ",", "\n"), []byte("x"), "shift"); err == nil {
+		t.Error("invalid mode accepted")
+	}
+	if _, err := EmbedDataInSubtitle([]byte("just some text\n"), []byte("x"), ""); err == nil {
+		t.Error("file without cue timings accepted")
+	}
+	if _, err := EmbedDataInSubtitle(nil, []byte("x"), ""); err == nil {
+		t.Error("empty file accepted")
+	}
+	if _, err := ExtractDataFromSubtitle(testSRT(200, ",", "\n")); err == nil {
+		t.Error("clean file extracted")
+	}
+
+	out, err := EmbedDataInSubtitle(testSRT(200, ",", "\n"), []byte("truncated payload"), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ExtractDataFromSubtitle(out[:len(out)/8]); err == nil {
+		t.Error("truncated file extracted")
+	}
+}
+
+func TestSubtitleStream(t *testing.T) {
+	carrier := testVTT(100)
+	var out bytes.Buffer
+	if err := EmbedDataInSubtitleStream(bytes.NewReader(carrier), int64(len(carrier)), []byte("stream"), "", &out); err != nil {
+		t.Fatal(err)
+	}
+	got, err := ExtractDataFromSubtitleStream(bytes.NewReader(out.Bytes()), int64(out.Len()))
+	if err != nil || string(got) != "stream" {
+		t.Fatalf("got %q, %v", got, err)
+	}
+	estimate, err := EstimateSubtitleCapacityStream(bytes.NewReader(carrier), int64(len(carrier)), "")
+	if err != nil || estimate.Capacity != (2*199)/8-8 {
+		t.Fatalf("estimate %+v, %v", estimate, err)
+	}
+}
@@ -0,0 +1,71 @@
+package utils
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Text embedding modes
+const (
+	TextModeZeroWidth  = "zerowidth"  // payload as zero-width characters between the cover characters (default)
+	TextModeWhitespace = "whitespace" // payload as trailing spaces and tabs at line ends
+)
+
+// EmbedDataInText hides data in the cover text using the chosen mode
+func EmbedDataInText(cover string, data []byte, mode, passphrase string) (string, error) {
+	if cover == "" {
+		return "", errors.New("cover text cannot be empty")
+	}
+
+	if len(data) == 0 {
+		return "", errors.New("data to embed cannot be empty")
+	}
+
+	if len(data) > MaxDataSize {
+		return "", fmt.Errorf("data too large: %d bytes, max allowed: %d bytes", len(data), MaxDataSize)
+	}
+
+	// The payload of the other mode is removed, extraction tries zero-width first
+	switch mode {
+	case "", TextModeZeroWidth:
+		return embedZeroWidth(stripWhitespacePayload(cover), data, passphrase)
+	case TextModeWhitespace:
+		return embedWhitespace(stripZeroWidthRuns(cover), data)
+	}
+	return "", invalidTextMode(mode)
+}
+
+// ExtractDataFromText reads data hidden in text by either mode
+func ExtractDataFromText(text string) ([]byte, error) {
+	if text == "" {
+		return nil, errors.New("text cannot be empty")
+	}
+
+	if data, err := extractZeroWidth(text); err == nil {
+		return data, nil
+	}
+	if data, err := extractWhitespace(text); err == nil {
+		return data, nil
+	}
+	return nil, errors.New("no embedded data found in text")
+}
+
+// EstimateTextCapacity estimates the capacity of a cover text for the chosen mode
+func EstimateTextCapacity(cover string, mode string) (CapacityEstimate, error) {
+	if cover == "" {
+		return CapacityEstimate{}, errors.New("cover text cannot be empty")
+	}
+
+	switch mode {
+	case "", TextModeZeroWidth:
+		return zeroWidthEstimate(cover), nil
+	case TextModeWhitespace:
+		return whitespaceEstimate(cover), nil
+	}
+	return CapacityEstimate{}, invalidTextMode(mode)
+}
+
+// invalidTextMode reports a mode text carriers do not support
+func invalidTextMode(mode string) error {
+	return fmt.Errorf("invalid text mode %q. Must be: %s or %s", mode, TextModeZeroWidth, TextModeWhitespace)
+}
@@ -0,0 +1,57 @@
+package utils
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestTextReembedAcrossModes(t *testing.T) {
+	cover := strings.Repeat("Hello world, a line of the cover text.\n", 40)
+	steps := []struct {
+		mode string
+		data string
+	}{
+		{TextModeZeroWidth, "zero-width one"},
+		{TextModeWhitespace, "whitespace one"},
+		{TextModeWhitespace, "whitespace two"},
+		{TextModeZeroWidth, "zero-width two"},
+		{"", "default mode"},
+	}
+
+	text := cover
+	for _, step := range steps {
+		out, err := EmbedDataInText(text, []byte(step.data), step.mode, "passphrase")
+		if err != nil {
+			t.Fatalf("embed %q in %q mode: %v", step.data, step.mode, err)
+		}
+		got, err := ExtractDataFromText(out)
+		if err != nil || string(got) != step.data {
+			t.Fatalf("after embedding %q in %q mode got %q, %v", step.data, step.mode, got, err)
+		}
+		if stripWhitespacePayload(stripZeroWidthRuns(out)) != cover {
+			t.Fatalf("after embedding %q in %q mode the visible text changed", step.data, step.mode)
+		}
+		text = out
+	}
+}
+
+func TestTextInvalidInput(t *testing.T) {
+	if _, err := EmbedDataInText("", []byte("x"), "", ""); err == nil {
+		t.Error("empty cover accepted")
+	}
+	if _, err := EmbedDataInText("a b", nil, "", ""); err == nil {
+		t.Error("empty data accepted")
+	}
+	if _, err := EmbedDataInText("a b", []byte("x"), "unicode", ""); err == nil {
+		t.Error("invalid mode accepted")
+	}
+	if _, err := EstimateTextCapacity("a b", "unicode"); err == nil {
+		t.Error("invalid estimate mode accepted")
+	}
+	if _, err := ExtractDataFromText(""); err == nil {
+		t.Error("empty text extracted")
+	}
+	if _, err := ExtractDataFromText("nothing hidden here\n"); err == nil {
+		t.Error("plain text extracted")
+	}
+}
@@ -0,0 +1,421 @@
+package utils
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+// MPEG-TS carrier modes
+const (
+	TSModePID = "pid" // payload on an unused PID that no table references
+	TSModePMT = "pmt" // same, and every PMT advertises the PID as private data
+)
+
+const (
+	tsPacketSize   = 188
+	tsSyncByte     = 0x47
+	tsNullPID      = 0x1FFF
+	tsFirstFreePID = 0x1000 // search for an unused PID starts here
+
+	tsStreamIDPrivate2   = 0xBF // PES private_stream_2, no optional PES header
+	tsStreamTypePrivate  = 0x06 // PMT stream_type for PES packets with private data
+	tsMaxPESPayload      = 0xFFFF
+	tsPMTTableID         = 0x02
+	tsProgramAssociation = 0x0000
+)
+
+// tsStream describes the packet layout of a transport stream
+type tsStream struct {
+	Prefix  int   // 4 for M2TS (BDAV) files, whose packets carry a timestamp before the sync byte
+	Packets []int // offset of the sync byte of every packet
+	End     int   // end of the last whole packet, new packets are inserted there
+}
+
+// tsPID returns the PID of the packet at offset p
+func tsPID(data []byte, p int) int {
+	return int(binary.BigEndian.Uint16(data[p+1:p+3]) & 0x1FFF)
+}
+
+// tsPayload returns the payload of the packet at offset p, after the adaptation field
+func tsPayload(data []byte, p int) []byte {
+	packet := data[p : p+tsPacketSize]
+	control := packet[3] >> 4 & 0x3
+	if control&0x1 == 0 {
+		return nil
+	}
+	start := 4
+	if control&0x2 != 0 {
+		start += 1 + int(packet[4])
+	}
+	if start > tsPacketSize {
+		return nil
+	}
+	return packet[start:]
+}
+
+// IsTS reports whether data is an MPEG transport stream (plain or M2TS)
+func IsTS(data []byte) bool {
+	_, err := parseTS(data)
+	return err == nil
+}
+
+// EmbedDataInTS stores data in PES packets on an unused PID. Null packets are
+// replaced first so the stream keeps its bitrate; packets that do not fit there
+// are appended after the last whole packet.
+func EmbedDataInTS(tsData []byte, data []byte, mode string) ([]byte, error) {
+	if len(data) == 0 {
+		return nil, errors.New("data to embed cannot be empty")
+	}
+
+	if len(data) > MaxDataSize {
+		return nil, fmt.Errorf("data too large: %d bytes, max allowed: %d bytes", len(data), MaxDataSize)
+	}
+
+	if mode != "" && mode != TSModePID && mode != TSModePMT {
+		return nil, fmt.Errorf("invalid ts mode %q. Must be: %s or %s", mode, TSModePID, TSModePMT)
+	}
+
+	stream, err := parseTS(tsData)
+	if err != nil {
+		return nil, err
+	}
+
+	result := make([]byte, len(tsData))
+	copy(result, tsData)
+
+	// A payload from a previous embed is turned into null packets and its PID reused
+	pid, found := findTSPayloadPID(result, stream)
+	if found {
+		for _, p := range stream.Packets {
+			if tsPID(result, p) == pid {
+				writeTSNullPacket(result[p : p+tsPacketSize])
+			}
+		}
+	} else if pid, err = unusedTSPID(result, stream); err != nil {
+		return nil, err
+	}
+
+	if mode == TSModePMT {
+		if err := advertiseTSPID(result, stream, pid); err != nil {
+			return nil, err
+		}
+	}
+
+	packets := packetizeTSPES(pid, prepareDataWithHeader(data))
+
+	next := 0
+	for _, p := range stream.Packets {
+		if next == len(packets) {
+			break
+		}
+		if tsPID(result, p) == tsNullPID {
+			copy(result[p:p+tsPacketSize], packets[next])
+			next++
+		}
+	}
+
+	if next == len(packets) {
+		return result, nil
+	}
+
+	var prefix []byte
+	if stream.Prefix > 0 {
+		// Appended M2TS packets repeat the timestamp of the last packet
+		last := stream.Packets[len(stream.Packets)-1]
+		prefix = result[last-stream.Prefix : last]
+	}
+	tail := result[stream.End:]
+	appended := make([]byte, 0, len(result)+(len(packets)-next)*(stream.Prefix+tsPacketSize))
+	appended = append(appended, result[:stream.End]...)
+	for _, packet := range packets[next:] {
+		appended = append(appended, prefix...)
+		appended = append(appended, packet...)
+	}
+
+	return append(appended, tail...), nil
+}
+
+// ExtractDataFromTS demuxes the payload PID and returns the data stored by EmbedDataInTS
+func ExtractDataFromTS(tsData []byte) ([]byte, error) {
+	stream, err := parseTS(tsData)
+	if err != nil {
+		return nil, err
+	}
+
+	pid, found := findTSPayloadPID(tsData, stream)
+	if !found {
+		return nil, errors.New("no embedded data found in ts")
+	}
+
+	// Reassemble the PES packets of the PID, dropping duplicate packets (same continuity counter)
+	var pes []byte
+	lastCC := -1
+	started := false
+	for _, p := range stream.Packets {
+		if tsPID(tsData, p) != pid {
+			continue
+		}
+		payload := tsPayload(tsData, p)
+		if payload == nil {
+			continue
+		}
+		cc := int(tsData[p+3] & 0x0F)
+		if cc == lastCC {
+			continue
+		}
+		if lastCC >= 0 && cc != (lastCC+1)&0x0F {
+			return nil, fmt.Errorf("ts packet lost on pid 0x%04x", pid)
+		}
+		lastCC = cc
+
+		if tsData[p+1]&0x40 != 0 {
+			started = true
+		}
+		if started {
+			pes = append(pes, payload...)
+		}
+	}
+
+	var stored []byte
+	for len(pes) >= 6 && bytes.Equal(pes[:3], []byte{0, 0, 1}) && pes[3] == tsStreamIDPrivate2 {
+		size := int(binary.BigEndian.Uint16(pes[4:6]))
+		if 6+size > len(pes) {
+			return nil, errors.New("truncated pes packet in ts")
+		}
+		stored = append(stored, pes[6:6+size]...)
+		pes = pes[6+size:]
+	}
+
+	return parseHeaderedData(stored)
+}
+
+// parseTS checks the sync bytes and locates every packet. A truncated last packet, as
+// left by an interrupted recording, is not listed and is kept as is.
+func parseTS(data []byte) (*tsStream, error) {
+	for _, prefix := range []int{0, 4} {
+		stride := tsPacketSize + prefix
+		if len(data) < stride {
+			continue
+		}
+
+		stream := &tsStream{Prefix: prefix, End: len(data) - len(data)%stride}
+		valid := true
+		for p := prefix; p < stream.End; p += stride {
+			if data[p] != tsSyncByte {
+				valid = false
+				break
+			}
+			stream.Packets = append(stream.Packets, p)
+		}
+		if tail := stream.End + prefix; tail < len(data) && data[tail] != tsSyncByte {
+			valid = false
+		}
+		if valid {
+			return stream, nil
+		}
+	}
+	return nil, errors.New("not an mpeg transport stream")
+}
+
+// findTSPayloadPID returns the PID whose first PES packet starts with the payload header
+func findTSPayloadPID(data []byte, stream *tsStream) (int, bool) {
+	var magic [4]byte
+	binary.LittleEndian.PutUint32(magic[:], MagicNumber)
+
+	for _, p := range stream.Packets {
+		if data[p+1]&0x40 == 0 { // payload_unit_start_indicator
+			continue
+		}
+		payload := tsPayload(data, p)
+		if len(payload) >= 10 && bytes.Equal(payload[:3], []byte{0, 0, 1}) &&
+			payload[3] == tsStreamIDPrivate2 && bytes.Equal(payload[6:10], magic[:]) {
+			return tsPID(data, p), true
+		}
+	}
+	return 0, false
+}
+
+// unusedTSPID picks a PID that neither appears in the stream nor is referenced by PAT/PMT
+func unusedTSPID(data []byte, stream *tsStream) (int, error) {
+	used := make(map[int]bool)
+	for _, p := range stream.Packets {
+		used[tsPID(data, p)] = true
+	}
+	for _, p := range stream.Packets {
+		pid := tsPID(data, p)
+		section := tsSection(data, p)
+		switch {
+		case section == nil:
+		case pid == tsProgramAssociation && section[0] == 0x00:
+			for _, entry := range tsSectionEntries(section, 8, 4) {
+				used[int(binary.BigEndian.Uint16(entry[2:4])&0x1FFF)] = true
+			}
+		case section[0] == tsPMTTableID && len(section) >= 12:
+			used[int(binary.BigEndian.Uint16(section[8:10])&0x1FFF)] = true // PCR PID
+			for _, es := range tsPMTStreams(section) {
+				used[int(binary.BigEndian.Uint16(es[1:3])&0x1FFF)] = true
+			}
+		}
+	}
+
+	for pid := tsFirstFreePID; pid < tsNullPID; pid++ {
+		if !used[pid] {
+			return pid, nil
+		}
+	}
+	return 0, errors.New("no unused pid left in ts")
+}
+
+// advertiseTSPID adds pid as a private data stream to every PMT section that does not list it yet
+func advertiseTSPID(data []byte, stream *tsStream, pid int) error {
+	for _, p := range stream.Packets {
+		section := tsSection(data, p)
+		if section == nil || section[0] != tsPMTTableID || len(section) < 16 {
+			continue
+		}
+
+		listed := false
+		for _, es := range tsPMTStreams(section) {
+			if int(binary.BigEndian.Uint16(es[1:3])&0x1FFF) == pid {
+				listed = true
+			}
+		}
+		if listed {
+			continue
+		}
+
+		// The section grows in place into the stuffing after it, so it must stay inside its packet
+		payload := tsPayload(data, p)
+		start := p + tsPacketSize - len(payload) + 1 + int(payload[0])
+		sectionLength := int(binary.BigEndian.Uint16(section[1:3]) & 0x0FFF)
+		sectionEnd := start + 3 + sectionLength
+		if p+tsPacketSize-sectionEnd < 5 {
+			return errors.New("pmt section does not fit in its packet, use pid mode")
+		}
+
+		entry := []byte{tsStreamTypePrivate, 0xE0 | byte(pid>>8), byte(pid), 0xF0, 0x00}
+		copy(data[sectionEnd+1:], data[sectionEnd-4:sectionEnd]) // move the CRC
+		copy(data[sectionEnd-4:], entry)
+
+		sectionLength += 5
+		binary.BigEndian.PutUint16(data[start+1:start+3], 0xB000|uint16(sectionLength))
+		data[start+5] = data[start+5]&0xC1 | (data[start+5]+2)&0x3E // version_number + 1
+		crcAt := start + 3 + sectionLength - 4
+		binary.BigEndian.PutUint32(data[crcAt:crcAt+4], mpegCRC32(data[start:crcAt]))
+	}
+	return nil
+}
+
+// tsSection returns the PSI section starting in the packet at p, including the
+// space up to the end of the packet, or nil when the packet does not start one
+func tsSection(data []byte, p int) []byte {
+	if data[p+1]&0x40 == 0 {
+		return nil
+	}
+	payload := tsPayload(data, p)
+	if len(payload) < 1 || 1+int(payload[0])+3 > len(payload) {
+		return nil
+	}
+	section := payload[1+int(payload[0]):]
+	sectionLength := int(binary.BigEndian.Uint16(section[1:3]) & 0x0FFF)
+	if section[1]&0x80 == 0 || 3+sectionLength > len(section) || sectionLength < 9 {
+		return nil // not a long-form section, or one spanning several packets
+	}
+	return section
+}
+
+// tsSectionEntries splits the loop of fixed size entries of a section, from start to the CRC
+func tsSectionEntries(section []byte, start, size int) [][]byte {
+	end := 3 + int(binary.BigEndian.Uint16(section[1:3])&0x0FFF) - 4
+	var entries [][]byte
+	for pos := start; pos+size <= end; pos += size {
+		entries = append(entries, section[pos:pos+size])
+	}
+	return entries
+}
+
+// tsPMTStreams returns the elementary stream entries of a PMT section, descriptors included
+func tsPMTStreams(section []byte) [][]byte {
+	end := 3 + int(binary.BigEndian.Uint16(section[1:3])&0x0FFF) - 4
+	pos := 12 + int(binary.BigEndian.Uint16(section[10:12])&0x0FFF)
+	var streams [][]byte
+	for pos+5 <= end {
+		size := 5 + int(binary.BigEndian.Uint16(section[pos+3:pos+5])&0x0FFF)
+		if pos+size > end {
+			break
+		}
+		streams = append(streams, section[pos:pos+size])
+		pos += size
+	}
+	return streams
+}
+
+// packetizeTSPES splits payload into private_stream_2 PES packets and those into TS packets
+// with continuity counters counting from zero
+func packetizeTSPES(pid int, payload []byte) [][]byte {
+	var packets [][]byte
+	cc := 0
+	for len(payload) > 0 {
+		n := min(len(payload), tsMaxPESPayload)
+		pes := make([]byte, 6, 6+n)
+		copy(pes, []byte{0, 0, 1, tsStreamIDPrivate2})
+		binary.BigEndian.PutUint16(pes[4:6], uint16(n))
+		pes = append(pes, payload[:n]...)
+		payload = payload[n:]
+
+		for first := true; len(pes) > 0; first = false {
+			packet := make([]byte, tsPacketSize)
+			packet[0] = tsSyncByte
+			packet[1] = byte(pid >> 8 & 0x1F)
+			if first {
+				packet[1] |= 0x40
+			}
+			packet[2] = byte(pid)
+
+			chunk := min(len(pes), tsPacketSize-4)
+			if chunk == tsPacketSize-4 {
+				packet[3] = 0x10 | byte(cc)
+				copy(packet[4:], pes[:chunk])
+			} else {
+				// The last packet is filled up with adaptation field stuffing
+				packet[3] = 0x30 | byte(cc)
+				afLength := tsPacketSize - 4 - chunk - 1
+				packet[4] = byte(afLength)
+				if afLength > 0 {
+					packet[5] = 0x00 // no adaptation field flags
+					for i := 6; i < 5+afLength; i++ {
+						packet[i] = 0xFF
+					}
+				}
+				copy(packet[5+afLength:], pes[:chunk])
+			}
+
+			pes = pes[chunk:]
+			cc = (cc + 1) & 0x0F
+			packets = append(packets, packet)
+		}
+	}
+	return packets
+}
+
+// writeTSNullPacket overwrites packet with a null packet
+func writeTSNullPacket(packet []byte) {
+	packet[0] = tsSyncByte
+	packet[1] = tsNullPID >> 8
+	packet[2] = tsNullPID & 0xFF
+	packet[3] = 0x10
+	for i := 4; i < len(packet); i++ {
+		packet[i] = 0xFF
+	}
+}
+
+// mpegCRC32 computes the CRC-32 used by MPEG-2 PSI sections
+func mpegCRC32(data []byte) uint32 {
+	crc := uint32(0xFFFFFFFF)
+	for _, b := range data {
+		crc = crc<<8 ^ oggCRCTable[byte(crc>>24)^b]
+	}
+	return crc
+}
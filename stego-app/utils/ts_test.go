@@ -0,0 +1,225 @@
+package utils
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+)
+
+const (
+	testTSPMTPID   = 0x100
+	testTSVideoPID = 0x101
+)
+
+// testTSSectionPacket wraps a PSI section, CRC added, into a packet on pid
+func testTSSectionPacket(pid int, section []byte) []byte {
+	section = binary.BigEndian.AppendUint32(section, mpegCRC32(section))
+	packet := bytes.Repeat([]byte{0xFF}, tsPacketSize)
+	packet[0], packet[1], packet[2], packet[3] = tsSyncByte, 0x40|byte(pid>>8), byte(pid), 0x10
+	packet[4] = 0 // pointer field
+	copy(packet[5:], section)
+	return packet
+}
+
+// testTS builds PAT, PMT, video packets and every other packet a null packet; prefix
+// adds the 4 byte M2TS timestamp before each packet
+func testTS(packets, prefix int) []byte {
+	pat := []byte{0x00, 0xB0, 13, 0x00, 0x01, 0xC1, 0x00, 0x00,
+		0x00, 0x01, 0xE0 | testTSPMTPID>>8, testTSPMTPID & 0xFF}
+	pmt := []byte{tsPMTTableID, 0xB0, 18, 0x00, 0x01, 0xC1, 0x00, 0x00,
+		0xE0 | testTSVideoPID>>8, testTSVideoPID & 0xFF, 0xF0, 0x00,
+		0x1B, 0xE0 | testTSVideoPID>>8, testTSVideoPID & 0xFF, 0xF0, 0x00}
+
+	var out []byte
+	add := func(packet []byte, i int) {
+		if prefix > 0 {
+			out = binary.BigEndian.AppendUint32(out, uint32(i*1000))
+		}
+		out = append(out, packet...)
+	}
+	add(testTSSectionPacket(tsProgramAssociation, pat), 0)
+	add(testTSSectionPacket(testTSPMTPID, pmt), 1)
+	for i := 2; i < packets; i++ {
+		packet := make([]byte, tsPacketSize)
+		if i%2 == 0 {
+			writeTSNullPacket(packet)
+		} else {
+			packet[0], packet[1], packet[2], packet[3] = tsSyncByte, testTSVideoPID>>8, testTSVideoPID&0xFF, 0x10|byte(i/2&0x0F)
+			for j := 4; j < tsPacketSize; j++ {
+				packet[j] = byte(i)
+			}
+		}
+		add(packet, i)
+	}
+	return out
+}
+
+func TestTSRoundTrip(t *testing.T) {
+	for _, prefix := range []int{0, 4} {
+		carrier := testTS(100, prefix)
+		for _, size := range []int{1, 1000, 70000} { // in null packets, appended, several PES packets
+			data := bytes.Repeat([]byte{0x55, 0xAA, 0x0F}, size)[:size]
+			for _, mode := range []string{"", TSModePID, TSModePMT} {
+				out, err := EmbedDataInTS(carrier, data, mode)
+				if err != nil {
+					t.Fatalf("prefix %d, %d bytes, %q mode: %v", prefix, size, mode, err)
+				}
+				got, err := ExtractDataFromTS(out)
+				if err != nil || !bytes.Equal(got, data) {
+					t.Fatalf("prefix %d, %d bytes, %q mode: got %d bytes, %v", prefix, size, mode, len(got), err)
+				}
+				if stream, err := parseTS(out); err != nil || stream.Prefix != prefix {
+					t.Fatalf("prefix %d, %d bytes, %q mode: stream no longer parses: %v", prefix, size, mode, err)
+				}
+				checkTSVideo(t, carrier, out)
+			}
+		}
+	}
+}
+
+// checkTSVideo checks that the packets of the video PID are unchanged and in order
+func checkTSVideo(t *testing.T, before, after []byte) {
+	t.Helper()
+	video := func(data []byte) []byte {
+		stream, _ := parseTS(data)
+		var out []byte
+		for _, p := range stream.Packets {
+			if tsPID(data, p) == testTSVideoPID {
+				out = append(out, data[p:p+tsPacketSize]...)
+			}
+		}
+		return out
+	}
+	if !bytes.Equal(video(before), video(after)) {
+		t.Fatal("video packets changed")
+	}
+}
+
+func TestTSNullPacketsKeepSize(t *testing.T) {
+	carrier := testTS(100, 0)
+	out, err := EmbedDataInTS(carrier, []byte("small"), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(out) != len(carrier) {
+		t.Fatalf("size changed from %d to %d", len(carrier), len(out))
+	}
+}
+
+func TestTSPMTAdvertisesPID(t *testing.T) {
+	out, err := EmbedDataInTS(testTS(20, 0), []byte("advertised"), TSModePMT)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stream, _ := parseTS(out)
+	pid, _ := findTSPayloadPID(out, stream)
+	for _, p := range stream.Packets {
+		section := tsSection(out, p)
+		if section == nil || section[0] != tsPMTTableID {
+			continue
+		}
+		end := 3 + int(binary.BigEndian.Uint16(section[1:3])&0x0FFF)
+		if mpegCRC32(section[:end-4]) != binary.BigEndian.Uint32(section[end-4:end]) {
+			t.Fatal("PMT CRC does not match")
+		}
+		for _, es := range tsPMTStreams(section) {
+			if int(binary.BigEndian.Uint16(es[1:3])&0x1FFF) == pid && es[0] == tsStreamTypePrivate {
+				return
+			}
+		}
+	}
+	t.Fatal("payload PID not listed in the PMT")
+}
+
+func TestTSReembedAcrossModes(t *testing.T) {
+	out := testTS(60, 0)
+	modes := []string{TSModePMT, TSModePID, TSModePID, TSModePMT, TSModePMT}
+	for i, mode := range modes {
+		data := bytes.Repeat([]byte{byte('a' + i)}, 300+700*(i%2))
+		var err error
+		out, err = EmbedDataInTS(out, data, mode)
+		if err != nil {
+			t.Fatalf("step %d (%s): %v", i, mode, err)
+		}
+		got, err := ExtractDataFromTS(out)
+		if err != nil || !bytes.Equal(got, data) {
+			t.Fatalf("step %d (%s): got %d bytes, %v", i, mode, len(got), err)
+		}
+		if i > 0 && bytes.Contains(out, bytes.Repeat([]byte{byte('a' + i - 1)}, 100)) {
+			t.Fatalf("step %d (%s): previous payload left in the stream", i, mode)
+		}
+	}
+}
+
+func TestTSTruncatedLastPacket(t *testing.T) {
+	for _, prefix := range []int{0, 4} {
+		tail := append(make([]byte, prefix), tsSyncByte, 0x01, 0x01, 0x10, 0xAB)
+		carrier := append(testTS(30, prefix), tail...)
+		if !IsTS(carrier) {
+			t.Fatalf("prefix %d: stream with a truncated last packet not recognized", prefix)
+		}
+		out, err := EmbedDataInTS(carrier, bytes.Repeat([]byte("x"), 5000), "")
+		if err != nil {
+			t.Fatalf("prefix %d: %v", prefix, err)
+		}
+		if !bytes.HasSuffix(out, tail) {
+			t.Fatalf("prefix %d: truncated packet not kept at the end", prefix)
+		}
+		if got, err := ExtractDataFromTS(out); err != nil || len(got) != 5000 {
+			t.Fatalf("prefix %d: got %d bytes, %v", prefix, len(got), err)
+		}
+	}
+}
+
+func TestTSMalformed(t *testing.T) {
+	carrier := testTS(20, 0)
+	if IsTS([]byte("G not a transport stream")) {
+		t.Error("short data recognized")
+	}
+	bad := bytes.Clone(carrier)
+	bad[5*tsPacketSize] = 0x00
+	if IsTS(bad) {
+		t.Error("stream with a lost sync byte recognized")
+	}
+	bad = append(bytes.Clone(carrier), 0x00, 0x01, 0x02)
+	if IsTS(bad) {
+		t.Error("stream followed by garbage recognized")
+	}
+	if _, err := EmbedDataInTS(carrier, []byte("x"), "sdt"); err == nil {
+		t.Error("invalid mode accepted")
+	}
+	if _, err := EmbedDataInTS(carrier, nil, ""); err == nil {
+		t.Error("empty data accepted")
+	}
+	if _, err := ExtractDataFromTS(carrier); err == nil {
+		t.Error("clean stream extracted")
+	}
+
+	// A packet lost from the payload PID is reported
+	out, err := EmbedDataInTS(carrier, bytes.Repeat([]byte("y"), 2000), TSModePID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stream, _ := parseTS(out)
+	pid, _ := findTSPayloadPID(out, stream)
+	var lossy []byte
+	dropped := false
+	for _, p := range stream.Packets {
+		if tsPID(out, p) == pid && out[p+1]&0x40 == 0 && !dropped {
+			dropped = true
+			continue
+		}
+		lossy = append(lossy, out[p:p+tsPacketSize]...)
+	}
+	if _, err := ExtractDataFromTS(lossy); err == nil {
+		t.Error("stream with a lost payload packet extracted")
+	}
+
+	// A PMT section filling its packet has no room for another stream entry
+	full := testTS(20, 0)
+	section := tsSection(full, tsPacketSize)
+	binary.BigEndian.PutUint16(section[1:3], 0xB000|uint16(tsPacketSize-5-3-2))
+	if _, err := EmbedDataInTS(full, []byte("x"), TSModePMT); err == nil {
+		t.Error("pmt mode accepted without room in the PMT")
+	}
+}
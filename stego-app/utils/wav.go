@@ -0,0 +1,142 @@
+package utils
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+// WAV format tags
+const (
+	wavFormatPCM        = 0x0001
+	wavFormatExtensible = 0xFFFE
+)
+
+// wavInfo holds the parts of a WAV file needed for sample embedding
+type wavInfo struct {
+	Channels      int
+	SampleRate    int
+	BitsPerSample int // container size of a sample
+	ValidBits     int // bits actually used, left-justified in the container
+	DataStart     int // offset of the first sample byte
+	DataEnd       int
+}
+
+// IsWAV reports whether data is a RIFF/WAVE file
+func IsWAV(data []byte) bool {
+	return len(data) >= 12 && string(data[:4]) == "RIFF" && string(data[8:12]) == "WAVE"
+}
+
+// EmbedDataInWAV embeds data into the sample LSBs of a PCM WAV file
+func EmbedDataInWAV(wavData []byte, data []byte, opts AudioOptions) ([]byte, error) {
+	if len(data) == 0 {
+		return nil, errors.New("data to embed cannot be empty")
+	}
+
+	if len(data) > MaxDataSize {
+		return nil, fmt.Errorf("data too large: %d bytes, max allowed: %d bytes", len(data), MaxDataSize)
+	}
+
+	info, err := parseWAV(wavData)
+	if err != nil {
+		return nil, err
+	}
+
+	result := make([]byte, len(wavData))
+	copy(result, wavData)
+
+	pcm, err := info.pcm(result)
+	if err != nil {
+		return nil, err
+	}
+	if err := pcm.embed(data, opts); err != nil {
+		return nil, err
+	}
+
+	return result, nil
+}
+
+// ExtractDataFromWAV extracts data from the sample LSBs of a PCM WAV file
+func ExtractDataFromWAV(wavData []byte, opts AudioOptions) ([]byte, error) {
+	info, err := parseWAV(wavData)
+	if err != nil {
+		return nil, err
+	}
+
+	pcm, err := info.pcm(wavData)
+	if err != nil {
+		return nil, err
+	}
+	return pcm.extract(opts)
+}
+
+// pcm returns a sample view on the data chunk of wavData
+func (info *wavInfo) pcm(wavData []byte) (*pcmAudio, error) {
+	pcm, err := newPCMAudio(wavData[info.DataStart:info.DataEnd], info.Channels, info.BitsPerSample, false)
+	if err != nil {
+		return nil, err
+	}
+	// WAV samples are left-justified in their container, the low bits below the valid
+	// bits are padding; 8-bit samples are unsigned
+	pcm.LSBShift = pcm.BytesPerSample*8 - info.ValidBits
+	pcm.Unsigned = pcm.BytesPerSample == 1
+	return pcm, nil
+}
+
+// parseWAV walks the RIFF chunks of a WAV file and locates "fmt " and "data"
+func parseWAV(data []byte) (*wavInfo, error) {
+	if !IsWAV(data) {
+		return nil, errors.New("not a wav file")
+	}
+
+	info := &wavInfo{}
+	var haveFmt, haveData bool
+
+	pos := 12
+	for pos+8 <= len(data) {
+		id := string(data[pos : pos+4])
+		size := int(binary.LittleEndian.Uint32(data[pos+4 : pos+8]))
+		body := pos + 8
+		if body+size > len(data) {
+			if id != "data" {
+				return nil, fmt.Errorf("truncated wav chunk %q", id)
+			}
+			size = len(data) - body // streaming writers leave the data size unset
+		}
+
+		switch id {
+		case "fmt ":
+			if size < 16 {
+				return nil, errors.New("invalid wav fmt chunk")
+			}
+			c := data[body : body+size]
+			format := binary.LittleEndian.Uint16(c[0:2])
+			info.Channels = int(binary.LittleEndian.Uint16(c[2:4]))
+			info.SampleRate = int(binary.LittleEndian.Uint32(c[4:8]))
+			info.BitsPerSample = int(binary.LittleEndian.Uint16(c[14:16]))
+			info.ValidBits = info.BitsPerSample
+			if format == wavFormatExtensible && size >= 26 {
+				format = binary.LittleEndian.Uint16(c[24:26]) // first two bytes of the sub-format GUID
+				if valid := int(binary.LittleEndian.Uint16(c[18:20])); valid > 0 && valid < info.BitsPerSample {
+					info.ValidBits = valid // wValidBitsPerSample
+				}
+			}
+			if format != wavFormatPCM {
+				return nil, fmt.Errorf("unsupported wav format tag 0x%04x, only PCM is supported", format)
+			}
+			haveFmt = true
+		case "data":
+			info.DataStart = body
+			info.DataEnd = body + size
+			haveData = true
+		}
+
+		pos = body + size + size%2 // chunks are padded to an even length
+	}
+
+	if !haveFmt || !haveData {
+		return nil, errors.New("wav file is missing fmt or data chunk")
+	}
+
+	return info, nil
+}
@@ -0,0 +1,220 @@
+package utils
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math"
+	"testing"
+)
+
+// testWAV builds a PCM WAV file of a sine per channel. validBits below the container
+// size writes WAVE_FORMAT_EXTENSIBLE with left-justified samples.
+func testWAV(channels, bits, validBits, frames int) []byte {
+	bytesPerSample := (bits + 7) / 8
+	var samples []byte
+	for f := 0; f < frames; f++ {
+		for ch := 0; ch < channels; ch++ {
+			v := int64(math.Sin(float64(f*(ch+1))/10) * float64(int64(1)<<(validBits-2)))
+			if bits == 8 {
+				v += 128
+			}
+			u := uint64(v) << (bytesPerSample*8 - validBits)
+			for k := 0; k < bytesPerSample; k++ {
+				samples = append(samples, byte(u>>(8*k)))
+			}
+		}
+	}
+
+	fmtChunk := binary.LittleEndian.AppendUint16(nil, wavFormatPCM)
+	if validBits != bits {
+		fmtChunk = binary.LittleEndian.AppendUint16(nil, wavFormatExtensible)
+	}
+	fmtChunk = binary.LittleEndian.AppendUint16(fmtChunk, uint16(channels))
+	fmtChunk = binary.LittleEndian.AppendUint32(fmtChunk, 44100)
+	fmtChunk = binary.LittleEndian.AppendUint32(fmtChunk, uint32(44100*channels*bytesPerSample))
+	fmtChunk = binary.LittleEndian.AppendUint16(fmtChunk, uint16(channels*bytesPerSample))
+	fmtChunk = binary.LittleEndian.AppendUint16(fmtChunk, uint16(bits))
+	if validBits != bits {
+		fmtChunk = binary.LittleEndian.AppendUint16(fmtChunk, 22)
+		fmtChunk = binary.LittleEndian.AppendUint16(fmtChunk, uint16(validBits))
+		fmtChunk = binary.LittleEndian.AppendUint32(fmtChunk, 0) // channel mask
+		fmtChunk = binary.LittleEndian.AppendUint16(fmtChunk, wavFormatPCM)
+		fmtChunk = append(fmtChunk, "\x00\x00\x00\x00\x10\x00\x80\x00\x00\xAA\x00\x38\x9B\x71"...)
+	}
+
+	body := append([]byte("WAVE"), riffTestChunk("fmt ", fmtChunk)...)
+	body = append(body, riffTestChunk("LIST", []byte("INFOISFT\x05\x00\x00\x00test\x00\x00"))...)
+	body = append(body, riffTestChunk("data", samples)...)
+	return riffTestChunk("RIFF", body)
+}
+
+func TestWAVRoundTrip(t *testing.T) {
+	tests := []struct {
+		name                  string
+		channels, bits, valid int
+		paddingMask, lsbMask  uint64 // bits of each sample that must stay zero, bit carrying the payload
+	}{
+		{"8-bit", 1, 8, 8, 0, 1},
+		{"16-bit stereo", 2, 16, 16, 0, 1},
+		{"24-bit", 2, 24, 24, 0, 1},
+		{"20 in 24", 2, 24, 20, 0x0F, 1 << 4},
+		{"24 in 32", 1, 32, 24, 0xFF, 1 << 8},
+		{"12 in 32", 1, 32, 12, 0xFFFFF, 1 << 20},
+	}
+	for _, tt := range tests {
+		carrier := testWAV(tt.channels, tt.bits, tt.valid, 4000)
+		data := bytes.Repeat([]byte{0xA5}, 300)
+		out, err := EmbedDataInWAV(carrier, data, AudioOptions{})
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		got, err := ExtractDataFromWAV(out, AudioOptions{})
+		if err != nil || !bytes.Equal(got, data) {
+			t.Fatalf("%s: got %d bytes, %v", tt.name, len(got), err)
+		}
+
+		info, _ := parseWAV(out)
+		size := (tt.bits + 7) / 8
+		changed := 0
+		for i := info.DataStart; i < info.DataEnd; i += size {
+			var before, after uint64
+			for k := size - 1; k >= 0; k-- {
+				before = before<<8 | uint64(carrier[i+k])
+				after = after<<8 | uint64(out[i+k])
+			}
+			if after&tt.paddingMask != 0 {
+				t.Fatalf("%s: padding bits below the valid bits written", tt.name)
+			}
+			if d := before ^ after; d != 0 && d != tt.lsbMask {
+				t.Fatalf("%s: sample changed by %x", tt.name, d)
+			} else if d != 0 {
+				changed++
+			}
+		}
+		if changed == 0 {
+			t.Fatalf("%s: no sample changed", tt.name)
+		}
+		if !bytes.Equal(carrier[:info.DataStart], out[:info.DataStart]) {
+			t.Fatalf("%s: chunks before the samples changed", tt.name)
+		}
+	}
+}
+
+func TestWAVChannelsAndSpread(t *testing.T) {
+	carrier := testWAV(4, 16, 16, 3000)
+	data := bytes.Repeat([]byte("channels"), 40)
+	for _, opts := range []AudioOptions{
+		{Channels: []int{2}},
+		{Channels: []int{3, 1}},
+		{Spread: true},
+		{Channels: []int{0, 3}, Spread: true},
+	} {
+		out, err := EmbedDataInWAV(carrier, data, opts)
+		if err != nil {
+			t.Fatalf("%+v: %v", opts, err)
+		}
+		if got, err := ExtractDataFromWAV(out, opts); err != nil || !bytes.Equal(got, data) {
+			t.Fatalf("%+v: got %d bytes, %v", opts, len(got), err)
+		}
+		// The extractor finds the layout without options
+		if got, err := ExtractDataFromWAV(out, AudioOptions{}); err != nil || !bytes.Equal(got, data) {
+			t.Fatalf("%+v, no options: got %d bytes, %v", opts, len(got), err)
+		}
+		if len(opts.Channels) == 1 {
+			info, _ := parseWAV(out)
+			for i := info.DataStart; i < info.DataEnd; i += 2 {
+				if ch := (i - info.DataStart) / 2 % 4; ch != opts.Channels[0] && out[i] != carrier[i] {
+					t.Fatalf("%+v: channel %d changed", opts, ch)
+				}
+			}
+		}
+	}
+}
+
+func TestWAVSkipsSilence(t *testing.T) {
+	carrier := testWAV(1, 16, 16, 2000)
+	info, _ := parseWAV(carrier)
+	silent := info.DataStart + 2*500
+	clear(carrier[silent : silent+2*1000])
+
+	out, err := EmbedDataInWAV(carrier, bytes.Repeat([]byte("s"), 100), AudioOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(out[silent:silent+2*1000], carrier[silent:silent+2*1000]) {
+		t.Fatal("digital silence changed")
+	}
+	if got, err := ExtractDataFromWAV(out, AudioOptions{}); err != nil || len(got) != 100 {
+		t.Fatalf("got %d bytes, %v", len(got), err)
+	}
+}
+
+func TestWAVReembed(t *testing.T) {
+	carrier := testWAV(2, 16, 16, 3000)
+	first, err := EmbedDataInWAV(carrier, bytes.Repeat([]byte("first"), 50), AudioOptions{Channels: []int{1}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := EmbedDataInWAV(first, []byte("second"), AudioOptions{Spread: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, err := ExtractDataFromWAV(second, AudioOptions{Spread: true}); err != nil || string(got) != "second" {
+		t.Fatalf("got %q, %v", got, err)
+	}
+}
+
+func TestWAVStreamingDataSize(t *testing.T) {
+	// Streaming writers leave the data size at its maximum
+	carrier := testWAV(1, 16, 16, 2000)
+	info, _ := parseWAV(carrier)
+	binary.LittleEndian.PutUint32(carrier[info.DataStart-4:], 0xFFFFFFFF)
+	out, err := EmbedDataInWAV(carrier, []byte("stream"), AudioOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, err := ExtractDataFromWAV(out, AudioOptions{}); err != nil || string(got) != "stream" {
+		t.Fatalf("got %q, %v", got, err)
+	}
+}
+
+func TestWAVMalformed(t *testing.T) {
+	carrier := testWAV(2, 16, 16, 1000)
+	if _, err := EmbedDataInWAV(carrier, make([]byte, 1000), AudioOptions{}); err == nil {
+		t.Error("data larger than the capacity accepted")
+	}
+	for _, channels := range [][]int{{2}, {-1}, {1, 1}} {
+		if _, err := EmbedDataInWAV(carrier, []byte("x"), AudioOptions{Channels: channels}); err == nil {
+			t.Errorf("channels %v accepted", channels)
+		}
+	}
+
+	float := bytes.Clone(carrier)
+	binary.LittleEndian.PutUint16(float[20:], 3) // WAVE_FORMAT_IEEE_FLOAT
+	noData := bytes.Replace(carrier, []byte("data"), []byte("skip"), 1)
+	zeroChannels := bytes.Clone(carrier)
+	binary.LittleEndian.PutUint16(zeroChannels[22:], 0)
+	wideSamples := bytes.Clone(carrier)
+	binary.LittleEndian.PutUint16(wideSamples[34:], 64)
+	shortFmt := bytes.Clone(carrier)
+	binary.LittleEndian.PutUint32(shortFmt[16:], 8)
+	for name, bad := range map[string][]byte{
+		"float":         float,
+		"no data":       noData,
+		"zero channels": zeroChannels,
+		"64-bit":        wideSamples,
+		"short fmt":     shortFmt,
+		"truncated fmt": carrier[:30],
+		"not riff":      []byte("RIFX\x00\x00\x00\x00WAVE"),
+	} {
+		if _, err := EmbedDataInWAV(bad, []byte("x"), AudioOptions{}); err == nil {
+			t.Errorf("%s accepted", name)
+		}
+		if _, err := ExtractDataFromWAV(bad, AudioOptions{}); err == nil {
+			t.Errorf("%s extracted", name)
+		}
+	}
+	if _, err := ExtractDataFromWAV(carrier, AudioOptions{}); err == nil {
+		t.Error("clean file extracted")
+	}
+}
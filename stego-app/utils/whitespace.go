@@ -0,0 +1,143 @@
+package utils
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// In whitespace mode the payload bits go at the end of the cover lines, a space for 0 and
+// a tab for 1, like SNOW. Everything after the last visible character of a line belongs to
+// the payload, so covers that already end lines with whitespace are refused: it can be
+// significant (Markdown hard line breaks, multi-line string literals) and would be lost.
+// Whitespace of an earlier payload is ours and is replaced. Only lines ending with a line
+// break are used, editors often trim the end of the last line.
+
+// whitespaceMaxPerLine is the most payload bits written after a single line
+const whitespaceMaxPerLine = 64
+
+// embedWhitespace writes data as trailing spaces and tabs, spread evenly over the lines
+func embedWhitespace(cover string, data []byte) (string, error) {
+	lines := strings.SplitAfter(cover, "\n")
+	usable := whitespaceLines(lines)
+	if err := whitespaceEstimate(cover).checkCapacity(len(data)); err != nil {
+		return "", err
+	}
+	if n := coverTrailingWhitespace(cover, lines); n > 0 {
+		return "", fmt.Errorf("cover text already has trailing whitespace on %d line(s), which can be significant "+
+			"(Markdown line breaks, multi-line strings); remove it first or use %s mode", n, TextModeZeroWidth)
+	}
+
+	bits := bytesToBits(prepareDataWithHeader(data))
+	perLine := (len(bits) + usable - 1) / usable
+
+	var out strings.Builder
+	out.Grow(len(cover) + len(bits))
+	for _, line := range lines {
+		body, ending := splitLineEnding(line)
+		out.WriteString(strings.TrimRight(body, " \t"))
+		if ending != "" {
+			n := min(perLine, len(bits))
+			for _, bit := range bits[:n] {
+				if bit == 1 {
+					out.WriteByte('\t')
+				} else {
+					out.WriteByte(' ')
+				}
+			}
+			bits = bits[n:]
+		}
+		out.WriteString(ending)
+	}
+	return out.String(), nil
+}
+
+// extractWhitespace reads the trailing spaces and tabs of every line back as bits.
+// Line endings are normalized first, so CRLF and CR-only files read the same.
+func extractWhitespace(text string) ([]byte, error) {
+	text = strings.ReplaceAll(text, "\r\n", "\n")
+	text = strings.ReplaceAll(text, "\r", "\n")
+
+	var bits []uint8
+	for _, line := range strings.Split(text, "\n") {
+		trimmed := strings.TrimRight(line, " \t")
+		for _, c := range []byte(line[len(trimmed):]) {
+			if c == '\t' {
+				bits = append(bits, 1)
+			} else {
+				bits = append(bits, 0)
+			}
+		}
+	}
+	if len(bits) == 0 {
+		return nil, errors.New("no trailing whitespace found in text")
+	}
+	return parseHeaderedData(bitsToBytes(bits))
+}
+
+// stripWhitespacePayload removes the trailing whitespace of every line when it holds a payload
+func stripWhitespacePayload(text string) string {
+	if _, err := extractWhitespace(text); err != nil {
+		return text
+	}
+	lines := strings.SplitAfter(text, "\n")
+	for i, line := range lines {
+		body, ending := splitLineEnding(line)
+		lines[i] = strings.TrimRight(body, " \t") + ending
+	}
+	return strings.Join(lines, "")
+}
+
+// whitespaceEstimate reports the capacity of a cover text in whitespace mode
+func whitespaceEstimate(cover string) CapacityEstimate {
+	lines := strings.SplitAfter(cover, "\n")
+	usable := whitespaceLines(lines)
+	estimate := newEstimate("text", TextModeWhitespace, usable*whitespaceMaxPerLine/8, fmt.Sprintf(
+		"up to %d trailing spaces or tabs, 1 bit each, after each of %d line(s) ending with a line break",
+		whitespaceMaxPerLine, usable))
+	if n := coverTrailingWhitespace(cover, lines); n > 0 {
+		estimate.Warning = fmt.Sprintf("%d line(s) already end with whitespace, the cover is refused "+
+			"until it is removed", n)
+	}
+	return estimate
+}
+
+// coverTrailingWhitespace counts the lines ending with whitespace that is not part of an
+// earlier payload
+func coverTrailingWhitespace(cover string, lines []string) int {
+	n := 0
+	for _, line := range lines {
+		body, _ := splitLineEnding(line)
+		if strings.TrimRight(body, " \t") != body {
+			n++
+		}
+	}
+	if n > 0 {
+		if _, err := extractWhitespace(cover); err == nil {
+			return 0
+		}
+	}
+	return n
+}
+
+// whitespaceLines counts the lines that can carry bits
+func whitespaceLines(lines []string) int {
+	n := 0
+	for _, line := range lines {
+		if _, ending := splitLineEnding(line); ending != "" {
+			n++
+		}
+	}
+	return n
+}
+
+// splitLineEnding splits a line into its content and its "\n" or "\r\n" ending
+func splitLineEnding(line string) (string, string) {
+	if body, ok := strings.CutSuffix(line, "\r\n"); ok {
+		return body, "\r\n"
+	}
+	if body, ok := strings.CutSuffix(line, "\n"); ok {
+		return body, "\n"
+	}
+	return line, ""
+}
@@ -0,0 +1,108 @@
+package utils
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+var whitespaceCover = strings.Repeat("A line of the cover text.\n", 50)
+
+func TestWhitespaceRoundTrip(t *testing.T) {
+	for _, size := range []int{1, 50, 380} {
+		data := bytes.Repeat([]byte{0xC3, 0x01}, size)[:size]
+		out, err := embedWhitespace(whitespaceCover, data)
+		if err != nil {
+			t.Fatalf("%d bytes: %v", size, err)
+		}
+		if stripWhitespacePayload(out) != whitespaceCover {
+			t.Fatalf("%d bytes: visible text changed", size)
+		}
+		got, err := extractWhitespace(out)
+		if err != nil || !bytes.Equal(got, data) {
+			t.Fatalf("%d bytes: got %d bytes, %v", size, len(got), err)
+		}
+	}
+}
+
+func TestWhitespaceLineEndings(t *testing.T) {
+	cover := strings.ReplaceAll(whitespaceCover, "\n", "\r\n")
+	out, err := embedWhitespace(cover, []byte("crlf"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Count(out, "\r\n") != strings.Count(cover, "\r\n") {
+		t.Fatal("line endings changed")
+	}
+	for name, text := range map[string]string{
+		"crlf": out,
+		"lf":   strings.ReplaceAll(out, "\r\n", "\n"),
+		"cr":   strings.ReplaceAll(out, "\r\n", "\r"),
+	} {
+		if got, err := extractWhitespace(text); err != nil || string(got) != "crlf" {
+			t.Errorf("%s: got %q, %v", name, got, err)
+		}
+	}
+}
+
+func TestWhitespaceSkipsLastLineWithoutBreak(t *testing.T) {
+	cover := whitespaceCover + "no line break"
+	out, err := embedWhitespace(cover, []byte("x"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasSuffix(out, "\nno line break") {
+		t.Fatal("last line without line break changed")
+	}
+}
+
+func TestWhitespaceRefusesSignificantWhitespace(t *testing.T) {
+	// Two trailing spaces are a hard line break in Markdown
+	cover := "First line  \nsecond line\n" + whitespaceCover
+	if _, err := embedWhitespace(cover, []byte("x")); err == nil {
+		t.Fatal("cover with trailing whitespace accepted")
+	}
+	if whitespaceEstimate(cover).Warning == "" {
+		t.Fatal("no warning for a cover with trailing whitespace")
+	}
+
+	// Whitespace of an earlier payload is replaced
+	first, err := embedWhitespace(whitespaceCover, []byte("first payload"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if whitespaceEstimate(first).Warning != "" {
+		t.Fatal("warning for the whitespace of a payload")
+	}
+	second, err := embedWhitespace(first, []byte("second"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, err := extractWhitespace(second); err != nil || string(got) != "second" {
+		t.Fatalf("got %q, %v", got, err)
+	}
+}
+
+func TestWhitespaceMalformed(t *testing.T) {
+	if _, err := embedWhitespace("one line\n", make([]byte, 100)); err == nil {
+		t.Error("data larger than the capacity accepted")
+	}
+	if _, err := embedWhitespace("no line break", []byte("x")); err == nil {
+		t.Error("cover without line break accepted")
+	}
+	if _, err := extractWhitespace(whitespaceCover); err == nil {
+		t.Error("plain text extracted")
+	}
+
+	out, err := embedWhitespace(whitespaceCover, []byte("truncated payload"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(out, "\n")
+	if _, err := extractWhitespace(strings.Join(lines[:len(lines)/2], "\n")); err == nil {
+		t.Error("truncated payload extracted")
+	}
+	if _, err := extractWhitespace(strings.ReplaceAll(out, "\t", " ")); err == nil {
+		t.Error("payload with tabs expanded extracted")
+	}
+}
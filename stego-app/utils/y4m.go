@@ -0,0 +1,281 @@
+package utils
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"iter"
+	"math/rand/v2"
+	"strconv"
+	"strings"
+)
+
+// Y4MModeLSB embeds into the luma/chroma sample LSBs of raw YUV4MPEG2 frames
+const Y4MModeLSB = "lsb"
+
+const y4mSignature = "YUV4MPEG2 "
+
+// y4mVideo describes the frame layout of a YUV4MPEG2 stream
+type y4mVideo struct {
+	Width, Height  int
+	BytesPerSample int   // 1 for 8-bit, 2 (little-endian) for higher bit depths
+	PlaneSamples   int   // Y + Cb + Cr samples per frame, alpha excluded
+	FrameSize      int   // bytes of sample data per frame, alpha included
+	Frames         []int // offset of the sample data of each frame
+}
+
+// IsY4M reports whether data is a YUV4MPEG2 stream
+func IsY4M(data []byte) bool {
+	return bytes.HasPrefix(data, []byte(y4mSignature))
+}
+
+// EmbedDataInY4M embeds data into the sample LSBs of the chosen frames of a Y4M stream.
+// Within each frame the samples are visited in an order keyed by the passphrase and
+// the frame index, and frames are filled one after another.
+func EmbedDataInY4M(y4mData []byte, data []byte, opts VideoOptions) ([]byte, error) {
+	if len(data) == 0 {
+		return nil, errors.New("data to embed cannot be empty")
+	}
+
+	if len(data) > MaxDataSize {
+		return nil, fmt.Errorf("data too large: %d bytes, max allowed: %d bytes", len(data), MaxDataSize)
+	}
+
+	if opts.Mode != "" && opts.Mode != Y4MModeLSB {
+		return nil, fmt.Errorf("invalid y4m mode %q. Must be: %s", opts.Mode, Y4MModeLSB)
+	}
+
+	video, err := parseY4M(y4mData)
+	if err != nil {
+		return nil, err
+	}
+	frames, err := video.selectFrames(opts.Frames)
+	if err != nil {
+		return nil, err
+	}
+
+	dataWithHeader := prepareDataWithHeader(data)
+	capacity := len(frames) * video.PlaneSamples / 8
+	if len(dataWithHeader) > capacity {
+		return nil, fmt.Errorf("y4m frames too small to embed data: need %d bytes, have %d bytes capacity",
+			len(dataWithHeader), capacity)
+	}
+
+	result := make([]byte, len(y4mData))
+	copy(result, y4mData)
+	embedBitsLSB(result, video.positions(frames, opts.Passphrase), bytesToBits(dataWithHeader))
+
+	return result, nil
+}
+
+// ExtractDataFromY4M extracts data embedded by EmbedDataInY4M; frames and passphrase must match
+func ExtractDataFromY4M(y4mData []byte, opts VideoOptions) ([]byte, error) {
+	video, err := parseY4M(y4mData)
+	if err != nil {
+		return nil, err
+	}
+	frames, err := video.selectFrames(opts.Frames)
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := extractHeaderedLSB(y4mData, video.positions(frames, opts.Passphrase))
+	if err != nil {
+		return nil, errors.New("no embedded data found in y4m frames")
+	}
+	return data, nil
+}
+
+// CalculateY4MCapacity returns how many bytes fit into the chosen frames of a Y4M stream
+func CalculateY4MCapacity(y4mData []byte, frames []int) int {
+	video, err := parseY4M(y4mData)
+	if err != nil {
+		return 0
+	}
+	selected, err := video.selectFrames(frames)
+	if err != nil {
+		return 0
+	}
+	return max(0, len(selected)*video.PlaneSamples/8-8) // Reserve 8 bytes for header
+}
+
+// selectFrames validates the requested frame indices; none means every frame
+func (v *y4mVideo) selectFrames(frames []int) ([]int, error) {
+	if len(frames) == 0 {
+		all := make([]int, len(v.Frames))
+		for i := range all {
+			all[i] = i
+		}
+		return all, nil
+	}
+
+	seen := make(map[int]bool, len(frames))
+	for _, f := range frames {
+		if f < 0 || f >= len(v.Frames) {
+			return nil, fmt.Errorf("frame %d out of range, video has %d frames", f, len(v.Frames))
+		}
+		if seen[f] {
+			return nil, fmt.Errorf("frame %d selected twice", f)
+		}
+		seen[f] = true
+	}
+	return frames, nil
+}
+
+// positions yields the file offsets of the carrier bytes of the given frames.
+// For samples wider than 8 bits that is the low byte of the little-endian sample.
+func (v *y4mVideo) positions(frames []int, passphrase string) iter.Seq[int] {
+	return func(yield func(int) bool) {
+		for _, f := range frames {
+			start := v.Frames[f]
+			for s := range keyedPermutation(v.PlaneSamples, y4mFrameSeed(passphrase, f)) {
+				if !yield(start + s*v.BytesPerSample) {
+					return
+				}
+			}
+		}
+	}
+}
+
+// y4mFrameSeed derives the sample order seed of a frame from the passphrase
+func y4mFrameSeed(passphrase string, frame int) [32]byte {
+	mac := hmac.New(sha256.New, []byte(passphrase))
+	mac.Write([]byte("y4m-frame"))
+	binary.Write(mac, binary.LittleEndian, uint64(frame))
+
+	var seed [32]byte
+	copy(seed[:], mac.Sum(nil))
+	return seed
+}
+
+// keyedPermutation yields the integers [0, n) in a pseudo-random order derived from seed.
+// It runs a Fisher-Yates shuffle lazily, so memory grows with the values consumed, not with n.
+func keyedPermutation(n int, seed [32]byte) iter.Seq[int] {
+	return func(yield func(int) bool) {
+		rng := rand.New(rand.NewChaCha8(seed))
+		swapped := make(map[int]int)
+		at := func(i int) int {
+			if v, ok := swapped[i]; ok {
+				return v
+			}
+			return i
+		}
+
+		for i := 0; i < n; i++ {
+			j := i + rng.IntN(n-i)
+			vi, vj := at(i), at(j)
+			swapped[j] = vi
+			delete(swapped, i)
+			if !yield(vj) {
+				return
+			}
+		}
+	}
+}
+
+// parseY4M parses the stream header and locates the sample data of every frame
+func parseY4M(data []byte) (*y4mVideo, error) {
+	if !IsY4M(data) {
+		return nil, errors.New("not a y4m file")
+	}
+
+	end := bytes.IndexByte(data, '\n')
+	if end < 0 {
+		return nil, errors.New("invalid y4m header")
+	}
+
+	video := &y4mVideo{}
+	colorspace := "420jpeg"
+	for _, param := range strings.Fields(string(data[len(y4mSignature):end])) {
+		value := param[1:]
+		var err error
+		switch param[0] {
+		case 'W':
+			video.Width, err = strconv.Atoi(value)
+		case 'H':
+			video.Height, err = strconv.Atoi(value)
+		case 'C':
+			colorspace = value
+		}
+		if err != nil {
+			return nil, fmt.Errorf("invalid y4m header parameter %q", param)
+		}
+	}
+	if video.Width <= 0 || video.Height <= 0 {
+		return nil, errors.New("y4m header is missing frame dimensions")
+	}
+	// A frame has at least one byte per luma sample, so larger dimensions cannot fit and
+	// would overflow the frame size
+	if video.Width > len(data) || video.Height > len(data)/video.Width {
+		return nil, fmt.Errorf("y4m frame size %dx%d is larger than the file", video.Width, video.Height)
+	}
+
+	// Chroma plane size and sample depth follow from the colorspace, e.g. 420jpeg, 422p10, mono16
+	luma := video.Width * video.Height
+	var chroma, alpha int
+	switch {
+	case strings.HasPrefix(colorspace, "420"):
+		chroma = 2 * ((video.Width + 1) / 2) * ((video.Height + 1) / 2)
+	case strings.HasPrefix(colorspace, "422"):
+		chroma = 2 * ((video.Width + 1) / 2) * video.Height
+	case colorspace == "444alpha":
+		chroma, alpha = 2*luma, luma
+	case strings.HasPrefix(colorspace, "444"):
+		chroma = 2 * luma
+	case strings.HasPrefix(colorspace, "411"):
+		chroma = 2 * ((video.Width + 3) / 4) * video.Height
+	case strings.HasPrefix(colorspace, "mono"):
+	default:
+		return nil, fmt.Errorf("unsupported y4m colorspace %q", colorspace)
+	}
+	depth := y4mBitDepth(colorspace)
+	if depth < 8 || depth > 16 {
+		return nil, fmt.Errorf("unsupported y4m bit depth %d", depth)
+	}
+
+	video.BytesPerSample = 1
+	if depth > 8 {
+		video.BytesPerSample = 2
+	}
+	video.PlaneSamples = luma + chroma
+	video.FrameSize = (luma + chroma + alpha) * video.BytesPerSample
+
+	pos := end + 1
+	for pos < len(data) {
+		if !bytes.HasPrefix(data[pos:], []byte("FRAME")) {
+			return nil, fmt.Errorf("invalid y4m frame header at offset %d", pos)
+		}
+		lineEnd := bytes.IndexByte(data[pos:], '\n')
+		if lineEnd < 0 {
+			return nil, errors.New("truncated y4m frame header")
+		}
+		start := pos + lineEnd + 1
+		if start+video.FrameSize > len(data) {
+			return nil, fmt.Errorf("truncated y4m frame %d", len(video.Frames))
+		}
+		video.Frames = append(video.Frames, start)
+		pos = start + video.FrameSize
+	}
+	if len(video.Frames) == 0 {
+		return nil, errors.New("y4m file contains no frames")
+	}
+
+	return video, nil
+}
+
+// y4mBitDepth returns the sample depth encoded in a colorspace such as 420p10 or mono16
+func y4mBitDepth(colorspace string) int {
+	suffix := ""
+	if strings.HasPrefix(colorspace, "mono") {
+		suffix = colorspace[4:]
+	} else if i := strings.LastIndexByte(colorspace, 'p'); i >= 0 {
+		suffix = colorspace[i+1:]
+	}
+	if d, err := strconv.Atoi(suffix); err == nil {
+		return d
+	}
+	return 8
+}
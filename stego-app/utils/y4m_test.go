@@ -0,0 +1,155 @@
+package utils
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+)
+
+// testY4M builds a stream of frames of frameSize bytes, samples filled with a pattern
+func testY4M(width, height, frames, frameSize int, colorspace string) []byte {
+	out := []byte(fmt.Sprintf("YUV4MPEG2 W%d H%d F25:1 Ip A1:1 C%s\n", width, height, colorspace))
+	for f := 0; f < frames; f++ {
+		out = append(out, "FRAME\n"...)
+		for i := 0; i < frameSize; i++ {
+			out = append(out, byte(i*7+f*13))
+		}
+	}
+	return out
+}
+
+func TestY4MRoundTrip(t *testing.T) {
+	carriers := map[string][]byte{
+		"420jpeg":  testY4M(32, 16, 3, 32*16+2*16*8, "420jpeg"),
+		"odd 420":  testY4M(15, 9, 4, 15*9+2*8*5, "420mpeg2"),
+		"422p10":   testY4M(16, 16, 2, 2*(16*16+2*8*16), "422p10"),
+		"444alpha": testY4M(8, 8, 4, 4*8*8, "444alpha"),
+		"mono16":   testY4M(16, 16, 3, 2*16*16, "mono16"),
+	}
+	for name, carrier := range carriers {
+		capacity := CalculateY4MCapacity(carrier, nil)
+		data := bytes.Repeat([]byte{0xF0, 0x0F, 0x33}, capacity)[:capacity]
+		opts := VideoOptions{Passphrase: "key"}
+		out, err := EmbedDataInY4M(carrier, data, opts)
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		got, err := ExtractDataFromY4M(out, opts)
+		if err != nil || !bytes.Equal(got, data) {
+			t.Fatalf("%s: got %d bytes, %v", name, len(got), err)
+		}
+		checkY4MOnlyLSBs(t, name, carrier, out)
+	}
+}
+
+// checkY4MOnlyLSBs checks that only the lowest bit of the carrier bytes changed
+func checkY4MOnlyLSBs(t *testing.T, name string, before, after []byte) {
+	t.Helper()
+	video, _ := parseY4M(before)
+	if !bytes.Equal(before[:video.Frames[0]], after[:video.Frames[0]]) {
+		t.Fatalf("%s: header changed", name)
+	}
+	for i := range before {
+		if d := before[i] ^ after[i]; d&^1 != 0 {
+			t.Fatalf("%s: byte %d changed by %08b", name, i, d)
+		}
+	}
+	for f, start := range video.Frames {
+		for s := 0; s < video.FrameSize; s++ {
+			inPlanes := s < video.PlaneSamples*video.BytesPerSample
+			lowByte := s%video.BytesPerSample == 0
+			if (!inPlanes || !lowByte) && before[start+s] != after[start+s] {
+				t.Fatalf("%s: frame %d byte %d is not a carrier but changed", name, f, s)
+			}
+		}
+	}
+}
+
+func TestY4MFramesAndPassphrase(t *testing.T) {
+	carrier := testY4M(32, 32, 5, 32*32*3/2, "420jpeg")
+	opts := VideoOptions{Frames: []int{3, 1}, Passphrase: "key"}
+	data := bytes.Repeat([]byte("y4m"), 100)
+	out, err := EmbedDataInY4M(carrier, data, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	video, _ := parseY4M(carrier)
+	for _, f := range []int{0, 2, 4} {
+		start := video.Frames[f]
+		if !bytes.Equal(carrier[start:start+video.FrameSize], out[start:start+video.FrameSize]) {
+			t.Fatalf("frame %d not selected but changed", f)
+		}
+	}
+
+	if got, err := ExtractDataFromY4M(out, opts); err != nil || !bytes.Equal(got, data) {
+		t.Fatalf("got %d bytes, %v", len(got), err)
+	}
+	for _, wrong := range []VideoOptions{
+		{Frames: []int{1, 3}, Passphrase: "key"},
+		{Frames: []int{3, 1}, Passphrase: "other"},
+		{Passphrase: "key"},
+	} {
+		if got, err := ExtractDataFromY4M(out, wrong); err == nil && bytes.Equal(got, data) {
+			t.Fatalf("extracted with frames %v and passphrase %q", wrong.Frames, wrong.Passphrase)
+		}
+	}
+}
+
+func TestY4MReembed(t *testing.T) {
+	carrier := testY4M(32, 32, 3, 32*32*3/2, "420jpeg")
+	opts := VideoOptions{Passphrase: "key"}
+	first, err := EmbedDataInY4M(carrier, bytes.Repeat([]byte("first"), 100), opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := EmbedDataInY4M(first, []byte("second"), opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, err := ExtractDataFromY4M(second, opts); err != nil || string(got) != "second" {
+		t.Fatalf("got %q, %v", got, err)
+	}
+}
+
+func TestY4MMalformed(t *testing.T) {
+	carrier := testY4M(16, 16, 2, 16*16*3/2, "420jpeg")
+	capacity := CalculateY4MCapacity(carrier, nil)
+	if capacity != 2*(16*16+2*8*8)/8-8 {
+		t.Fatalf("capacity %d", capacity)
+	}
+	if _, err := EmbedDataInY4M(carrier, make([]byte, capacity+1), VideoOptions{}); err == nil {
+		t.Error("data larger than the capacity accepted")
+	}
+	if _, err := EmbedDataInY4M(carrier, []byte("x"), VideoOptions{Mode: "dct"}); err == nil {
+		t.Error("invalid mode accepted")
+	}
+	for _, frames := range [][]int{{2}, {-1}, {0, 0}} {
+		if _, err := EmbedDataInY4M(carrier, []byte("x"), VideoOptions{Frames: frames}); err == nil {
+			t.Errorf("frames %v accepted", frames)
+		}
+	}
+
+	headers := []string{
+		"YUV4MPEG2 W16\nFRAME\n",
+		"YUV4MPEG2 W16 H16 C410\nFRAME\n",
+		"YUV4MPEG2 W16 H16 C420p7\nFRAME\n",
+		"YUV4MPEG2 Wabc H16\nFRAME\n",
+		"YUV4MPEG2 W4000000000 H4000000000 C444p16\nFRAME\n",
+		"YUV4MPEG2 W16 H16",
+		"YUV4MPEG2 W16 H16\n",
+		"YUV4MPEG2 W2 H2\nFRAME",
+		"YUV4MPEG2 W2 H2\nFRAME\n\x00",
+		"YUV4MPEG2 W2 H2\nFRAME\n\x00\x00\x00\x00\x00\x00JUNK\n",
+	}
+	for _, h := range headers {
+		if _, err := parseY4M([]byte(h)); err == nil {
+			t.Errorf("%q parsed", h)
+		}
+	}
+	for n := len(carrier) - 1; n > 0; n -= 37 {
+		if _, err := ExtractDataFromY4M(carrier[:n], VideoOptions{}); err == nil {
+			t.Fatalf("stream truncated to %d bytes extracted", n)
+		}
+	}
+}
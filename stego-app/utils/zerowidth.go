@@ -0,0 +1,248 @@
+package utils
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"slices"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// In zero-width mode the payload becomes zero-width characters, two bits each, inserted in
+// runs at gaps of the cover text chosen with the passphrase. Extraction only looks at the
+// runs themselves, so it survives copy/paste that rewraps lines, changes line endings, trims
+// whitespace or applies Unicode normalization (NFC/NFKC leave these characters alone).
+
+// zeroWidthSymbols maps the 2-bit symbols to the characters carrying them
+var zeroWidthSymbols = [4]rune{
+	'\u200b', // ZERO WIDTH SPACE
+	'\u200c', // ZERO WIDTH NON-JOINER
+	'\u200d', // ZERO WIDTH JOINER
+	'\u2060', // WORD JOINER
+}
+
+// minZeroWidthRun is the shortest run written. Covers use single zero-width characters
+// on their own (emoji ZWJ sequences, ZWNJ in Persian, ZWSP in Thai), so shorter runs
+// are ignored when extracting.
+const minZeroWidthRun = 2
+
+// embedZeroWidth hides data as zero-width characters in the cover text. The runs of an
+// earlier payload are removed first, extraction would otherwise find either one.
+func embedZeroWidth(cover string, data []byte, passphrase string) (string, error) {
+	cover = stripZeroWidthRuns(cover)
+	gaps := zeroWidthGaps(cover)
+	if len(gaps) == 0 {
+		return "", errors.New("cover text has no word boundary to hide data at")
+	}
+
+	bits := bytesToBits(prepareDataWithHeader(data))
+	symbols := make([]rune, len(bits)/2)
+	for i := range symbols {
+		symbols[i] = zeroWidthSymbols[bits[2*i]|bits[2*i+1]<<1]
+	}
+
+	// Pick the gaps with the passphrase and spread the symbols evenly over them
+	runs := min(len(gaps), len(symbols)/minZeroWidthRun)
+	chosen := make([]int, 0, runs)
+	for i := range keyedPermutation(len(gaps), zeroWidthSeed(passphrase)) {
+		if len(chosen) == runs {
+			break
+		}
+		chosen = append(chosen, gaps[i])
+	}
+	slices.Sort(chosen)
+
+	var out strings.Builder
+	out.Grow(len(cover) + len(symbols)*3)
+	pos, next := 0, 0
+	for i, gap := range chosen {
+		n := len(symbols) / runs
+		if i < len(symbols)%runs {
+			n++
+		}
+		out.WriteString(cover[pos:gap])
+		out.WriteString(string(symbols[next : next+n]))
+		pos, next = gap, next+n
+	}
+	out.WriteString(cover[pos:])
+	return out.String(), nil
+}
+
+// extractZeroWidth reads data hidden as zero-width characters. The payload may start
+// at any run, so text pasted around the stego text does not get in the way.
+func extractZeroWidth(text string) ([]byte, error) {
+	var symbols []uint8
+	var starts []int // index of the first symbol of each run
+	run := 0
+	for _, r := range text {
+		if symbol, ok := zeroWidthSymbol(r); ok {
+			symbols = append(symbols, symbol)
+			run++
+			continue
+		}
+		symbols = endZeroWidthRun(symbols, &starts, run)
+		run = 0
+	}
+	symbols = endZeroWidthRun(symbols, &starts, run)
+	if len(starts) == 0 {
+		return nil, errors.New("no zero-width characters found in text")
+	}
+
+	// Only the header is decoded at each start, the payload once the header checks out
+	const headerSymbols = 8 * 4
+	for _, start := range starts {
+		if start+headerSymbols > len(symbols) {
+			break
+		}
+		header := zeroWidthBytes(symbols[start : start+headerSymbols])
+		if binary.LittleEndian.Uint32(header[:4]) != MagicNumber {
+			continue
+		}
+		length := int(binary.LittleEndian.Uint32(header[4:8]))
+		end := start + headerSymbols + 4*length
+		if length == 0 || length > MaxDataSize || end > len(symbols) {
+			continue
+		}
+		return zeroWidthBytes(symbols[start+headerSymbols : end]), nil
+	}
+	return nil, errors.New("no valid embedded data found in text")
+}
+
+// endZeroWidthRun keeps the last n symbols as a run when it is long enough, otherwise drops them
+func endZeroWidthRun(symbols []uint8, starts *[]int, n int) []uint8 {
+	if n < minZeroWidthRun {
+		return symbols[:len(symbols)-n]
+	}
+	*starts = append(*starts, len(symbols)-n)
+	return symbols
+}
+
+// stripZeroWidthRuns removes the runs of zero-width characters a payload is written as,
+// the single ones of the cover are kept
+func stripZeroWidthRuns(text string) string {
+	var out strings.Builder
+	out.Grow(len(text))
+	written, start, run := 0, 0, 0
+	for i, r := range text {
+		if _, ok := zeroWidthSymbol(r); ok {
+			if run == 0 {
+				start = i
+			}
+			run++
+			continue
+		}
+		if run >= minZeroWidthRun {
+			out.WriteString(text[written:start])
+			written = i
+		}
+		run = 0
+	}
+	if run >= minZeroWidthRun {
+		out.WriteString(text[written:start])
+		written = len(text)
+	}
+	out.WriteString(text[written:])
+	return out.String()
+}
+
+// zeroWidthBytes packs 2-bit symbols into bytes, the first symbol in the lowest bits
+func zeroWidthBytes(symbols []uint8) []byte {
+	b := make([]byte, len(symbols)/4)
+	for i := range b {
+		for j := 0; j < 4; j++ {
+			b[i] |= symbols[4*i+j] << (2 * j)
+		}
+	}
+	return b
+}
+
+// zeroWidthEstimate reports the capacity of a cover text in zero-width mode
+func zeroWidthEstimate(cover string) CapacityEstimate {
+	gaps := len(zeroWidthGaps(stripZeroWidthRuns(cover)))
+	room := 0
+	if gaps > 0 {
+		room = math.MaxInt32
+	}
+	return newEstimate("text", TextModeZeroWidth, room, fmt.Sprintf(
+		"2 bits per zero-width character in runs at %d word boundaries of the cover text, "+
+			"each payload byte adds 12 bytes of UTF-8 to the text", gaps))
+}
+
+// zeroWidthSymbol returns the symbol a zero-width character carries. ZERO WIDTH NO-BREAK
+// SPACE is read as WORD JOINER, which replaced it and which some software converts back.
+func zeroWidthSymbol(r rune) (uint8, bool) {
+	if r == '\ufeff' {
+		return 3, true
+	}
+	for i, c := range zeroWidthSymbols {
+		if r == c {
+			return uint8(i), true
+		}
+	}
+	return 0, false
+}
+
+// zeroWidthGaps returns the byte offsets at word boundaries of the cover where a run can go
+// without splitting a line ending, a combining sequence or an emoji sequence. Inside a word a
+// ZERO WIDTH SPACE adds a line break opportunity, and next to a letter of a joining script
+// ZWJ and ZWNJ change its shape, so runs only go where neither is visible.
+func zeroWidthGaps(cover string) []int {
+	var gaps []int
+	prev, i := utf8.DecodeRuneInString(cover)
+	for i < len(cover) {
+		r, size := utf8.DecodeRuneInString(cover[i:])
+		if zeroWidthNeighbour(prev) && zeroWidthNeighbour(r) && !(zeroWidthWordChar(prev) && zeroWidthWordChar(r)) {
+			gaps = append(gaps, i)
+		}
+		prev = r
+		i += size
+	}
+	return gaps
+}
+
+// zeroWidthJoining are the scripts whose letters join their neighbours
+var zeroWidthJoining = []*unicode.RangeTable{
+	unicode.Arabic, unicode.Syriac, unicode.Nko, unicode.Mongolian, unicode.Mandaic,
+	unicode.Manichaean, unicode.Psalter_Pahlavi, unicode.Adlam, unicode.Hanifi_Rohingya, unicode.Sogdian,
+}
+
+// zeroWidthNeighbour reports whether a run may be written next to r
+func zeroWidthNeighbour(r rune) bool {
+	switch {
+	case r == utf8.RuneError, unicode.IsControl(r), unicode.IsMark(r), unicode.Is(unicode.Cf, r):
+		return false
+	case r >= 0x1F1E6 && r <= 0x1F1FF: // regional indicators pair into flags
+		return false
+	case r >= 0x1F3FB && r <= 0x1F3FF: // emoji skin tone modifiers
+		return false
+	case r >= 0x1160 && r <= 0x11FF: // conjoining Hangul vowels and trailing consonants
+		return false
+	case unicode.In(r, zeroWidthJoining...):
+		return false
+	}
+	return true
+}
+
+// zeroWidthWordChar reports whether r continues a word. Han and kana text breaks lines
+// between any two characters already, so those count as word boundaries.
+func zeroWidthWordChar(r rune) bool {
+	if unicode.In(r, unicode.Han, unicode.Hiragana, unicode.Katakana) {
+		return false
+	}
+	return unicode.IsLetter(r) || unicode.IsDigit(r) || r == '_' || r == '\''
+}
+
+// zeroWidthSeed derives the gap order seed from the passphrase
+func zeroWidthSeed(passphrase string) [32]byte {
+	mac := hmac.New(sha256.New, []byte(passphrase))
+	mac.Write([]byte("text-zero-width"))
+
+	var seed [32]byte
+	copy(seed[:], mac.Sum(nil))
+	return seed
+}
@@ -0,0 +1,151 @@
+package utils
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+	"unicode/utf8"
+)
+
+const zeroWidthCover = "The quick brown fox jumps over the lazy dog. Pack my box with five dozen liquor jugs!\n" +
+	"Xin chào thế giới, đây là một đoạn văn bản thử nghiệm.\n"
+
+func TestZeroWidthRoundTrip(t *testing.T) {
+	for _, size := range []int{1, 16, 1000} {
+		data := bytes.Repeat([]byte{0x00, 0xFF, 0x5A}, size)[:size]
+		out, err := embedZeroWidth(zeroWidthCover, data, "secret")
+		if err != nil {
+			t.Fatalf("%d bytes: %v", size, err)
+		}
+		if stripZeroWidthRuns(out) != zeroWidthCover {
+			t.Fatalf("%d bytes: visible text changed", size)
+		}
+		got, err := extractZeroWidth(out)
+		if err != nil || !bytes.Equal(got, data) {
+			t.Fatalf("%d bytes: got %d bytes, %v", size, len(got), err)
+		}
+	}
+}
+
+func TestZeroWidthSurvivesCopyPaste(t *testing.T) {
+	out, err := embedZeroWidth(zeroWidthCover, []byte("pasted"), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	edits := map[string]string{
+		"crlf":    strings.ReplaceAll(out, "\n", "\r\n"),
+		"rewrap":  strings.ReplaceAll(out, " ", "\n"),
+		"trimmed": strings.TrimSpace(strings.ReplaceAll(out, " \n", "\n")),
+		"quoted":  "> " + strings.ReplaceAll(out, "\n", "\n> "),
+		"context": "Earlier message\n\n" + out + "\n-- \nsignature",
+		"bom":     strings.ReplaceAll(out, "\u2060", "\ufeff"),
+	}
+	for name, text := range edits {
+		got, err := extractZeroWidth(text)
+		if err != nil || string(got) != "pasted" {
+			t.Errorf("%s: got %q, %v", name, got, err)
+		}
+	}
+}
+
+func TestZeroWidthGapsAtWordBoundaries(t *testing.T) {
+	tests := []struct {
+		cover string
+		gaps  int
+	}{
+		{"word", 0},
+		{"two words", 2},
+		{"a-b", 2},
+		{"日本語", 2},
+		{"مرحبا بالعالم", 0}, // Arabic letters join their neighbours
+		{"e\u0301 x", 1},     // not next to the combining accent
+		{"🇻🇳 🇻🇳", 0},         // not next to the regional indicators of a flag
+		{"\r\n", 0},
+	}
+	for _, tt := range tests {
+		if got := len(zeroWidthGaps(tt.cover)); got != tt.gaps {
+			t.Errorf("zeroWidthGaps(%q) = %d gaps, want %d", tt.cover, got, tt.gaps)
+		}
+	}
+}
+
+func TestZeroWidthKeepsCoverCharacters(t *testing.T) {
+	// An emoji ZWJ sequence and a Persian ZWNJ are single zero-width characters of the cover
+	cover := "Hi 👩\u200d💻 there, می\u200cخواهم go home now.\n"
+	out, err := embedZeroWidth(cover, []byte("emoji"), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stripZeroWidthRuns(out) != cover {
+		t.Fatal("cover zero-width characters changed")
+	}
+	if got, err := extractZeroWidth(out); err != nil || string(got) != "emoji" {
+		t.Fatalf("got %q, %v", got, err)
+	}
+	if !strings.Contains(out, "👩\u200d💻") {
+		t.Fatal("emoji sequence split")
+	}
+}
+
+func TestZeroWidthReembed(t *testing.T) {
+	first, err := embedZeroWidth(zeroWidthCover, []byte("first payload"), "one")
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := embedZeroWidth(first, []byte("second"), "two")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stripZeroWidthRuns(second) != zeroWidthCover {
+		t.Fatal("runs of the first payload left in the text")
+	}
+	if got, err := extractZeroWidth(second); err != nil || string(got) != "second" {
+		t.Fatalf("got %q, %v", got, err)
+	}
+}
+
+func TestZeroWidthMalformed(t *testing.T) {
+	if _, err := embedZeroWidth("nogaps", []byte("x"), ""); err == nil {
+		t.Error("cover without word boundary accepted")
+	}
+
+	out, err := embedZeroWidth(zeroWidthCover, []byte("truncated payload"), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cut := []rune(out)
+	var kept []rune
+	removed := 0
+	for _, r := range cut {
+		if _, ok := zeroWidthSymbol(r); ok && removed < 8 {
+			removed++
+			continue
+		}
+		kept = append(kept, r)
+	}
+	if _, err := extractZeroWidth(string(kept)); err == nil {
+		t.Error("payload with missing symbols extracted")
+	}
+	if _, err := extractZeroWidth(zeroWidthCover); err == nil {
+		t.Error("plain text extracted")
+	}
+	if _, err := extractZeroWidth("a\u200bb\xff\u200dc"); err == nil {
+		t.Error("short runs extracted")
+	}
+}
+
+func TestZeroWidthExtractionIsLinear(t *testing.T) {
+	// Many runs that are not payloads must not be decoded one after another to the end
+	text := strings.Repeat("x \u200b\u200c\u200d\u2060 ", 200000)
+	start := time.Now()
+	if _, err := extractZeroWidth(text); err == nil {
+		t.Fatal("noise extracted")
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Fatalf("extraction took %v", elapsed)
+	}
+	if !utf8.ValidString(text) {
+		t.Fatal("invalid test text")
+	}
+}
@@ -0,0 +1,393 @@
+package utils
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"slices"
+	"strings"
+	"time"
+)
+
+// ZIP archives (zip, jar, epub) are rewritten entry by entry with the compressed data
+// copied as is, so the writer recomputes every local header and central directory offset.
+// The payload is either split over private extra fields of the entries or stored in an
+// extra entry appended after the others.
+
+// ZIP embedding modes
+const (
+	ZIPModeExtra = "extra" // payload split over the extra fields of the entries (default)
+	ZIPModeEntry = "entry" // payload in a hidden entry after the others
+)
+
+// zipPayloadEntry is the name of the hidden entry; META-INF is left alone by jar and EPUB readers
+const zipPayloadEntry = "META-INF/.cache"
+
+// Extra field blocks holding the payload: header ID, size, uint16 chunk index, chunk bytes
+const (
+	zipExtraID     = 0x5347 // "GS"
+	zipExtraHeader = 6
+	zip64ExtraID   = 0x0001
+	// room left in each extra field for the zip64 block the writer adds to large entries
+	zipExtraMargin = 32
+)
+
+// apkSigBlockMagic ends the APK Signing Block (signature scheme v2 and later), which sits
+// between the last entry and the central directory
+const apkSigBlockMagic = "APK Sig Block 42"
+
+// errAPK refuses APKs: zip.Writer rebuilds the archive without the APK Signing Block and
+// without the zipalign padding of stored entries, so the result would no longer install
+// (Android 11 and later also reject v1-only APKs whose stored entries are unaligned)
+var errAPK = errors.New("apk files are not supported: rewriting the archive drops the APK Signing Block " +
+	"and the zipalign alignment of stored entries, so the apk would no longer install")
+
+// IsZIP checks if data starts with a ZIP local file header or an empty archive's end record
+func IsZIP(data []byte) bool {
+	return bytes.HasPrefix(data, []byte("PK\x03\x04")) || bytes.HasPrefix(data, []byte("PK\x05\x06"))
+}
+
+// EmbedDataInZIP embeds data in a ZIP archive using the chosen mode
+func EmbedDataInZIP(zipData []byte, data []byte, mode string) ([]byte, error) {
+	var out bytes.Buffer
+	if err := EmbedDataInZIPStream(bytes.NewReader(zipData), int64(len(zipData)), data, mode, &out); err != nil {
+		return nil, err
+	}
+	return out.Bytes(), nil
+}
+
+// EmbedDataInZIPStream is EmbedDataInZIP reading the size byte archive from src and writing to dst.
+// A payload of an earlier embed is removed first, in either mode.
+func EmbedDataInZIPStream(src io.ReaderAt, size int64, data []byte, mode string, dst io.Writer) error {
+	if size == 0 {
+		return errors.New("zip data cannot be empty")
+	}
+
+	if len(data) == 0 {
+		return errors.New("data to embed cannot be empty")
+	}
+
+	if len(data) > MaxDataSize {
+		return fmt.Errorf("data too large: %d bytes, max allowed: %d bytes", len(data), MaxDataSize)
+	}
+
+	if mode != "" && mode != ZIPModeExtra && mode != ZIPModeEntry {
+		return invalidZIPMode(mode)
+	}
+
+	r, err := zip.NewReader(src, size)
+	if err != nil {
+		return errors.New("invalid zip archive: " + err.Error())
+	}
+	if isAPK(r, src, size) {
+		return errAPK
+	}
+	if mode != ZIPModeEntry {
+		if err := zipExtraEstimate(r).checkCapacity(len(data)); err != nil {
+			return err
+		}
+	}
+
+	payload := prepareDataWithHeader(data)
+	w := zip.NewWriter(dst)
+	var last *zip.File
+	chunk := 0
+	for i, f := range r.File {
+		if f.Name == zipPayloadEntry {
+			continue
+		}
+		last = f
+
+		extra := stripZipExtra(f.Extra)
+		if mode != ZIPModeEntry && len(payload) > 0 {
+			if room := zipExtraRoom(i, f, extra); room > 0 {
+				n := min(room, len(payload))
+				block := make([]byte, zipExtraHeader, zipExtraHeader+n)
+				binary.LittleEndian.PutUint16(block[0:2], zipExtraID)
+				binary.LittleEndian.PutUint16(block[2:4], uint16(2+n))
+				binary.LittleEndian.PutUint16(block[4:6], uint16(chunk))
+				extra = append(slices.Clip(extra), append(block, payload[:n]...)...)
+				payload = payload[n:]
+				chunk++
+			}
+		}
+		if err := copyZipEntry(w, f, extra); err != nil {
+			return err
+		}
+	}
+
+	if mode == ZIPModeEntry {
+		header := &zip.FileHeader{Name: zipPayloadEntry, Method: zip.Store}
+		if last != nil {
+			header.ModifiedTime, header.ModifiedDate = last.ModifiedTime, last.ModifiedDate
+		}
+		entry, err := w.CreateHeader(header)
+		if err != nil {
+			return err
+		}
+		if _, err := entry.Write(payload); err != nil {
+			return err
+		}
+	}
+
+	if err := w.SetComment(r.Comment); err != nil {
+		return err
+	}
+	return w.Close()
+}
+
+// ExtractDataFromZIP extracts data hidden in a ZIP archive by either mode
+func ExtractDataFromZIP(zipData []byte) ([]byte, error) {
+	return ExtractDataFromZIPStream(bytes.NewReader(zipData), int64(len(zipData)))
+}
+
+// ExtractDataFromZIPStream is ExtractDataFromZIP for the size byte archive read from src
+func ExtractDataFromZIPStream(src io.ReaderAt, size int64) ([]byte, error) {
+	if size == 0 {
+		return nil, errors.New("zip data cannot be empty")
+	}
+
+	r, err := zip.NewReader(src, size)
+	if err != nil {
+		return nil, errors.New("invalid zip archive: " + err.Error())
+	}
+
+	for _, f := range r.File {
+		if f.Name != zipPayloadEntry || f.UncompressedSize64 > MaxDataSize+8 {
+			continue
+		}
+		if raw, err := readZipEntry(f); err == nil {
+			if data, err := parseHeaderedData(raw); err == nil {
+				return data, nil
+			}
+		}
+	}
+
+	// Chunks are ordered by their index, in case a tool reordered the entries
+	chunks := map[int][]byte{}
+	for _, f := range r.File {
+		for _, block := range zipExtraBlocks(f.Extra) {
+			if binary.LittleEndian.Uint16(block[0:2]) == zipExtraID && len(block) >= zipExtraHeader {
+				chunks[int(binary.LittleEndian.Uint16(block[4:6]))] = block[zipExtraHeader:]
+			}
+		}
+	}
+	if len(chunks) == 0 {
+		return nil, errors.New("no embedded data found in zip archive")
+	}
+	var payload []byte
+	for i := 0; i < len(chunks); i++ {
+		chunk, ok := chunks[i]
+		if !ok {
+			return nil, fmt.Errorf("embedded data chunk %d is missing", i)
+		}
+		payload = append(payload, chunk...)
+	}
+	return parseHeaderedData(payload)
+}
+
+// EstimateZIPCapacityStream is EstimateZIPCapacity for the size byte archive read from src
+func EstimateZIPCapacityStream(src io.ReaderAt, size int64, mode string) (CapacityEstimate, error) {
+	if size == 0 {
+		return CapacityEstimate{}, errors.New("zip data cannot be empty")
+	}
+
+	r, err := zip.NewReader(src, size)
+	if err != nil {
+		return CapacityEstimate{}, errors.New("invalid zip archive: " + err.Error())
+	}
+	if isAPK(r, src, size) {
+		return CapacityEstimate{}, errAPK
+	}
+
+	switch mode {
+	case "", ZIPModeExtra:
+		return zipExtraEstimate(r), nil
+	case ZIPModeEntry:
+		return newEstimate("zip", ZIPModeEntry, math.MaxInt32, fmt.Sprintf(
+			"payload is stored uncompressed in a hidden %s entry after the others, entry sizes are not limited",
+			zipPayloadEntry)), nil
+	}
+	return CapacityEstimate{}, invalidZIPMode(mode)
+}
+
+// isAPK reports whether the archive is an Android package: it has an APK Signing Block, or a
+// root AndroidManifest.xml next to compiled code or resources (AAR libraries have neither)
+func isAPK(r *zip.Reader, src io.ReaderAt, size int64) bool {
+	if hasAPKSigningBlock(src, size) {
+		return true
+	}
+	manifest, compiled := false, false
+	for _, f := range r.File {
+		switch f.Name {
+		case "AndroidManifest.xml":
+			manifest = true
+		case "classes.dex", "resources.arsc":
+			compiled = true
+		}
+	}
+	return manifest && compiled
+}
+
+// hasAPKSigningBlock reports whether the APK Signing Block magic ends right where the
+// central directory of the end record starts
+func hasAPKSigningBlock(src io.ReaderAt, size int64) bool {
+	i := lastIndexAt(src, size, []byte("PK\x05\x06"))
+	if i < 0 {
+		return false
+	}
+	record := make([]byte, 22)
+	if _, err := src.ReadAt(record, i); err != nil && err != io.EOF {
+		return false
+	}
+
+	// The central directory ends right before the end record, or before the ZIP64 end record
+	cdSize := int64(binary.LittleEndian.Uint32(record[12:16]))
+	cdEnd := i
+	if cdSize == 0xFFFFFFFF || binary.LittleEndian.Uint32(record[16:20]) == 0xFFFFFFFF {
+		locator := make([]byte, 20)
+		if i < 20 {
+			return false
+		}
+		if _, err := src.ReadAt(locator, i-20); err != nil || string(locator[:4]) != "PK\x06\x07" {
+			return false
+		}
+		cdEnd = int64(binary.LittleEndian.Uint64(locator[8:16]))
+		record64 := make([]byte, 56)
+		if _, err := src.ReadAt(record64, cdEnd); err != nil || string(record64[:4]) != "PK\x06\x06" {
+			return false
+		}
+		cdSize = int64(binary.LittleEndian.Uint64(record64[40:48]))
+	}
+
+	cdStart := cdEnd - cdSize
+	if cdStart < int64(len(apkSigBlockMagic)) || cdStart > size {
+		return false
+	}
+	magic := make([]byte, len(apkSigBlockMagic))
+	if _, err := src.ReadAt(magic, cdStart-int64(len(magic))); err != nil {
+		return false
+	}
+	return string(magic) == apkSigBlockMagic
+}
+
+// invalidZIPMode reports a mode ZIP archives do not support
+func invalidZIPMode(mode string) error {
+	return fmt.Errorf("invalid zip mode %q. Must be: %s or %s", mode, ZIPModeExtra, ZIPModeEntry)
+}
+
+// zipExtraEstimate sums the room left in the extra fields of the entries
+func zipExtraEstimate(r *zip.Reader) CapacityEstimate {
+	room, entries := 0, 0
+	for i, f := range r.File {
+		if f.Name == zipPayloadEntry {
+			continue
+		}
+		if n := zipExtraRoom(i, f, stripZipExtra(f.Extra)); n > 0 {
+			room += n
+			entries++
+		}
+	}
+	return newEstimate("zip", ZIPModeExtra, room, fmt.Sprintf(
+		"payload is split over private extra field blocks of %d entries, each extra field being limited to 65535 bytes",
+		entries))
+}
+
+// zipExtraRoom returns how many payload bytes the extra field of the i-th entry can take.
+// The uncompressed mimetype entry EPUB requires first must keep an empty extra field.
+func zipExtraRoom(i int, f *zip.File, extra []byte) int {
+	if i == 0 && f.Name == "mimetype" {
+		return 0
+	}
+	return max(0, math.MaxUint16-len(extra)-zipExtraMargin-zipExtraHeader)
+}
+
+// zipExtraBlocks splits an extra field into its blocks, each starting with its header
+func zipExtraBlocks(extra []byte) [][]byte {
+	var blocks [][]byte
+	for len(extra) >= 4 {
+		n := 4 + int(binary.LittleEndian.Uint16(extra[2:4]))
+		if n > len(extra) {
+			break
+		}
+		blocks = append(blocks, extra[:n])
+		extra = extra[n:]
+	}
+	return blocks
+}
+
+// stripZipExtra removes the payload blocks of an earlier embed from an extra field
+func stripZipExtra(extra []byte) []byte {
+	var out []byte
+	for _, block := range zipExtraBlocks(extra) {
+		if binary.LittleEndian.Uint16(block[0:2]) != zipExtraID {
+			out = append(out, block...)
+		}
+	}
+	return out
+}
+
+// readZipEntry returns the uncompressed content of an archive entry
+func readZipEntry(f *zip.File) ([]byte, error) {
+	rc, err := f.Open()
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+	return io.ReadAll(rc)
+}
+
+// copyZipEntry copies an entry to w without recompressing it, with extra as its extra field
+func copyZipEntry(w *zip.Writer, f *zip.File, extra []byte) error {
+	// A zero Modified keeps the original MS-DOS time without adding a timestamp block,
+	// and the writer adds its own zip64 block when the entry needs one
+	header := f.FileHeader
+	header.Modified = time.Time{}
+	header.Extra = nil
+	for _, block := range zipExtraBlocks(extra) {
+		if binary.LittleEndian.Uint16(block[0:2]) != zip64ExtraID {
+			header.Extra = append(header.Extra, block...)
+		}
+	}
+
+	// Directories take no data; jar tools deflate them to a two-byte empty stream
+	if strings.HasSuffix(header.Name, "/") {
+		header.Method = zip.Store
+		header.Flags &^= 0x8
+		header.CRC32 = 0
+		header.CompressedSize, header.CompressedSize64 = 0, 0
+		header.UncompressedSize, header.UncompressedSize64 = 0, 0
+		_, err := w.CreateRaw(&header)
+		return err
+	}
+
+	raw, err := f.OpenRaw()
+	if err != nil {
+		return err
+	}
+	dst, err := w.CreateRaw(&header)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(dst, raw)
+	return err
+}
+
+// writeZipEntry deflates content into a new entry dated like the entry of like
+func writeZipEntry(w *zip.Writer, name string, like *zip.FileHeader, content []byte) error {
+	dst, err := w.CreateHeader(&zip.FileHeader{
+		Name:         name,
+		Method:       zip.Deflate,
+		ModifiedTime: like.ModifiedTime,
+		ModifiedDate: like.ModifiedDate,
+	})
+	if err != nil {
+		return err
+	}
+	_, err = dst.Write(content)
+	return err
+}
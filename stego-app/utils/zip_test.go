@@ -0,0 +1,218 @@
+package utils
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/binary"
+	"strings"
+	"testing"
+)
+
+// testZIP builds an archive from name, content pairs: names ending in "/" are directories,
+// mimetype is stored and everything else deflated
+func testZIP(comment string, entries ...string) []byte {
+	var buf bytes.Buffer
+	w := zip.NewWriter(&buf)
+	for i := 0; i+1 < len(entries); i += 2 {
+		header := &zip.FileHeader{Name: entries[i], Method: zip.Deflate}
+		if entries[i] == "mimetype" || strings.HasSuffix(entries[i], "/") {
+			header.Method = zip.Store
+		}
+		f, err := w.CreateHeader(header)
+		if err != nil {
+			panic(err)
+		}
+		f.Write([]byte(entries[i+1]))
+	}
+	w.SetComment(comment)
+	w.Close()
+	return buf.Bytes()
+}
+
+// checkZIPEntries checks that out holds the entries of carrier in order with the same
+// content and method, besides the hidden payload entry
+func checkZIPEntries(t *testing.T, name string, carrier, out []byte) {
+	t.Helper()
+	a, _ := zip.NewReader(bytes.NewReader(carrier), int64(len(carrier)))
+	b, err := zip.NewReader(bytes.NewReader(out), int64(len(out)))
+	if err != nil {
+		t.Fatalf("%s: %v", name, err)
+	}
+	var files []*zip.File
+	for _, f := range b.File {
+		if f.Name != zipPayloadEntry {
+			files = append(files, f)
+		}
+	}
+	if len(files) != len(a.File) || b.Comment != a.Comment {
+		t.Fatalf("%s: %d entries, comment %q", name, len(files), b.Comment)
+	}
+	for i, f := range a.File {
+		want, _ := readZipEntry(f)
+		got, err := readZipEntry(files[i])
+		if err != nil || files[i].Name != f.Name || files[i].Method != f.Method || !bytes.Equal(got, want) {
+			t.Fatalf("%s: entry %d is %q, %v", name, i, files[i].Name, err)
+		}
+	}
+}
+
+func TestZIPRoundTrip(t *testing.T) {
+	carriers := map[string][]byte{
+		"plain": testZIP("archive comment", "a.txt", "hello", "b/", "", "b/c.txt", strings.Repeat("zip ", 100)),
+		"epub":  testZIP("", "mimetype", "application/epub+zip", "META-INF/container.xml", "<container/>", "OEBPS/text.xhtml", "<html/>"),
+		"aar":   testZIP("", "AndroidManifest.xml", "<manifest/>", "classes.jar", "PK"),
+	}
+	data := bytes.Repeat([]byte("zip payload "), 10)
+	for name, carrier := range carriers {
+		for _, mode := range []string{"", ZIPModeExtra, ZIPModeEntry} {
+			out, err := EmbedDataInZIP(carrier, data, mode)
+			if err != nil {
+				t.Fatalf("%s, %q mode: %v", name, mode, err)
+			}
+			got, err := ExtractDataFromZIP(out)
+			if err != nil || !bytes.Equal(got, data) {
+				t.Fatalf("%s, %q mode: got %q, %v", name, mode, got, err)
+			}
+			checkZIPEntries(t, name, carrier, out)
+
+			r, _ := zip.NewReader(bytes.NewReader(out), int64(len(out)))
+			if r.File[0].Name == "mimetype" && (len(r.File[0].Extra) != 0 || r.File[0].Method != zip.Store) {
+				t.Fatalf("%s, %q mode: EPUB mimetype entry changed", name, mode)
+			}
+		}
+	}
+}
+
+func TestZIPExtraSpansEntries(t *testing.T) {
+	carrier := testZIP("", "a", "1", "b", "2", "c", "3")
+	estimate, err := EstimateZIPCapacity(carrier, ZIPModeExtra)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := bytes.Repeat([]byte{0x42}, 100000)
+	if estimate.Capacity < len(data) {
+		t.Fatalf("capacity %d", estimate.Capacity)
+	}
+	out, err := EmbedDataInZIP(carrier, data, ZIPModeExtra)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, err := ExtractDataFromZIP(out); err != nil || !bytes.Equal(got, data) {
+		t.Fatalf("got %d bytes, %v", len(got), err)
+	}
+	if _, err := EmbedDataInZIP(carrier, make([]byte, estimate.Capacity+1), ZIPModeExtra); err == nil {
+		t.Fatal("data larger than the capacity accepted")
+	}
+
+	// Chunks are read by their index when a tool reorders the entries
+	r, _ := zip.NewReader(bytes.NewReader(out), int64(len(out)))
+	var reordered bytes.Buffer
+	w := zip.NewWriter(&reordered)
+	for i := len(r.File) - 1; i >= 0; i-- {
+		if err := copyZipEntry(w, r.File[i], r.File[i].Extra); err != nil {
+			t.Fatal(err)
+		}
+	}
+	w.Close()
+	if got, err := ExtractDataFromZIP(reordered.Bytes()); err != nil || !bytes.Equal(got, data) {
+		t.Fatalf("reordered: got %d bytes, %v", len(got), err)
+	}
+
+	// Dropping the entry holding a chunk is reported
+	reordered.Reset()
+	w = zip.NewWriter(&reordered)
+	for _, f := range r.File[1:] {
+		copyZipEntry(w, f, f.Extra)
+	}
+	w.Close()
+	if _, err := ExtractDataFromZIP(reordered.Bytes()); err == nil {
+		t.Fatal("missing chunk not reported")
+	}
+}
+
+func TestZIPReembedAcrossModes(t *testing.T) {
+	carrier := testZIP("c", "a.txt", "hello", "b.txt", "world")
+	out := carrier
+	modes := []string{ZIPModeExtra, ZIPModeEntry, ZIPModeEntry, ZIPModeExtra, ZIPModeExtra, ZIPModeEntry}
+	for i, mode := range modes {
+		data := bytes.Repeat([]byte{byte('a' + i)}, 30+5*i)
+		var err error
+		out, err = EmbedDataInZIP(out, data, mode)
+		if err != nil {
+			t.Fatalf("step %d (%s): %v", i, mode, err)
+		}
+		got, err := ExtractDataFromZIP(out)
+		if err != nil || !bytes.Equal(got, data) {
+			t.Fatalf("step %d (%s): got %q, %v", i, mode, got, err)
+		}
+		if i > 0 && bytes.Contains(out, bytes.Repeat([]byte{byte('a' + i - 1)}, 30)) {
+			t.Fatalf("step %d (%s): previous payload left in the file", i, mode)
+		}
+		checkZIPEntries(t, mode, carrier, out)
+	}
+}
+
+// testAPKSigned inserts an APK Signing Block before the central directory of an archive
+func testAPKSigned(archive []byte) []byte {
+	eocd := bytes.LastIndex(archive, []byte("PK\x05\x06"))
+	cd := int(binary.LittleEndian.Uint32(archive[eocd+16:]))
+	block := append(make([]byte, 16), apkSigBlockMagic...)
+	out := append(append(bytes.Clone(archive[:cd]), block...), archive[cd:]...)
+	binary.LittleEndian.PutUint32(out[eocd+len(block)+16:], uint32(cd+len(block)))
+	return out
+}
+
+func TestZIPRefusesAPK(t *testing.T) {
+	for name, apk := range map[string][]byte{
+		"v1 signed": testZIP("", "AndroidManifest.xml", "<manifest/>", "classes.dex", "dex", "META-INF/CERT.RSA", "sig"),
+		"resources": testZIP("", "AndroidManifest.xml", "<manifest/>", "resources.arsc", "arsc"),
+		"v2 signed": testAPKSigned(testZIP("", "a.txt", "hello")),
+	} {
+		for _, mode := range []string{ZIPModeExtra, ZIPModeEntry} {
+			if _, err := EmbedDataInZIP(apk, []byte("x"), mode); err != errAPK {
+				t.Errorf("%s, %s mode: %v", name, mode, err)
+			}
+			if _, err := EstimateZIPCapacity(apk, mode); err != errAPK {
+				t.Errorf("%s, %s mode estimate: %v", name, mode, err)
+			}
+		}
+	}
+}
+
+func TestZIPMalformed(t *testing.T) {
+	carrier := testZIP("", "a.txt", "hello")
+	if _, err := EmbedDataInZIP(carrier, []byte("x"), "comment"); err == nil {
+		t.Error("invalid mode accepted")
+	}
+	if _, err := EstimateZIPCapacity(carrier, "comment"); err == nil {
+		t.Error("invalid mode estimated")
+	}
+	if _, err := EmbedDataInZIP(carrier, nil, ""); err == nil {
+		t.Error("empty data accepted")
+	}
+	empty := testZIP("")
+	if _, err := EmbedDataInZIP(empty, []byte("x"), ZIPModeExtra); err == nil {
+		t.Error("empty archive accepted in extra mode")
+	}
+	if out, err := EmbedDataInZIP(empty, []byte("x"), ZIPModeEntry); err != nil {
+		t.Errorf("empty archive in entry mode: %v", err)
+	} else if got, err := ExtractDataFromZIP(out); err != nil || string(got) != "x" {
+		t.Errorf("empty archive in entry mode: got %q, %v", got, err)
+	}
+
+	for name, bad := range map[string][]byte{
+		"not zip":   []byte("PK\x03\x04 not really"),
+		"truncated": carrier[:len(carrier)-10],
+		"empty":     nil,
+	} {
+		if _, err := EmbedDataInZIP(bad, []byte("x"), ""); err == nil {
+			t.Errorf("%s accepted", name)
+		}
+		if _, err := ExtractDataFromZIP(bad); err == nil {
+			t.Errorf("%s extracted", name)
+		}
+	}
+	if _, err := ExtractDataFromZIP(carrier); err == nil {
+		t.Error("clean archive extracted")
+	}
+}